@@ -0,0 +1,109 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// --- Account Deletion & Export ---
+
+// deleteAccount erases a user from the server: every stored row but their bans and the reports against
+// them, their avatar blobs, the in-memory codes and requests, and their open sockets. Their contacts receive an 'account_deleted' event, queued if they are offline.
+func deleteAccount(userID string) error {
+	contactIDs, err := store.GetContactIDs(userID)
+	if err != nil {
+		return err
+	}
+	avatarBlobsMutex.Lock()
+	avatar, err := store.GetUserAvatar(userID)
+	if err != nil {
+		avatarBlobsMutex.Unlock()
+		return err
+	}
+	if err := store.DeleteUserData(userID); err != nil {
+		avatarBlobsMutex.Unlock()
+		return err
+	}
+	releaseAvatarBlobs(avatar)
+	avatarBlobsMutex.Unlock()
+
+	syncCodesMutex.Lock()
+	for code, sc := range syncCodes {
+		if sc.UserID == userID {
+			delete(syncCodes, code)
+		}
+	}
+	syncCodesMutex.Unlock()
+
+	linkRequestsMutex.Lock()
+	for id, lr := range linkRequests {
+		if lr.UserID == userID {
+			delete(linkRequests, id)
+		}
+	}
+	linkRequestsMutex.Unlock()
+
+	closed := closeUserConnections(userID, func(*clientInfo) bool { return true }, closeCodeAccountDeleted, "account_deleted")
+	log.Printf("[ACCOUNT] Account %s deleted. Closed %d open connection(s), notifying %d contact(s).", userID, closed, len(contactIDs))
+
+	for _, contactID := range contactIDs {
+		sendServerEvent(Message{
+			Type:    "account_deleted",
+			From:    userID,
+			To:      contactID,
+			Payload: MessagePayload{UserID: userID},
+		})
+	}
+	return nil
+}
+
+// exportAccount gathers everything the server holds about a user.
+func exportAccount(userID string, now time.Time) (AccountExport, error) {
+	export := AccountExport{ExportedAt: now, UserID: userID}
+	var err error
+
+	if export.Pseudo, err = store.GetUserPseudo(userID); err != nil {
+		return export, err
+	}
+	if export.Avatar, err = store.GetUserAvatar(userID); err != nil {
+		return export, err
+	}
+
+	devices, err := store.GetUserDevices(userID)
+	if err != nil {
+		return export, err
+	}
+	export.Devices = make([]DeviceExport, 0, len(devices))
+	for _, d := range devices {
+		export.Devices = append(export.Devices, DeviceExport{Device: d, PushTokens: d.PushTokens})
+	}
+
+	if export.Contacts, err = store.GetContactIDs(userID); err != nil {
+		return export, err
+	}
+
+	settings, err := store.GetPresenceSettings([]string{userID})
+	if err != nil {
+		return export, err
+	}
+	if ps, found := settings[userID]; found {
+		export.PresenceSettings = &ps
+	}
+
+	if export.Invitations, err = store.GetInvitationsByCreator(userID); err != nil {
+		return export, err
+	}
+	if export.PendingMessages, err = store.GetPendingMessagesInvolving(userID); err != nil {
+		return export, err
+	}
+	if export.ScheduledPlops, err = store.GetScheduledPlopsForUser(userID); err != nil {
+		return export, err
+	}
+	if export.WebPushSubscriptions, err = store.GetWebPushSubscriptions(userID); err != nil {
+		return export, err
+	}
+	if export.UnifiedPushEndpoints, err = store.GetUnifiedPushEndpoints(userID); err != nil {
+		return export, err
+	}
+	return export, nil
+}
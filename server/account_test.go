@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+
+	"plop_server/plopclient"
+)
+
+func TestDeleteAccount(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	setDB(db)
+
+	syncCodesMutex.Lock()
+	syncCodes["LEAVE1"] = SyncCode{Code: "LEAVE1", UserID: "alice"}
+	syncCodesMutex.Unlock()
+
+	mock.ExpectQuery("SELECT contact_id FROM contacts").WithArgs("alice").
+		WillReturnRows(sqlmock.NewRows([]string{"contact_id"}).AddRow("bob"))
+	mock.ExpectQuery("SELECT user_id, size, hash FROM user_avatars").WillReturnRows(sqlmock.NewRows([]string{"user_id", "size", "hash"}))
+	mock.ExpectBegin()
+	for range userDataDeletions {
+		mock.ExpectExec(".").WithArgs("alice").WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+	mock.ExpectCommit()
+	// bob is offline: the event waits in his pending messages.
+	mock.ExpectExec("INSERT INTO pending_messages").WithArgs("bob", "alice", "account_deleted", sqlmock.AnyArg(), "", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	if err := deleteAccount("alice"); err != nil {
+		t.Fatalf("deleteAccount failed: %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+	syncCodesMutex.Lock()
+	_, found := syncCodes["LEAVE1"]
+	syncCodesMutex.Unlock()
+	if found {
+		t.Error("sync codes of a deleted account should be dropped")
+	}
+}
+
+func TestDeleteAccountKeepsModerationRecords(t *testing.T) {
+	s := newTestServer(t)
+	alice, mallory := s.newUser("Alice", ""), s.newUser("Mallory", "")
+	s.store.SaveReport(Report{ID: "against-mallory", ReporterID: alice.ID, ReportedID: mallory.ID, Reason: "spam", Status: reportStatusOpen, CreatedAt: s.clock.Now()})
+	s.store.SaveReport(Report{ID: "by-mallory", ReporterID: mallory.ID, ReportedID: alice.ID, Reason: "spam", Status: reportStatusOpen, CreatedAt: s.clock.Now()})
+	s.store.BanUser(UserBan{UserID: mallory.ID, Reason: "spam", BannedAt: s.clock.Now()})
+
+	if _, err := mallory.api.DeleteAccount(context.Background(), plopclient.DeleteAccountParams{UserID: mallory.ID}); err != nil {
+		t.Fatalf("DeleteAccount failed: %v", err)
+	}
+	if _, banned, _ := s.store.GetUserBan(mallory.ID); !banned {
+		t.Error("deleting the account must not lift the ban")
+	}
+	if _, found, _ := s.store.GetReport("against-mallory"); !found {
+		t.Error("the reports against the user should be kept")
+	}
+	if _, found, _ := s.store.GetReport("by-mallory"); found {
+		t.Error("the reports filed by the user should be deleted")
+	}
+}
+
+func TestHandleDeleteAccountRequiresDelete(t *testing.T) {
+	req := httptest.NewRequest("GET", "/users/me?userId=alice", nil)
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(handleDeleteAccount).ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusMethodNotAllowed {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusMethodNotAllowed)
+	}
+}
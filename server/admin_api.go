@@ -0,0 +1,269 @@
+package main
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// --- Admin API ---
+//
+// An HTTP API for operators, served on its own listener (ADMIN_ADDR) so it is never exposed with the
+// public endpoints. Callers authenticate with the static ADMIN_TOKEN as a bearer token, with a client
+// certificate signed by ADMIN_TLS_CLIENT_CA (mTLS), or both when both are configured.
+
+// serveAdminAPI starts the admin listener if ADMIN_ADDR is set. It blocks, so run it in a goroutine.
+func serveAdminAPI() {
+	addr := getEnv("ADMIN_ADDR", "")
+	if addr == "" {
+		log.Println("[INFO] Admin API disabled (ADMIN_ADDR is not set).")
+		return
+	}
+	token := os.Getenv("ADMIN_TOKEN")
+	certFile, keyFile := os.Getenv("ADMIN_TLS_CERT"), os.Getenv("ADMIN_TLS_KEY")
+	clientCAFile := os.Getenv("ADMIN_TLS_CLIENT_CA")
+
+	if token == "" && clientCAFile == "" {
+		log.Println("[ERROR] Admin API not started: set ADMIN_TOKEN or ADMIN_TLS_CLIENT_CA to protect it.")
+		return
+	}
+	server := &http.Server{Addr: addr, Handler: newAdminHandler(token)}
+	if clientCAFile != "" {
+		if certFile == "" || keyFile == "" {
+			log.Println("[ERROR] Admin API not started: mTLS needs ADMIN_TLS_CERT and ADMIN_TLS_KEY.")
+			return
+		}
+		pem, err := os.ReadFile(clientCAFile)
+		if err != nil {
+			log.Printf("[ERROR] Admin API not started: could not read the client CA: %v", err)
+			return
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			log.Printf("[ERROR] Admin API not started: no certificate found in %s.", clientCAFile)
+			return
+		}
+		server.TLSConfig = &tls.Config{ClientCAs: pool, ClientAuth: tls.RequireAndVerifyClientCert, MinVersion: tls.VersionTLS12}
+	}
+
+	var err error
+	if certFile != "" {
+		log.Printf("[INFO] Admin API listening on https://%s (mTLS: %t, token: %t)", addr, clientCAFile != "", token != "")
+		err = server.ListenAndServeTLS(certFile, keyFile)
+	} else {
+		log.Printf("[INFO] Admin API listening on http://%s (token only, keep it on a private network)", addr)
+		err = server.ListenAndServe()
+	}
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Printf("[ERROR] Admin API stopped: %v", err)
+	}
+}
+
+// newAdminHandler returns the admin routes, requiring the bearer token when one is set.
+func newAdminHandler(token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/connections", handleAdminListConnections)
+	mux.HandleFunc("/admin/connections/disconnect", handleAdminDisconnect)
+	mux.HandleFunc("/admin/pending", handleAdminPendingStats)
+	mux.HandleFunc("/admin/announcements", handleAdminAnnouncement)
+	mux.HandleFunc("/admin/reports", handleAdminListReports)
+	mux.HandleFunc("/admin/reports/resolve", handleAdminResolveReport)
+	if token == "" {
+		return mux
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		provided, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !found || subtle.ConstantTimeCompare([]byte(provided), []byte(token)) != 1 {
+			log.Printf("[ADMIN] Refused %s %s from %s: invalid token", r.Method, r.URL.Path, r.RemoteAddr)
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// connectedUsers snapshots the live connections, grouped by user and sorted by user ID then connect time.
+func connectedUsers() []ConnectedUser {
+	clientsMutex.Lock()
+	users := make([]ConnectedUser, 0, len(clients))
+	for userID, conns := range clients {
+		user := ConnectedUser{UserID: userID, Connections: make([]ConnectionInfo, 0, len(conns))}
+		devices := make(map[string]bool)
+		for _, info := range conns {
+			devices[info.DeviceID] = true
+			user.Connections = append(user.Connections, ConnectionInfo{ID: info.ID, DeviceID: info.DeviceID, ConnectedAt: info.ConnectedAt, RemoteAddr: info.RemoteAddr})
+		}
+		user.Devices = len(devices)
+		users = append(users, user)
+	}
+	clientsMutex.Unlock()
+
+	sort.Slice(users, func(i, j int) bool { return users[i].UserID < users[j].UserID })
+	for _, user := range users {
+		sort.Slice(user.Connections, func(i, j int) bool { return user.Connections[i].ConnectedAt.Before(user.Connections[j].ConnectedAt) })
+	}
+	return users
+}
+
+// handleAdminListConnections lists the connected users with their live connections.
+func handleAdminListConnections(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(connectedUsers())
+}
+
+// handleAdminDisconnect closes a user's connections: one connection by ID, those of one device, or all of them.
+func handleAdminDisconnect(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		UserID       string `json:"userId"`
+		ConnectionID string `json:"connectionId"`
+		DeviceID     string `json:"deviceId"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.UserID == "" {
+		http.Error(w, "userId is required", http.StatusBadRequest)
+		return
+	}
+
+	closed := closeUserConnections(req.UserID, func(c *clientInfo) bool {
+		return (req.ConnectionID == "" || c.ID == req.ConnectionID) && (req.DeviceID == "" || c.DeviceID == req.DeviceID)
+	}, closeCodeAdminDisconnect, "admin_disconnect")
+	log.Printf("[ADMIN] Disconnected %d connection(s) of user %s (connectionId='%s', deviceId='%s').", closed, req.UserID, req.ConnectionID, req.DeviceID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"closed": closed})
+}
+
+// handleAdminPendingStats returns the pending queue depth, with the deepest recipients ("top", default 20).
+func handleAdminPendingStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	top := 20
+	if raw := r.URL.Query().Get("top"); raw != "" {
+		parsed, err := strconv.Atoi(raw)
+		if err != nil || parsed < 1 {
+			http.Error(w, "top must be a positive integer", http.StatusBadRequest)
+			return
+		}
+		top = parsed
+	}
+
+	stats, err := store.GetPendingStats(top)
+	if err != nil {
+		http.Error(w, "Failed to read the pending queue", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
+// handleAdminAnnouncement sends an 'announcement' to the given users, queued for those who are offline,
+// or to every connected user when no user is given.
+func handleAdminAnnouncement(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		Text    string   `json:"text"`
+		UserIDs []string `json:"userIds"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || strings.TrimSpace(req.Text) == "" {
+		http.Error(w, "text is required", http.StatusBadRequest)
+		return
+	}
+
+	recipients := req.UserIDs
+	if len(recipients) == 0 {
+		for _, user := range connectedUsers() {
+			recipients = append(recipients, user.UserID)
+		}
+	}
+	for _, userID := range recipients {
+		sendServerEvent(Message{Type: "announcement", From: "server", To: userID, Payload: MessagePayload{Text: req.Text}})
+	}
+	log.Printf("[ADMIN] Announcement sent to %d user(s).", len(recipients))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"recipients": len(recipients)})
+}
+
+// handleAdminListReports lists reports, oldest first. "status" filters them (default "open", "all" for every report).
+func handleAdminListReports(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	status := r.URL.Query().Get("status")
+	switch status {
+	case "":
+		status = reportStatusOpen
+	case "all":
+		status = ""
+	case reportStatusOpen, reportStatusResolved:
+	default:
+		http.Error(w, "status must be open, resolved or all", http.StatusBadRequest)
+		return
+	}
+
+	reports, err := store.GetReports(status, 200)
+	if err != nil {
+		http.Error(w, "Failed to list reports", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(reports)
+}
+
+// handleAdminResolveReport resolves an open report with a moderation action: dismiss, warn, suspend
+// (for "suspendHours") or ban. The note is kept with the report and sent to the user with a warning.
+func handleAdminResolveReport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		ReportID     string `json:"reportId"`
+		Action       string `json:"action"`
+		Note         string `json:"note"`
+		SuspendHours int    `json:"suspendHours"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ReportID == "" {
+		http.Error(w, "reportId is required", http.StatusBadRequest)
+		return
+	}
+
+	report, err := resolveReport(req.ReportID, req.Action, req.Note, time.Duration(req.SuspendHours)*time.Hour, timeNow())
+	switch err {
+	case nil:
+	case errInvalidModeration, errSuspensionNeedsLimit:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case errReportNotFound:
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	default:
+		http.Error(w, "Failed to resolve report", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
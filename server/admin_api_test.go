@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gorilla/websocket"
+)
+
+func TestAdminHandlerRequiresToken(t *testing.T) {
+	handler := newAdminHandler("s3cret")
+	for _, auth := range []string{"", "Bearer wrong", "s3cret"} {
+		req := httptest.NewRequest("GET", "/admin/connections", nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != http.StatusUnauthorized {
+			t.Errorf("Authorization %q: got %v, want %v", auth, rr.Code, http.StatusUnauthorized)
+		}
+	}
+
+	req := httptest.NewRequest("GET", "/admin/connections", nil)
+	req.Header.Set("Authorization", "Bearer s3cret")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Errorf("valid token: got %v, want %v", rr.Code, http.StatusOK)
+	}
+}
+
+func TestAdminConnectionsAndDisconnect(t *testing.T) {
+	dial := newTestClientDialer(t, "alice")
+	phone := dial("phone")
+	dial("tablet")
+	dial("tablet")
+
+	var alice *ConnectedUser
+	for _, user := range connectedUsers() {
+		if user.UserID == "alice" {
+			alice = &user
+		}
+	}
+	if alice == nil || alice.Devices != 2 || len(alice.Connections) != 3 {
+		t.Fatalf("unexpected connections for alice: %+v", alice)
+	}
+	var phoneConnID string
+	for _, c := range alice.Connections {
+		if c.ConnectedAt.IsZero() || c.RemoteAddr == "" {
+			t.Errorf("connection is missing its details: %+v", c)
+		}
+		if c.DeviceID == "phone" {
+			phoneConnID = c.ID
+		}
+	}
+
+	body := `{"userId": "alice", "connectionId": "` + phoneConnID + `"}`
+	rr := httptest.NewRecorder()
+	handleAdminDisconnect(rr, httptest.NewRequest("POST", "/admin/connections/disconnect", strings.NewReader(body)))
+	var resp map[string]int
+	json.Unmarshal(rr.Body.Bytes(), &resp)
+	if resp["closed"] != 1 {
+		t.Errorf("expected exactly one connection to be closed, got %v", rr.Body.String())
+	}
+
+	phone.SetReadDeadline(time.Now().Add(time.Second))
+	if _, _, err := phone.ReadMessage(); !websocket.IsCloseError(err, closeCodeAdminDisconnect) {
+		t.Errorf("expected close code %d, got %v", closeCodeAdminDisconnect, err)
+	}
+}
+
+func TestAdminAnnouncement(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	setDB(db)
+
+	dial := newTestClientDialer(t, "alice")
+	phone := dial("phone")
+	// bob is offline: the announcement waits in his pending messages.
+	mock.ExpectExec("INSERT INTO pending_messages").WithArgs("bob", "server", "announcement", sqlmock.AnyArg(), "", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	body := `{"text": "Maintenance tonight", "userIds": ["alice", "bob"]}`
+	rr := httptest.NewRecorder()
+	handleAdminAnnouncement(rr, httptest.NewRequest("POST", "/admin/announcements", strings.NewReader(body)))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+
+	var msg Message
+	phone.SetReadDeadline(time.Now().Add(time.Second))
+	if err := phone.ReadJSON(&msg); err != nil || msg.Type != "announcement" || msg.Payload.Text != "Maintenance tonight" {
+		t.Errorf("alice should receive the announcement, got %+v, %v", msg, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
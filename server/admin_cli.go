@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// --- Admin CLI ---
+//
+// Running the server binary with arguments executes an admin command against the database instead
+// of starting the server, e.g. `server_binary users show <id> --json`.
+
+// errAdminUsage is returned when the command line is invalid; the usage was already printed.
+var errAdminUsage = errors.New("invalid usage")
+
+// adminCommand is one admin subcommand. run receives the arguments that follow the command name.
+type adminCommand struct {
+	name    string
+	usage   string
+	summary string
+	run     func(args []string, out io.Writer) error
+}
+
+// adminCommands lists the subcommands, in the order they are shown in the usage.
+var adminCommands = []adminCommand{
+	{"users list", "[--limit N] [--json]", "List users, most recently seen first", runUsersList},
+	{"users show", "<userId> [--json]", "Show a user's devices, contacts and queue", runUsersShow},
+	{"users ban", "<userId> [--reason TEXT]", "Ban a user: their next connections are refused", runUsersBan},
+	{"invitations list", "[--json]", "List invitations, expired ones included", runInvitationsList},
+	{"invitations purge", "[--all]", "Delete expired invitations (or all of them)", runInvitationsPurge},
+	{"pending stats", "[--top N] [--json]", "Summarize the pending message queue", runPendingStats},
+	{"tokens prune", "[--days N] [--dry-run]", "Drop push registrations of revoked or stale devices", runTokensPrune},
+	{"data rekey", "[--dry-run]", "Re-encrypt pseudos, push tokens, push subscriptions, invitations and pending messages under the active data key", runDataRekey},
+}
+
+// runAdminCLI connects to the database and runs an admin command. It returns the process exit code.
+// Only errors are logged, so the output stays readable.
+func runAdminCLI(args []string) int {
+	log.SetOutput(&adminLogFilter{w: os.Stderr})
+	initializeDataEncryption()
+	initDB()
+	if err := runAdminCommand(args, os.Stdout); err != nil {
+		if err != errAdminUsage {
+			fmt.Fprintln(os.Stderr, "error:", err)
+		}
+		return 1
+	}
+	return 0
+}
+
+// runAdminCommand dispatches args to the matching subcommand.
+func runAdminCommand(args []string, out io.Writer) error {
+	if len(args) >= 2 {
+		name := args[0] + " " + args[1]
+		for _, cmd := range adminCommands {
+			if cmd.name == name {
+				return cmd.run(args[2:], out)
+			}
+		}
+	}
+	printAdminUsage(os.Stderr)
+	return errAdminUsage
+}
+
+func printAdminUsage(w io.Writer) {
+	fmt.Fprintln(w, "Usage: server_binary <command> [arguments]")
+	fmt.Fprintln(w, "Without a command, the server starts. Commands:")
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, cmd := range adminCommands {
+		fmt.Fprintf(tw, "  %s %s\t%s\n", cmd.name, cmd.usage, cmd.summary)
+	}
+	tw.Flush()
+}
+
+// parseAdminFlags parses the flags of a subcommand, which may come before or after its positional
+// arguments, and returns the positional ones.
+func parseAdminFlags(fs *flag.FlagSet, args []string) ([]string, error) {
+	fs.SetOutput(os.Stderr)
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, errAdminUsage
+		}
+		if fs.NArg() == 0 {
+			return positional, nil
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+}
+
+// writeAdminOutput prints v as indented JSON, or as a table through writeTable.
+func writeAdminOutput(out io.Writer, asJSON bool, v interface{}, writeTable func(tw *tabwriter.Writer)) error {
+	if asJSON {
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	}
+	tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	writeTable(tw)
+	return tw.Flush()
+}
+
+// formatAdminTime formats an optional timestamp for tables.
+func formatAdminTime(t *time.Time) string {
+	if t == nil {
+		return "-"
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+func runUsersList(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("users list", flag.ContinueOnError)
+	limit := fs.Int("limit", 100, "maximum number of users to list")
+	asJSON := fs.Bool("json", false, "print JSON")
+	if _, err := parseAdminFlags(fs, args); err != nil {
+		return err
+	}
+
+	users, err := store.GetUserSummaries("", *limit)
+	if err != nil {
+		return err
+	}
+	return writeAdminOutput(out, *asJSON, users, func(tw *tabwriter.Writer) {
+		fmt.Fprintln(tw, "USER ID\tPSEUDO\tDEVICES\tCONTACTS\tLAST SEEN\tBANNED")
+		for _, u := range users {
+			fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%s\t%s\n", u.UserID, u.Pseudo, u.Devices, u.Contacts, formatAdminTime(u.LastSeenAt), formatAdminTime(u.BannedAt))
+		}
+	})
+}
+
+// adminUserDetails is the output of `users show`. Push tokens and message contents are left out.
+type adminUserDetails struct {
+	UserSummary
+	Ban             *UserBan `json:"ban"`
+	DeviceList      []Device `json:"deviceList"`
+	ContactIDs      []string `json:"contactIds"`
+	Invitations     int      `json:"invitations"`
+	PendingReceived int      `json:"pendingReceived"`
+	PendingSent     int      `json:"pendingSent"`
+}
+
+func runUsersShow(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("users show", flag.ContinueOnError)
+	asJSON := fs.Bool("json", false, "print JSON")
+	positional, err := parseAdminFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		fmt.Fprintln(os.Stderr, "usage: users show <userId> [--json]")
+		return errAdminUsage
+	}
+	userID := positional[0]
+
+	summaries, err := store.GetUserSummaries(userID, 1)
+	if err != nil {
+		return err
+	}
+	if len(summaries) == 0 {
+		return fmt.Errorf("user %s not found", userID)
+	}
+	details := adminUserDetails{UserSummary: summaries[0]}
+	if ban, banned, err := store.GetUserBan(userID); err != nil {
+		return err
+	} else if banned {
+		details.Ban = &ban
+	}
+	if details.DeviceList, err = store.GetUserDevices(userID); err != nil {
+		return err
+	}
+	if details.ContactIDs, err = store.GetContactIDs(userID); err != nil {
+		return err
+	}
+	invitations, err := store.GetInvitationsByCreator(userID)
+	if err != nil {
+		return err
+	}
+	details.Invitations = len(invitations)
+	pending, err := store.GetPendingMessagesInvolving(userID)
+	if err != nil {
+		return err
+	}
+	for _, msg := range pending {
+		if msg.To == userID {
+			details.PendingReceived++
+		} else {
+			details.PendingSent++
+		}
+	}
+
+	return writeAdminOutput(out, *asJSON, details, func(tw *tabwriter.Writer) {
+		fmt.Fprintf(tw, "User ID:\t%s\n", details.UserID)
+		fmt.Fprintf(tw, "Pseudo:\t%s\n", details.Pseudo)
+		fmt.Fprintf(tw, "Last seen:\t%s\n", formatAdminTime(details.LastSeenAt))
+		if details.Ban != nil {
+			fmt.Fprintf(tw, "Banned:\t%s (%s)\n", formatAdminTime(&details.Ban.BannedAt), details.Ban.Reason)
+		}
+		fmt.Fprintf(tw, "Contacts:\t%d %s\n", len(details.ContactIDs), strings.Join(details.ContactIDs, ", "))
+		fmt.Fprintf(tw, "Invitations:\t%d\n", details.Invitations)
+		fmt.Fprintf(tw, "Pending:\t%d received, %d sent\n", details.PendingReceived, details.PendingSent)
+		fmt.Fprintln(tw, "\nDEVICE ID\tNAME\tPLATFORM\tVERSION\tLAST SEEN")
+		for _, d := range details.DeviceList {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", d.DeviceID, d.Name, d.Platform, d.AppVersion, formatAdminTime(&d.LastSeenAt))
+		}
+	})
+}
+
+func runUsersBan(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("users ban", flag.ContinueOnError)
+	reason := fs.String("reason", "", "reason recorded with the ban")
+	positional, err := parseAdminFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		fmt.Fprintln(os.Stderr, "usage: users ban <userId> [--reason TEXT]")
+		return errAdminUsage
+	}
+
+	if err := store.BanUser(UserBan{UserID: positional[0], Reason: *reason, BannedAt: time.Now()}); err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "User %s banned. Connections already open stay up until they reconnect.\n", positional[0])
+	return nil
+}
+
+func runInvitationsList(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("invitations list", flag.ContinueOnError)
+	asJSON := fs.Bool("json", false, "print JSON")
+	if _, err := parseAdminFlags(fs, args); err != nil {
+		return err
+	}
+
+	invitations, err := store.ListInvitations()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	return writeAdminOutput(out, *asJSON, invitations, func(tw *tabwriter.Writer) {
+		fmt.Fprintln(tw, "CODE\tCREATOR\tPSEUDO\tEXPIRES AT\tSTATUS")
+		for _, inv := range invitations {
+			status := "active"
+			if now.After(inv.ExpiresAt) {
+				status = "expired"
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", inv.Code, inv.CreatorUserID, inv.CreatorPseudo, formatAdminTime(&inv.ExpiresAt), status)
+		}
+	})
+}
+
+func runInvitationsPurge(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("invitations purge", flag.ContinueOnError)
+	all := fs.Bool("all", false, "also delete invitations that are still valid")
+	if _, err := parseAdminFlags(fs, args); err != nil {
+		return err
+	}
+
+	deleted, err := store.PurgeInvitations(*all)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "Deleted %d invitation(s).\n", deleted)
+	return nil
+}
+
+func runPendingStats(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("pending stats", flag.ContinueOnError)
+	top := fs.Int("top", 10, "number of recipients to list")
+	asJSON := fs.Bool("json", false, "print JSON")
+	if _, err := parseAdminFlags(fs, args); err != nil {
+		return err
+	}
+
+	stats, err := store.GetPendingStats(*top)
+	if err != nil {
+		return err
+	}
+	return writeAdminOutput(out, *asJSON, stats, func(tw *tabwriter.Writer) {
+		fmt.Fprintf(tw, "Total:\t%d\n", stats.Total)
+		types := make([]string, 0, len(stats.ByType))
+		for t := range stats.ByType {
+			types = append(types, t)
+		}
+		sort.Strings(types)
+		for _, t := range types {
+			label := t
+			if label == "" {
+				label = "plop"
+			}
+			fmt.Fprintf(tw, "  %s:\t%d\n", label, stats.ByType[t])
+		}
+		fmt.Fprintln(tw, "\nRECIPIENT\tPENDING\tNEXT EXPIRY")
+		for _, d := range stats.TopRecipients {
+			fmt.Fprintf(tw, "%s\t%d\t%s\n", d.UserID, d.Count, formatAdminTime(d.NextExpiry))
+		}
+	})
+}
+
+func runTokensPrune(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("tokens prune", flag.ContinueOnError)
+	days := fs.Int("days", 270, "prune devices not seen for this many days")
+	dryRun := fs.Bool("dry-run", false, "only count what would be pruned")
+	if _, err := parseAdminFlags(fs, args); err != nil {
+		return err
+	}
+
+	result, err := store.PruneStaleTokens(time.Now().AddDate(0, 0, -*days), *dryRun)
+	if err != nil {
+		return err
+	}
+	verb := "Pruned"
+	if *dryRun {
+		verb = "Would prune"
+	}
+	fmt.Fprintf(out, "%s push tokens of %d device(s), %d Web Push subscription(s) and %d UnifiedPush endpoint(s).\n",
+		verb, result.PushTokens, result.WebPushSubscriptions, result.UnifiedPushEndpoints)
+	return nil
+}
+
+func runDataRekey(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("data rekey", flag.ContinueOnError)
+	dryRun := fs.Bool("dry-run", false, "only count the rows to re-encrypt")
+	if _, err := parseAdminFlags(fs, args); err != nil {
+		return err
+	}
+
+	result, err := store.Rekey(*dryRun)
+	if err != nil {
+		return err
+	}
+	verb := "Re-encrypted"
+	if *dryRun {
+		verb = "Would re-encrypt"
+	}
+	fmt.Fprintf(out, "%s %d pseudo(s), the push tokens of %d device(s), %d push subscription(s), %d invitation(s) and %d pending message(s) under key '%s'.\n",
+		verb, result.Pseudos, result.Devices, result.PushSubscriptions, result.Invitations, result.PendingMessages, dataKeys.active)
+	return nil
+}
+
+// adminLogFilter only lets error and fatal log lines through.
+type adminLogFilter struct {
+	w io.Writer
+}
+
+func (f *adminLogFilter) Write(p []byte) (int, error) {
+	if bytes.Contains(p, []byte("[ERROR]")) || bytes.Contains(p, []byte("[FATAL]")) {
+		return f.w.Write(p)
+	}
+	return len(p), nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestRunAdminCommandUsage(t *testing.T) {
+	var out bytes.Buffer
+	for _, args := range [][]string{{}, {"users"}, {"users", "frobnicate"}, {"users", "show"}, {"users", "ban", "a", "b"}} {
+		if err := runAdminCommand(args, &out); err != errAdminUsage {
+			t.Errorf("runAdminCommand(%q) = %v, want errAdminUsage", args, err)
+		}
+	}
+}
+
+func TestRunUsersList(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	setDB(db)
+
+	lastSeen := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+	summaryRows := func() *sqlmock.Rows {
+		return sqlmock.NewRows([]string{"user_id", "pseudo", "devices", "contacts", "last_seen", "banned_at"}).
+			AddRow("alice", "Alice", 2, 3, lastSeen, nil)
+	}
+
+	mock.ExpectQuery("SELECT u.user_id").WithArgs("", 5).WillReturnRows(summaryRows())
+	var out bytes.Buffer
+	if err := runAdminCommand([]string{"users", "list", "--limit", "5"}, &out); err != nil {
+		t.Fatalf("users list failed: %v", err)
+	}
+	if !strings.Contains(out.String(), "PSEUDO") || !strings.Contains(out.String(), "2025-03-01T12:00:00Z") {
+		t.Errorf("unexpected table output:\n%s", out.String())
+	}
+
+	mock.ExpectQuery("SELECT u.user_id").WithArgs("", 100).WillReturnRows(summaryRows())
+	out.Reset()
+	if err := runAdminCommand([]string{"users", "list", "--json"}, &out); err != nil {
+		t.Fatalf("users list --json failed: %v", err)
+	}
+	var users []UserSummary
+	if err := json.Unmarshal(out.Bytes(), &users); err != nil || len(users) != 1 || users[0].Devices != 2 || users[0].BannedAt != nil {
+		t.Errorf("unexpected JSON output %q: %v", out.String(), err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRunUsersBan(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	setDB(db)
+
+	// Flags may follow the user ID.
+	mock.ExpectExec("INSERT INTO user_bans").WithArgs("mallory", "harassment", sqlmock.AnyArg(), nil).WillReturnResult(sqlmock.NewResult(0, 1))
+	var out bytes.Buffer
+	if err := runAdminCommand([]string{"users", "ban", "mallory", "--reason", "harassment"}, &out); err != nil {
+		t.Fatalf("users ban failed: %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
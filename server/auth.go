@@ -0,0 +1,255 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+)
+
+// --- Credentials ---
+//
+// Accounts created by clients that send credentials have an account secret, the recovery key shown on
+// the backup screen, and every device of theirs gets a random secret when it is first registered (or
+// linked through a sync code). Only SHA-256 hashes are stored. Once an account has credentials, the
+// user ID alone no longer grants access: requests must carry device credentials or the account
+// secret, so that revoking a device or rotating a leaked account secret actually locks the old
+// holder out. Accounts without credentials never get any: every contact knows their user ID, so
+// whoever asked first would lock the owner out of their own account.
+
+var (
+	errDeviceNotFound     = errors.New("device not found")
+	errDeviceRevoked      = errors.New("device has been revoked")
+	errInvalidCredentials = errors.New("invalid device credentials")
+	errCredentialsNeeded  = errors.New("device credentials are required for this account")
+	errNoCredentials      = errors.New("the account has no credentials")
+)
+
+// closeCodeCredentialsRotated is the WebSocket close code sent to sockets that authenticated with a rotated account secret.
+const closeCodeCredentialsRotated = 4003
+
+// generateSecret returns a new random device or account secret.
+func generateSecret() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		log.Fatalf("[FATAL] Error generating device secret: %v", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// hashSecret returns the hex SHA-256 of a secret, as stored in the database.
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// deviceCredentialsFromRequest reads the device ID and secret from the X-Device-Id / X-Device-Secret
+// headers, or from the deviceId / deviceSecret query parameters (browsers cannot set WebSocket headers).
+func deviceCredentialsFromRequest(r *http.Request) (deviceID, secret string) {
+	deviceID = r.Header.Get("X-Device-Id")
+	if deviceID == "" {
+		deviceID = r.URL.Query().Get("deviceId")
+	}
+	secret = r.Header.Get("X-Device-Secret")
+	if secret == "" {
+		secret = r.URL.Query().Get("deviceSecret")
+	}
+	return deviceID, secret
+}
+
+// requestUserID returns the user a request acts for: the X-User-Id header, or the userId query parameter.
+func requestUserID(r *http.Request) string {
+	if userID := r.Header.Get("X-User-Id"); userID != "" {
+		return userID
+	}
+	return r.URL.Query().Get("userId")
+}
+
+// accountSecretFromRequest reads the account secret from the X-Account-Secret header, or from the accountSecret query parameter.
+func accountSecretFromRequest(r *http.Request) string {
+	if secret := r.Header.Get("X-Account-Secret"); secret != "" {
+		return secret
+	}
+	return r.URL.Query().Get("accountSecret")
+}
+
+// authenticateAccount checks an account secret against the stored hash.
+func authenticateAccount(userID, secret string) error {
+	secretHash, _, err := store.GetAccountSecretHash(userID)
+	if err != nil {
+		return err
+	}
+	if !checkSecret(secretHash, secret) {
+		return errInvalidCredentials
+	}
+	return nil
+}
+
+// authenticateDevice checks a device secret against the stored hash.
+func authenticateDevice(userID, deviceID, secret string) error {
+	secretHash, revoked, found, err := store.GetDeviceAuth(userID, deviceID)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return errDeviceNotFound
+	}
+	if revoked {
+		return errDeviceRevoked
+	}
+	if !checkSecret(secretHash, secret) {
+		return errInvalidCredentials
+	}
+	return nil
+}
+
+// checkSecret compares a secret with a stored hash in constant time. No secret matches an empty hash.
+func checkSecret(secretHash, secret string) bool {
+	return secretHash != "" && subtle.ConstantTimeCompare([]byte(secretHash), []byte(hashSecret(secret))) == 1
+}
+
+// authenticateRequest identifies the device making a request for userID. Requests authenticated with
+// the account secret return an empty device ID. Accounts without any credentials are still accepted
+// without credentials (also returning an empty device ID).
+func authenticateRequest(r *http.Request, userID string) (string, error) {
+	deviceID, secret := deviceCredentialsFromRequest(r)
+	if deviceID != "" && secret != "" {
+		return deviceID, authenticateDevice(userID, deviceID, secret)
+	}
+	if accountSecret := accountSecretFromRequest(r); accountSecret != "" {
+		return "", authenticateAccount(userID, accountSecret)
+	}
+	hasCredentials, err := store.UserHasCredentials(userID)
+	if err != nil {
+		return "", err
+	}
+	if hasCredentials {
+		return "", errCredentialsNeeded
+	}
+	return "", nil
+}
+
+// writeAuthError answers a request that failed authentication with the matching status code.
+func writeAuthError(w http.ResponseWriter, err error) {
+	switch err {
+	case errDeviceRevoked, errNoCredentials:
+		http.Error(w, err.Error(), http.StatusForbidden)
+	case errDeviceNotFound, errInvalidCredentials, errCredentialsNeeded:
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+	default:
+		http.Error(w, "Failed to check device credentials", http.StatusInternalServerError)
+	}
+}
+
+// issueDeviceCredentials gives a device a new secret and returns it. The secret is only ever returned here.
+func issueDeviceCredentials(userID, deviceID string) (string, error) {
+	secret := generateSecret()
+	if err := store.SetDeviceSecretHash(userID, deviceID, hashSecret(secret)); err != nil {
+		return "", err
+	}
+	log.Printf("[AUTH] Issued new credentials for device %s of user %s.", deviceID, userID)
+	return secret, nil
+}
+
+// linkDevice registers a new device for a user and issues its credentials, unless the account has
+// none: its devices are registered without a secret. Revoked device IDs cannot be reused.
+func linkDevice(device Device) (string, error) {
+	_, revoked, _, err := store.GetDeviceAuth(device.UserID, device.DeviceID)
+	if err != nil {
+		return "", err
+	}
+	if revoked {
+		return "", errDeviceRevoked
+	}
+	hasCredentials, err := store.UserHasCredentials(device.UserID)
+	if err != nil {
+		return "", err
+	}
+	if err := store.UpsertDevice(device); err != nil {
+		return "", err
+	}
+	if !hasCredentials {
+		return "", nil
+	}
+	return issueDeviceCredentials(device.UserID, device.DeviceID)
+}
+
+// revokeDevice signs a device out remotely: its credentials and push endpoints are dropped,
+// its open sockets are closed, the user's other devices get a 'device_revoked' event and contacts the remaining device keys.
+// Accounts without credentials cannot revoke devices: the device would reconnect with the user ID alone.
+func revokeDevice(userID, deviceID string) (bool, error) {
+	hasCredentials, err := store.UserHasCredentials(userID)
+	if err != nil {
+		return false, err
+	}
+	if !hasCredentials {
+		return false, errNoCredentials
+	}
+	revoked, err := store.RevokeDevice(userID, deviceID)
+	if err != nil || !revoked {
+		return revoked, err
+	}
+
+	closed := closeUserConnections(userID, func(c *clientInfo) bool { return c.DeviceID == deviceID }, closeCodeDeviceRevoked, "device_revoked")
+	log.Printf("[AUTH] Device %s of user %s revoked. Closed %d open connection(s).", deviceID, userID, closed)
+
+	broadcastMessageToUser(userID, Message{
+		Type:    "device_revoked",
+		From:    "server",
+		To:      userID,
+		Payload: MessagePayload{DeviceID: deviceID},
+	}, nil)
+	notifyDeviceKeysChanged(userID) // Contacts must stop encrypting for the revoked device
+	return true, nil
+}
+
+// rotateAccountSecret replaces the account secret of a user and returns the new one. The user's other
+// devices connected with device credentials receive it in-band through an 'account_secret_rotated'
+// event. Sockets that were authenticated with the old secret are closed without it: whoever leaked the
+// old secret must not learn the new one. callerDeviceID is the device that asked for the rotation,
+// which gets the secret in the HTTP response.
+//
+// Accounts without credentials cannot get an account secret this way, as their user ID is all it would take.
+func rotateAccountSecret(userID, callerDeviceID string) (string, error) {
+	hasCredentials, err := store.UserHasCredentials(userID)
+	if err != nil {
+		return "", err
+	}
+	if !hasCredentials {
+		return "", errNoCredentials
+	}
+	secret := generateSecret()
+	if err := store.SetAccountSecretHash(userID, hashSecret(secret)); err != nil {
+		return "", err
+	}
+	log.Printf("[AUTH] Account secret of user %s rotated from device '%s'.", userID, callerDeviceID)
+
+	clientsMutex.Lock()
+	var deviceConns []*clientConn
+	for conn, info := range clients[userID] {
+		if info.DeviceID != "" && info.DeviceID != callerDeviceID {
+			deviceConns = append(deviceConns, conn)
+		}
+	}
+	clientsMutex.Unlock()
+
+	event := Message{Type: "account_secret_rotated", From: "server", To: userID, Payload: MessagePayload{AccountSecret: secret}}
+	for _, conn := range deviceConns {
+		if err := conn.WriteJSON(event); err != nil {
+			log.Printf("[ERROR] Failed to send 'account_secret_rotated' to userId=%s: %v", userID, err)
+		}
+	}
+	closed := closeUserConnections(userID, func(c *clientInfo) bool { return c.DeviceID == "" }, closeCodeCredentialsRotated, "credentials_rotated")
+	log.Printf("[AUTH] Sent the new account secret to %d device connection(s) of user %s, closed %d.", len(deviceConns), userID, closed)
+
+	if len(deviceConns) == 0 {
+		// No other device is online: offline devices only learn that their copy is stale and can get the
+		// new secret from the rotating device through the usual device sync.
+		store.SavePendingMessage(Message{Type: "account_secret_rotated", From: "server", To: userID})
+	}
+	return secret, nil
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+// newTestClientDialer returns a function opening a WebSocket registered in clients for userID
+// with the given device, as handleWebSocket would. Connections are closed and unregistered at the end of the test.
+func newTestClientDialer(t *testing.T, userID string) func(deviceID string) *websocket.Conn {
+	serverConns := make(chan *clientConn, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("upgrade failed: %v", err)
+			return
+		}
+		serverConns <- newClientConn(conn)
+	}))
+	t.Cleanup(func() {
+		clientsMutex.Lock()
+		delete(clients, userID)
+		clientsMutex.Unlock()
+		server.Close()
+	})
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	return func(deviceID string) *websocket.Conn {
+		client, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+		if err != nil {
+			t.Fatalf("could not open a ws connection: %v", err)
+		}
+		t.Cleanup(func() { client.Close() })
+		conn := <-serverConns
+		clientsMutex.Lock()
+		if clients[userID] == nil {
+			clients[userID] = make(map[*clientConn]*clientInfo)
+		}
+		clients[userID][conn] = &clientInfo{ID: uuid.New().String(), DeviceID: deviceID, ConnectedAt: time.Now(), RemoteAddr: conn.RemoteAddr().String()}
+		clientsMutex.Unlock()
+		return client
+	}
+}
+
+func TestAuthenticateDevice(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	setDB(db)
+
+	secret := generateSecret()
+	authRows := func(hash string, revoked bool) *sqlmock.Rows {
+		return sqlmock.NewRows([]string{"secret_hash", "revoked"}).AddRow(hash, revoked)
+	}
+	mock.ExpectQuery("SELECT secret_hash").WithArgs("alice", "phone").WillReturnRows(authRows(hashSecret(secret), false))
+	mock.ExpectQuery("SELECT secret_hash").WithArgs("alice", "phone").WillReturnRows(authRows(hashSecret(secret), false))
+	mock.ExpectQuery("SELECT secret_hash").WithArgs("alice", "phone").WillReturnRows(authRows("", true))
+	mock.ExpectQuery("SELECT secret_hash").WithArgs("alice", "tablet").WillReturnRows(sqlmock.NewRows([]string{"secret_hash", "revoked"}))
+
+	if err := authenticateDevice("alice", "phone", secret); err != nil {
+		t.Errorf("valid secret should authenticate, got %v", err)
+	}
+	if err := authenticateDevice("alice", "phone", "guess"); err != errInvalidCredentials {
+		t.Errorf("wrong secret: got %v, want %v", err, errInvalidCredentials)
+	}
+	if err := authenticateDevice("alice", "phone", secret); err != errDeviceRevoked {
+		t.Errorf("revoked device: got %v, want %v", err, errDeviceRevoked)
+	}
+	if err := authenticateDevice("alice", "tablet", secret); err != errDeviceNotFound {
+		t.Errorf("unknown device: got %v, want %v", err, errDeviceNotFound)
+	}
+	if checkSecret("", "") {
+		t.Error("an empty hash must never match")
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRevokeDevice(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	setDB(db)
+
+	mock.ExpectQuery("SELECT EXISTS").WithArgs("alice").WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE devices SET revoked_at").WithArgs("alice", "lost-phone").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM web_push_subscriptions").WithArgs("alice", "lost-phone").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("DELETE FROM unifiedpush_endpoints").WithArgs("alice", "lost-phone").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	mock.ExpectQuery("SELECT device_id, public_key FROM devices").WithArgs("alice").
+		WillReturnRows(sqlmock.NewRows([]string{"device_id", "public_key"}).AddRow("laptop", "bGFwdG9w"))
+	mock.ExpectQuery("SELECT contact_id FROM contacts").WithArgs("alice").WillReturnRows(sqlmock.NewRows([]string{"contact_id"}))
+
+	dial := newTestClientDialer(t, "alice")
+	lost := dial("lost-phone")
+	laptop := dial("laptop")
+
+	revoked, err := revokeDevice("alice", "lost-phone")
+	if err != nil || !revoked {
+		t.Fatalf("revokeDevice() = %v, %v; want true, nil", revoked, err)
+	}
+
+	lost.SetReadDeadline(time.Now().Add(time.Second))
+	_, _, err = lost.ReadMessage()
+	if !websocket.IsCloseError(err, closeCodeDeviceRevoked) {
+		t.Errorf("revoked device should be closed with code %d, got %v", closeCodeDeviceRevoked, err)
+	}
+
+	var event Message
+	laptop.SetReadDeadline(time.Now().Add(time.Second))
+	if err := laptop.ReadJSON(&event); err != nil {
+		t.Fatalf("other device should be notified: %v", err)
+	}
+	if event.Type != "device_revoked" || event.Payload.DeviceID != "lost-phone" {
+		t.Errorf("unexpected event: %+v", event)
+	}
+	laptop.SetReadDeadline(time.Now().Add(time.Second))
+	if err := laptop.ReadJSON(&event); err != nil || event.Type != "device_keys_changed" || len(event.Payload.DeviceKeys) != 1 {
+		t.Errorf("the remaining device keys should be sent, got %+v, %v", event, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRotateAccountSecret(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	setDB(db)
+
+	mock.ExpectQuery("SELECT EXISTS").WithArgs("alice").WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+	mock.ExpectExec("INSERT INTO account_credentials").WithArgs("alice", sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+
+	dial := newTestClientDialer(t, "alice")
+	laptop := dial("laptop")
+	legacy := dial("") // Authenticated with the account secret only
+
+	secret, err := rotateAccountSecret("alice", "phone")
+	if err != nil || secret == "" {
+		t.Fatalf("rotateAccountSecret() = %q, %v", secret, err)
+	}
+
+	var event Message
+	laptop.SetReadDeadline(time.Now().Add(time.Second))
+	if err := laptop.ReadJSON(&event); err != nil {
+		t.Fatalf("laptop should receive the new secret: %v", err)
+	}
+	if event.Type != "account_secret_rotated" || event.Payload.AccountSecret != secret {
+		t.Errorf("laptop: unexpected event %+v", event)
+	}
+	// Whoever holds the old secret must not learn the new one: the socket is only closed.
+	legacy.SetReadDeadline(time.Now().Add(time.Second))
+	if _, data, err := legacy.ReadMessage(); !websocket.IsCloseError(err, closeCodeCredentialsRotated) {
+		t.Errorf("socket authenticated with the old secret should be closed with code %d, got %s, %v", closeCodeCredentialsRotated, data, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestUserEndpointsRequireCredentials(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	setDB(db)
+
+	mux := newMux()
+	for _, request := range []struct{ method, target, body string }{
+		{"POST", "/contacts/sync", `{"userId":"victim","contactIds":["mallory"]}`},
+		{"POST", "/users/presence-settings", `{"userId":"victim","visibility":"contacts"}`},
+		{"POST", "/users/presence", `{"userId":"victim","userIds":["bob"]}`},
+		{"POST", "/schedules/create", `{"ownerId":"victim","recipientIds":["bob"],"cronExpr":"0 9 * * *"}`},
+		{"GET", "/schedules/list?userId=victim", ""},
+		{"POST", "/schedules/cancel", `{"userId":"victim","id":"schedule"}`},
+		{"POST", "/webpush/subscribe", `{"userId":"victim","subscription":{"endpoint":"https://push.example.com/1","keys":{"p256dh":"key","auth":"auth"}}}`},
+		{"POST", "/unifiedpush/register", `{"userId":"victim","endpoint":"https://push.example.com/2"}`},
+		{"POST", "/webpush/unsubscribe", `{"userId":"victim","endpoint":"https://push.example.com/1"}`},
+		{"POST", "/unifiedpush/unregister", `{"userId":"victim","endpoint":"https://push.example.com/2"}`},
+	} {
+		mock.ExpectQuery("SELECT EXISTS").WithArgs("victim").WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest(request.method, request.target, strings.NewReader(request.body)))
+		if rr.Code != http.StatusUnauthorized {
+			t.Errorf("%s %s without credentials: got %d, want %d (%s)", request.method, request.target, rr.Code, http.StatusUnauthorized, rr.Body.String())
+		}
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/draw"
+	_ "image/gif" // Registers the GIF decoder; only the first frame is kept
+	_ "image/jpeg"
+	"image/png"
+	"log"
+	"net/http"
+	"sync"
+)
+
+// --- Avatars ---
+//
+// Uploaded avatars are decoded, cropped to a square and re-encoded as PNG in a few standard sizes.
+// Each size is stored in the blob store under the hash of its content, so clients can cache them forever.
+
+const (
+	maxAvatarUploadBytes = 5 << 20
+	minAvatarDimension   = 16
+	maxAvatarDimension   = 4096 // Bounds the memory needed to decode an upload
+)
+
+// avatarSizes are the square sizes, in pixels, avatars are rendered in.
+var avatarSizes = []int{64, 128, 256}
+
+// avatarContentTypes are the image formats accepted for upload, as sniffed from the content.
+var avatarContentTypes = map[string]bool{"image/png": true, "image/jpeg": true, "image/gif": true}
+
+// avatarBlobsMutex is held from storing an avatar's blobs until the user references them, and while
+// releasing blobs. Blobs are shared by content: without it, a blob could be deleted as unused between
+// another upload of the same image storing it, a no-op, and that upload being recorded.
+var avatarBlobsMutex sync.Mutex
+
+var (
+	errAvatarTooLarge        = errors.New("avatar is too large")
+	errAvatarUnsupportedType = errors.New("avatar must be a PNG, JPEG or GIF image")
+	errAvatarInvalid         = errors.New("avatar could not be decoded")
+	errAvatarTooSmall        = errors.New("avatar is too small")
+)
+
+// decodeAvatar checks the type and dimensions of an upload before decoding it.
+func decodeAvatar(data []byte) (image.Image, error) {
+	if len(data) > maxAvatarUploadBytes {
+		return nil, errAvatarTooLarge
+	}
+	if !avatarContentTypes[http.DetectContentType(data)] {
+		return nil, errAvatarUnsupportedType
+	}
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, errAvatarInvalid
+	}
+	if config.Width > maxAvatarDimension || config.Height > maxAvatarDimension {
+		return nil, errAvatarTooLarge
+	}
+	if config.Width < minAvatarDimension || config.Height < minAvatarDimension {
+		return nil, errAvatarTooSmall
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, errAvatarInvalid
+	}
+	return img, nil
+}
+
+// resizeAvatar crops the center square of img and scales it to size x size. Downscaling averages
+// the source pixels covered by each destination pixel; upscaling repeats the nearest one.
+func resizeAvatar(img image.Image, size int) *image.RGBA {
+	b := img.Bounds()
+	side := min(b.Dx(), b.Dy())
+	crop := image.Rect(0, 0, side, side)
+	src := image.NewRGBA(crop) // Premultiplied, so transparent pixels do not bleed their color
+	draw.Draw(src, crop, img, image.Pt(b.Min.X+(b.Dx()-side)/2, b.Min.Y+(b.Dy()-side)/2), draw.Src)
+
+	dst := image.NewRGBA(image.Rect(0, 0, size, size))
+	for dy := 0; dy < size; dy++ {
+		y0, y1 := dy*side/size, max((dy+1)*side/size, dy*side/size+1)
+		for dx := 0; dx < size; dx++ {
+			x0, x1 := dx*side/size, max((dx+1)*side/size, dx*side/size+1)
+			var r, g, bl, a, n uint32
+			for y := y0; y < y1; y++ {
+				row := src.Pix[y*src.Stride:]
+				for x := x0; x < x1; x++ {
+					p := row[x*4 : x*4+4]
+					r, g, bl, a = r+uint32(p[0]), g+uint32(p[1]), bl+uint32(p[2]), a+uint32(p[3])
+					n++
+				}
+			}
+			i := dst.PixOffset(dx, dy)
+			dst.Pix[i], dst.Pix[i+1], dst.Pix[i+2], dst.Pix[i+3] = uint8(r/n), uint8(g/n), uint8(bl/n), uint8(a/n)
+		}
+	}
+	return dst
+}
+
+// setAvatar validates an upload, stores every rendered size and records them for the user.
+// Contacts and the user's other devices receive an 'avatar_changed' event with the new hashes.
+func setAvatar(userID string, data []byte) (map[int]string, error) {
+	img, err := decodeAvatar(data)
+	if err != nil {
+		return nil, err
+	}
+
+	rendered := make(map[int][]byte, len(avatarSizes))
+	for _, size := range avatarSizes {
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, resizeAvatar(img, size)); err != nil {
+			return nil, err
+		}
+		rendered[size] = buf.Bytes()
+	}
+
+	avatarBlobsMutex.Lock()
+	defer avatarBlobsMutex.Unlock()
+	hashes := make(map[int]string, len(avatarSizes))
+	for size, data := range rendered {
+		if hashes[size], err = blobStore.Put(data); err != nil {
+			log.Printf("[ERROR] Failed to store the %dpx avatar of user %s: %v", size, userID, err)
+			return nil, err
+		}
+	}
+
+	previous, err := store.GetUserAvatar(userID)
+	if err != nil {
+		return nil, err
+	}
+	if err := store.SetUserAvatar(userID, hashes); err != nil {
+		return nil, err
+	}
+	log.Printf("[AVATAR] User %s uploaded a new avatar.", userID)
+	releaseAvatarBlobs(previous)
+	notifyAvatarChanged(userID, hashes)
+	return hashes, nil
+}
+
+// removeAvatar clears the user's avatar and tells their contacts, with an 'avatar_changed' event without hashes.
+func removeAvatar(userID string) error {
+	avatarBlobsMutex.Lock()
+	defer avatarBlobsMutex.Unlock()
+	previous, err := store.GetUserAvatar(userID)
+	if err != nil {
+		return err
+	}
+	if len(previous) == 0 {
+		return nil
+	}
+	if err := store.DeleteUserAvatar(userID); err != nil {
+		return err
+	}
+	log.Printf("[AVATAR] User %s removed their avatar.", userID)
+	releaseAvatarBlobs(previous)
+	notifyAvatarChanged(userID, nil)
+	return nil
+}
+
+// releaseAvatarBlobs deletes the blobs of a replaced avatar that no other user still references.
+// Failures are only logged: the worst outcome is an orphan blob. The caller holds avatarBlobsMutex.
+func releaseAvatarBlobs(hashes map[int]string) {
+	for _, hash := range hashes {
+		inUse, err := store.AvatarHashInUse(hash)
+		if err != nil || inUse {
+			continue
+		}
+		if err := blobStore.Delete(hash); err != nil {
+			log.Printf("[AVATAR] Could not delete blob %s: %v", hash, err)
+		}
+	}
+}
+
+// notifyAvatarChanged sends 'avatar_changed' to the user's contacts (queued if offline) and to their own devices.
+func notifyAvatarChanged(userID string, hashes map[int]string) {
+	contactIDs, err := store.GetContactIDs(userID)
+	if err != nil {
+		log.Printf("[AVATAR] Could not notify the contacts of user %s of their new avatar: %v", userID, err)
+	}
+	payload := MessagePayload{UserID: userID, Avatar: hashes}
+	for _, contactID := range contactIDs {
+		sendServerEvent(Message{Type: "avatar_changed", From: userID, To: contactID, Payload: payload})
+	}
+	broadcastMessageToUser(userID, Message{Type: "avatar_changed", From: "server", To: userID, Payload: payload}, nil)
+}
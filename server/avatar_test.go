@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// encodeTestPNG returns a w x h PNG whose left half is red and right half is blue.
+func encodeTestPNG(t *testing.T, w, h int) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			if x < w/2 {
+				img.Set(x, y, color.RGBA{R: 255, A: 255})
+			} else {
+				img.Set(x, y, color.RGBA{B: 255, A: 255})
+			}
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDecodeAvatar(t *testing.T) {
+	if _, err := decodeAvatar(encodeTestPNG(t, 40, 30)); err != nil {
+		t.Errorf("a valid PNG should decode, got %v", err)
+	}
+	cases := map[string]struct {
+		data []byte
+		want error
+	}{
+		"not an image":  {[]byte("<svg xmlns='http://www.w3.org/2000/svg'></svg>"), errAvatarUnsupportedType},
+		"too small":     {encodeTestPNG(t, 8, 8), errAvatarTooSmall},
+		"too wide":      {encodeTestPNG(t, maxAvatarDimension+1, 16), errAvatarTooLarge},
+		"truncated PNG": {encodeTestPNG(t, 32, 32)[:60], errAvatarInvalid},
+		"too heavy":     {make([]byte, maxAvatarUploadBytes+1), errAvatarTooLarge},
+	}
+	for name, c := range cases {
+		if _, err := decodeAvatar(c.data); err != c.want {
+			t.Errorf("%s: got %v, want %v", name, err, c.want)
+		}
+	}
+}
+
+func TestResizeAvatar(t *testing.T) {
+	img, _ := png.Decode(bytes.NewReader(encodeTestPNG(t, 200, 100)))
+
+	// The center 100x100 square is half red, half blue.
+	small := resizeAvatar(img, 4)
+	if small.Bounds().Dx() != 4 || small.Bounds().Dy() != 4 {
+		t.Fatalf("unexpected size %v", small.Bounds())
+	}
+	if got := small.RGBAAt(0, 0); got != (color.RGBA{R: 255, A: 255}) {
+		t.Errorf("left pixel = %v, want red", got)
+	}
+	if got := small.RGBAAt(3, 3); got != (color.RGBA{B: 255, A: 255}) {
+		t.Errorf("right pixel = %v, want blue", got)
+	}
+
+	// Upscaling keeps the image intact.
+	large := resizeAvatar(img, 256)
+	if got := large.RGBAAt(10, 200); got != (color.RGBA{R: 255, A: 255}) {
+		t.Errorf("upscaled left pixel = %v, want red", got)
+	}
+}
+
+func TestSetAvatar(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	setDB(db)
+
+	blobs, _ := newLocalBlobStore(t.TempDir())
+	blobStore = blobs
+	defer func() { blobStore = nil }()
+	stale, _ := blobs.Put([]byte("previous avatar"))
+
+	mock.ExpectQuery("SELECT user_id, size, hash FROM user_avatars").
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "size", "hash"}).AddRow("alice", 64, stale))
+	mock.ExpectBegin()
+	mock.ExpectExec("DELETE FROM user_avatars").WithArgs("alice").WillReturnResult(sqlmock.NewResult(0, 1))
+	for range avatarSizes {
+		mock.ExpectExec("INSERT INTO user_avatars").WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+	mock.ExpectCommit()
+	mock.ExpectQuery("SELECT EXISTS").WithArgs(stale).WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+	mock.ExpectQuery("SELECT contact_id FROM contacts").WithArgs("alice").WillReturnRows(sqlmock.NewRows([]string{"contact_id"}))
+
+	hashes, err := setAvatar("alice", encodeTestPNG(t, 300, 300))
+	if err != nil {
+		t.Fatalf("setAvatar failed: %v", err)
+	}
+	for _, size := range avatarSizes {
+		data, err := blobs.Get(hashes[size])
+		if err != nil {
+			t.Fatalf("%dpx avatar not stored: %v", size, err)
+		}
+		if config, _ := png.DecodeConfig(bytes.NewReader(data)); config.Width != size || config.Height != size {
+			t.Errorf("%dpx avatar is %dx%d", size, config.Width, config.Height)
+		}
+	}
+	if _, err := blobs.Get(stale); err != errBlobNotFound {
+		t.Errorf("the unreferenced previous avatar should be deleted, got %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
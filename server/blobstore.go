@@ -0,0 +1,122 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// --- Blob Storage ---
+
+// errBlobNotFound is returned by BlobStore.Get for unknown hashes.
+var errBlobNotFound = errors.New("blob not found")
+
+// BlobStore stores immutable blobs addressed by the hex SHA-256 of their content.
+type BlobStore interface {
+	// Put stores data and returns its hash. Storing the same content twice is a no-op.
+	Put(data []byte) (string, error)
+	// Get returns the content of a blob, or errBlobNotFound.
+	Get(hash string) ([]byte, error)
+	// Delete removes a blob. Deleting a missing blob is not an error.
+	Delete(hash string) error
+}
+
+// blobStore is the store used for avatars, set up at startup by initializeBlobStore.
+var blobStore BlobStore
+
+// initializeBlobStore opens the local blob store in BLOB_DIR (default "data/blobs").
+func initializeBlobStore() {
+	dir := getEnv("BLOB_DIR", "data/blobs")
+	blobs, err := newLocalBlobStore(dir)
+	if err != nil {
+		log.Fatalf("[FATAL] Could not open the blob store in %s: %v", dir, err)
+	}
+	blobStore = blobs
+	log.Printf("[INFO] Blob store ready in %s.", dir)
+}
+
+// blobHash returns the content address of data.
+func blobHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// isBlobHash reports whether s looks like a blob hash, so it can safely be used as a path.
+func isBlobHash(s string) bool {
+	if len(s) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+// localBlobStore keeps blobs on the local filesystem, fanned out in sub-directories named after
+// the first two hex digits of their hash.
+type localBlobStore struct {
+	dir string
+}
+
+func newLocalBlobStore(dir string) (*localBlobStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &localBlobStore{dir: dir}, nil
+}
+
+func (s *localBlobStore) path(hash string) string {
+	return filepath.Join(s.dir, hash[:2], hash)
+}
+
+func (s *localBlobStore) Put(data []byte) (string, error) {
+	hash := blobHash(data)
+	path := s.path(hash)
+	if _, err := os.Stat(path); err == nil {
+		return hash, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return "", err
+	}
+
+	// Write to a temporary file first so readers never see a partial blob.
+	tmp, err := os.CreateTemp(filepath.Dir(path), hash+".tmp-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return "", err
+	}
+	return hash, nil
+}
+
+func (s *localBlobStore) Get(hash string) ([]byte, error) {
+	if !isBlobHash(hash) {
+		return nil, errBlobNotFound
+	}
+	data, err := os.ReadFile(s.path(hash))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, errBlobNotFound
+	}
+	return data, err
+}
+
+func (s *localBlobStore) Delete(hash string) error {
+	if !isBlobHash(hash) {
+		return fmt.Errorf("invalid blob hash %q", hash)
+	}
+	if err := os.Remove(s.path(hash)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
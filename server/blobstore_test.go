@@ -0,0 +1,38 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestLocalBlobStore(t *testing.T) {
+	blobs, err := newLocalBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("newLocalBlobStore failed: %v", err)
+	}
+
+	data := []byte("avatar bytes")
+	hash, err := blobs.Put(data)
+	if err != nil || hash != blobHash(data) {
+		t.Fatalf("Put() = %q, %v; want %q", hash, err, blobHash(data))
+	}
+	if again, err := blobs.Put(data); err != nil || again != hash {
+		t.Errorf("storing the same content again should return the same hash, got %q, %v", again, err)
+	}
+	if got, err := blobs.Get(hash); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("Get() = %q, %v", got, err)
+	}
+
+	if err := blobs.Delete(hash); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if _, err := blobs.Get(hash); err != errBlobNotFound {
+		t.Errorf("expected errBlobNotFound after delete, got %v", err)
+	}
+	if err := blobs.Delete(hash); err != nil {
+		t.Errorf("deleting a missing blob should not fail, got %v", err)
+	}
+	if _, err := blobs.Get("../../etc/passwd"); err != errBlobNotFound {
+		t.Errorf("invalid hashes must not reach the filesystem, got %v", err)
+	}
+}
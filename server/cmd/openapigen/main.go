@@ -0,0 +1,36 @@
+// Command openapigen generates the Go client of the server from its OpenAPI document.
+//
+//	go run ./cmd/openapigen -spec openapi.json -package plopclient -out plopclient/api.gen.go
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"path/filepath"
+
+	"plop_server/internal/openapigen"
+)
+
+func main() {
+	spec := flag.String("spec", "openapi.json", "OpenAPI document to read")
+	pkg := flag.String("package", "plopclient", "package of the generated file")
+	out := flag.String("out", "plopclient/api.gen.go", "file to write")
+	flag.Parse()
+
+	data, err := os.ReadFile(*spec)
+	if err != nil {
+		log.Fatalf("[FATAL] %v", err)
+	}
+	doc, err := openapigen.Parse(data)
+	if err != nil {
+		log.Fatalf("[FATAL] Invalid OpenAPI document %s: %v", *spec, err)
+	}
+	source, err := openapigen.Generate(doc, *pkg, filepath.Base(*spec))
+	if err != nil {
+		log.Fatalf("[FATAL] Failed to generate the client: %v", err)
+	}
+	if err := os.WriteFile(*out, source, 0o644); err != nil {
+		log.Fatalf("[FATAL] %v", err)
+	}
+}
@@ -0,0 +1,541 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+
+	"plop_server/plopclient"
+)
+
+const (
+	cliAppVersion      = "plop-cli"
+	syncStatusInterval = 2 * time.Second
+	maxReconnectDelay  = time.Minute
+)
+
+// finalCloseCodes are the close codes after which reconnecting with the same credentials is pointless.
+var finalCloseCodes = map[int]bool{
+	plopclient.CloseDeviceRevoked:      true,
+	plopclient.CloseAccountDeleted:     true,
+	plopclient.CloseCredentialsRotated: true,
+	plopclient.CloseSuspended:          true,
+	plopclient.CloseBanned:             true,
+}
+
+func (c *cli) loadIdentity() (*identity, error) {
+	return loadIdentity(c.identityPath)
+}
+
+// checkOverwrite refuses to replace an existing identity unless forced, since its secrets may be the only copy.
+func (c *cli) checkOverwrite(force bool) error {
+	if _, err := os.Stat(c.identityPath); err == nil && !force {
+		return fmt.Errorf("an identity already exists in %s: use --force to replace it", c.identityPath)
+	}
+	return nil
+}
+
+// newDevice describes this installation of the CLI.
+func newDevice(userID, name string) plopclient.Device {
+	if name == "" {
+		host, _ := os.Hostname()
+		name = strings.TrimSpace("plop CLI " + host)
+	}
+	platform := runtime.GOOS
+	if platform == "darwin" {
+		platform = "macos"
+	}
+	return plopclient.Device{UserID: userID, DeviceID: "cli-" + uuid.NewString(), Name: name, Platform: platform, AppVersion: cliAppVersion}
+}
+
+// registerDevice registers a new device for an identity holding the account secret and stores its credentials.
+func (c *cli) registerDevice(id *identity, deviceName string) error {
+	client := plopclient.New(id.Server)
+	client.Credentials = plopclient.Credentials{UserID: id.UserID, AccountSecret: id.AccountSecret}
+	device := newDevice(id.UserID, deviceName)
+	resp, err := client.RegisterDevice(c.ctx, plopclient.RegisterDeviceRequest{Device: device})
+	if err != nil {
+		return fmt.Errorf("could not register the device: %w", err)
+	}
+	if resp.DeviceSecret == "" {
+		return errors.New("the server did not issue device credentials")
+	}
+	id.DeviceID, id.DeviceSecret = device.DeviceID, resp.DeviceSecret
+	return nil
+}
+
+func runIdentityNew(c *cli, args []string) error {
+	fs := flag.NewFlagSet("identity new", flag.ContinueOnError)
+	server := fs.String("server", os.Getenv("PLOP_SERVER"), "server URL (default $PLOP_SERVER)")
+	pseudo := fs.String("pseudo", "", "pseudo shown to contacts")
+	deviceName := fs.String("device-name", "", "name shown in the device list (default: the host name)")
+	force := fs.Bool("force", false, "replace the existing identity")
+	positional, err := c.parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 0 || *server == "" || *pseudo == "" {
+		return c.usageError("identity new")
+	}
+	if err := c.checkOverwrite(*force); err != nil {
+		return err
+	}
+
+	client := plopclient.New(*server)
+	created, err := client.GenerateUserID(c.ctx, plopclient.GenerateUserIDParams{Credentials: "true"})
+	if err != nil {
+		return err
+	}
+	id := &identity{Server: client.BaseURL, UserID: created.UserID, AccountSecret: created.AccountSecret}
+	client.Credentials = plopclient.Credentials{UserID: id.UserID, AccountSecret: id.AccountSecret}
+	changed, err := client.ChangePseudo(c.ctx, plopclient.ChangePseudoRequest{UserID: id.UserID, Pseudo: *pseudo})
+	if err != nil {
+		return fmt.Errorf("could not set the pseudo: %w", err)
+	}
+	id.Pseudo = changed.Pseudo
+	if err := c.registerDevice(id, *deviceName); err != nil {
+		return err
+	}
+	if err := id.save(c.identityPath); err != nil {
+		return err
+	}
+	fmt.Fprintf(c.errOut, "Created user %s (%s). Its account secret is stored in %s: keep a copy to sign in elsewhere.\n", id.UserID, id.Pseudo, c.identityPath)
+	fmt.Fprintln(c.out, id.UserID)
+	return nil
+}
+
+func runIdentityImport(c *cli, args []string) error {
+	fs := flag.NewFlagSet("identity import", flag.ContinueOnError)
+	server := fs.String("server", os.Getenv("PLOP_SERVER"), "server URL (default $PLOP_SERVER)")
+	syncCode := fs.String("sync-code", "", "sync code shown by one of the account's devices")
+	userID := fs.String("user-id", "", "user ID of the account")
+	accountSecret := fs.String("account-secret", "", "account secret of the account")
+	deviceName := fs.String("device-name", "", "name shown in the device list (default: the host name)")
+	force := fs.Bool("force", false, "replace the existing identity")
+	positional, err := c.parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	withSecret := *userID != "" && *accountSecret != ""
+	if len(positional) != 0 || *server == "" || withSecret == (*syncCode != "") {
+		return c.usageError("identity import")
+	}
+	if err := c.checkOverwrite(*force); err != nil {
+		return err
+	}
+
+	id := &identity{Server: plopclient.New(*server).BaseURL, UserID: *userID, AccountSecret: *accountSecret}
+	if withSecret {
+		err = c.importWithSecret(id, *deviceName)
+	} else {
+		err = c.importWithSyncCode(id, *syncCode, *deviceName)
+	}
+	if err != nil {
+		return err
+	}
+	if err := id.save(c.identityPath); err != nil {
+		return err
+	}
+	fmt.Fprintf(c.errOut, "Signed in as %s (%s) with device %s.\n", id.UserID, id.Pseudo, id.DeviceID)
+	fmt.Fprintln(c.out, id.UserID)
+	return nil
+}
+
+// importWithSecret registers a device with the account secret, like an app restoring a backup.
+func (c *cli) importWithSecret(id *identity, deviceName string) error {
+	if err := c.registerDevice(id, deviceName); err != nil {
+		return err
+	}
+	pseudos, err := c.fetchPseudos(id, []string{id.UserID})
+	if err != nil {
+		return err
+	}
+	id.Pseudo = pseudos[id.UserID]
+	return nil
+}
+
+// importWithSyncCode links a device with a sync code and waits until one of the account's devices approves it.
+func (c *cli) importWithSyncCode(id *identity, code, deviceName string) error {
+	client := plopclient.New(id.Server)
+	device := newDevice("", deviceName)
+	link, err := client.UseSyncCode(c.ctx, plopclient.UseSyncCodeRequest{Device: device, Code: code})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(c.errOut, "Approve the sign-in of %q on one of your devices before %s.\n", device.Name, link.ExpiresAt.Local().Format(time.Kitchen))
+
+	ticker := time.NewTicker(syncStatusInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.ctx.Done():
+			return c.ctx.Err()
+		case <-ticker.C:
+		}
+		status, err := client.GetSyncStatus(c.ctx, plopclient.GetSyncStatusParams{RequestID: link.RequestID})
+		if err != nil {
+			return err
+		}
+		switch status.Status {
+		case plopclient.LinkStatusPending:
+			continue
+		case plopclient.LinkStatusApproved:
+			id.UserID, id.Pseudo = status.UserID, status.Pseudo
+			id.DeviceID, id.DeviceSecret = device.DeviceID, status.DeviceSecret
+			return nil
+		default:
+			return fmt.Errorf("the sign-in was %s", status.Status)
+		}
+	}
+}
+
+// identitySummary is the output of `identity show`: the identity without its secrets.
+type identitySummary struct {
+	Server           string    `json:"server"`
+	UserID           string    `json:"userId"`
+	Pseudo           string    `json:"pseudo"`
+	DeviceID         string    `json:"deviceId"`
+	HasAccountSecret bool      `json:"hasAccountSecret"`
+	Contacts         []contact `json:"contacts"`
+}
+
+func runIdentityShow(c *cli, args []string) error {
+	fs := flag.NewFlagSet("identity show", flag.ContinueOnError)
+	asJSON := fs.Bool("json", false, "print JSON")
+	if positional, err := c.parseFlags(fs, args); err != nil || len(positional) != 0 {
+		return c.usageError("identity show")
+	}
+	id, err := c.loadIdentity()
+	if err != nil {
+		return err
+	}
+
+	summary := identitySummary{Server: id.Server, UserID: id.UserID, Pseudo: id.Pseudo, DeviceID: id.DeviceID, HasAccountSecret: id.AccountSecret != "", Contacts: id.Contacts}
+	return c.writeOutput(*asJSON, summary, func(tw *tabwriter.Writer) {
+		fmt.Fprintf(tw, "Server:\t%s\n", summary.Server)
+		fmt.Fprintf(tw, "User ID:\t%s\n", summary.UserID)
+		fmt.Fprintf(tw, "Pseudo:\t%s\n", summary.Pseudo)
+		fmt.Fprintf(tw, "Device ID:\t%s\n", summary.DeviceID)
+		fmt.Fprintf(tw, "Account secret:\t%t\n", summary.HasAccountSecret)
+		fmt.Fprintf(tw, "Contacts:\t%d\n", len(summary.Contacts))
+	})
+}
+
+func runInvitationsCreate(c *cli, args []string) error {
+	fs := flag.NewFlagSet("invitations create", flag.ContinueOnError)
+	if positional, err := c.parseFlags(fs, args); err != nil || len(positional) != 0 {
+		return c.usageError("invitations create")
+	}
+	id, err := c.loadIdentity()
+	if err != nil {
+		return err
+	}
+
+	invitation, err := id.client().CreateInvitation(c.ctx, plopclient.CreateInvitationParams{UserID: id.UserID, Pseudo: id.Pseudo})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(c.errOut, "Valid for %d minutes. Run `plop listen` to see who uses it.\n", invitation.ValidityMinutes)
+	fmt.Fprintln(c.out, invitation.Code)
+	return nil
+}
+
+func runInvitationsUse(c *cli, args []string) error {
+	fs := flag.NewFlagSet("invitations use", flag.ContinueOnError)
+	positional, err := c.parseFlags(fs, args)
+	if err != nil || len(positional) != 1 {
+		return c.usageError("invitations use")
+	}
+	id, err := c.loadIdentity()
+	if err != nil {
+		return err
+	}
+
+	creator, err := id.client().UseInvitation(c.ctx, plopclient.UseInvitationRequest{Code: positional[0], UserID: id.UserID, Pseudo: id.Pseudo})
+	if err != nil {
+		return err
+	}
+	id.addContact(contact{UserID: creator.UserID, Pseudo: creator.Pseudo})
+	if err := id.save(c.identityPath); err != nil {
+		return err
+	}
+	fmt.Fprintf(c.errOut, "Added %s to your contacts.\n", creator.Pseudo)
+	fmt.Fprintln(c.out, creator.UserID)
+	return nil
+}
+
+// fetchPseudos returns the current pseudos of users. Users without a pseudo are left out.
+func (c *cli) fetchPseudos(id *identity, userIDs []string) (map[string]string, error) {
+	raw, err := id.client().GetPseudos(c.ctx, plopclient.GetPseudosRequest{UserIDs: userIDs})
+	if err != nil {
+		return nil, err
+	}
+	pseudos := make(map[string]string, len(raw))
+	for userID, value := range raw {
+		var pseudo string
+		if err := json.Unmarshal(value, &pseudo); err != nil {
+			return nil, fmt.Errorf("unexpected pseudo of user %s: %s", userID, value)
+		}
+		pseudos[userID] = pseudo
+	}
+	return pseudos, nil
+}
+
+// refreshContacts replaces the cached contacts with the server's list and their current pseudos.
+func (c *cli) refreshContacts(id *identity) error {
+	export, err := id.client().ExportAccount(c.ctx, plopclient.ExportAccountParams{UserID: id.UserID})
+	if err != nil {
+		return err
+	}
+	pseudos, err := c.fetchPseudos(id, export.Contacts)
+	if err != nil {
+		return err
+	}
+	cached := id.Contacts
+	id.Contacts = make([]contact, 0, len(export.Contacts))
+	for _, userID := range export.Contacts {
+		pseudo := pseudos[userID]
+		for _, known := range cached {
+			if known.UserID == userID && pseudo == "" {
+				pseudo = known.Pseudo
+			}
+		}
+		id.Contacts = append(id.Contacts, contact{UserID: userID, Pseudo: pseudo})
+	}
+	return id.save(c.identityPath)
+}
+
+func runContactsList(c *cli, args []string) error {
+	fs := flag.NewFlagSet("contacts list", flag.ContinueOnError)
+	asJSON := fs.Bool("json", false, "print JSON")
+	if positional, err := c.parseFlags(fs, args); err != nil || len(positional) != 0 {
+		return c.usageError("contacts list")
+	}
+	id, err := c.loadIdentity()
+	if err != nil {
+		return err
+	}
+	if err := c.refreshContacts(id); err != nil {
+		return err
+	}
+
+	return c.writeOutput(*asJSON, id.Contacts, func(tw *tabwriter.Writer) {
+		fmt.Fprintln(tw, "USER ID\tPSEUDO")
+		for _, contact := range id.Contacts {
+			fmt.Fprintf(tw, "%s\t%s\n", contact.UserID, contact.Pseudo)
+		}
+	})
+}
+
+// resolveContact finds a contact in the cache, refreshing it once from the server when the name is unknown.
+func (c *cli) resolveContact(id *identity, name string) (contact, error) {
+	if found, err := id.findContact(name); err == nil {
+		return found, nil
+	}
+	if err := c.refreshContacts(id); err != nil {
+		return contact{}, err
+	}
+	return id.findContact(name)
+}
+
+func runSend(c *cli, args []string) error {
+	fs := flag.NewFlagSet("send", flag.ContinueOnError)
+	ttl := fs.Int64("ttl", 0, "seconds the plop stays deliverable to an offline contact (default: the server's)")
+	timeout := fs.Duration("timeout", 10*time.Second, "how long to wait for the server's acknowledgement")
+	positional, err := c.parseFlags(fs, args)
+	if err != nil || len(positional) == 0 {
+		return c.usageError("send")
+	}
+	id, err := c.loadIdentity()
+	if err != nil {
+		return err
+	}
+	to, err := c.resolveContact(id, positional[0])
+	if err != nil {
+		return err
+	}
+
+	conn, err := id.client().Dial(c.ctx, id.Pseudo)
+	if err != nil {
+		return err
+	}
+	defer closeConn(conn)
+	defer closeOnDone(c.ctx, conn)()
+
+	plop := plopclient.Message{
+		ID:      uuid.NewString(),
+		Type:    "plop",
+		To:      to.UserID,
+		TTL:     *ttl,
+		Payload: plopclient.MessagePayload{Text: strings.Join(positional[1:], " ")},
+	}
+	if err := conn.WriteJSON(plop); err != nil {
+		return err
+	}
+	conn.SetReadDeadline(time.Now().Add(*timeout))
+	for {
+		frame, data, err := readFrame(conn)
+		if err != nil {
+			return fmt.Errorf("no acknowledgement from the server: %w", err)
+		}
+		if frame.Payload.MessageID != plop.ID {
+			// Pending messages are delivered on connection: print them rather than lose them.
+			c.printFrame(data)
+			continue
+		}
+		switch frame.Type {
+		case "message_ack":
+			fmt.Fprintf(c.errOut, "Plop sent to %s.\n", to.Pseudo)
+			return nil
+		case "rate_limited":
+			return fmt.Errorf("rate limited: retry in %v", time.Duration(frame.Payload.RetryAfterMs)*time.Millisecond)
+		case "plop_error":
+			return fmt.Errorf("plop refused: %s", frame.Payload.Text)
+		default:
+			c.printFrame(data)
+		}
+	}
+}
+
+func runListen(c *cli, args []string) error {
+	fs := flag.NewFlagSet("listen", flag.ContinueOnError)
+	noReconnect := fs.Bool("no-reconnect", false, "exit when the connection drops")
+	if positional, err := c.parseFlags(fs, args); err != nil || len(positional) != 0 {
+		return c.usageError("listen")
+	}
+	id, err := c.loadIdentity()
+	if err != nil {
+		return err
+	}
+
+	delay := time.Second
+	for {
+		connectedAt := time.Now()
+		err := c.listenOnce(id)
+		if c.ctx.Err() != nil {
+			return nil // Interrupted
+		}
+		var closeErr *websocket.CloseError
+		if errors.As(err, &closeErr) && finalCloseCodes[closeErr.Code] {
+			return fmt.Errorf("disconnected by the server (%d): %s", closeErr.Code, closeErr.Text)
+		}
+		var apiErr *plopclient.APIError
+		if errors.As(err, &apiErr) && apiErr.StatusCode < 500 {
+			return err
+		}
+		if *noReconnect {
+			return err
+		}
+		if time.Since(connectedAt) > maxReconnectDelay {
+			delay = time.Second
+		}
+		fmt.Fprintf(c.errOut, "Disconnected: %v. Reconnecting in %v.\n", err, delay)
+		select {
+		case <-c.ctx.Done():
+			return nil
+		case <-time.After(delay):
+		}
+		delay = min(2*delay, maxReconnectDelay)
+	}
+}
+
+// listenOnce prints the frames of one connection until it drops. Events about the identity itself
+// (new contacts, a rotated account secret) are saved as well.
+func (c *cli) listenOnce(id *identity) error {
+	conn, err := id.client().Dial(c.ctx, id.Pseudo)
+	if err != nil {
+		return err
+	}
+	defer closeConn(conn)
+	defer closeOnDone(c.ctx, conn)()
+	fmt.Fprintf(c.errOut, "Listening as %s (%s).\n", id.Pseudo, id.UserID)
+
+	for {
+		frame, data, err := readFrame(conn)
+		if err != nil {
+			return err
+		}
+		c.printFrame(data)
+
+		changed := false
+		switch frame.Type {
+		case "new_contact":
+			changed = id.addContact(contact{UserID: frame.Payload.UserID, Pseudo: frame.Payload.Pseudo})
+		case "account_secret_rotated":
+			if id.AccountSecret != "" && frame.Payload.AccountSecret != "" {
+				id.AccountSecret, changed = frame.Payload.AccountSecret, true
+			}
+		}
+		if changed {
+			if err := id.save(c.identityPath); err != nil {
+				fmt.Fprintln(c.errOut, "error: could not save the identity:", err)
+			}
+		}
+	}
+}
+
+// readFrame reads the next frame, returning it decoded and as received.
+func readFrame(conn *websocket.Conn) (plopclient.Message, []byte, error) {
+	var frame plopclient.Message
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		return frame, nil, err
+	}
+	if err := json.Unmarshal(data, &frame); err != nil {
+		return frame, nil, fmt.Errorf("invalid frame from the server: %v", err)
+	}
+	return frame, data, nil
+}
+
+// printFrame prints a frame as one line of JSON.
+func (c *cli) printFrame(data []byte) {
+	var line bytes.Buffer
+	if err := json.Compact(&line, data); err != nil {
+		return
+	}
+	line.WriteByte('\n')
+	c.out.Write(line.Bytes())
+}
+
+// closeOnDone closes a connection when ctx is cancelled, which ends any pending read.
+// The returned function stops watching.
+func closeOnDone(ctx context.Context, conn *websocket.Conn) func() {
+	stop := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			closeConn(conn)
+		case <-stop:
+		}
+	}()
+	return func() { close(stop) }
+}
+
+// closeConn closes a connection, telling the server it is a normal closure.
+func closeConn(conn *websocket.Conn) {
+	conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+	conn.Close()
+}
+
+// writeOutput prints v as indented JSON, or as a table through writeTable.
+func (c *cli) writeOutput(asJSON bool, v interface{}, writeTable func(tw *tabwriter.Writer)) error {
+	if asJSON {
+		enc := json.NewEncoder(c.out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	}
+	tw := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+	writeTable(tw)
+	return tw.Flush()
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"plop_server/plopclient"
+)
+
+// identity is a Plop account as seen by one CLI device. It is stored as JSON with mode 0600, since
+// it holds the account and device secrets.
+type identity struct {
+	Server        string    `json:"server"`
+	UserID        string    `json:"userId"`
+	Pseudo        string    `json:"pseudo"`
+	AccountSecret string    `json:"accountSecret,omitempty"` // Only known on the device that created the account or imported it with the secret
+	DeviceID      string    `json:"deviceId"`
+	DeviceSecret  string    `json:"deviceSecret"`
+	Contacts      []contact `json:"contacts"` // Cached; refreshed by `contacts list`
+}
+
+// contact is a user the identity exchanged an invitation with.
+type contact struct {
+	UserID string `json:"userId"`
+	Pseudo string `json:"pseudo"`
+}
+
+var errNoIdentity = errors.New("no identity yet: run `plop identity new` or `plop identity import` first")
+
+// defaultIdentityPath is $PLOP_IDENTITY, or identity.json in the user's configuration directory.
+func defaultIdentityPath() string {
+	if path := os.Getenv("PLOP_IDENTITY"); path != "" {
+		return path
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "plop-identity.json"
+	}
+	return filepath.Join(dir, "plop", "identity.json")
+}
+
+func loadIdentity(path string) (*identity, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, errNoIdentity
+	}
+	if err != nil {
+		return nil, err
+	}
+	var id identity
+	if err := json.Unmarshal(data, &id); err != nil {
+		return nil, fmt.Errorf("invalid identity file %s: %v", path, err)
+	}
+	return &id, nil
+}
+
+// save writes the identity atomically, so that an interrupted write never loses the secrets.
+func (id *identity) save(path string) error {
+	data, err := json.MarshalIndent(id, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// client returns an API client authenticated as the identity's device.
+func (id *identity) client() *plopclient.Client {
+	c := plopclient.New(id.Server)
+	c.Credentials = plopclient.Credentials{UserID: id.UserID, DeviceID: id.DeviceID, DeviceSecret: id.DeviceSecret, AccountSecret: id.AccountSecret}
+	return c
+}
+
+// addContact records a contact, updating the pseudo of a known one. It reports whether anything changed.
+func (id *identity) addContact(c contact) bool {
+	for i := range id.Contacts {
+		if id.Contacts[i].UserID == c.UserID {
+			if c.Pseudo == "" || id.Contacts[i].Pseudo == c.Pseudo {
+				return false
+			}
+			id.Contacts[i].Pseudo = c.Pseudo
+			return true
+		}
+	}
+	id.Contacts = append(id.Contacts, c)
+	return true
+}
+
+// findContact looks a contact up by user ID, or by pseudo (case-insensitively) if it is unambiguous.
+func (id *identity) findContact(name string) (contact, error) {
+	var matches []contact
+	for _, c := range id.Contacts {
+		if c.UserID == name {
+			return c, nil
+		}
+		if strings.EqualFold(c.Pseudo, name) {
+			matches = append(matches, c)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return contact{}, fmt.Errorf("unknown contact %q", name)
+	case 1:
+		return matches[0], nil
+	default:
+		return contact{}, fmt.Errorf("%d contacts are called %q: use their user ID", len(matches), name)
+	}
+}
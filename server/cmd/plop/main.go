@@ -0,0 +1,141 @@
+// Command plop is a command-line Plop client for developers and shell scripts. It speaks the same
+// REST and WebSocket protocol as the app:
+//
+//	plop identity new --server https://plop.example.com --pseudo alice
+//	plop invitations create
+//	plop invitations use 123456
+//	plop contacts list
+//	plop send bob "on my way"
+//	plop listen | jq .
+//
+// The identity (user ID, device credentials and cached contacts) is kept in $PLOP_IDENTITY, by
+// default identity.json in the user's configuration directory. Use --identity to switch accounts.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"text/tabwriter"
+)
+
+// errUsage is returned when the command line is invalid; the usage was already printed.
+var errUsage = errors.New("invalid usage")
+
+// cli is the environment commands run in.
+type cli struct {
+	ctx          context.Context
+	identityPath string
+	out          io.Writer // Results, meant to be piped
+	errOut       io.Writer // Progress and errors
+}
+
+// command is one subcommand. run receives the arguments that follow the command name.
+type command struct {
+	name    string
+	usage   string
+	summary string
+	run     func(c *cli, args []string) error
+}
+
+// commands lists the subcommands, in the order they are shown in the usage. It is filled in init,
+// since commands print their own usage from it.
+var commands []command
+
+func init() {
+	commands = []command{
+		{"identity new", "--server URL --pseudo NAME [--device-name NAME] [--force]", "Create an account and register this device", runIdentityNew},
+		{"identity import", "--server URL (--sync-code CODE | --user-id ID --account-secret SECRET) [--device-name NAME] [--force]", "Sign this device in to an existing account", runIdentityImport},
+		{"identity show", "[--json]", "Show the identity, secrets excluded", runIdentityShow},
+		{"invitations create", "", "Create an invitation code for a new contact", runInvitationsCreate},
+		{"invitations use", "<code>", "Use an invitation code and add its creator as a contact", runInvitationsUse},
+		{"contacts list", "[--json]", "List contacts, refreshed from the server", runContactsList},
+		{"send", "[--ttl SECONDS] [--timeout DURATION] <contact> [text]", "Send a plop to a contact, by user ID or pseudo", runSend},
+		{"listen", "[--no-reconnect]", "Print incoming frames as JSON lines until interrupted", runListen},
+	}
+}
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	os.Exit(run(ctx, os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// run parses the global flags and runs a command. It returns the process exit code.
+func run(ctx context.Context, args []string, out, errOut io.Writer) int {
+	fs := flag.NewFlagSet("plop", flag.ContinueOnError)
+	fs.SetOutput(errOut)
+	identityPath := fs.String("identity", defaultIdentityPath(), "identity file")
+	fs.Usage = func() { printUsage(errOut) }
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	c := &cli{ctx: ctx, identityPath: *identityPath, out: out, errOut: errOut}
+	if err := c.dispatch(fs.Args()); err != nil {
+		if err == errUsage {
+			return 2
+		}
+		fmt.Fprintln(errOut, "error:", err)
+		return 1
+	}
+	return 0
+}
+
+// dispatch runs the command whose name starts args.
+func (c *cli) dispatch(args []string) error {
+	for _, cmd := range commands {
+		words := strings.Fields(cmd.name)
+		if len(args) >= len(words) && strings.Join(args[:len(words)], " ") == cmd.name {
+			return cmd.run(c, args[len(words):])
+		}
+	}
+	printUsage(c.errOut)
+	return errUsage
+}
+
+func printUsage(w io.Writer) {
+	fmt.Fprintln(w, "Usage: plop [--identity FILE] <command> [arguments]")
+	fmt.Fprintln(w, "Commands:")
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, cmd := range commands {
+		fmt.Fprintf(tw, "  %s %s\t%s\n", cmd.name, cmd.usage, cmd.summary)
+	}
+	tw.Flush()
+}
+
+// parseFlags parses the flags of a command, which may come before or after its positional
+// arguments, and returns the positional ones. Arguments after "--" are all positional.
+func (c *cli) parseFlags(fs *flag.FlagSet, args []string) ([]string, error) {
+	fs.SetOutput(c.errOut)
+	var positional []string
+	for {
+		rest := args
+		if err := fs.Parse(args); err != nil {
+			return nil, errUsage
+		}
+		if fs.NArg() == 0 {
+			return positional, nil
+		}
+		if len(rest) > fs.NArg() && rest[len(rest)-fs.NArg()-1] == "--" {
+			return append(positional, fs.Args()...), nil
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+}
+
+// usageError prints the usage of a command and returns errUsage.
+func (c *cli) usageError(name string) error {
+	for _, cmd := range commands {
+		if cmd.name == name {
+			fmt.Fprintf(c.errOut, "usage: plop %s %s\n", cmd.name, cmd.usage)
+		}
+	}
+	return errUsage
+}
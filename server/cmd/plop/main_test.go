@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+
+	"plop_server/plopclient"
+)
+
+// fakeServer answers the REST calls of the CLI like the server would, and hands each WebSocket
+// connection to onConnect.
+type fakeServer struct {
+	*httptest.Server
+	onConnect func(conn *websocket.Conn, r *http.Request)
+}
+
+func newFakeServer(t *testing.T) *fakeServer {
+	fake := &fakeServer{}
+	writeJSON := func(w http.ResponseWriter, v interface{}) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(v)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/users/generate-id", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, plopclient.GenerateUserIDResponse{UserID: "alice", AccountSecret: "account-secret"})
+	})
+	mux.HandleFunc("/users/pseudo", func(w http.ResponseWriter, r *http.Request) {
+		var req plopclient.ChangePseudoRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		if r.Header.Get("X-Account-Secret") != "account-secret" {
+			http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+			return
+		}
+		writeJSON(w, plopclient.PseudoResponse{Pseudo: strings.TrimSpace(req.Pseudo)})
+	})
+	mux.HandleFunc("/devices/register", func(w http.ResponseWriter, r *http.Request) {
+		var req plopclient.RegisterDeviceRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		if req.UserID != "alice" || !strings.HasPrefix(req.DeviceID, "cli-") {
+			http.Error(w, "unexpected device", http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, plopclient.RegisterDeviceResponse{Success: true, DeviceSecret: "device-secret"})
+	})
+	mux.HandleFunc("/users/me/export", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, plopclient.AccountExport{UserID: "alice", Contacts: []string{"bob", "carol"}})
+	})
+	mux.HandleFunc("/users/get-pseudos", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]string{"bob": "Bob", "carol": "Carol"})
+	})
+	mux.HandleFunc("/connect", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Device-Secret") != "device-secret" || r.URL.Query().Get("userId") != "alice" {
+			http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+			return
+		}
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("upgrade failed: %v", err)
+			return
+		}
+		defer conn.Close()
+		fake.onConnect(conn, r)
+	})
+	fake.Server = httptest.NewServer(mux)
+	t.Cleanup(fake.Close)
+	return fake
+}
+
+// runCLI runs the CLI with an identity file in a temporary directory.
+func runCLI(t *testing.T, identityPath string, args ...string) (code int, stdout, stderr string) {
+	t.Helper()
+	var out, errOut bytes.Buffer
+	code = run(context.Background(), append([]string{"--identity", identityPath}, args...), &out, &errOut)
+	return code, out.String(), errOut.String()
+}
+
+// testIdentity saves an identity of alice with one contact, for the server at url.
+func testIdentity(t *testing.T, url string) string {
+	path := filepath.Join(t.TempDir(), "identity.json")
+	id := &identity{Server: url, UserID: "alice", Pseudo: "Alice", DeviceID: "cli-1", DeviceSecret: "device-secret", Contacts: []contact{{UserID: "bob", Pseudo: "Bob"}}}
+	if err := id.save(path); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestIdentityNew(t *testing.T) {
+	fake := newFakeServer(t)
+	path := filepath.Join(t.TempDir(), "plop", "identity.json")
+
+	code, stdout, stderr := runCLI(t, path, "identity", "new", "--server", fake.URL+"/", "--pseudo", "Alice ")
+	if code != 0 || stdout != "alice\n" {
+		t.Fatalf("identity new = %d, %q, %q", code, stdout, stderr)
+	}
+	info, err := os.Stat(path)
+	if err != nil || info.Mode().Perm() != 0o600 {
+		t.Fatalf("the identity file must only be readable by its owner: %v, %v", info, err)
+	}
+	id, err := loadIdentity(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := identity{Server: fake.URL, UserID: "alice", Pseudo: "Alice", AccountSecret: "account-secret", DeviceID: id.DeviceID, DeviceSecret: "device-secret"}
+	if !reflect.DeepEqual(*id, want) {
+		t.Errorf("saved identity = %+v, want %+v", *id, want)
+	}
+
+	if code, _, stderr := runCLI(t, path, "identity", "new", "--server", fake.URL, "--pseudo", "Alice"); code != 1 || !strings.Contains(stderr, "--force") {
+		t.Errorf("an existing identity must not be replaced without --force: %d, %q", code, stderr)
+	}
+
+	code, stdout, _ = runCLI(t, path, "identity", "show", "--json")
+	if code != 0 || strings.Contains(stdout, "secret\"") || !strings.Contains(stdout, `"hasAccountSecret": true`) {
+		t.Errorf("identity show must leave the secrets out: %d, %s", code, stdout)
+	}
+}
+
+func TestContactsList(t *testing.T) {
+	fake := newFakeServer(t)
+	path := testIdentity(t, fake.URL)
+
+	code, stdout, stderr := runCLI(t, path, "contacts", "list", "--json")
+	if code != 0 {
+		t.Fatalf("contacts list = %d, %q", code, stderr)
+	}
+	var contacts []contact
+	json.Unmarshal([]byte(stdout), &contacts)
+	want := []contact{{UserID: "bob", Pseudo: "Bob"}, {UserID: "carol", Pseudo: "Carol"}}
+	if !reflect.DeepEqual(contacts, want) {
+		t.Errorf("contacts = %+v, want %+v", contacts, want)
+	}
+	if id, _ := loadIdentity(path); !reflect.DeepEqual(id.Contacts, want) {
+		t.Errorf("cached contacts = %+v, want %+v", id.Contacts, want)
+	}
+}
+
+func TestSend(t *testing.T) {
+	fake := newFakeServer(t)
+	path := testIdentity(t, fake.URL)
+	pending := `{"type":"plop","to":"alice","from":"carol","payload":{"text":"hi"},"isPending":true}`
+	var reply string
+	var received plopclient.Message
+	fake.onConnect = func(conn *websocket.Conn, r *http.Request) {
+		conn.WriteMessage(websocket.TextMessage, []byte(pending))
+		if err := conn.ReadJSON(&received); err != nil {
+			t.Errorf("no plop received: %v", err)
+			return
+		}
+		conn.WriteMessage(websocket.TextMessage, []byte(strings.ReplaceAll(reply, "ID", received.ID)))
+		conn.ReadMessage() // Until the CLI closes the connection
+	}
+
+	reply = `{"type":"message_ack","from":"server","to":"alice","payload":{"text":"plop_ack","messageId":"ID","recipientId":"bob"}}`
+	code, stdout, stderr := runCLI(t, path, "send", "--ttl", "60", "bob", "on", "my", "way")
+	if code != 0 {
+		t.Fatalf("send = %d, %q", code, stderr)
+	}
+	if received.Type != "plop" || received.To != "bob" || received.Payload.Text != "on my way" || received.TTL != 60 || received.ID == "" {
+		t.Errorf("unexpected plop %+v", received)
+	}
+	if stdout != pending+"\n" {
+		t.Errorf("frames received while sending should be printed, got %q", stdout)
+	}
+
+	reply = `{"type":"rate_limited","from":"server","to":"alice","payload":{"text":"","messageId":"ID","retryAfterMs":1500}}`
+	if code, _, stderr := runCLI(t, path, "send", "Bob", "--", "-1"); code != 1 || !strings.Contains(stderr, "retry in 1.5s") {
+		t.Errorf("a rate limited plop should fail: %d, %q", code, stderr)
+	}
+	if received.Payload.Text != "-1" {
+		t.Errorf("arguments after -- should be the text, got %q", received.Payload.Text)
+	}
+
+	if code, _, stderr := runCLI(t, path, "send", "dave", "hi"); code != 1 || !strings.Contains(stderr, `unknown contact "dave"`) {
+		t.Errorf("unknown contacts should be refused: %d, %q", code, stderr)
+	}
+}
+
+func TestListen(t *testing.T) {
+	fake := newFakeServer(t)
+	path := testIdentity(t, fake.URL)
+	newContact := `{"type":"new_contact","payload":{"text":"","userId":"carol","pseudo":"Carol"}}`
+	fake.onConnect = func(conn *websocket.Conn, r *http.Request) {
+		if r.URL.Query().Get("pseudo") != "Alice" {
+			t.Errorf("the pseudo should be sent on connection, got %q", r.URL.RawQuery)
+		}
+		conn.WriteMessage(websocket.TextMessage, []byte("{\n  \"type\": \"sync_request\",\n  \"payload\": {\"text\": \"\"}\n}"))
+		conn.WriteMessage(websocket.TextMessage, []byte(newContact))
+		conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(plopclient.CloseDeviceRevoked, "device revoked"))
+	}
+
+	code, stdout, stderr := runCLI(t, path, "listen")
+	if code != 1 || !strings.Contains(stderr, "disconnected by the server (4001)") {
+		t.Errorf("listen should stop once the device is revoked: %d, %q", code, stderr)
+	}
+	if want := `{"type":"sync_request","payload":{"text":""}}` + "\n" + newContact + "\n"; stdout != want {
+		t.Errorf("listen printed %q, want %q", stdout, want)
+	}
+	if id, _ := loadIdentity(path); len(id.Contacts) != 2 || id.Contacts[1] != (contact{UserID: "carol", Pseudo: "Carol"}) {
+		t.Errorf("the new contact should be saved, got %+v", id.Contacts)
+	}
+
+	id, _ := loadIdentity(path)
+	id.DeviceSecret = "wrong"
+	id.save(path)
+	if code, _, stderr := runCLI(t, path, "listen"); code != 1 || !strings.Contains(stderr, "401") {
+		t.Errorf("refused credentials should not be retried: %d, %q", code, stderr)
+	}
+}
+
+func TestFindContact(t *testing.T) {
+	id := &identity{Contacts: []contact{{"u1", "Bob"}, {"u2", "bob"}, {"u3", "Carol"}}}
+	if c, err := id.findContact("carol"); err != nil || c.UserID != "u3" {
+		t.Errorf("findContact(carol) = %+v, %v", c, err)
+	}
+	if c, err := id.findContact("u2"); err != nil || c.UserID != "u2" {
+		t.Errorf("findContact(u2) = %+v, %v", c, err)
+	}
+	if _, err := id.findContact("bob"); err == nil {
+		t.Error("ambiguous pseudos should be refused")
+	}
+}
+
+func TestParseFlags(t *testing.T) {
+	c := &cli{errOut: &bytes.Buffer{}}
+	fs := flag.NewFlagSet("send", flag.ContinueOnError)
+	ttl := fs.Int64("ttl", 0, "")
+	positional, err := c.parseFlags(fs, []string{"bob", "--ttl", "5", "hello", "--", "--ttl"})
+	if err != nil || *ttl != 5 || !reflect.DeepEqual(positional, []string{"bob", "hello", "--ttl"}) {
+		t.Errorf("parseFlags = %q, %v (ttl %d)", positional, err, *ttl)
+	}
+}
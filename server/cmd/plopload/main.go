@@ -0,0 +1,116 @@
+// Command plopload is a load generator for a Plop server. It tells how many concurrent sockets and
+// plops per second one instance handles:
+//
+//	plopload --server http://localhost:8080 --users 1000 --devices 2 --rate 200 --duration 5m
+//
+// It creates the users and their devices, makes every user exchange invitations with the next
+// --invitations users, connects every device and sends plops between random contacts at the
+// target rate while dropping random connections. Devices reconnect after --reconnect-after, give
+// or take half of it. When the time is up, it waits --drain for the last deliveries and reports
+// the latency percentiles of connections, invitation handshakes, acknowledgements and deliveries,
+// and how many plops were delivered or lost.
+//
+// The server keeps only the latest plop from each sender for a user with no connected device, so
+// plops lost while their recipient was offline are expected; plops lost while the recipient was
+// online are not. The server also allows each user 2 plops per second and 1 per second to a given
+// contact: spread the rate over enough users, or expect rate_limited answers.
+//
+// Every device holds a socket open: raise the open files limit (ulimit -n) of both ends for large
+// runs. The users are left on the server; run it against a disposable database.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"time"
+)
+
+// config is what the command line asks for.
+type config struct {
+	server         string
+	users          int
+	devices        int // Per user
+	invitations    int // Created by each user
+	rate           float64
+	duration       time.Duration
+	disconnects    float64 // Drops per connected device per minute, on average
+	reconnectAfter time.Duration
+	drain          time.Duration
+	concurrency    int // Of the setup requests
+	asJSON         bool
+}
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	os.Exit(run(ctx, os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// run parses the command line, runs the load test and prints its report. It returns the process exit code.
+func run(ctx context.Context, args []string, out, errOut io.Writer) int {
+	cfg, err := parseConfig(args, errOut)
+	if err != nil {
+		if err != flag.ErrHelp {
+			fmt.Fprintln(errOut, "error:", err)
+		}
+		return 2
+	}
+
+	s := newSimulation(cfg, errOut)
+	if err := s.run(ctx); err != nil {
+		fmt.Fprintln(errOut, "error:", err)
+		return 1
+	}
+	r := s.report()
+	if cfg.asJSON {
+		err = r.writeJSON(out)
+	} else {
+		err = r.writeText(out)
+	}
+	if err != nil {
+		fmt.Fprintln(errOut, "error:", err)
+		return 1
+	}
+	return 0
+}
+
+func parseConfig(args []string, errOut io.Writer) (config, error) {
+	var cfg config
+	fs := flag.NewFlagSet("plopload", flag.ContinueOnError)
+	fs.SetOutput(errOut)
+	fs.StringVar(&cfg.server, "server", os.Getenv("PLOP_SERVER"), "server URL (default $PLOP_SERVER)")
+	fs.IntVar(&cfg.users, "users", 100, "simulated users")
+	fs.IntVar(&cfg.devices, "devices", 1, "devices per user, each with its own connection")
+	fs.IntVar(&cfg.invitations, "invitations", 2, "invitations each user exchanges with the next users")
+	fs.Float64Var(&cfg.rate, "rate", 20, "plops per second, over all users")
+	fs.DurationVar(&cfg.duration, "duration", time.Minute, "how long plops are sent")
+	fs.Float64Var(&cfg.disconnects, "disconnects", 0.5, "drops per connected device per minute, on average")
+	fs.DurationVar(&cfg.reconnectAfter, "reconnect-after", 5*time.Second, "how long a dropped device stays offline, on average")
+	fs.DurationVar(&cfg.drain, "drain", 5*time.Second, "how long to wait for the last deliveries")
+	fs.IntVar(&cfg.concurrency, "concurrency", 50, "concurrent requests while creating the users")
+	fs.BoolVar(&cfg.asJSON, "json", false, "print the report as JSON")
+	if err := fs.Parse(args); err != nil {
+		return cfg, err
+	}
+
+	switch {
+	case fs.NArg() != 0:
+		return cfg, fmt.Errorf("unexpected argument %q", fs.Arg(0))
+	case cfg.server == "":
+		return cfg, errors.New("--server is required")
+	case cfg.users < 2:
+		return cfg, errors.New("--users must be at least 2")
+	case cfg.devices < 1 || cfg.invitations < 1 || cfg.concurrency < 1:
+		return cfg, errors.New("--devices, --invitations and --concurrency must be at least 1")
+	case cfg.rate <= 0 || cfg.duration <= 0:
+		return cfg, errors.New("--rate and --duration must be positive")
+	case cfg.disconnects < 0 || cfg.reconnectAfter < 0 || cfg.drain < 0:
+		return cfg, errors.New("--disconnects, --reconnect-after and --drain cannot be negative")
+	}
+	return cfg, nil
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"plop_server/plopclient"
+)
+
+// fakeRelay is a minimal Plop server: it creates accounts and devices, exchanges invitations and
+// relays plops, keeping the latest one of each sender for offline users like the real server.
+type fakeRelay struct {
+	*httptest.Server
+	mu          sync.Mutex
+	nextID      int
+	invitations map[string]string // Code to creator
+	unknownOnce map[string]bool   // Codes answered with a 404 once, like an invitation not saved yet
+	conns       map[string]map[*relayConn]bool
+	queued      map[[2]string]plopclient.Message // By recipient and sender
+}
+
+type relayConn struct {
+	mu   sync.Mutex
+	conn *websocket.Conn
+}
+
+func (c *relayConn) send(msg plopclient.Message) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.conn.WriteJSON(msg)
+}
+
+func newFakeRelay(t *testing.T) *fakeRelay {
+	f := &fakeRelay{
+		invitations: make(map[string]string),
+		unknownOnce: make(map[string]bool),
+		conns:       make(map[string]map[*relayConn]bool),
+		queued:      make(map[[2]string]plopclient.Message),
+	}
+	writeJSON := func(w http.ResponseWriter, v interface{}) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(v)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/users/generate-id", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, plopclient.GenerateUserIDResponse{UserID: f.newID("user"), AccountSecret: "account-secret"})
+	})
+	mux.HandleFunc("/users/pseudo", func(w http.ResponseWriter, r *http.Request) {
+		var req plopclient.ChangePseudoRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		writeJSON(w, plopclient.PseudoResponse{Pseudo: req.Pseudo})
+	})
+	mux.HandleFunc("/devices/register", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, plopclient.RegisterDeviceResponse{Success: true, DeviceSecret: "device-secret"})
+	})
+	mux.HandleFunc("/invitations/create", func(w http.ResponseWriter, r *http.Request) {
+		code := f.newID("code")
+		f.mu.Lock()
+		f.invitations[code] = r.URL.Query().Get("userId")
+		f.mu.Unlock()
+		writeJSON(w, plopclient.CreateInvitationResponse{Code: code, ValidityMinutes: 5})
+	})
+	mux.HandleFunc("/invitations/use", func(w http.ResponseWriter, r *http.Request) {
+		var req plopclient.UseInvitationRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		f.mu.Lock()
+		creator, found := f.invitations[req.Code]
+		unknown := !f.unknownOnce[req.Code]
+		f.unknownOnce[req.Code] = true
+		f.mu.Unlock()
+		if !found || unknown {
+			http.Error(w, "Invitation not found or expired", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, plopclient.UseInvitationResponse{UserID: creator})
+	})
+	mux.HandleFunc("/connect", func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("upgrade failed: %v", err)
+			return
+		}
+		f.serve(r.URL.Query().Get("userId"), &relayConn{conn: conn})
+	})
+	f.Server = httptest.NewServer(mux)
+	t.Cleanup(f.Close)
+	return f
+}
+
+func (f *fakeRelay) newID(prefix string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.nextID++
+	return fmt.Sprintf("%s-%d", prefix, f.nextID)
+}
+
+// serve delivers the queued plops of a connection's user, then relays its plops until it drops.
+func (f *fakeRelay) serve(userID string, c *relayConn) {
+	defer c.conn.Close()
+	f.mu.Lock()
+	if f.conns[userID] == nil {
+		f.conns[userID] = make(map[*relayConn]bool)
+	}
+	f.conns[userID][c] = true
+	var queued []plopclient.Message
+	for key, msg := range f.queued {
+		if key[0] == userID {
+			queued = append(queued, msg)
+			delete(f.queued, key)
+		}
+	}
+	f.mu.Unlock()
+	defer func() {
+		f.mu.Lock()
+		delete(f.conns[userID], c)
+		f.mu.Unlock()
+	}()
+	for _, msg := range queued {
+		c.send(msg)
+	}
+
+	for {
+		var msg plopclient.Message
+		if err := c.conn.ReadJSON(&msg); err != nil {
+			return
+		}
+		msg.From = userID
+		c.send(plopclient.Message{Type: "message_ack", From: "server", To: userID, Payload: plopclient.MessagePayload{MessageID: msg.ID, RecipientID: msg.To}})
+		f.mu.Lock()
+		recipients := make([]*relayConn, 0, len(f.conns[msg.To]))
+		for rc := range f.conns[msg.To] {
+			recipients = append(recipients, rc)
+		}
+		if len(recipients) == 0 {
+			msg.IsPending = true
+			f.queued[[2]string{msg.To, userID}] = msg
+		}
+		f.mu.Unlock()
+		for _, rc := range recipients {
+			rc.send(msg)
+		}
+	}
+}
+
+// runLoad runs plopload with a short load against a fake relay and returns its JSON report.
+func runLoad(t *testing.T, args ...string) report {
+	t.Helper()
+	fake := newFakeRelay(t)
+	var out, errOut bytes.Buffer
+	args = append([]string{"--server", fake.URL, "--json", "--rate", "100", "--duration", "500ms", "--drain", "200ms"}, args...)
+	if code := run(context.Background(), args, &out, &errOut); code != 0 {
+		t.Fatalf("plopload exited with %d: %s", code, errOut.String())
+	}
+	var r report
+	if err := json.Unmarshal(out.Bytes(), &r); err != nil {
+		t.Fatalf("invalid report %q: %v", out.String(), err)
+	}
+	return r
+}
+
+func TestLoad(t *testing.T) {
+	r := runLoad(t, "--users", "6", "--devices", "2", "--invitations", "2", "--disconnects", "0")
+
+	if r.Connections.Opened != 12 || r.Connections.Failed != 0 || r.Connections.Dropped != 0 || r.Connections.ServerDrops != 0 {
+		t.Errorf("every device should connect once, got %+v", r.Connections)
+	}
+	if r.Latency.Handshake.Count != 12 {
+		t.Errorf("6 users inviting the next 2 make 12 handshakes, got %d", r.Latency.Handshake.Count)
+	}
+	p, d := r.Plops, r.Delivery
+	if p.Sent < 10 || p.Acked != p.Sent || p.Unanswered+p.RateLimited+p.Refused+p.WriteFailed+p.Skipped != 0 {
+		t.Errorf("every plop should be acknowledged, got %+v", p)
+	}
+	if d.Live != p.Acked || d.LostOnline+d.LostOffline+d.FromQueue != 0 || d.DeviceDeliveries != 2*d.Live {
+		t.Errorf("every plop should reach both devices of its recipient, got %+v", d)
+	}
+	if r.Latency.Ack.Count != p.Sent || r.Latency.Delivery.Count != d.Live || r.Latency.Delivery.Max <= 0 {
+		t.Errorf("unexpected latencies %+v", r.Latency)
+	}
+}
+
+func TestLoadWithDisconnects(t *testing.T) {
+	r := runLoad(t, "--users", "4", "--disconnects", "300", "--reconnect-after", "100ms")
+
+	if r.Connections.Dropped == 0 || r.Connections.Opened <= 4 {
+		t.Errorf("devices should be dropped and reconnect, got %+v", r.Connections)
+	}
+	d := r.Delivery
+	if r.Plops.Acked == 0 || d.Live+d.FromQueue+d.LostOnline+d.LostOffline != r.Plops.Acked {
+		t.Errorf("every acknowledged plop should be delivered or lost, got %+v for %+v", d, r.Plops)
+	}
+	if d.FromQueue == 0 {
+		t.Errorf("plops sent to offline users should be delivered from the queue, got %+v", d)
+	}
+}
+
+func TestParseConfig(t *testing.T) {
+	for _, args := range [][]string{
+		{"--users", "10"},
+		{"--server", "http://localhost", "--users", "1"},
+		{"--server", "http://localhost", "--rate", "0"},
+		{"--server", "http://localhost", "--disconnects", "-1"},
+		{"--server", "http://localhost", "extra"},
+	} {
+		var errOut bytes.Buffer
+		if code := run(context.Background(), args, &bytes.Buffer{}, &errOut); code != 2 || !strings.Contains(errOut.String(), "error:") {
+			t.Errorf("run(%q) = %d, %q; want a usage error", args, code, errOut.String())
+		}
+	}
+}
+
+func TestSummarize(t *testing.T) {
+	var latencies []time.Duration
+	for ms := 100; ms >= 1; ms-- {
+		latencies = append(latencies, time.Duration(ms)*time.Millisecond)
+	}
+	want := percentiles{Count: 100, P50: 50, P90: 90, P99: 99, Max: 100}
+	if got := summarize(latencies); got != want {
+		t.Errorf("summarize = %+v, want %+v", got, want)
+	}
+	if latencies[0] != 100*time.Millisecond {
+		t.Error("summarize should not reorder its argument")
+	}
+	if got := summarize(nil); got != (percentiles{}) {
+		t.Errorf("summarize(nil) = %+v", got)
+	}
+}
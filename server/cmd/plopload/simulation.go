@@ -0,0 +1,447 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+
+	"plop_server/plopclient"
+)
+
+const (
+	loadAppVersion = "plopload"
+	// invitationAttempts bounds the retries of an invitation code the server did not save yet.
+	invitationAttempts = 5
+	// chaosInterval is how often connections are picked to be dropped.
+	chaosInterval = 100 * time.Millisecond
+	// connectTimeout is how long the devices have to come online before plops are sent anyway.
+	connectTimeout = 30 * time.Second
+	// progressInterval is how often progress is printed while plops are sent.
+	progressInterval = 5 * time.Second
+	writeTimeout     = 10 * time.Second
+)
+
+var errNotConnected = errors.New("device not connected")
+
+// simulation is a load test: the simulated users and what was measured on them.
+type simulation struct {
+	cfg    config
+	errOut io.Writer // Progress
+	runID  string    // Makes the pseudos of this run unique
+	http   *http.Client
+	stats  *stats
+
+	mu    sync.Mutex // Guards the contacts while invitations are exchanged
+	users []*simUser
+}
+
+// simUser is a simulated account.
+type simUser struct {
+	id       string
+	pseudo   string
+	contacts []*simUser
+	devices  []*simDevice
+}
+
+// simDevice is a device of a simulated user, with its connection when it is online.
+type simDevice struct {
+	api *plopclient.Client // Authenticated as the device
+
+	mu      sync.Mutex // Also serializes the writes to conn
+	conn    *websocket.Conn
+	dropped bool // The current connection is being dropped on purpose
+}
+
+func newSimulation(cfg config, errOut io.Writer) *simulation {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = cfg.concurrency
+	return &simulation{
+		cfg:    cfg,
+		errOut: errOut,
+		runID:  uuid.NewString()[:8],
+		http:   &http.Client{Transport: transport, Timeout: time.Minute},
+		stats:  newStats(),
+		users:  make([]*simUser, cfg.users),
+	}
+}
+
+// run creates the users, connects them, sends plops for the configured duration and waits for the
+// last deliveries. The connections are closed when it returns.
+func (s *simulation) run(ctx context.Context) error {
+	s.progress("Creating %d users with %d devices each...", s.cfg.users, s.cfg.devices)
+	if err := s.parallel(ctx, s.cfg.users, s.createUser); err != nil {
+		return fmt.Errorf("could not create the users: %w", err)
+	}
+	pairs := s.contactPairs()
+	s.progress("Exchanging %d invitations...", len(pairs))
+	if err := s.parallel(ctx, len(pairs), func(ctx context.Context, i int) error {
+		return s.befriend(ctx, pairs[i][0], pairs[i][1])
+	}); err != nil {
+		return fmt.Errorf("could not exchange the invitations: %w", err)
+	}
+
+	var connections sync.WaitGroup
+	defer connections.Wait()
+	connCtx, disconnect := context.WithCancel(ctx)
+	defer disconnect()
+	for _, u := range s.users {
+		for _, d := range u.devices {
+			connections.Add(1)
+			go func() {
+				defer connections.Done()
+				s.keepConnected(connCtx, d)
+			}()
+		}
+	}
+	online := s.waitOnline(ctx, connectTimeout)
+	s.progress("%d of %d devices online.", online, s.cfg.users*s.cfg.devices)
+
+	s.progress("Sending %.1f plops per second for %v...", s.cfg.rate, s.cfg.duration)
+	loadCtx, stop := context.WithTimeout(ctx, s.cfg.duration)
+	defer stop()
+	start := time.Now()
+	var load sync.WaitGroup
+	load.Add(2)
+	go func() {
+		defer load.Done()
+		s.sendPlops(loadCtx)
+	}()
+	go func() {
+		defer load.Done()
+		s.dropConnections(loadCtx)
+	}()
+	s.printProgress(loadCtx)
+	load.Wait()
+	s.stats.setLoadDuration(time.Since(start))
+
+	// Dropped devices come back to collect their queued plops.
+	s.progress("Waiting %v for the last deliveries...", s.cfg.drain)
+	s.waitOnline(ctx, s.cfg.reconnectAfter*3/2)
+	sleep(ctx, s.cfg.drain)
+	disconnect()
+	return ctx.Err()
+}
+
+func (s *simulation) progress(format string, args ...interface{}) {
+	fmt.Fprintf(s.errOut, format+"\n", args...)
+}
+
+// printProgress prints the counters regularly until ctx is done.
+func (s *simulation) printProgress(ctx context.Context) {
+	ticker := time.NewTicker(progressInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			sent, acked, delivered := s.stats.counts()
+			s.progress("%d plops sent, %d acknowledged, %d delivered, %d devices online.", sent, acked, delivered, s.countOnline())
+		}
+	}
+}
+
+// parallel calls fn for 0 to n-1 with at most cfg.concurrency calls at a time. It stops at the
+// first error, which it returns.
+func (s *simulation) parallel(ctx context.Context, n int, fn func(ctx context.Context, i int) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var (
+		wg      sync.WaitGroup
+		errOnce sync.Once
+		first   error
+	)
+	slots := make(chan struct{}, s.cfg.concurrency)
+	for i := 0; i < n && ctx.Err() == nil; i++ {
+		slots <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() { <-slots; wg.Done() }()
+			if err := fn(ctx, i); err != nil {
+				errOnce.Do(func() { first = err; cancel() })
+			}
+		}()
+	}
+	wg.Wait()
+	if first == nil {
+		first = ctx.Err()
+	}
+	return first
+}
+
+func (s *simulation) newClient() *plopclient.Client {
+	client := plopclient.New(s.cfg.server)
+	client.HTTPClient = s.http
+	return client
+}
+
+// createUser creates the i-th user and registers its devices with the account secret.
+func (s *simulation) createUser(ctx context.Context, i int) error {
+	api := s.newClient()
+	account, err := api.GenerateUserID(ctx, plopclient.GenerateUserIDParams{Credentials: "true"})
+	if err != nil {
+		return err
+	}
+	u := &simUser{id: account.UserID, pseudo: fmt.Sprintf("load-%s-%d", s.runID, i)}
+	api.Credentials = plopclient.Credentials{UserID: u.id, AccountSecret: account.AccountSecret}
+	if _, err := api.ChangePseudo(ctx, plopclient.ChangePseudoRequest{UserID: u.id, Pseudo: u.pseudo}); err != nil {
+		return err
+	}
+	for n := 1; n <= s.cfg.devices; n++ {
+		device := plopclient.Device{UserID: u.id, DeviceID: "load-" + uuid.NewString(), Name: fmt.Sprintf("Load device %d", n), Platform: "other", AppVersion: loadAppVersion}
+		registered, err := api.RegisterDevice(ctx, plopclient.RegisterDeviceRequest{Device: device})
+		if err != nil {
+			return err
+		}
+		if registered.DeviceSecret == "" {
+			return errors.New("the server did not issue device credentials")
+		}
+		client := s.newClient()
+		client.Credentials = plopclient.Credentials{UserID: u.id, DeviceID: device.DeviceID, DeviceSecret: registered.DeviceSecret}
+		u.devices = append(u.devices, &simDevice{api: client})
+	}
+	s.users[i] = u
+	return nil
+}
+
+// contactPairs returns the users who exchange an invitation: each user invites the next
+// cfg.invitations users, wrapping around, and each pair is listed once.
+func (s *simulation) contactPairs() [][2]*simUser {
+	var pairs [][2]*simUser
+	seen := make(map[[2]int]bool)
+	n := len(s.users)
+	for i := range s.users {
+		for step := 1; step <= s.cfg.invitations; step++ {
+			j := (i + step) % n
+			key := [2]int{min(i, j), max(i, j)}
+			if i == j || seen[key] {
+				continue
+			}
+			seen[key] = true
+			pairs = append(pairs, [2]*simUser{s.users[i], s.users[j]})
+		}
+	}
+	return pairs
+}
+
+// befriend makes two users contacts: the creator makes an invitation code and the guest uses it.
+func (s *simulation) befriend(ctx context.Context, creator, guest *simUser) error {
+	start := time.Now()
+	invitation, err := creator.devices[0].api.CreateInvitation(ctx, plopclient.CreateInvitationParams{UserID: creator.id, Pseudo: creator.pseudo})
+	if err != nil {
+		return err
+	}
+	for attempt := 1; ; attempt++ {
+		_, err = guest.devices[0].api.UseInvitation(ctx, plopclient.UseInvitationRequest{Code: invitation.Code, UserID: guest.id, Pseudo: guest.pseudo})
+		// The server saves invitations in the background, so a new code can be unknown for a moment.
+		var apiErr *plopclient.APIError
+		if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusNotFound || attempt == invitationAttempts {
+			break
+		}
+		sleep(ctx, time.Duration(attempt)*50*time.Millisecond)
+	}
+	if err != nil {
+		return err
+	}
+	s.stats.handshake(time.Since(start))
+
+	s.mu.Lock()
+	creator.contacts = append(creator.contacts, guest)
+	guest.contacts = append(guest.contacts, creator)
+	s.mu.Unlock()
+	return nil
+}
+
+// keepConnected keeps a device connected until ctx is done, reconnecting after every drop.
+func (s *simulation) keepConnected(ctx context.Context, d *simDevice) {
+	for ctx.Err() == nil {
+		start := time.Now()
+		conn, err := d.api.Dial(ctx, "")
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			s.stats.connectFailed()
+		} else {
+			s.stats.connected(time.Since(start))
+			d.setConn(conn)
+			stop := context.AfterFunc(ctx, func() { conn.Close() })
+			s.readFrames(conn)
+			stop()
+			conn.Close()
+			if !d.setConn(nil) && ctx.Err() == nil {
+				s.stats.serverDrop()
+			}
+		}
+		sleep(ctx, jitter(s.cfg.reconnectAfter))
+	}
+}
+
+// readFrames records the frames of a connection until it drops.
+func (s *simulation) readFrames(conn *websocket.Conn) {
+	for {
+		var frame plopclient.Message
+		if err := conn.ReadJSON(&frame); err != nil {
+			return
+		}
+		now := time.Now()
+		switch frame.Type {
+		case "plop":
+			s.stats.delivered(frame.ID, frame.IsPending, now)
+		case "message_ack", "rate_limited", "plop_error":
+			s.stats.answered(frame.Payload.MessageID, frame.Type, now)
+		}
+	}
+}
+
+// waitOnline waits up to timeout for every device to be connected and returns how many are.
+func (s *simulation) waitOnline(ctx context.Context, timeout time.Duration) int {
+	deadline := time.Now().Add(timeout)
+	for {
+		online := s.countOnline()
+		if online == s.cfg.users*s.cfg.devices || time.Now().After(deadline) || ctx.Err() != nil {
+			return online
+		}
+		sleep(ctx, 50*time.Millisecond)
+	}
+}
+
+func (s *simulation) countOnline() int {
+	online := 0
+	for _, u := range s.users {
+		for _, d := range u.devices {
+			if d.online() {
+				online++
+			}
+		}
+	}
+	return online
+}
+
+// sendPlops sends plops at the configured rate until ctx is done.
+func (s *simulation) sendPlops(ctx context.Context) {
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / s.cfg.rate))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.sendPlop()
+		}
+	}
+}
+
+// sendPlop sends a plop from a random connected device to a random contact of its user.
+func (s *simulation) sendPlop() {
+	from := s.users[rand.IntN(len(s.users))]
+	d := from.connectedDevice()
+	if d == nil || len(from.contacts) == 0 {
+		s.stats.skip()
+		return
+	}
+	to := from.contacts[rand.IntN(len(from.contacts))]
+	plop := plopclient.Message{ID: uuid.NewString(), Type: "plop", To: to.id, Payload: plopclient.MessagePayload{Text: "plopload"}}
+	s.stats.sent(plop.ID, to.connectedDevice() != nil, time.Now())
+	if err := d.write(plop); err != nil {
+		s.stats.writeFailed(plop.ID)
+	}
+}
+
+// dropConnections closes random connections without a close frame, like a lost network, until ctx is done.
+func (s *simulation) dropConnections(ctx context.Context) {
+	if s.cfg.disconnects == 0 {
+		return
+	}
+	probability := min(1, s.cfg.disconnects*chaosInterval.Minutes())
+	ticker := time.NewTicker(chaosInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for _, u := range s.users {
+				for _, d := range u.devices {
+					if rand.Float64() < probability && d.drop() {
+						s.stats.drop()
+					}
+				}
+			}
+		}
+	}
+}
+
+// connectedDevice returns a random connected device of the user, or nil.
+func (u *simUser) connectedDevice() *simDevice {
+	offset := rand.IntN(len(u.devices))
+	for i := range u.devices {
+		if d := u.devices[(offset+i)%len(u.devices)]; d.online() {
+			return d
+		}
+	}
+	return nil
+}
+
+func (d *simDevice) online() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.conn != nil
+}
+
+// setConn sets the current connection, nil once it dropped. It reports whether the previous
+// connection was dropped on purpose.
+func (d *simDevice) setConn(conn *websocket.Conn) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	dropped := d.dropped
+	d.conn, d.dropped = conn, false
+	return dropped
+}
+
+// drop closes the current connection, if any, and reports whether there was one.
+func (d *simDevice) drop() bool {
+	d.mu.Lock()
+	conn := d.conn
+	if conn == nil || d.dropped {
+		d.mu.Unlock()
+		return false
+	}
+	d.dropped = true
+	d.mu.Unlock()
+	conn.Close()
+	return true
+}
+
+func (d *simDevice) write(msg plopclient.Message) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.conn == nil || d.dropped {
+		return errNotConnected
+	}
+	d.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	return d.conn.WriteJSON(msg)
+}
+
+// jitter returns a random duration between half and one and a half times d.
+func jitter(d time.Duration) time.Duration {
+	return d/2 + time.Duration(rand.Int64N(int64(d)+1))
+}
+
+// sleep waits for d or until ctx is done.
+func sleep(ctx context.Context, d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+	case <-timer.C:
+	}
+}
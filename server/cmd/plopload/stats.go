@@ -0,0 +1,290 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"slices"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// stats collects what a load test measures. Every method is safe for concurrent use.
+type stats struct {
+	mu           sync.Mutex
+	plops        map[string]*plopRecord // By message ID
+	skipped      int                    // Plops not sent: the sender had no connected device
+	loadDuration time.Duration
+
+	connections     int
+	connectFailures int
+	drops           int // Connections dropped on purpose
+	serverDrops     int // Connections dropped by the server or the network
+
+	connectLatencies   []time.Duration
+	handshakeLatencies []time.Duration
+}
+
+// plopRecord is what happened to a plop.
+type plopRecord struct {
+	sentAt          time.Time
+	recipientOnline bool   // Whether a device of the recipient was connected when the plop was sent
+	writeFailed     bool   // The plop never left
+	answer          string // The frame type the server answered with: message_ack, rate_limited or plop_error
+	answeredAt      time.Time
+	deliveredAt     time.Time // First delivery to a device of the recipient
+	fromQueue       bool      // First delivered from the offline queue
+	deliveries      int       // Deliveries over all the recipient's devices
+}
+
+func newStats() *stats {
+	return &stats{plops: make(map[string]*plopRecord)}
+}
+
+func (s *stats) sent(id string, recipientOnline bool, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.plops[id] = &plopRecord{sentAt: now, recipientOnline: recipientOnline}
+}
+
+func (s *stats) writeFailed(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if p, found := s.plops[id]; found {
+		p.writeFailed = true
+	}
+}
+
+func (s *stats) skip() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.skipped++
+}
+
+// answered records the server's answer to a plop; only the first one counts.
+func (s *stats) answered(id, frameType string, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if p, found := s.plops[id]; found && p.answer == "" {
+		p.answer, p.answeredAt = frameType, now
+	}
+}
+
+func (s *stats) delivered(id string, fromQueue bool, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, found := s.plops[id]
+	if !found {
+		return
+	}
+	if p.deliveries == 0 {
+		p.deliveredAt, p.fromQueue = now, fromQueue
+	}
+	p.deliveries++
+}
+
+func (s *stats) connected(latency time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.connections++
+	s.connectLatencies = append(s.connectLatencies, latency)
+}
+
+func (s *stats) connectFailed() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.connectFailures++
+}
+
+func (s *stats) drop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.drops++
+}
+
+func (s *stats) serverDrop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.serverDrops++
+}
+
+func (s *stats) handshake(latency time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.handshakeLatencies = append(s.handshakeLatencies, latency)
+}
+
+func (s *stats) setLoadDuration(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.loadDuration = d
+}
+
+// counts returns the plops sent, acknowledged and delivered so far.
+func (s *stats) counts() (sent, acked, delivered int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, p := range s.plops {
+		sent++
+		if p.answer == "message_ack" {
+			acked++
+		}
+		if p.deliveries > 0 {
+			delivered++
+		}
+	}
+	return sent, acked, delivered
+}
+
+// report is the outcome of a load test.
+type report struct {
+	Users          int     `json:"users"`
+	DevicesPerUser int     `json:"devicesPerUser"`
+	Duration       float64 `json:"durationSeconds"`
+	TargetRate     float64 `json:"targetRate"`
+	AchievedRate   float64 `json:"achievedRate"` // Plops sent per second
+
+	Connections struct {
+		Opened      int `json:"opened"`
+		Failed      int `json:"failed"`
+		Dropped     int `json:"dropped"`     // On purpose
+		ServerDrops int `json:"serverDrops"` // By the server or the network
+	} `json:"connections"`
+
+	Plops struct {
+		Sent        int `json:"sent"`
+		Skipped     int `json:"skipped"` // The sender had no connected device
+		WriteFailed int `json:"writeFailed"`
+		Acked       int `json:"acked"`
+		RateLimited int `json:"rateLimited"`
+		Refused     int `json:"refused"`
+		Unanswered  int `json:"unanswered"`
+	} `json:"plops"`
+
+	// Delivery is about the acknowledged plops.
+	Delivery struct {
+		Live             int `json:"live"`
+		FromQueue        int `json:"fromQueue"`
+		LostOnline       int `json:"lostOnline"`  // The recipient had a connected device when the plop was sent
+		LostOffline      int `json:"lostOffline"` // Expected: the queue keeps the latest plop of each sender
+		DeviceDeliveries int `json:"deviceDeliveries"`
+	} `json:"delivery"`
+
+	Latency struct {
+		Connect   percentiles `json:"connect"`
+		Handshake percentiles `json:"handshake"` // Invitation created and used
+		Ack       percentiles `json:"ack"`
+		Delivery  percentiles `json:"delivery"` // First delivery, live or from the queue
+	} `json:"latency"`
+}
+
+// percentiles summarizes latencies, in milliseconds.
+type percentiles struct {
+	Count int     `json:"count"`
+	P50   float64 `json:"p50"`
+	P90   float64 `json:"p90"`
+	P99   float64 `json:"p99"`
+	Max   float64 `json:"max"`
+}
+
+// summarize returns the nearest-rank percentiles of latencies.
+func summarize(latencies []time.Duration) percentiles {
+	if len(latencies) == 0 {
+		return percentiles{}
+	}
+	sorted := slices.Clone(latencies)
+	slices.Sort(sorted)
+	at := func(p float64) float64 {
+		rank := int(math.Ceil(p*float64(len(sorted)))) - 1
+		return float64(sorted[max(rank, 0)]) / float64(time.Millisecond)
+	}
+	return percentiles{Count: len(sorted), P50: at(0.50), P90: at(0.90), P99: at(0.99), Max: at(1)}
+}
+
+func (s *simulation) report() report {
+	st := s.stats
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	var r report
+	r.Users, r.DevicesPerUser, r.TargetRate = s.cfg.users, s.cfg.devices, s.cfg.rate
+	r.Duration = st.loadDuration.Seconds()
+	r.Connections.Opened, r.Connections.Failed = st.connections, st.connectFailures
+	r.Connections.Dropped, r.Connections.ServerDrops = st.drops, st.serverDrops
+	r.Plops.Sent, r.Plops.Skipped = len(st.plops), st.skipped
+	if r.Duration > 0 {
+		r.AchievedRate = float64(r.Plops.Sent) / r.Duration
+	}
+
+	var acks, deliveries []time.Duration
+	for _, p := range st.plops {
+		switch {
+		case p.writeFailed:
+			r.Plops.WriteFailed++
+			continue
+		case p.answer == "":
+			r.Plops.Unanswered++
+		case p.answer == "rate_limited":
+			r.Plops.RateLimited++
+		case p.answer == "plop_error":
+			r.Plops.Refused++
+		}
+		if p.answer != "" {
+			acks = append(acks, p.answeredAt.Sub(p.sentAt))
+		}
+		if p.answer != "message_ack" {
+			continue
+		}
+		r.Plops.Acked++
+		r.Delivery.DeviceDeliveries += p.deliveries
+		switch {
+		case p.deliveries > 0 && p.fromQueue:
+			r.Delivery.FromQueue++
+		case p.deliveries > 0:
+			r.Delivery.Live++
+		case p.recipientOnline:
+			r.Delivery.LostOnline++
+		default:
+			r.Delivery.LostOffline++
+		}
+		if p.deliveries > 0 {
+			deliveries = append(deliveries, p.deliveredAt.Sub(p.sentAt))
+		}
+	}
+	r.Latency.Connect = summarize(st.connectLatencies)
+	r.Latency.Handshake = summarize(st.handshakeLatencies)
+	r.Latency.Ack = summarize(acks)
+	r.Latency.Delivery = summarize(deliveries)
+	return r
+}
+
+func (r report) writeJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+func (r report) writeText(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "Users\t%d with %d devices each\n", r.Users, r.DevicesPerUser)
+	fmt.Fprintf(tw, "Load\t%.1fs at %.1f plops/s (target %.1f)\n", r.Duration, r.AchievedRate, r.TargetRate)
+	c := r.Connections
+	fmt.Fprintf(tw, "Connections\t%d opened, %d failed, %d dropped on purpose, %d dropped by the server\n", c.Opened, c.Failed, c.Dropped, c.ServerDrops)
+	p := r.Plops
+	fmt.Fprintf(tw, "Plops\t%d sent, %d acknowledged, %d rate limited, %d refused, %d unanswered, %d write failures, %d skipped\n",
+		p.Sent, p.Acked, p.RateLimited, p.Refused, p.Unanswered, p.WriteFailed, p.Skipped)
+	d := r.Delivery
+	fmt.Fprintf(tw, "Delivery\t%d live, %d from the queue, %d lost with the recipient online, %d lost offline (%d device deliveries)\n",
+		d.Live, d.FromQueue, d.LostOnline, d.LostOffline, d.DeviceDeliveries)
+	fmt.Fprintln(tw)
+	fmt.Fprintln(tw, "LATENCY (ms)\tCOUNT\tP50\tP90\tP99\tMAX")
+	for _, row := range []struct {
+		name string
+		p    percentiles
+	}{{"connect", r.Latency.Connect}, {"handshake", r.Latency.Handshake}, {"ack", r.Latency.Ack}, {"delivery", r.Latency.Delivery}} {
+		fmt.Fprintf(tw, "%s\t%d\t%.1f\t%.1f\t%.1f\t%.1f\n", row.name, row.p.Count, row.p.P50, row.p.P90, row.p.P99, row.p.Max)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// --- Cron Expressions ---
+
+// cronSearchYears bounds how far ahead cronSchedule.next looks for a matching time,
+// so impossible expressions like "0 0 31 2 *" terminate.
+const cronSearchYears = 5
+
+// cronSchedule is a parsed standard 5-field cron expression: minute hour day-of-month month day-of-week.
+// Each field is stored as a bitset of the values it matches.
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	// domStar and dowStar record whether the day fields were '*', which changes how they combine:
+	// when both are restricted, a day matches if EITHER field matches (standard cron behaviour).
+	domStar, dowStar bool
+}
+
+type cronField struct {
+	name     string
+	min, max int
+}
+
+var (
+	cronMinuteField = cronField{"minute", 0, 59}
+	cronHourField   = cronField{"hour", 0, 23}
+	cronDomField    = cronField{"day of month", 1, 31}
+	cronMonthField  = cronField{"month", 1, 12}
+	cronDowField    = cronField{"day of week", 0, 7}
+)
+
+// parseCron parses a standard 5-field cron expression such as "0 9 * * 1" (every Monday at 9:00).
+// Fields support '*', single values, ranges (a-b), lists (a,b,c) and steps (*/n, a-b/n).
+func parseCron(expr string) (*cronSchedule, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron expression %q must have 5 fields, got %d", expr, len(fields))
+	}
+
+	var c cronSchedule
+	var err error
+	if c.minute, err = parseCronField(fields[0], cronMinuteField); err != nil {
+		return nil, err
+	}
+	if c.hour, err = parseCronField(fields[1], cronHourField); err != nil {
+		return nil, err
+	}
+	if c.dom, err = parseCronField(fields[2], cronDomField); err != nil {
+		return nil, err
+	}
+	if c.month, err = parseCronField(fields[3], cronMonthField); err != nil {
+		return nil, err
+	}
+	if c.dow, err = parseCronField(fields[4], cronDowField); err != nil {
+		return nil, err
+	}
+	// Sunday can be written as 0 or 7.
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1
+	}
+	c.domStar = strings.HasPrefix(fields[2], "*")
+	c.dowStar = strings.HasPrefix(fields[4], "*")
+	return &c, nil
+}
+
+// parseCronField turns one comma-separated cron field into a bitset.
+func parseCronField(field string, f cronField) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		rangePart, step := part, 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			rangePart = part[:i]
+			step, err = strconv.Atoi(part[i+1:])
+			if err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step in %s field %q", f.name, part)
+			}
+		}
+
+		start, end := f.min, f.max
+		switch {
+		case rangePart == "*":
+		case strings.Contains(rangePart, "-"):
+			bounds := strings.SplitN(rangePart, "-", 2)
+			var err1, err2 error
+			start, err1 = strconv.Atoi(bounds[0])
+			end, err2 = strconv.Atoi(bounds[1])
+			if err1 != nil || err2 != nil {
+				return 0, fmt.Errorf("invalid range in %s field %q", f.name, part)
+			}
+		default:
+			value, err := strconv.Atoi(rangePart)
+			if err != nil {
+				return 0, fmt.Errorf("invalid value in %s field %q", f.name, part)
+			}
+			start = value
+			if step == 1 {
+				end = value
+			}
+		}
+
+		if start < f.min || end > f.max || start > end {
+			return 0, fmt.Errorf("%s field %q out of range [%d-%d]", f.name, part, f.min, f.max)
+		}
+		for v := start; v <= end; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+// dayMatches reports whether the day of t matches the day-of-month and day-of-week fields.
+func (c *cronSchedule) dayMatches(t time.Time) bool {
+	domMatch := c.dom&(1<<uint(t.Day())) != 0
+	dowMatch := c.dow&(1<<uint(t.Weekday())) != 0
+	if c.domStar || c.dowStar {
+		return domMatch && dowMatch
+	}
+	return domMatch || dowMatch
+}
+
+// next returns the first time strictly after 'after' matching the schedule, evaluated in after's location.
+// It returns the zero time if nothing matches within cronSearchYears.
+//
+// The search starts from the next minute in absolute time: rebuilding it from the wall clock with
+// time.Date would pick the first occurrence of a time repeated when clocks go back, before 'after'.
+func (c *cronSchedule) next(after time.Time) time.Time {
+	loc := after.Location()
+	t := after.Truncate(time.Minute).Add(time.Minute)
+	yearLimit := t.Year() + cronSearchYears
+
+wrap:
+	if t.Year() > yearLimit {
+		return time.Time{}
+	}
+	for c.month&(1<<uint(t.Month())) == 0 {
+		t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+		if t.Month() == time.January {
+			goto wrap
+		}
+	}
+	for !c.dayMatches(t) {
+		t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+		if t.Day() == 1 {
+			goto wrap
+		}
+	}
+	for c.hour&(1<<uint(t.Hour())) == 0 {
+		t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, loc)
+		if t.Hour() == 0 {
+			goto wrap
+		}
+	}
+	for c.minute&(1<<uint(t.Minute())) == 0 {
+		t = t.Add(time.Minute)
+		if t.Minute() == 0 {
+			goto wrap
+		}
+	}
+	if !t.After(after) {
+		// A schedule due again right away would fire on every tick of the scheduler.
+		log.Printf("[ERROR] Cron search went back from %s to %s.", after, t)
+		return time.Time{}
+	}
+	return t
+}
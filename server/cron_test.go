@@ -0,0 +1,87 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCronErrors(t *testing.T) {
+	for _, expr := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "*/0 * * * *", "a * * * *", "5-1 * * * *"} {
+		if _, err := parseCron(expr); err == nil {
+			t.Errorf("parseCron(%q) should have failed", expr)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	paris, err := time.LoadLocation("Europe/Paris")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		expr     string
+		after    time.Time
+		expected time.Time
+	}{
+		{"every minute", "* * * * *", time.Date(2026, 3, 2, 10, 15, 30, 0, time.UTC), time.Date(2026, 3, 2, 10, 16, 0, 0, time.UTC)},
+		{"monday standup", "0 9 * * 1", time.Date(2026, 3, 2, 9, 0, 0, 0, paris), time.Date(2026, 3, 9, 9, 0, 0, 0, paris)},
+		{"daily at 18:00", "0 18 * * *", time.Date(2026, 3, 2, 17, 59, 0, 0, paris), time.Date(2026, 3, 2, 18, 0, 0, 0, paris)},
+		{"steps", "*/20 8-10 * * *", time.Date(2026, 3, 2, 10, 41, 0, 0, time.UTC), time.Date(2026, 3, 3, 8, 0, 0, 0, time.UTC)},
+		{"sunday as 7", "30 7 * * 7", time.Date(2026, 3, 2, 0, 0, 0, 0, time.UTC), time.Date(2026, 3, 8, 7, 30, 0, 0, time.UTC)},
+		{"dom or dow", "0 0 1 * 5", time.Date(2026, 3, 2, 0, 0, 0, 0, time.UTC), time.Date(2026, 3, 6, 0, 0, 0, 0, time.UTC)},
+		{"leap day", "0 12 29 2 *", time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC), time.Date(2028, 2, 29, 12, 0, 0, 0, time.UTC)},
+		{"across DST change", "0 9 * * *", time.Date(2026, 3, 28, 9, 0, 0, 0, paris), time.Date(2026, 3, 29, 9, 0, 0, 0, paris)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := parseCron(tt.expr)
+			if err != nil {
+				t.Fatalf("parseCron(%q) failed: %v", tt.expr, err)
+			}
+			if next := c.next(tt.after); !next.Equal(tt.expected) {
+				t.Errorf("next(%s) = %s, want %s", tt.after, next, tt.expected)
+			}
+		})
+	}
+}
+
+func TestCronNextDSTFallBack(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := parseCron("30 1 * * *")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// On 2025-11-02, 01:00-02:00 happens twice: 05:00-06:00 UTC in EDT, then 06:00-07:00 UTC in EST.
+	secondOneThirty := time.Date(2025, 11, 2, 6, 30, 0, 0, time.UTC)
+	if next := c.next(time.Date(2025, 11, 2, 5, 30, 5, 0, time.UTC).In(newYork)); !next.Equal(secondOneThirty) {
+		t.Errorf("after the first 01:30, next = %s, want %s", next, secondOneThirty.In(newYork))
+	}
+	tomorrow := time.Date(2025, 11, 3, 1, 30, 0, 0, newYork)
+	if next := c.next(secondOneThirty.Add(5 * time.Second).In(newYork)); !next.Equal(tomorrow) {
+		t.Errorf("after the second 01:30, next = %s, want %s", next, tomorrow)
+	}
+
+	// The scheduler asks for the next fire time on every tick: it must always be in the future.
+	for now := time.Date(2025, 11, 2, 4, 0, 0, 0, time.UTC); now.Before(time.Date(2025, 11, 2, 8, 0, 0, 0, time.UTC)); now = now.Add(15 * time.Second) {
+		if next := c.next(now.In(newYork)); !next.After(now) {
+			t.Fatalf("next(%s) = %s, not after it", now.In(newYork), next)
+		}
+	}
+}
+
+func TestCronNextNeverMatches(t *testing.T) {
+	c, err := parseCron("0 0 31 2 *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next := c.next(time.Now()); !next.IsZero() {
+		t.Errorf("February 31st should never match, got %s", next)
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+)
+
+// --- Encryption at Rest ---
+//
+// Pseudos, push tokens, push subscriptions, invitation pseudos and pending message payloads are stored
+// encrypted, so that a database dump does not contain them in clear. Each value gets its own random data key, which encrypts the value
+// with AES-256-GCM and is itself wrapped by a master key from the configuration:
+//
+//	enc:<keyId>:<base64 wrapped data key>:<base64 encrypted value>
+//
+// DATA_ENCRYPTION_KEYS lists the master keys as "id:base64key" pairs separated by commas, and
+// DATA_ENCRYPTION_KEY_ID selects the one new values are written with (the first one by default).
+// To rotate, add a key, make it active, run the `data rekey` admin command, then drop the old key.
+// DATA_INDEX_KEY keys the blind indexes that keep pseudos unique and push endpoints addressable
+// without storing them in clear.
+//
+// Without keys, values are stored in clear. Values written in clear stay readable once keys are
+// configured; `data rekey` encrypts them.
+
+const (
+	encryptedValuePrefix = "enc:"
+	gcmNonceSize         = 12
+	gcmTagSize           = 16
+	wrappedDataKeySize   = gcmNonceSize + 32 + gcmTagSize
+)
+
+// dataKeyIDPattern restricts key IDs to characters that cannot be confused with the value separator.
+var dataKeyIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,32}$`)
+
+var (
+	errUnknownDataKey     = errors.New("value is encrypted with an unknown data key")
+	errMalformedValue     = errors.New("malformed encrypted value")
+	errNoDataKeys         = errors.New("value is encrypted but no data keys are configured")
+	errValueAuthFailure   = errors.New("encrypted value failed authentication")
+	errEncryptionDisabled = errors.New("encryption at rest is disabled: set DATA_ENCRYPTION_KEYS")
+)
+
+// dataKeyring holds the master keys and the blind index key.
+type dataKeyring struct {
+	active   string
+	keys     map[string]cipher.AEAD
+	indexKey []byte
+}
+
+// dataKeys is the keyring of this process; nil when encryption at rest is disabled.
+var dataKeys *dataKeyring
+
+// initializeDataEncryption loads the keyring from the environment.
+func initializeDataEncryption() {
+	keyring, err := parseDataKeyring(getEnv("DATA_ENCRYPTION_KEYS", ""), getEnv("DATA_ENCRYPTION_KEY_ID", ""), getEnv("DATA_INDEX_KEY", ""))
+	if err != nil {
+		log.Fatalf("[FATAL] Invalid data encryption configuration: %v", err)
+	}
+	dataKeys = keyring
+	if keyring == nil {
+		log.Println("[WARN] DATA_ENCRYPTION_KEYS is not set: pseudos, push tokens, push subscriptions, invitations and pending messages are stored in clear.")
+		return
+	}
+	log.Printf("[INFO] Encryption at rest enabled with %d key(s), active key '%s'.", len(keyring.keys), keyring.active)
+}
+
+// parseDataKeyring builds a keyring from its configuration. It returns nil when no keys are given.
+func parseDataKeyring(spec, activeID, indexKey string) (*dataKeyring, error) {
+	if strings.TrimSpace(spec) == "" {
+		return nil, nil
+	}
+	keyring := &dataKeyring{active: activeID, keys: make(map[string]cipher.AEAD)}
+	for _, entry := range strings.Split(spec, ",") {
+		id, encoded, found := strings.Cut(strings.TrimSpace(entry), ":")
+		if !found || !dataKeyIDPattern.MatchString(id) {
+			return nil, fmt.Errorf("DATA_ENCRYPTION_KEYS entries must be 'id:base64key' with an ID of letters, digits, '-' or '_'")
+		}
+		if _, dup := keyring.keys[id]; dup {
+			return nil, fmt.Errorf("key '%s' is listed twice", id)
+		}
+		aead, err := newAESGCM(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("key '%s': %v", id, err)
+		}
+		keyring.keys[id] = aead
+		if keyring.active == "" {
+			keyring.active = id
+		}
+	}
+	if _, found := keyring.keys[keyring.active]; !found {
+		return nil, fmt.Errorf("DATA_ENCRYPTION_KEY_ID '%s' is not in DATA_ENCRYPTION_KEYS", keyring.active)
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(indexKey)
+	if err != nil || len(raw) < 32 {
+		return nil, errors.New("DATA_INDEX_KEY must be set to at least 32 base64-encoded bytes when encryption is enabled")
+	}
+	keyring.indexKey = raw
+	return keyring, nil
+}
+
+// newAESGCM returns an AES-256-GCM cipher for a base64-encoded 32-byte key.
+func newAESGCM(encoded string) (cipher.AEAD, error) {
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(key) != 32 {
+		return nil, errors.New("keys must be 32 base64-encoded bytes")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts b with a fresh nonce, prepended to the result.
+func seal(aead cipher.AEAD, b, aad []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(b)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, b, aad), nil
+}
+
+// unseal reverses seal.
+func unseal(aead cipher.AEAD, b, aad []byte) ([]byte, error) {
+	if len(b) < aead.NonceSize() {
+		return nil, errMalformedValue
+	}
+	plain, err := aead.Open(nil, b[:aead.NonceSize()], b[aead.NonceSize():], aad)
+	if err != nil {
+		return nil, errValueAuthFailure
+	}
+	return plain, nil
+}
+
+// encrypt seals a value under the active master key. context binds the value to where it is stored
+// (column and owner), so that it cannot be copied to another row.
+func (k *dataKeyring) encrypt(plaintext, context string) (string, error) {
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return "", err
+	}
+	block, _ := aes.NewCipher(dataKey)
+	aead, _ := cipher.NewGCM(block)
+	body, err := seal(aead, []byte(plaintext), []byte(context))
+	if err != nil {
+		return "", err
+	}
+	wrapped, err := seal(k.keys[k.active], dataKey, []byte(k.active))
+	if err != nil {
+		return "", err
+	}
+	return encryptedValuePrefix + k.active + ":" + base64.StdEncoding.EncodeToString(wrapped) + ":" + base64.StdEncoding.EncodeToString(body), nil
+}
+
+// decrypt opens a value sealed by encrypt with any of the configured master keys.
+func (k *dataKeyring) decrypt(v encryptedValue, context string) (string, error) {
+	master, found := k.keys[v.keyID]
+	if !found {
+		return "", errUnknownDataKey
+	}
+	dataKey, err := unseal(master, v.wrapped, []byte(v.keyID))
+	if err != nil {
+		return "", err
+	}
+	block, err := aes.NewCipher(dataKey)
+	if err != nil {
+		return "", errMalformedValue
+	}
+	aead, _ := cipher.NewGCM(block)
+	plain, err := unseal(aead, v.body, []byte(context))
+	return string(plain), err
+}
+
+// encryptedValue is a stored value sealed by encrypt.
+type encryptedValue struct {
+	keyID         string
+	wrapped, body []byte
+}
+
+// parseEncryptedValue splits a value sealed by encrypt. Values without its exact shape, like a pseudo
+// that happens to start with "enc:", were stored in clear.
+func parseEncryptedValue(stored string) (encryptedValue, bool) {
+	rest, found := strings.CutPrefix(stored, encryptedValuePrefix)
+	parts := strings.Split(rest, ":")
+	if !found || len(parts) != 3 || !dataKeyIDPattern.MatchString(parts[0]) {
+		return encryptedValue{}, false
+	}
+	wrapped, err1 := base64.StdEncoding.DecodeString(parts[1])
+	body, err2 := base64.StdEncoding.DecodeString(parts[2])
+	if err1 != nil || err2 != nil || len(wrapped) != wrappedDataKeySize || len(body) < gcmNonceSize+gcmTagSize {
+		return encryptedValue{}, false
+	}
+	return encryptedValue{keyID: parts[0], wrapped: wrapped, body: body}, true
+}
+
+// encryptColumn returns the value to store for plaintext, encrypted when keys are configured.
+// Empty values are stored as is.
+func encryptColumn(plaintext, context string) (string, error) {
+	if dataKeys == nil || plaintext == "" {
+		return plaintext, nil
+	}
+	return dataKeys.encrypt(plaintext, context)
+}
+
+// decryptColumn returns the plaintext of a stored value. Values stored in clear are returned as is.
+func decryptColumn(stored, context string) (string, error) {
+	v, encrypted := parseEncryptedValue(stored)
+	if !encrypted {
+		return stored, nil
+	}
+	if dataKeys == nil {
+		return "", errNoDataKeys
+	}
+	return dataKeys.decrypt(v, context)
+}
+
+// needsRekey reports whether a stored value should be rewritten under the active master key.
+func needsRekey(stored string) bool {
+	if dataKeys == nil || stored == "" {
+		return false
+	}
+	v, encrypted := parseEncryptedValue(stored)
+	return !encrypted || v.keyID != dataKeys.active
+}
+
+// encryptJSONColumn returns the JSONB value to store for a JSON document: the document itself,
+// or a JSON string holding it encrypted.
+func encryptJSONColumn(doc []byte, context string) ([]byte, error) {
+	if dataKeys == nil {
+		return doc, nil
+	}
+	sealed, err := dataKeys.encrypt(string(doc), context)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(sealed)
+}
+
+// decryptJSONColumn reverses encryptJSONColumn. Documents stored in clear are returned as is.
+func decryptJSONColumn(stored []byte, context string) ([]byte, error) {
+	var sealed string
+	if len(stored) == 0 || stored[0] != '"' || json.Unmarshal(stored, &sealed) != nil {
+		return stored, nil
+	}
+	if _, encrypted := parseEncryptedValue(sealed); !encrypted {
+		return stored, nil
+	}
+	doc, err := decryptColumn(sealed, context)
+	return []byte(doc), err
+}
+
+// blindIndex returns a keyed hash of value, to look up or enforce the uniqueness of an encrypted column.
+// Without keys, value itself is the index.
+func blindIndex(value string) string {
+	if dataKeys == nil {
+		return value
+	}
+	mac := hmac.New(sha256.New, dataKeys.indexKey)
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Contexts binding the encrypted columns to their row.
+func pseudoContext(userID string) string    { return "user_pseudos.pseudo\x00" + userID }
+func pushTokenContext(userID string) string { return "devices.push_tokens\x00" + userID }
+func pendingPayloadContext(recipientID string) string {
+	return "pending_messages.message_payload\x00" + recipientID
+}
+func invitationPseudoContext(code string) string { return "invitations.creator_pseudo\x00" + code }
+func webPushContext(column, userID string) string {
+	return "web_push_subscriptions." + column + "\x00" + userID
+}
+func unifiedPushContext(userID string) string { return "unifiedpush_endpoints.endpoint\x00" + userID }
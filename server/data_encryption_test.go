@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+)
+
+func testDataKey(b byte) string {
+	return base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{b}, 32))
+}
+
+// useDataKeys enables encryption at rest for the duration of a test.
+func useDataKeys(t *testing.T, spec, activeID string) {
+	t.Helper()
+	keyring, err := parseDataKeyring(spec, activeID, testDataKey(9))
+	if err != nil {
+		t.Fatalf("parseDataKeyring failed: %v", err)
+	}
+	previous := dataKeys
+	dataKeys = keyring
+	t.Cleanup(func() { dataKeys = previous })
+}
+
+func TestParseDataKeyring(t *testing.T) {
+	if keyring, err := parseDataKeyring("", "", ""); keyring != nil || err != nil {
+		t.Errorf("no keys should disable encryption, got %v, %v", keyring, err)
+	}
+	keyring, err := parseDataKeyring("k1:"+testDataKey(1)+", k2:"+testDataKey(2), "", testDataKey(9))
+	if err != nil || keyring.active != "k1" || len(keyring.keys) != 2 {
+		t.Fatalf("unexpected keyring %+v, %v", keyring, err)
+	}
+
+	for name, c := range map[string][3]string{
+		"bad id":        {"k:1:" + testDataKey(1), "", testDataKey(9)},
+		"short key":     {"k1:" + base64.StdEncoding.EncodeToString([]byte("short")), "", testDataKey(9)},
+		"duplicate":     {"k1:" + testDataKey(1) + ",k1:" + testDataKey(2), "", testDataKey(9)},
+		"unknown":       {"k1:" + testDataKey(1), "k2", testDataKey(9)},
+		"no index key":  {"k1:" + testDataKey(1), "", ""},
+		"missing colon": {testDataKey(1), "", testDataKey(9)},
+	} {
+		if _, err := parseDataKeyring(c[0], c[1], c[2]); err == nil {
+			t.Errorf("%s: configuration should be refused", name)
+		}
+	}
+}
+
+func TestEncryptColumn(t *testing.T) {
+	useDataKeys(t, "old:"+testDataKey(1), "")
+	ctx := pseudoContext("alice")
+
+	sealed, err := encryptColumn("Alice", ctx)
+	if err != nil || !strings.HasPrefix(sealed, "enc:old:") || strings.Contains(sealed, "Alice") {
+		t.Fatalf("encryptColumn() = %q, %v", sealed, err)
+	}
+	if again, _ := encryptColumn("Alice", ctx); again == sealed {
+		t.Error("each value should get its own data key and nonce")
+	}
+	if _, err := decryptColumn(sealed, pseudoContext("mallory")); err != errValueAuthFailure {
+		t.Errorf("a value copied to another row must not decrypt, got %v", err)
+	}
+	for _, clear := range []string{"Bob", "enc:not-really"} {
+		if got, err := decryptColumn(clear, ctx); got != clear || err != nil {
+			t.Errorf("values stored in clear should be read as is, got %q, %v", got, err)
+		}
+	}
+
+	// After a rotation, old values stay readable and need a rekey.
+	useDataKeys(t, "new:"+testDataKey(2)+",old:"+testDataKey(1), "new")
+	if got, err := decryptColumn(sealed, ctx); got != "Alice" || err != nil {
+		t.Errorf("decryptColumn() = %q, %v", got, err)
+	}
+	if !needsRekey(sealed) || !needsRekey("Bob") {
+		t.Error("values under the old key or in clear need a rekey")
+	}
+	resealed, _ := encryptColumn("Alice", ctx)
+	if needsRekey(resealed) {
+		t.Error("values under the active key do not need a rekey")
+	}
+
+	useDataKeys(t, "new:"+testDataKey(2), "")
+	if _, err := decryptColumn(sealed, ctx); err != errUnknownDataKey {
+		t.Errorf("values under a dropped key cannot be read, got %v", err)
+	}
+}
+
+func TestEncryptJSONColumn(t *testing.T) {
+	useDataKeys(t, "k1:"+testDataKey(1), "")
+	ctx := pendingPayloadContext("bob")
+	doc := []byte(`{"text":"J'arrive"}`)
+
+	stored, err := encryptJSONColumn(doc, ctx)
+	if err != nil || stored[0] != '"' || bytes.Contains(stored, []byte("arrive")) {
+		t.Fatalf("encryptJSONColumn() = %s, %v", stored, err)
+	}
+	if got, err := decryptJSONColumn(stored, ctx); !bytes.Equal(got, doc) || err != nil {
+		t.Errorf("decryptJSONColumn() = %s, %v", got, err)
+	}
+	if got, _ := decryptJSONColumn(doc, ctx); !bytes.Equal(got, doc) {
+		t.Errorf("documents stored in clear should be read as is, got %s", got)
+	}
+}
+
+func TestEncryptWebPushSubscription(t *testing.T) {
+	useDataKeys(t, "k1:"+testDataKey(1), "")
+	sub := WebPushSubscription{UserID: "alice", Endpoint: "https://push.example.com/alice", P256dh: "p256dh-key", Auth: "auth-secret"}
+
+	stored, err := encryptWebPushSubscription(sub)
+	if err != nil || strings.Contains(stored.Endpoint, "example.com") || strings.Contains(stored.P256dh, "p256dh") || strings.Contains(stored.Auth, "auth") {
+		t.Fatalf("encryptWebPushSubscription() = %+v, %v", stored, err)
+	}
+	if err := decryptWebPushSubscription(&stored); err != nil || stored != sub {
+		t.Errorf("decryptWebPushSubscription() = %+v, %v", stored, err)
+	}
+	moved, _ := encryptWebPushSubscription(sub)
+	moved.UserID = "mallory"
+	if err := decryptWebPushSubscription(&moved); err != errValueAuthFailure {
+		t.Errorf("a subscription copied to another user must not decrypt, got %v", err)
+	}
+}
+
+func TestPseudoKeyIsBlindIndex(t *testing.T) {
+	useDataKeys(t, "k1:"+testDataKey(1), "")
+	key := pseudoKey("Alice")
+	if key != pseudoKey("ALICE") || strings.Contains(key, "alice") {
+		t.Errorf("pseudo keys should stay case-insensitive without revealing the pseudo, got %q", key)
+	}
+}
+
+func TestRunDataRekey(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	setDB(db)
+
+	useDataKeys(t, "old:"+testDataKey(1), "")
+	oldToken, _ := encryptColumn("fcm-token", pushTokenContext("bob"))
+	useDataKeys(t, "new:"+testDataKey(2)+",old:"+testDataKey(1), "new")
+	currentPayload, _ := encryptJSONColumn([]byte(`{"text":"Plop"}`), pendingPayloadContext("bob"))
+	currentEndpoint, _ := encryptColumn("https://up.example.com/bob", unifiedPushContext("bob"))
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT user_id, pseudo, COALESCE").
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "pseudo", "pseudo_key"}).AddRow("alice", "Alice", "alice"))
+	mock.ExpectExec("UPDATE user_pseudos SET pseudo").WithArgs("alice", sqlmock.AnyArg(), pseudoKey("Alice")).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("SELECT user_id, device_id, push_tokens FROM devices").
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "device_id", "push_tokens"}).AddRow("bob", "phone", pq.Array([]string{oldToken})))
+	mock.ExpectExec("UPDATE devices SET push_tokens").WithArgs("bob", "phone", sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("SELECT recipient_id, sender_id, message_type, message_payload FROM pending_messages").
+		WillReturnRows(sqlmock.NewRows([]string{"recipient_id", "sender_id", "message_type", "message_payload"}).AddRow("bob", "alice", "", currentPayload))
+	mock.ExpectQuery("SELECT code, creator_pseudo FROM invitations").
+		WillReturnRows(sqlmock.NewRows([]string{"code", "creator_pseudo"}).AddRow("ABC123", "Alice"))
+	mock.ExpectExec("UPDATE invitations SET creator_pseudo").WithArgs("ABC123", sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+	// Saved in clear before endpoints were encrypted: rewritten with its blind index.
+	mock.ExpectQuery("SELECT endpoint, COALESCE\\(endpoint_key, ''\\), user_id, p256dh, auth FROM web_push_subscriptions").
+		WillReturnRows(sqlmock.NewRows([]string{"endpoint", "endpoint_key", "user_id", "p256dh", "auth"}).AddRow("https://push.example.com/alice", "", "alice", "p256dh-key", "auth-secret"))
+	mock.ExpectExec("UPDATE web_push_subscriptions SET endpoint").
+		WithArgs("https://push.example.com/alice", sqlmock.AnyArg(), blindIndex("https://push.example.com/alice"), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("SELECT endpoint, COALESCE\\(endpoint_key, ''\\), user_id FROM unifiedpush_endpoints").
+		WillReturnRows(sqlmock.NewRows([]string{"endpoint", "endpoint_key", "user_id"}).AddRow(currentEndpoint, blindIndex("https://up.example.com/bob"), "bob"))
+	mock.ExpectCommit()
+
+	var out bytes.Buffer
+	if err := runAdminCommand([]string{"data", "rekey"}, &out); err != nil {
+		t.Fatalf("data rekey failed: %v", err)
+	}
+	if !strings.Contains(out.String(), "1 pseudo(s), the push tokens of 1 device(s), 1 push subscription(s), 1 invitation(s) and 0 pending message(s) under key 'new'") {
+		t.Errorf("unexpected output %q", out.String())
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
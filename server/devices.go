@@ -0,0 +1,63 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"unicode/utf8"
+)
+
+// --- Device Registry ---
+
+const (
+	maxDeviceIDLength   = 128
+	maxDeviceNameLength = 64
+	maxAppVersionLength = 32
+	maxLocaleLength     = 35 // Longest reasonable BCP 47 tag
+)
+
+// knownPlatforms are the platforms the app is built for. Anything else is stored as "other".
+var knownPlatforms = map[string]bool{
+	"android": true, "ios": true, "web": true, "linux": true, "macos": true, "windows": true,
+}
+
+// normalizePlatform lowercases a platform name and maps unknown values to "other".
+func normalizePlatform(platform string) string {
+	platform = strings.ToLower(strings.TrimSpace(platform))
+	if platform == "" {
+		return ""
+	}
+	if !knownPlatforms[platform] {
+		return "other"
+	}
+	return platform
+}
+
+// legacyDeviceID derives a stable device ID for clients that only send a push token.
+// It matches the IDs given to tokens migrated from the former user_device_tokens table.
+func legacyDeviceID(token string) string {
+	sum := md5.Sum([]byte(token))
+	return "legacy-" + hex.EncodeToString(sum[:])
+}
+
+// validateDevice checks and normalizes the client-provided fields of a device registration.
+func validateDevice(d *Device) error {
+	d.Name = strings.TrimSpace(d.Name)
+	d.Platform = normalizePlatform(d.Platform)
+	switch {
+	case d.UserID == "" || d.DeviceID == "":
+		return errors.New("userId and deviceId are required")
+	case len(d.DeviceID) > maxDeviceIDLength:
+		return errors.New("deviceId is too long")
+	case utf8.RuneCountInString(d.Name) > maxDeviceNameLength:
+		return errors.New("name is too long")
+	case len(d.AppVersion) > maxAppVersionLength:
+		return errors.New("appVersion is too long")
+	case len(d.Locale) > maxLocaleLength:
+		return errors.New("locale is too long")
+	case d.PublicKey != "" && validatePublicKey(d.PublicKey) != nil:
+		return errInvalidPublicKey
+	}
+	return nil
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateDevice(t *testing.T) {
+	device := Device{UserID: "alice", DeviceID: "phone-1", Name: "  Pixel  ", Platform: "Android"}
+	if err := validateDevice(&device); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if device.Name != "Pixel" || device.Platform != "android" {
+		t.Errorf("device was not normalized: %+v", device)
+	}
+
+	device = Device{UserID: "alice", DeviceID: "pc", Platform: "BeOS"}
+	validateDevice(&device)
+	if device.Platform != "other" {
+		t.Errorf("unknown platforms should become 'other', got %q", device.Platform)
+	}
+
+	invalid := []Device{
+		{DeviceID: "phone-1"},
+		{UserID: "alice"},
+		{UserID: "alice", DeviceID: "phone-1", Name: strings.Repeat("é", maxDeviceNameLength+1)},
+		{UserID: "alice", DeviceID: strings.Repeat("x", maxDeviceIDLength+1)},
+	}
+	for _, d := range invalid {
+		if err := validateDevice(&d); err == nil {
+			t.Errorf("device %+v should be rejected", d)
+		}
+	}
+}
+
+func TestLegacyDeviceID(t *testing.T) {
+	// Must match 'legacy-' || md5(token) used when migrating user_device_tokens.
+	if id := legacyDeviceID("token"); id != "legacy-94a08da1fecbb6e8b46990538c7b50b2" {
+		t.Errorf("unexpected legacy device ID %s", id)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+)
+
+// --- End-to-End Encryption ---
+//
+// Each device publishes an X25519 public key (/devices/register). Contacts get each other's device keys
+// when an invitation is used, from /users/keys, and through 'device_keys_changed' events. A plop is then
+// sent with an EncryptedEnvelope: the content encrypted once, and its key wrapped for every recipient
+// device. The server never sees the content key; it only relays and queues the envelope, and push
+// notifications for encrypted plops are generic.
+
+const (
+	devicePublicKeyBytes  = 32 // X25519
+	maxEnvelopeAlgorithm  = 64
+	maxEnvelopeRecipients = 64
+	maxEnvelopeWrappedKey = 512
+	maxEnvelopeNonce      = 32
+	maxEnvelopeCiphertext = 16 * 1024
+	encryptedPushTitle    = "Plop"
+	encryptedPushBody     = "You received a plop"
+)
+
+// requireEncryptedPlops refuses plops sent without an envelope, once every client encrypts.
+var requireEncryptedPlops = getEnv("REQUIRE_ENCRYPTED_PLOPS", "") == "true"
+
+var (
+	errInvalidPublicKey   = fmt.Errorf("publicKey must be a base64 %d-byte X25519 public key", devicePublicKeyBytes)
+	errEncryptionRequired = errors.New("plops must be end-to-end encrypted")
+)
+
+// validatePublicKey checks that a device public key is well formed.
+func validatePublicKey(publicKey string) error {
+	raw, err := base64.StdEncoding.DecodeString(publicKey)
+	if err != nil || len(raw) != devicePublicKeyBytes {
+		return errInvalidPublicKey
+	}
+	return nil
+}
+
+// validateEnvelope checks the shape and sizes of an envelope. Its content cannot be checked.
+func validateEnvelope(env *EncryptedEnvelope) error {
+	switch {
+	case env.Algorithm == "" || len(env.Algorithm) > maxEnvelopeAlgorithm:
+		return fmt.Errorf("envelope.alg must be between 1 and %d characters", maxEnvelopeAlgorithm)
+	case env.SenderDeviceID == "":
+		return errors.New("envelope.senderDeviceId is required")
+	case len(env.Keys) == 0 || len(env.Keys) > maxEnvelopeRecipients:
+		return fmt.Errorf("envelope.keys must wrap the content key for 1 to %d devices", maxEnvelopeRecipients)
+	}
+	for deviceID, wrapped := range env.Keys {
+		if deviceID == "" || !isBase64Within(wrapped, maxEnvelopeWrappedKey) {
+			return fmt.Errorf("envelope.keys[%q] must be base64, at most %d bytes", deviceID, maxEnvelopeWrappedKey)
+		}
+	}
+	if !isBase64Within(env.Nonce, maxEnvelopeNonce) {
+		return fmt.Errorf("envelope.nonce must be base64, at most %d bytes", maxEnvelopeNonce)
+	}
+	if !isBase64Within(env.Ciphertext, maxEnvelopeCiphertext) {
+		return fmt.Errorf("envelope.ciphertext must be base64, at most %d bytes", maxEnvelopeCiphertext)
+	}
+	return nil
+}
+
+// isBase64Within reports whether value is non-empty standard base64 decoding to at most max bytes.
+func isBase64Within(value string, max int) bool {
+	if value == "" || len(value) > base64.StdEncoding.EncodedLen(max) {
+		return false
+	}
+	raw, err := base64.StdEncoding.DecodeString(value)
+	return err == nil && len(raw) <= max
+}
+
+// preparePlopPayload checks the content of a plop before it is relayed or scheduled. Plaintext fields
+// sent next to an envelope are dropped, so that they are neither delivered nor stored.
+func preparePlopPayload(payload *MessagePayload) error {
+	if payload.Envelope == nil {
+		if requireEncryptedPlops {
+			return errEncryptionRequired
+		}
+		return nil
+	}
+	if err := validateEnvelope(payload.Envelope); err != nil {
+		return err
+	}
+	payload.Text, payload.Latitude, payload.Longitude = "", 0, 0
+	return nil
+}
+
+// notifyDeviceKeysChanged sends the current device keys of a user to their contacts (queued if offline)
+// and to their own devices. Each event carries the full set, so a queued one is never stale.
+func notifyDeviceKeysChanged(userID string) {
+	keys, err := store.GetDeviceKeys(userID)
+	if err != nil {
+		return
+	}
+	contactIDs, err := store.GetContactIDs(userID)
+	if err != nil {
+		return
+	}
+	event := Message{Type: "device_keys_changed", From: userID, Payload: MessagePayload{UserID: userID, DeviceKeys: keys}}
+	for _, contactID := range contactIDs {
+		event.To = contactID
+		sendServerEvent(event)
+	}
+	event.From, event.To = "server", userID
+	broadcastMessageToUser(userID, event, nil)
+	log.Printf("[E2E] Device keys of user %s changed (%d key(s)). Notified %d contact(s).", userID, len(keys), len(contactIDs))
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func testEnvelope() *EncryptedEnvelope {
+	return &EncryptedEnvelope{
+		Algorithm:      "x25519-hkdf-aes256gcm",
+		SenderDeviceID: "phone",
+		Keys:           map[string]string{"bob-phone": base64.StdEncoding.EncodeToString(make([]byte, 80))},
+		Nonce:          base64.StdEncoding.EncodeToString(make([]byte, 12)),
+		Ciphertext:     base64.StdEncoding.EncodeToString([]byte("sealed")),
+	}
+}
+
+func TestValidatePublicKey(t *testing.T) {
+	if err := validatePublicKey(base64.StdEncoding.EncodeToString(make([]byte, devicePublicKeyBytes))); err != nil {
+		t.Errorf("a 32-byte key should be accepted, got %v", err)
+	}
+	for _, key := range []string{"", "not base64!", base64.StdEncoding.EncodeToString(make([]byte, 16))} {
+		if err := validatePublicKey(key); err != errInvalidPublicKey {
+			t.Errorf("validatePublicKey(%q) = %v, want errInvalidPublicKey", key, err)
+		}
+	}
+}
+
+func TestPreparePlopPayload(t *testing.T) {
+	payload := MessagePayload{Text: "meet me here", Latitude: 48.85, Longitude: 2.35, Envelope: testEnvelope()}
+	if err := preparePlopPayload(&payload); err != nil {
+		t.Fatalf("a valid envelope should be accepted, got %v", err)
+	}
+	if payload.Text != "" || payload.Latitude != 0 || payload.Longitude != 0 {
+		t.Errorf("plaintext next to an envelope must be dropped, got %+v", payload)
+	}
+
+	for name, mutate := range map[string]func(*EncryptedEnvelope){
+		"no keys":       func(e *EncryptedEnvelope) { e.Keys = nil },
+		"no sender":     func(e *EncryptedEnvelope) { e.SenderDeviceID = "" },
+		"bad nonce":     func(e *EncryptedEnvelope) { e.Nonce = "%%%" },
+		"huge content":  func(e *EncryptedEnvelope) { e.Ciphertext = strings.Repeat("A", 4*maxEnvelopeCiphertext) },
+		"empty wrapped": func(e *EncryptedEnvelope) { e.Keys["bob-phone"] = "" },
+	} {
+		env := testEnvelope()
+		mutate(env)
+		if err := preparePlopPayload(&MessagePayload{Envelope: env}); err == nil {
+			t.Errorf("envelope with %s should be refused", name)
+		}
+	}
+
+	defer func(required bool) { requireEncryptedPlops = required }(requireEncryptedPlops)
+	requireEncryptedPlops = false
+	if err := preparePlopPayload(&MessagePayload{Text: "Plop"}); err != nil {
+		t.Errorf("plaintext plops are allowed by default, got %v", err)
+	}
+	requireEncryptedPlops = true
+	if err := preparePlopPayload(&MessagePayload{Text: "Plop"}); err != errEncryptionRequired {
+		t.Errorf("plaintext plops should be refused when encryption is required, got %v", err)
+	}
+}
+
+func TestBuildPushNotificationEncrypted(t *testing.T) {
+	notification := buildPushNotification(Message{From: "alice", To: "bob", Payload: MessagePayload{Envelope: testEnvelope()}})
+	if notification.Title != encryptedPushTitle || notification.Body != encryptedPushBody || notification.SenderID != "alice" {
+		t.Errorf("encrypted plops should get a generic notification, got %+v", notification)
+	}
+}
+
+func TestHandleGetDeviceKeys(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	setDB(db)
+
+	key := base64.StdEncoding.EncodeToString(make([]byte, devicePublicKeyBytes))
+	for _, c := range []struct {
+		contactID string
+		status    int
+	}{{"bob", http.StatusOK}, {"mallory", http.StatusNotFound}} {
+		mock.ExpectQuery("SELECT EXISTS").WithArgs("alice").WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+		mock.ExpectQuery("SELECT contact_id FROM contacts").WithArgs("alice").
+			WillReturnRows(sqlmock.NewRows([]string{"contact_id"}).AddRow("bob"))
+		if c.status == http.StatusOK {
+			mock.ExpectQuery("SELECT device_id, public_key FROM devices").WithArgs("bob").
+				WillReturnRows(sqlmock.NewRows([]string{"device_id", "public_key"}).AddRow("bob-phone", key))
+		}
+
+		rr := httptest.NewRecorder()
+		handleGetDeviceKeys(rr, httptest.NewRequest("GET", "/users/keys?userId=alice&contactId="+c.contactID, nil))
+		if rr.Code != c.status {
+			t.Fatalf("keys of %s: got status %d, want %d", c.contactID, rr.Code, c.status)
+		}
+		if c.status == http.StatusOK {
+			var keys []DeviceKey
+			if err := json.Unmarshal(rr.Body.Bytes(), &keys); err != nil || len(keys) != 1 || keys[0].PublicKey != key {
+				t.Errorf("unexpected keys %s: %v", rr.Body.String(), err)
+			}
+		}
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
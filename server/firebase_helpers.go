@@ -2,8 +2,22 @@ package main
 
 import (
 	"context"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/fs"
 	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
 
 	firebase "firebase.google.com/go/v4"
 	"firebase.google.com/go/v4/messaging"
@@ -13,126 +27,266 @@ import (
 var firebaseApp *firebase.App
 
 // initializeFirebase sets up the connection to the Firebase Admin SDK.
-func initializeFirebase() {
+func initializeFirebase() error {
 	log.Println("[INFO] Initializing Firebase...")
 	ctx := context.Background()
-	opt := option.WithCredentialsFile("serviceAccountKey.json")
-	var err error
-	firebaseApp, err = firebase.NewApp(ctx, nil, opt)
+	credentials, key, source, err := loadFirebaseCredentials()
+	if err != nil {
+		log.Printf("[ERROR] Error loading the Firebase credentials: %v", err)
+		return err
+	}
+	firebaseApp, err = firebase.NewApp(ctx, &firebase.Config{ProjectID: key.ProjectID}, option.WithCredentialsJSON(credentials))
 	if err != nil {
-		log.Fatalf("[FATAL] Error initializing Firebase app: %v\n", err)
+		log.Printf("[ERROR] Error initializing Firebase app: %v", err)
+		return err
 	}
-	log.Println("[INFO] Firebase initialized successfully.")
+	log.Printf("[INFO] Firebase initialized for project %s with the credentials from %s.", key.ProjectID, source)
+	return nil
 }
 
-// sendDirectMessageThroughFirebase sends a push notification to an offline user's devices.
-func sendDirectMessageThroughFirebase(msg Message) {
-	log.Printf("[FCM] Attempting to send push notification from %s to %s.", msg.From, msg.To)
+// --- Credentials ---
+//
+// The service account key is read from the first of these sources that is set:
+//   - FIREBASE_CREDENTIALS_JSON: the key itself, as JSON or base64-encoded JSON;
+//   - FIREBASE_CREDENTIALS_FILE: the path of the key file;
+//   - FIREBASE_CREDENTIALS_DIR: a mounted secrets directory holding either serviceAccountKey.json
+//     or one file per field (project_id, private_key, client_email...), like a Kubernetes secret;
+//   - PROJECT_ID, PRIVATE_KEY, CLIENT_EMAIL... the variables start.sh used to template the key with;
+//   - serviceAccountKey.json in the working directory, for local runs.
+//
+// The key stays in memory: it is never written to disk, and errors name the faulty fields, never their values.
 
-	deviceTokens, err := dbGetUserDeviceTokens(msg.To)
-	if err != nil {
-		log.Printf("[FCM] Error getting device tokens for user %s: %v", msg.To, err)
-		return
-	}
+// firebaseCredentialsFile is the name of the key file in a secrets directory or the working directory.
+const firebaseCredentialsFile = "serviceAccountKey.json"
 
-	if len(deviceTokens) == 0 {
-		log.Printf("[FCM] No FCM tokens found for user %s. Aborting push notification.", msg.To)
-		return
-	}
+// firebaseCredentialsVariables are the variables pointing to the credentials, only one of which can be set.
+var firebaseCredentialsVariables = []string{"FIREBASE_CREDENTIALS_JSON", "FIREBASE_CREDENTIALS_FILE", "FIREBASE_CREDENTIALS_DIR"}
 
-	ctx := context.Background()
-	client, err := firebaseApp.Messaging(ctx)
-	if err != nil {
-		log.Printf("[ERROR] Error getting FCM client: %v", err)
-		return
+// serviceAccountFields are the fields of a service account key that can be given one by one, in a
+// secrets directory or in the legacy variables named after them in upper case.
+var serviceAccountFields = []string{"project_id", "private_key_id", "private_key", "client_email", "client_id", "client_x509_cert_url"}
+
+var errNoFirebaseCredentials = errors.New("no Firebase credentials: set FIREBASE_CREDENTIALS_JSON, FIREBASE_CREDENTIALS_FILE or FIREBASE_CREDENTIALS_DIR")
+
+// serviceAccountKey holds the fields of a Google service account key that are validated at startup.
+type serviceAccountKey struct {
+	Type        string `json:"type"`
+	ProjectID   string `json:"project_id"`
+	PrivateKey  string `json:"private_key"`
+	ClientEmail string `json:"client_email"`
+	TokenURI    string `json:"token_uri"`
+}
+
+// loadFirebaseCredentials finds the service account key and validates it. It returns the key as
+// JSON, its parsed fields and a description of where it was found.
+func loadFirebaseCredentials() ([]byte, *serviceAccountKey, string, error) {
+	var set []string
+	for _, name := range firebaseCredentialsVariables {
+		if getEnv(name, "") != "" {
+			set = append(set, name)
+		}
+	}
+	if len(set) > 1 {
+		return nil, nil, "", fmt.Errorf("only one of %s can be set", strings.Join(set, ", "))
 	}
 
-	senderPseudo, err := dbGetUserPseudo(msg.From)
+	var credentials []byte
+	var source string
+	var err error
+	switch {
+	case getEnv("FIREBASE_CREDENTIALS_JSON", "") != "":
+		source = "FIREBASE_CREDENTIALS_JSON"
+		credentials, err = decodeCredentialsJSON(getEnv("FIREBASE_CREDENTIALS_JSON", ""))
+	case getEnv("FIREBASE_CREDENTIALS_FILE", "") != "":
+		source = getEnv("FIREBASE_CREDENTIALS_FILE", "")
+		credentials, err = os.ReadFile(source)
+	case getEnv("FIREBASE_CREDENTIALS_DIR", "") != "":
+		source = getEnv("FIREBASE_CREDENTIALS_DIR", "")
+		credentials, err = readCredentialsDir(source)
+	case getEnv("PRIVATE_KEY", "") != "":
+		source = "the PROJECT_ID, PRIVATE_KEY and CLIENT_EMAIL variables"
+		credentials, err = buildServiceAccountKey(func(field string) (string, error) {
+			return getEnv(strings.ToUpper(field), ""), nil
+		})
+	default:
+		if _, statErr := os.Stat(firebaseCredentialsFile); statErr != nil {
+			return nil, nil, "", errNoFirebaseCredentials
+		}
+		source = firebaseCredentialsFile
+		credentials, err = os.ReadFile(firebaseCredentialsFile)
+	}
 	if err != nil {
-		log.Printf("[FCM] Error getting pseudo for user %s: %v. Using fallback.", msg.From, err)
-		senderPseudo = "Someone" // Fallback pseudo
+		return nil, nil, "", fmt.Errorf("could not read the Firebase credentials from %s: %w", source, err)
 	}
-	if senderPseudo == "" {
-		senderPseudo = "Someone"
+	key, err := parseServiceAccountKey(credentials)
+	if err != nil {
+		return nil, nil, "", fmt.Errorf("invalid Firebase credentials in %s: %w", source, err)
 	}
+	return credentials, key, source, nil
+}
 
-	notificationBody := extractPayloadText(msg.Payload)
-	log.Printf("[FCM] Attempting to send push notification from %s to %s with notificationBody %s.", msg.From, msg.To,notificationBody);
-
-	if notificationBody == "" {
-		notificationBody = "Plop"
+// decodeCredentialsJSON accepts the key as JSON or as base64-encoded JSON, which survives being
+// passed through tools that mangle line breaks and quotes.
+func decodeCredentialsJSON(value string) ([]byte, error) {
+	value = strings.TrimSpace(value)
+	if strings.HasPrefix(value, "{") {
+		return []byte(value), nil
+	}
+	decoded, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return nil, errors.New("the value is neither JSON nor base64")
 	}
-log.Printf("[FCM] Attempting to send push notification from %s to %s with notificationBody %s.", msg.From, msg.To,notificationBody);
+	return decoded, nil
+}
 
-	var tokensToRemove []string
-	for _, token := range deviceTokens {
-		fcmMessage := &messaging.Message{
-			Notification: &messaging.Notification{Title: senderPseudo, Body: notificationBody},
-			Data: map[string]string{
-				"senderId":  msg.From,
-				"payload":   notificationBody,
-				"isDefault": strconv.FormatBool(msg.IsDefault),
-			},
-			Android: &messaging.AndroidConfig{
-				Notification: &messaging.AndroidNotification{ChannelID: "plop_channel_id", Icon: "icon"},
-			},
-			APNS: &messaging.APNSConfig{
-				Payload: &messaging.APNSPayload{
-					Aps: &messaging.Aps{
-						Alert: &messaging.ApsAlert{Title: senderPseudo, Body: notificationBody},
-						Badge: intPtr(1),
-						Sound: "plop.aiff",
-					},
-				},
-			},
-			Token: token,
+// readCredentialsDir reads the key from a secrets directory, as a whole file or one file per field.
+func readCredentialsDir(dir string) ([]byte, error) {
+	credentials, err := os.ReadFile(filepath.Join(dir, firebaseCredentialsFile))
+	if !errors.Is(err, fs.ErrNotExist) {
+		return credentials, err
+	}
+	return buildServiceAccountKey(func(field string) (string, error) {
+		value, err := os.ReadFile(filepath.Join(dir, field))
+		if errors.Is(err, fs.ErrNotExist) {
+			return "", nil
 		}
+		return strings.TrimSpace(string(value)), err
+	})
+}
 
-		_, err := client.Send(ctx, fcmMessage)
+// buildServiceAccountKey assembles a key from its fields. Escaped line breaks in the private key
+// are restored, as they were when the key was templated into a JSON file.
+func buildServiceAccountKey(field func(name string) (string, error)) ([]byte, error) {
+	key := map[string]string{
+		"type":                        "service_account",
+		"auth_uri":                    "https://accounts.google.com/o/oauth2/auth",
+		"token_uri":                   "https://oauth2.googleapis.com/token",
+		"auth_provider_x509_cert_url": "https://www.googleapis.com/oauth2/v1/certs",
+		"universe_domain":             "googleapis.com",
+	}
+	for _, name := range serviceAccountFields {
+		value, err := field(name)
 		if err != nil {
-			log.Printf("[ERROR] FCM send failed for token %s: %v", token, err)
-			if messaging.IsUnregistered(err) || messaging.IsInvalidArgument(err) {
-				log.Printf("[INFO] Invalid FCM token %s detected. Scheduling for removal.", token)
-				tokensToRemove = append(tokensToRemove, token)
-			}
-		} else {
-			log.Printf("[FCM] Push notification sent successfully to token %s for user %s.", token, msg.To)
+			return nil, err
+		}
+		if value != "" {
+			key[name] = value
 		}
 	}
+	if privateKey, ok := key["private_key"]; ok {
+		key["private_key"] = strings.TrimRight(strings.ReplaceAll(privateKey, `\n`, "\n"), "\n") + "\n"
+	}
+	return json.Marshal(key)
+}
+
+// parseServiceAccountKey checks that the key has the fields the Admin SDK needs and that its
+// private key is usable, so that bad credentials stop the server at startup rather than at the
+// first push notification.
+func parseServiceAccountKey(credentials []byte) (*serviceAccountKey, error) {
+	var key serviceAccountKey
+	if err := json.Unmarshal(credentials, &key); err != nil {
+		return nil, errors.New("not a valid JSON document")
+	}
+	if key.Type != "service_account" {
+		return nil, fmt.Errorf("type is %q, expected \"service_account\"", key.Type)
+	}
 
-	if len(tokensToRemove) > 0 {
-		removeInvalidTokens(msg.To, tokensToRemove)
+	var missing []string
+	for name, value := range map[string]string{"project_id": key.ProjectID, "private_key": key.PrivateKey, "client_email": key.ClientEmail, "token_uri": key.TokenURI} {
+		if strings.TrimSpace(value) == "" {
+			missing = append(missing, name)
+		} else if strings.Contains(value, "___") {
+			return nil, fmt.Errorf("%s still holds a template placeholder", name)
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return nil, fmt.Errorf("missing %s", strings.Join(missing, ", "))
+	}
+
+	if !strings.Contains(key.ClientEmail, "@") {
+		return nil, errors.New("client_email is not an email address")
+	}
+	if u, err := url.Parse(key.TokenURI); err != nil || u.Scheme != "https" || u.Host == "" {
+		return nil, errors.New("token_uri is not an https URL")
+	}
+	block, _ := pem.Decode([]byte(key.PrivateKey))
+	if block == nil {
+		return nil, errors.New("private_key is not PEM-encoded (check that its line breaks were kept)")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
 	}
+	if err != nil {
+		return nil, errors.New("private_key is not a valid private key")
+	}
+	if _, ok := parsed.(*rsa.PrivateKey); !ok {
+		return nil, errors.New("private_key is not an RSA key")
+	}
+	return &key, nil
 }
 
-// removeInvalidTokens cleans up FCM tokens that are no longer valid from the database.
-func removeInvalidTokens(userID string, tokensToRemove []string) {
-	log.Printf("[INFO] Removing %d invalid tokens for user %s.", len(tokensToRemove), userID)
+// fcmNotifier sends push notifications through Firebase Cloud Messaging.
+type fcmNotifier struct {
+	client *messaging.Client
+}
 
-	currentTokens, err := dbGetUserDeviceTokens(userID)
+// newFCMNotifier initializes Firebase and returns a notifier backed by its messaging client.
+func newFCMNotifier() (*fcmNotifier, error) {
+	if err := initializeFirebase(); err != nil {
+		return nil, err
+	}
+	client, err := firebaseApp.Messaging(context.Background())
 	if err != nil {
-		log.Printf("[ERROR] Could not get tokens for invalid token removal for user %s: %v", userID, err)
-		return
+		log.Printf("[ERROR] Error getting FCM client: %v", err)
+		return nil, err
+	}
+	return &fcmNotifier{client: client}, nil
+}
+
+func (f *fcmNotifier) Name() string { return "fcm" }
+
+// Send delivers one notification to an FCM token.
+func (f *fcmNotifier) Send(ctx context.Context, token string, n PushNotification) error {
+	// Let FCM and APNs drop the notification once the message itself would have expired.
+	var androidTTL *time.Duration
+	apnsHeaders := map[string]string{}
+	if n.TTL > 0 {
+		ttl := n.TTL
+		androidTTL = &ttl
+		apnsHeaders["apns-expiration"] = strconv.FormatInt(time.Now().Add(ttl).Unix(), 10)
 	}
 
-	if len(currentTokens) == 0 {
-		return // Nothing to do
+	fcmMessage := &messaging.Message{
+		Notification: &messaging.Notification{Title: n.Title, Body: n.Body},
+		Data: map[string]string{
+			"senderId":  n.SenderID,
+			"payload":   n.Body,
+			"isDefault": strconv.FormatBool(n.IsDefault),
+		},
+		Android: &messaging.AndroidConfig{
+			TTL:          androidTTL,
+			Notification: &messaging.AndroidNotification{ChannelID: "plop_channel_id", Icon: "icon"},
+		},
+		APNS: &messaging.APNSConfig{
+			Headers: apnsHeaders,
+			Payload: &messaging.APNSPayload{
+				Aps: &messaging.Aps{
+					Alert: &messaging.ApsAlert{Title: n.Title, Body: n.Body},
+					Badge: intPtr(1),
+					Sound: "plop.aiff",
+				},
+			},
+		},
+		Token: token,
 	}
 
-	var validTokens []string
-	for _, token := range currentTokens {
-		isInvalid := false
-		for _, tokenToRemove := range tokensToRemove {
-			if token == tokenToRemove {
-				isInvalid = true
-				break
-			}
-		}
-		if !isInvalid {
-			validTokens = append(validTokens, token)
+	if _, err := f.client.Send(ctx, fcmMessage); err != nil {
+		if messaging.IsUnregistered(err) || messaging.IsInvalidArgument(err) {
+			return &UnregisteredTokenError{Token: token, Err: err}
 		}
+		return err
 	}
-
-	go dbSaveUserDeviceTokens(userID, validTokens)
-	log.Printf("[INFO] Finished removing invalid tokens for user %s. Remaining: %d.", userID, len(validTokens))
+	return nil
 }
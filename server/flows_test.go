@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"plop_server/plopclient"
+)
+
+// End-to-end flows, run against the in-process server of harness_test.go.
+
+func TestInvitationFlow(t *testing.T) {
+	s := newTestServer(t)
+	ctx := context.Background()
+	alice, bob := s.newUser("Alice", ""), s.newUser("Bob", "")
+	aliceWS := s.connect(alice)
+
+	invitation, err := alice.api.CreateInvitation(ctx, plopclient.CreateInvitationParams{UserID: alice.ID, Pseudo: alice.Pseudo})
+	if err != nil {
+		t.Fatalf("CreateInvitation failed: %v", err)
+	}
+	s.waitFor("the invitation to be saved", func() bool {
+		_, found, _ := s.store.GetInvitation(invitation.Code)
+		return found
+	})
+	creator, err := bob.api.UseInvitation(ctx, plopclient.UseInvitationRequest{Code: invitation.Code, UserID: bob.ID, Pseudo: bob.Pseudo})
+	if err != nil || creator.UserID != alice.ID || creator.Pseudo != "Alice" {
+		t.Fatalf("UseInvitation = %+v, %v", creator, err)
+	}
+	if event := aliceWS.expect("new_contact"); event.Payload.UserID != bob.ID || event.Payload.Pseudo != "Bob" {
+		t.Errorf("alice was told about %+v, want bob", event.Payload)
+	}
+	s.waitFor("the contacts to be saved", func() bool {
+		mutual, _ := s.store.GetMutualContacts(bob.ID)
+		return len(mutual) == 1 && mutual[0] == alice.ID
+	})
+	s.waitFor("the invitation to be consumed", func() bool {
+		_, found, _ := s.store.GetInvitation(invitation.Code)
+		return !found
+	})
+
+	// Invitations expire even before the cleanup routine removes them.
+	carol := s.newUser("Carol", "")
+	invitation, _ = alice.api.CreateInvitation(ctx, plopclient.CreateInvitationParams{UserID: alice.ID, Pseudo: alice.Pseudo})
+	s.waitFor("the invitation to be saved", func() bool {
+		_, found, _ := s.store.GetInvitation(invitation.Code)
+		return found
+	})
+	s.clock.Advance(invitationValidityMinutes*time.Minute + time.Second)
+	_, err = carol.api.UseInvitation(ctx, plopclient.UseInvitationRequest{Code: invitation.Code, UserID: carol.ID, Pseudo: carol.Pseudo})
+	var apiErr *plopclient.APIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusNotFound {
+		t.Errorf("an expired invitation should be refused with a 404, got %v", err)
+	}
+}
+
+func TestPlopFlow(t *testing.T) {
+	s := newTestServer(t)
+	alice, bob := s.newUser("Alice", ""), s.newUser("Bob", "")
+	s.befriend(alice, bob)
+	aliceWS, bobWS := s.connect(alice), s.connect(bob)
+
+	id := aliceWS.plop(bob, "on my way", 0)
+	if ack := aliceWS.expect("message_ack"); ack.Payload.MessageID != id || ack.Payload.RecipientID != bob.ID {
+		t.Errorf("unexpected ack %+v", ack.Payload)
+	}
+	if plop := bobWS.expect("plop"); plop.ID != id || plop.From != alice.ID || plop.Payload.Text != "on my way" || plop.IsPending {
+		t.Errorf("bob received %+v", plop)
+	}
+
+	// The rate limiter runs on the server clock: the fourth plop in a row to the same friend waits a second.
+	for range pairBurst - 1 {
+		aliceWS.plop(bob, "plop", 0)
+		aliceWS.expect("message_ack")
+		bobWS.expect("plop")
+	}
+	id = aliceWS.plop(bob, "too fast", 0)
+	if limited := aliceWS.expect("rate_limited"); limited.Payload.MessageID != id || limited.Payload.RetryAfterMs != pairRefillInterval.Milliseconds() {
+		t.Errorf("unexpected rate_limited frame %+v", limited.Payload)
+	}
+	s.clock.Advance(pairRefillInterval)
+	aliceWS.plop(bob, "better", 0)
+	aliceWS.expect("message_ack")
+	if plop := bobWS.expect("plop"); plop.Payload.Text != "better" {
+		t.Errorf("bob received %q after the rate limit, want the plop sent once it was lifted", plop.Payload.Text)
+	}
+}
+
+func TestOfflineQueueFlow(t *testing.T) {
+	s := newTestServer(t)
+	alice, bob := s.newUser("Alice", ""), s.newUser("Bob", "")
+	s.befriend(alice, bob)
+	aliceWS := s.connect(alice)
+
+	id := aliceWS.plop(bob, "call me", 0)
+	aliceWS.expect("message_ack")
+	s.waitFor("the plop to be queued", func() bool {
+		pending, _ := s.store.GetPendingMessages(bob.ID)
+		return len(pending) == 1
+	})
+
+	bobWS := s.connect(bob)
+	if plop := bobWS.expect("plop"); plop.ID != id || plop.From != alice.ID || plop.Payload.Text != "call me" || !plop.IsPending {
+		t.Errorf("bob received %+v", plop)
+	}
+	s.waitFor("the queue to be cleared", func() bool {
+		pending, _ := s.store.GetPendingMessages(bob.ID)
+		return len(pending) == 0
+	})
+	bobWS.close(s)
+
+	// A plop whose TTL elapses before bob comes back is dropped, and alice is told.
+	id = aliceWS.plop(bob, "lunch?", 60)
+	aliceWS.expect("message_ack")
+	s.waitFor("the plop to be queued", func() bool {
+		pending, _ := s.store.GetPendingMessages(bob.ID)
+		return len(pending) == 1
+	})
+	s.clock.Advance(59 * time.Second)
+	purgeExpiredPendingMessages()
+	if pending, _ := s.store.GetPendingMessages(bob.ID); len(pending) != 1 {
+		t.Fatal("the plop expired before its TTL")
+	}
+	s.clock.Advance(2 * time.Second)
+	purgeExpiredPendingMessages()
+	if status := aliceWS.expect("message_status"); status.Payload.MessageID != id || status.Payload.Status != "expired" || status.Payload.RecipientID != bob.ID {
+		t.Errorf("unexpected message_status %+v", status.Payload)
+	}
+	if pending, _ := s.store.GetPendingMessagesInvolving(bob.ID); len(pending) != 0 {
+		t.Errorf("the expired plop is still queued: %+v", pending)
+	}
+}
+
+func TestSyncFlow(t *testing.T) {
+	s := newTestServer(t)
+	ctx := context.Background()
+	alice := s.newUser("Alice", "")
+	phone := s.connect(alice)
+
+	code, err := alice.api.CreateSyncCode(ctx, plopclient.CreateSyncCodeParams{UserID: alice.ID})
+	if err != nil {
+		t.Fatalf("CreateSyncCode failed: %v", err)
+	}
+	laptop := &testUser{ID: alice.ID, Pseudo: "Alice's laptop", DeviceID: "laptop", api: s.api()}
+	request, err := laptop.api.UseSyncCode(ctx, plopclient.UseSyncCodeRequest{Code: code.Code, Device: plopclient.Device{DeviceID: "laptop", Name: "Laptop", Platform: "linux"}})
+	if err != nil || request.Status != plopclient.LinkStatus(linkStatusPending) {
+		t.Fatalf("UseSyncCode = %+v, %v", request, err)
+	}
+
+	prompt := phone.expect("link_request")
+	if lr := prompt.Payload.LinkRequest; lr == nil || lr.ID != request.RequestID || lr.DeviceName != "Laptop" {
+		t.Fatalf("unexpected link_request %+v", prompt.Payload.LinkRequest)
+	}
+	if status, err := laptop.api.GetSyncStatus(ctx, plopclient.GetSyncStatusParams{RequestID: request.RequestID}); err != nil || status.Status != plopclient.LinkStatus(linkStatusPending) || status.DeviceSecret != "" {
+		t.Fatalf("the laptop must wait for the approval, got %+v, %v", status, err)
+	}
+	phone.send(Message{Type: "link_approve", Payload: MessagePayload{LinkRequest: &LinkRequest{ID: request.RequestID}}})
+	if resolved := phone.expect("link_request_resolved"); resolved.Payload.LinkRequest.Status != linkStatusApproved {
+		t.Errorf("unexpected link_request_resolved %+v", resolved.Payload.LinkRequest)
+	}
+
+	status, err := laptop.api.GetSyncStatus(ctx, plopclient.GetSyncStatusParams{RequestID: request.RequestID})
+	if err != nil || status.Status != plopclient.LinkStatus(linkStatusApproved) || status.UserID != alice.ID || status.Pseudo != "Alice" || status.DeviceSecret == "" {
+		t.Fatalf("GetSyncStatus = %+v, %v", status, err)
+	}
+	phone.expect("sync_request")
+	laptop.DeviceSecret = status.DeviceSecret
+	laptop.api.Credentials = plopclient.Credentials{UserID: alice.ID, DeviceID: "laptop", DeviceSecret: status.DeviceSecret}
+	s.connect(laptop)
+	phone.expect("sync_request")
+	if devices, _ := s.store.GetUserDevices(alice.ID); len(devices) != 2 {
+		t.Errorf("alice should have 2 devices, got %+v", devices)
+	}
+
+	// Sync codes expire after five minutes.
+	code, _ = alice.api.CreateSyncCode(ctx, plopclient.CreateSyncCodeParams{UserID: alice.ID})
+	s.clock.Advance(5*time.Minute + time.Second)
+	_, err = s.api().UseSyncCode(ctx, plopclient.UseSyncCodeRequest{Code: code.Code, Device: plopclient.Device{DeviceID: "tablet"}})
+	var apiErr *plopclient.APIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusNotFound {
+		t.Errorf("an expired sync code should be refused with a 404, got %v", err)
+	}
+}
+
+func TestAccountWithoutCredentialsFlow(t *testing.T) {
+	s := newTestServer(t)
+	ctx := context.Background()
+	account, err := s.api().GenerateUserID(ctx, plopclient.GenerateUserIDParams{})
+	if err != nil || account.AccountSecret != "" {
+		t.Fatalf("GenerateUserID = %+v, %v; want no account secret", account, err)
+	}
+
+	// Any contact knows the user ID: whatever they ask for, they must not get the account's first credentials.
+	mallory := s.api()
+	registered, err := mallory.RegisterDevice(ctx, plopclient.RegisterDeviceRequest{
+		Device: plopclient.Device{UserID: account.UserID, DeviceID: "mallory-phone", Platform: "android"},
+	})
+	if err != nil || registered.DeviceSecret != "" {
+		t.Errorf("a device of an account without credentials should get no secret, got %+v, %v", registered, err)
+	}
+	var apiErr *plopclient.APIError
+	if _, err := mallory.RotateAccountSecret(ctx, plopclient.RotateAccountSecretParams{UserID: account.UserID}); !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusForbidden {
+		t.Errorf("an account without credentials should not get an account secret, got %v", err)
+	}
+	if _, err := mallory.RevokeDevice(ctx, plopclient.RevokeDeviceRequest{UserID: account.UserID, DeviceID: "mallory-phone"}); !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusForbidden {
+		t.Errorf("revoking a device of an account without credentials should be refused, got %v", err)
+	}
+
+	if _, err := s.api().CreateSyncCode(ctx, plopclient.CreateSyncCodeParams{UserID: account.UserID}); err != nil {
+		t.Errorf("the owner should still be able to use their account, got %v", err)
+	}
+}
+
+func TestPushFallbackFlow(t *testing.T) {
+	s := newTestServer(t)
+	alice, bob := s.newUser("Alice", ""), s.newUser("Bob", "bob-fcm-token")
+	s.befriend(alice, bob)
+	aliceWS := s.connect(alice)
+
+	aliceWS.plop(bob, "where are you?", 3600)
+	aliceWS.expect("message_ack")
+	s.waitFor("the push notification", func() bool { return len(s.notifier.sentTo("bob-fcm-token")) == 1 })
+	notification := s.notifier.sentTo("bob-fcm-token")[0]
+	if notification.SenderID != alice.ID || notification.Title != "Alice" || notification.Body != "where are you?" || notification.TTL != time.Hour {
+		t.Errorf("unexpected notification %+v", notification)
+	}
+
+	// Tokens the push service no longer knows are forgotten.
+	s.notifier.mu.Lock()
+	s.notifier.unregistered["bob-fcm-token"] = true
+	s.notifier.mu.Unlock()
+	aliceWS.plop(bob, "hello?", 0)
+	aliceWS.expect("message_ack")
+	s.waitFor("the stale token to be removed", func() bool {
+		tokens, _ := s.store.GetUserDeviceTokens(bob.ID)
+		return len(tokens) == 0
+	})
+}
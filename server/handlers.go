@@ -3,8 +3,13 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
+	"math"
 	"net/http"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
@@ -15,12 +20,23 @@ const (
 	invitationValidityMinutes = 10
 )
 
-// handleGenerateUserID creates and returns a new unique user ID.
+// handleGenerateUserID creates and returns a new unique user ID with its account secret.
+//
+// An account secret is only issued when the client asks for one with credentials=true: from then on
+// every request for the account must carry credentials, which older apps do not send.
 func handleGenerateUserID(w http.ResponseWriter, r *http.Request) {
 	log.Println("[HTTP] Received request for /users/generate-id")
 	id := uuid.New()
+	var accountSecret string
+	if r.URL.Query().Get("credentials") == "true" {
+		accountSecret = generateSecret()
+		if err := store.SetAccountSecretHash(id.String(), hashSecret(accountSecret)); err != nil {
+			http.Error(w, "Failed to create account", http.StatusInternalServerError)
+			return
+		}
+	}
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{"userId": id.String()})
+	json.NewEncoder(w).Encode(GenerateUserIDResponse{UserID: id.String(), AccountSecret: accountSecret})
 	log.Printf("[HTTP] Generated new UserID: %s", id.String())
 }
 
@@ -33,47 +49,59 @@ func handleCreateInvitation(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "'userId' and 'pseudo' are required", http.StatusBadRequest)
 		return
 	}
+	if refuseSanctioned(w, creatorID) {
+		return
+	}
 	code := generateRandomCode(6)
 	invitation := Invitation{
 		Code:          code,
 		CreatorUserID: creatorID,
 		CreatorPseudo: creatorPseudo,
-		ExpiresAt:     time.Now().Add(invitationValidityMinutes * time.Minute),
+		ExpiresAt:     timeNow().Add(invitationValidityMinutes * time.Minute),
 	}
-	go dbSaveInvitation(invitation)
+	goBackground(func() { store.SaveInvitation(invitation) })
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{"code": code, "validityMinutes": invitationValidityMinutes})
+	json.NewEncoder(w).Encode(CreateInvitationResponse{Code: code, ValidityMinutes: invitationValidityMinutes})
 	log.Printf("[HTTP] Invitation code %s created for user %s", code, creatorID)
 }
 
 // handleUseInvitation allows a user to consume an invitation code to connect with its creator.
 func handleUseInvitation(w http.ResponseWriter, r *http.Request) {
 	log.Println("[HTTP] Received request for /invitations/use")
-	var req struct{ Code, UserID, Pseudo string }
+	var req UseInvitationRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
+	if refuseSanctioned(w, req.UserID) {
+		return
+	}
 
-	invitation, found, err := dbGetInvitation(req.Code)
+	invitation, found, err := store.GetInvitation(req.Code)
 	if err != nil {
 		log.Printf("[ERROR] Failed to get invitation %s: %v", req.Code, err)
 		http.Error(w, "Error checking invitation", http.StatusInternalServerError)
 		return
 	}
 
-	if !found || time.Now().After(invitation.ExpiresAt) {
+	if !found || timeNow().After(invitation.ExpiresAt) {
 		http.Error(w, "Invitation code is invalid or has expired", http.StatusNotFound)
 		return
 	}
 
-	go dbDeleteInvitation(req.Code)
+	goBackground(func() { store.DeleteInvitation(req.Code) })
+	goBackground(func() { store.SaveContactPair(invitation.CreatorUserID, req.UserID) })
+
+	// Both sides get the other's device keys so that they can encrypt plops right away.
+	// Without them, clients fall back to /users/keys.
+	creatorKeys, _ := store.GetDeviceKeys(invitation.CreatorUserID)
+	userKeys, _ := store.GetDeviceKeys(req.UserID)
 
-	// Notify the creator that a new contact has been added
 	// Notify the creator that a new contact has been added
 	contactPayload := MessagePayload{
-		UserID: req.UserID,
-		Pseudo: req.Pseudo,
+		UserID:     req.UserID,
+		Pseudo:     req.Pseudo,
+		DeviceKeys: userKeys,
 		// Text: fmt.Sprintf("%s (%s) has been added to your contacts!", req.Pseudo, req.UserID), // Optional: add a text field too
 	}
 	notificationMsg := Message{
@@ -84,26 +112,199 @@ func handleUseInvitation(w http.ResponseWriter, r *http.Request) {
 
 	log.Printf("[HTTP] Invitation code %s successfully used by %s to connect with %s", req.Code, req.UserID, invitation.CreatorUserID)
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{"userId": invitation.CreatorUserID, "pseudo": invitation.CreatorPseudo})
+	json.NewEncoder(w).Encode(UseInvitationResponse{UserID: invitation.CreatorUserID, Pseudo: invitation.CreatorPseudo, DeviceKeys: creatorKeys})
+}
+
+// handleGetDeviceKeys returns the device public keys of one of the user's contacts, to encrypt plops for them.
+func handleGetDeviceKeys(w http.ResponseWriter, r *http.Request) {
+	log.Println("[HTTP] Received request for /users/keys")
+	userID, contactID := r.URL.Query().Get("userId"), r.URL.Query().Get("contactId")
+	if userID == "" || contactID == "" {
+		http.Error(w, "userId and contactId are required", http.StatusBadRequest)
+		return
+	}
+	if _, err := authenticateRequest(r, userID); err != nil {
+		writeAuthError(w, err)
+		return
+	}
+
+	if contactID != userID {
+		contactIDs, err := store.GetContactIDs(userID)
+		if err != nil {
+			http.Error(w, "Failed to retrieve keys", http.StatusInternalServerError)
+			return
+		}
+		if !slices.Contains(contactIDs, contactID) {
+			http.Error(w, "Not a contact", http.StatusNotFound)
+			return
+		}
+	}
+	keys, err := store.GetDeviceKeys(contactID)
+	if err != nil {
+		http.Error(w, "Failed to retrieve keys", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(keys)
 }
 
-// handleGetPseudos returns the pseudos for a given list of user IDs.
+// handleGetPseudos returns the pseudos for a given list of user IDs. With "includeAvatars", each user
+// maps to a UserProfile carrying their avatar hashes instead of a bare pseudo.
 func handleGetPseudos(w http.ResponseWriter, r *http.Request) {
 	log.Println("[HTTP] Received request for /users/get-pseudos")
-	var req struct{ UserIDs []string `json:"userIds"` }
+	var req GetPseudosRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
 
-	responsePseudos, err := dbGetUsersPseudos(req.UserIDs)
+	responsePseudos, err := store.GetUsersPseudos(req.UserIDs)
 	if err != nil {
 		http.Error(w, "Failed to retrieve pseudos", http.StatusInternalServerError)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(responsePseudos)
+	if !req.IncludeAvatars {
+		json.NewEncoder(w).Encode(responsePseudos)
+		return
+	}
+
+	avatars, err := store.GetUsersAvatars(req.UserIDs)
+	if err != nil {
+		http.Error(w, "Failed to retrieve avatars", http.StatusInternalServerError)
+		return
+	}
+	profiles := make(map[string]UserProfile, len(responsePseudos))
+	for userID, pseudo := range responsePseudos {
+		profiles[userID] = UserProfile{Pseudo: pseudo, Avatar: avatars[userID]}
+	}
+	for userID, avatar := range avatars {
+		if _, found := profiles[userID]; !found {
+			profiles[userID] = UserProfile{Avatar: avatar}
+		}
+	}
+	json.NewEncoder(w).Encode(profiles)
+}
+
+// handleAvatar uploads (POST, with the raw image as body) or removes (DELETE) the calling user's avatar.
+func handleAvatar(w http.ResponseWriter, r *http.Request) {
+	log.Println("[HTTP] Received request for /users/avatar")
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		w.Header().Set("Allow", "POST, DELETE")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userId := requestUserID(r)
+	if userId == "" {
+		http.Error(w, "userId is required", http.StatusBadRequest)
+		return
+	}
+	if _, err := authenticateRequest(r, userId); err != nil {
+		writeAuthError(w, err)
+		return
+	}
+
+	if r.Method == http.MethodDelete {
+		if err := removeAvatar(userId); err != nil {
+			http.Error(w, "Failed to remove avatar", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(SuccessResponse{Success: true})
+		return
+	}
+	if refuseSanctioned(w, userId) {
+		return
+	}
+
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxAvatarUploadBytes))
+	if err != nil {
+		http.Error(w, errAvatarTooLarge.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	hashes, err := setAvatar(userId, data)
+	switch err {
+	case nil:
+	case errAvatarTooLarge:
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	case errAvatarUnsupportedType:
+		http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+		return
+	case errAvatarInvalid, errAvatarTooSmall:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	default:
+		http.Error(w, "Failed to save avatar", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(AvatarResponse{Avatar: hashes})
+}
+
+// handleGetAvatar serves an avatar blob by hash. Blobs never change, so they can be cached forever.
+func handleGetAvatar(w http.ResponseWriter, r *http.Request) {
+	hash := strings.TrimPrefix(r.URL.Path, "/avatars/")
+	data, err := blobStore.Get(hash)
+	if err == errBlobNotFound {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		log.Printf("[ERROR] Failed to read avatar blob %s: %v", hash, err)
+		http.Error(w, "Failed to read avatar", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	w.Header().Set("ETag", `"`+hash+`"`)
+	w.Write(data)
+}
+
+// handleChangePseudo sets the user's public pseudo after validating, normalizing and checking it is unique.
+func handleChangePseudo(w http.ResponseWriter, r *http.Request) {
+	log.Println("[HTTP] Received request for /users/pseudo")
+	var req ChangePseudoRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.UserID == "" {
+		http.Error(w, "userId is required", http.StatusBadRequest)
+		return
+	}
+	if _, err := authenticateRequest(r, req.UserID); err != nil {
+		writeAuthError(w, err)
+		return
+	}
+	if refuseSanctioned(w, req.UserID) {
+		return
+	}
+
+	if _, err := normalizePseudo(req.Pseudo); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	pseudo, retryAfter, err := changePseudo(req.UserID, req.Pseudo, timeNow())
+	switch err {
+	case nil:
+	case errPseudoTaken:
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case errPseudoRateLimited:
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return
+	default:
+		http.Error(w, "Failed to change pseudo", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(PseudoResponse{Pseudo: pseudo})
 }
 
 // handleCreateSyncCode creates a new synchronization code for a user.
@@ -114,25 +315,38 @@ func handleCreateSyncCode(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "userId is required", http.StatusBadRequest)
 		return
 	}
+	if _, err := authenticateRequest(r, userId); err != nil {
+		writeAuthError(w, err)
+		return
+	}
+	if refuseSanctioned(w, userId) {
+		return
+	}
 	code := generateRandomCode(6)
-	syncCode := SyncCode{Code: code, UserID: userId, ExpiresAt: time.Now().Add(5 * time.Minute)}
+	syncCode := SyncCode{Code: code, UserID: userId, ExpiresAt: timeNow().Add(5 * time.Minute)}
 
 	syncCodesMutex.Lock()
 	syncCodes[code] = syncCode
 	syncCodesMutex.Unlock()
 
-	json.NewEncoder(w).Encode(map[string]string{"code": code})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(SyncCodeResponse{Code: code})
 	log.Printf("[HTTP] Sync code created for user %s", userId)
 }
 
-// handleUseSyncCode allows a user to consume a sync code to link a new device.
+// handleUseSyncCode lets a new device consume a sync code. The device does not get access to the
+// account right away: it waits for one of the user's existing devices to approve it (see /sync/status).
 func handleUseSyncCode(w http.ResponseWriter, r *http.Request) {
 	log.Println("[HTTP] Received request for /sync/use")
-	var req struct{ Code string `json:"code"` }
+	var req UseSyncCodeRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
+	if req.DeviceID == "" {
+		http.Error(w, "deviceId is required", http.StatusBadRequest)
+		return
+	}
 
 	syncCodesMutex.Lock()
 	syncData, found := syncCodes[req.Code]
@@ -141,28 +355,65 @@ func handleUseSyncCode(w http.ResponseWriter, r *http.Request) {
 	}
 	syncCodesMutex.Unlock()
 
-	if !found || time.Now().After(syncData.ExpiresAt) {
+	if !found || timeNow().After(syncData.ExpiresAt) {
 		http.Error(w, "Sync code is invalid or has expired", http.StatusNotFound)
 		return
 	}
 
-	// Trigger a sync event on the user's other devices
-	broadcastMessageToUser(syncData.UserID, Message{Type: "sync_request"}, nil)
+	device := req.Device
+	device.UserID = syncData.UserID
+	device.PushTokens = nil
+	if err := validateDevice(&device); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	pseudo, err := dbGetUserPseudo(syncData.UserID)
-	if err != nil {
-		http.Error(w, "Failed to retrieve user pseudo", http.StatusInternalServerError)
+	lr := createLinkRequest(device, timeNow())
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(UseSyncCodeResponse{RequestID: lr.ID, Status: lr.Status, ExpiresAt: lr.ExpiresAt})
+	log.Printf("[HTTP] Sync code %s used by device %s, waiting for approval from user %s", req.Code, device.DeviceID, syncData.UserID)
+}
+
+// handleSyncStatus lets a new device poll its link request. Once approved, the response carries
+// the account and the device credentials; it can only be collected once.
+func handleSyncStatus(w http.ResponseWriter, r *http.Request) {
+	requestId := r.URL.Query().Get("requestId")
+	if requestId == "" {
+		http.Error(w, "requestId is required", http.StatusBadRequest)
+		return
+	}
+
+	lr, deviceSecret, found := collectLinkRequest(requestId, timeNow())
+	if !found {
+		http.Error(w, "Link request not found", http.StatusNotFound)
 		return
 	}
 
-	json.NewEncoder(w).Encode(map[string]string{"userId": syncData.UserID, "pseudo": pseudo})
-	log.Printf("[HTTP] Sync code %s successfully used, linking to user %s", req.Code, syncData.UserID)
+	response := SyncStatusResponse{Status: lr.Status}
+	if lr.Status == linkStatusApproved {
+		pseudo, err := store.GetUserPseudo(lr.UserID)
+		if err != nil {
+			log.Printf("[HTTP] Could not retrieve pseudo of user %s for link request %s: %v", lr.UserID, lr.ID, err)
+		}
+		response.UserID = lr.UserID
+		response.Pseudo = pseudo
+		response.DeviceSecret = deviceSecret
+
+		// Trigger a sync event on the user's other devices
+		broadcastMessageToUser(lr.UserID, Message{Type: "sync_request", From: "server"}, nil)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
 }
 
 // handleUpdateToken adds or updates an FCM device token for a user.
+// Clients that do not send a deviceId get one derived from the token.
 func handleUpdateToken(w http.ResponseWriter, r *http.Request) {
 	log.Println("[HTTP] Received request for /users/update-token")
-	var req struct{ UserID, Token string }
+	var req UpdateTokenRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
@@ -171,31 +422,663 @@ func handleUpdateToken(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "userId and token are required", http.StatusBadRequest)
 		return
 	}
+	authenticatedDevice, err := authenticateRequest(r, req.UserID)
+	if err != nil {
+		writeAuthError(w, err)
+		return
+	}
+	if refuseSanctioned(w, req.UserID) {
+		return
+	}
+	if authenticatedDevice != "" {
+		req.DeviceID = authenticatedDevice
+	}
+	if req.DeviceID == "" {
+		req.DeviceID = legacyDeviceID(req.Token)
+	}
+
+	device := Device{
+		UserID:     req.UserID,
+		DeviceID:   req.DeviceID,
+		Platform:   req.Platform,
+		AppVersion: req.AppVersion,
+		Locale:     req.Locale,
+		PushTokens: []string{req.Token},
+	}
+	if err := validateDevice(&device); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := store.UpsertDevice(device); err != nil {
+		http.Error(w, "Failed to save token", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("[INFO] FCM token saved for device %s of user %s.", req.DeviceID, req.UserID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(SuccessResponse{Success: true})
+}
 
-	tokens, err := dbGetUserDeviceTokens(req.UserID)
+// handleRegisterDevice registers a device or refreshes its platform, app version, locale, push token and public key.
+func handleRegisterDevice(w http.ResponseWriter, r *http.Request) {
+	log.Println("[HTTP] Received request for /devices/register")
+	var req RegisterDeviceRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	device := req.Device
+	if req.PushToken != "" {
+		device.PushTokens = []string{req.PushToken}
+	}
+	if err := validateDevice(&device); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if refuseSanctioned(w, device.UserID) {
+		return
+	}
+
+	secretHash, revoked, found, err := store.GetDeviceAuth(device.UserID, device.DeviceID)
 	if err != nil {
-		http.Error(w, "Failed to retrieve tokens", http.StatusInternalServerError)
+		http.Error(w, "Failed to register device", http.StatusInternalServerError)
+		return
+	}
+	if revoked {
+		writeAuthError(w, errDeviceRevoked)
 		return
 	}
 
-	tokenExists := false
-	for _, t := range tokens {
-		if t == req.Token {
-			tokenExists = true
-			break
+	response := RegisterDeviceResponse{Success: true}
+	if found && secretHash != "" {
+		// Known device: refreshing its details requires its credentials.
+		if _, secret := deviceCredentialsFromRequest(r); !checkSecret(secretHash, secret) {
+			writeAuthError(w, errInvalidCredentials)
+			return
+		}
+		if err := store.UpsertDevice(device); err != nil {
+			http.Error(w, "Failed to register device", http.StatusInternalServerError)
+			return
+		}
+	} else {
+		// New device: it must prove it holds the account secret (first device, restored backup),
+		// unless the account has no credentials, and then it gets none either. Other devices are
+		// linked with a sync code.
+		if accountSecret := accountSecretFromRequest(r); accountSecret != "" {
+			if err := authenticateAccount(device.UserID, accountSecret); err != nil {
+				writeAuthError(w, err)
+				return
+			}
+		} else {
+			hasCredentials, err := store.UserHasCredentials(device.UserID)
+			if err != nil {
+				http.Error(w, "Failed to register device", http.StatusInternalServerError)
+				return
+			}
+			if hasCredentials {
+				http.Error(w, "New devices must be linked with a sync code or the account secret", http.StatusForbidden)
+				return
+			}
+		}
+		secret, err := linkDevice(device)
+		if err != nil {
+			writeAuthError(w, err)
+			return
+		}
+		response.DeviceSecret = secret
+	}
+	if device.PublicKey != "" {
+		changed, err := store.SetDevicePublicKey(device.UserID, device.DeviceID, device.PublicKey)
+		if err != nil {
+			http.Error(w, "Failed to register device", http.StatusInternalServerError)
+			return
+		}
+		if changed {
+			goBackground(func() { notifyDeviceKeysChanged(device.UserID) })
 		}
 	}
 
-	if !tokenExists {
-		newTokens := append(tokens, req.Token)
-		go dbSaveUserDeviceTokens(req.UserID, newTokens)
-		log.Printf("[INFO] New FCM token added for user %s.", req.UserID)
-	} else {
-		log.Printf("[INFO] Existing FCM token received for user %s", req.UserID)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+	log.Printf("[HTTP] Device %s (%s) registered for user %s", device.DeviceID, device.Platform, device.UserID)
+}
+
+// handleListDevices lists the devices of a user.
+func handleListDevices(w http.ResponseWriter, r *http.Request) {
+	log.Println("[HTTP] Received request for /devices/list")
+	userId := r.URL.Query().Get("userId")
+	if userId == "" {
+		http.Error(w, "userId is required", http.StatusBadRequest)
+		return
+	}
+	if _, err := authenticateRequest(r, userId); err != nil {
+		writeAuthError(w, err)
+		return
+	}
+
+	devices, err := store.GetUserDevices(userId)
+	if err != nil {
+		http.Error(w, "Failed to retrieve devices", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(devices)
+}
+
+// handleRenameDevice changes the display name of one of the user's devices.
+func handleRenameDevice(w http.ResponseWriter, r *http.Request) {
+	log.Println("[HTTP] Received request for /devices/rename")
+	var req Device
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := validateDevice(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Name == "" {
+		http.Error(w, "name is required", http.StatusBadRequest)
+		return
+	}
+	if _, err := authenticateRequest(r, req.UserID); err != nil {
+		writeAuthError(w, err)
+		return
+	}
+
+	found, err := store.RenameDevice(req.UserID, req.DeviceID, req.Name)
+	if err != nil {
+		http.Error(w, "Failed to rename device", http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.Error(w, "Device not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(SuccessResponse{Success: true})
+}
+
+// handleRevokeDevice signs one of the user's devices out remotely, e.g. a lost phone.
+// The request must come from another device of the same user (or the device itself).
+func handleRevokeDevice(w http.ResponseWriter, r *http.Request) {
+	log.Println("[HTTP] Received request for /devices/revoke")
+	var req RevokeDeviceRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.UserID == "" || req.DeviceID == "" {
+		http.Error(w, "userId and deviceId are required", http.StatusBadRequest)
+		return
+	}
+	callerDevice, err := authenticateRequest(r, req.UserID)
+	if err != nil {
+		writeAuthError(w, err)
+		return
+	}
+
+	revoked, err := revokeDevice(req.UserID, req.DeviceID)
+	if err == errNoCredentials {
+		writeAuthError(w, err)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to revoke device", http.StatusInternalServerError)
+		return
+	}
+	if !revoked {
+		http.Error(w, "Device not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(SuccessResponse{Success: true})
+	log.Printf("[HTTP] Device %s of user %s revoked from device '%s'", req.DeviceID, req.UserID, callerDevice)
+}
+
+// handleSyncContacts replaces the list of contacts a user declares on the server.
+// Only mutual contacts (declared on both sides) are used, e.g. to share presence.
+func handleSyncContacts(w http.ResponseWriter, r *http.Request) {
+	log.Println("[HTTP] Received request for /contacts/sync")
+	var req SyncContactsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.UserID == "" {
+		http.Error(w, "userId is required", http.StatusBadRequest)
+		return
+	}
+	if _, err := authenticateRequest(r, req.UserID); err != nil {
+		writeAuthError(w, err)
+		return
+	}
+	if refuseSanctioned(w, req.UserID) {
+		return
+	}
+
+	if err := store.ReplaceContacts(req.UserID, req.ContactIDs); err != nil {
+		http.Error(w, "Failed to save contacts", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(SuccessResponse{Success: true})
+}
+
+// handleUpdatePresenceSettings saves who can see a user's presence and last-seen timestamp.
+func handleUpdatePresenceSettings(w http.ResponseWriter, r *http.Request) {
+	log.Println("[HTTP] Received request for /users/presence-settings")
+	var req PresenceSettings
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.UserID == "" {
+		http.Error(w, "userId is required", http.StatusBadRequest)
+		return
+	}
+	if req.Visibility != presenceVisibilityNobody && req.Visibility != presenceVisibilityContacts {
+		http.Error(w, "visibility must be 'nobody' or 'contacts'", http.StatusBadRequest)
+		return
+	}
+	if _, err := authenticateRequest(r, req.UserID); err != nil {
+		writeAuthError(w, err)
+		return
+	}
+	if refuseSanctioned(w, req.UserID) {
+		return
+	}
+
+	if err := store.SavePresenceSettings(req); err != nil {
+		http.Error(w, "Failed to save presence settings", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(SuccessResponse{Success: true})
+	log.Printf("[HTTP] Presence settings updated for user %s (visibility=%s)", req.UserID, req.Visibility)
+}
+
+// handleGetPresence returns the current presence of the requested users the requester is allowed to see.
+// Users whose presence is not visible to the requester are left out of the response.
+func handleGetPresence(w http.ResponseWriter, r *http.Request) {
+	log.Println("[HTTP] Received request for /users/presence")
+	var req PresenceRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.UserID == "" {
+		http.Error(w, "userId is required", http.StatusBadRequest)
+		return
+	}
+	if _, err := authenticateRequest(r, req.UserID); err != nil {
+		writeAuthError(w, err)
+		return
+	}
+
+	contactIDs, err := store.GetMutualContacts(req.UserID)
+	if err != nil {
+		http.Error(w, "Failed to retrieve contacts", http.StatusInternalServerError)
+		return
+	}
+	isContact := make(map[string]bool, len(contactIDs))
+	for _, contactID := range contactIDs {
+		isContact[contactID] = true
+	}
+
+	settingsByUser, err := store.GetPresenceSettings(req.UserIDs)
+	if err != nil {
+		http.Error(w, "Failed to retrieve presence", http.StatusInternalServerError)
+		return
+	}
+
+	presence := make(map[string]PresenceInfo)
+	for _, targetID := range req.UserIDs {
+		settings, found := settingsByUser[targetID]
+		if !found || !presenceVisibleTo(settings, req.UserID, isContact[targetID]) {
+			continue
+		}
+		presence[targetID] = buildPresenceInfo(settings, isUserOnline(targetID))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(presence)
+}
+
+// handleCreateSchedule creates a one-shot or recurring scheduled plop.
+func handleCreateSchedule(w http.ResponseWriter, r *http.Request) {
+	log.Println("[HTTP] Received request for /schedules/create")
+	var req ScheduledPlop
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.OwnerID == "" {
+		http.Error(w, "ownerId is required", http.StatusBadRequest)
+		return
+	}
+	if _, err := authenticateRequest(r, req.OwnerID); err != nil {
+		writeAuthError(w, err)
+		return
+	}
+	if refuseSanctioned(w, req.OwnerID) {
+		return
+	}
+
+	sp, err := createScheduledPlop(req.OwnerID, req)
+	if err == errTooManySchedules {
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sp)
+}
+
+// handleListSchedules lists the scheduled plops created by a user.
+func handleListSchedules(w http.ResponseWriter, r *http.Request) {
+	log.Println("[HTTP] Received request for /schedules/list")
+	userId := r.URL.Query().Get("userId")
+	if userId == "" {
+		http.Error(w, "userId is required", http.StatusBadRequest)
+		return
+	}
+	if _, err := authenticateRequest(r, userId); err != nil {
+		writeAuthError(w, err)
+		return
+	}
+
+	schedules, err := store.GetScheduledPlopsForUser(userId)
+	if err != nil {
+		http.Error(w, "Failed to retrieve schedules", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(schedules)
+}
+
+// handleCancelSchedule deletes a scheduled plop owned by the user.
+func handleCancelSchedule(w http.ResponseWriter, r *http.Request) {
+	log.Println("[HTTP] Received request for /schedules/cancel")
+	var req CancelScheduleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.UserID == "" || req.ID == "" {
+		http.Error(w, "userId and id are required", http.StatusBadRequest)
+		return
+	}
+	if _, err := authenticateRequest(r, req.UserID); err != nil {
+		writeAuthError(w, err)
+		return
+	}
+
+	deleted, err := store.DeleteScheduledPlop(req.ID, req.UserID)
+	if err != nil {
+		http.Error(w, "Failed to cancel schedule", http.StatusInternalServerError)
+		return
+	}
+	if !deleted {
+		http.Error(w, "Schedule not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(SuccessResponse{Success: true})
+	log.Printf("[HTTP] Schedule %s cancelled by user %s", req.ID, req.UserID)
+}
+
+// handleGetVAPIDPublicKey returns the server's VAPID public key, used by browsers as applicationServerKey.
+func handleGetVAPIDPublicKey(w http.ResponseWriter, r *http.Request) {
+	log.Println("[HTTP] Received request for /webpush/vapid-public-key")
+	if vapidKey == nil {
+		http.Error(w, "Web Push is not available", http.StatusServiceUnavailable)
+		return
 	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(VAPIDPublicKeyResponse{PublicKey: vapidPublicKeyString()})
+}
 
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]bool{"success": true})
+// handleWebPushSubscribe registers a browser push subscription for one of the user's devices.
+// The subscription object is the JSON form of the browser's PushSubscription.
+func handleWebPushSubscribe(w http.ResponseWriter, r *http.Request) {
+	log.Println("[HTTP] Received request for /webpush/subscribe")
+	var req WebPushSubscribeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	sub := WebPushSubscription{
+		UserID:    req.UserID,
+		DeviceID:  req.DeviceID,
+		Endpoint:  req.Subscription.Endpoint,
+		P256dh:    req.Subscription.Keys.P256dh,
+		Auth:      req.Subscription.Keys.Auth,
+		CreatedAt: timeNow(),
+	}
+	if sub.UserID == "" || sub.Endpoint == "" || sub.P256dh == "" || sub.Auth == "" {
+		http.Error(w, "userId, subscription.endpoint and subscription.keys are required", http.StatusBadRequest)
+		return
+	}
+	if err := validateWebPushEndpoint(sub.Endpoint); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, err := authenticateRequest(r, sub.UserID); err != nil {
+		writeAuthError(w, err)
+		return
+	}
+	if refuseSanctioned(w, sub.UserID) {
+		return
+	}
+
+	if err := store.SaveWebPushSubscription(sub); err != nil {
+		http.Error(w, "Failed to save subscription", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(SuccessResponse{Success: true})
+}
+
+// handleWebPushUnsubscribe removes one of the user's browser push subscriptions.
+func handleWebPushUnsubscribe(w http.ResponseWriter, r *http.Request) {
+	log.Println("[HTTP] Received request for /webpush/unsubscribe")
+	var req EndpointRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.UserID == "" || req.Endpoint == "" {
+		http.Error(w, "userId and endpoint are required", http.StatusBadRequest)
+		return
+	}
+	if _, err := authenticateRequest(r, req.UserID); err != nil {
+		writeAuthError(w, err)
+		return
+	}
+
+	store.DeleteWebPushSubscription(req.UserID, req.Endpoint)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(SuccessResponse{Success: true})
+}
+
+// handleUnifiedPushRegister registers the UnifiedPush distributor endpoint of one of the user's devices.
+func handleUnifiedPushRegister(w http.ResponseWriter, r *http.Request) {
+	log.Println("[HTTP] Received request for /unifiedpush/register")
+	var req UnifiedPushRegisterRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.UserID == "" || req.Endpoint == "" {
+		http.Error(w, "userId and endpoint are required", http.StatusBadRequest)
+		return
+	}
+	if _, err := authenticateRequest(r, req.UserID); err != nil {
+		writeAuthError(w, err)
+		return
+	}
+	if refuseSanctioned(w, req.UserID) {
+		return
+	}
+	if err := validateUnifiedPushEndpoint(req.Endpoint); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := store.SaveUnifiedPushEndpoint(req.UserID, req.DeviceID, req.Endpoint); err != nil {
+		http.Error(w, "Failed to save endpoint", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(SuccessResponse{Success: true})
+}
+
+// handleUnifiedPushUnregister removes one of the user's UnifiedPush endpoints, e.g. when the distributor is uninstalled.
+func handleUnifiedPushUnregister(w http.ResponseWriter, r *http.Request) {
+	log.Println("[HTTP] Received request for /unifiedpush/unregister")
+	var req EndpointRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.UserID == "" || req.Endpoint == "" {
+		http.Error(w, "userId and endpoint are required", http.StatusBadRequest)
+		return
+	}
+	if _, err := authenticateRequest(r, req.UserID); err != nil {
+		writeAuthError(w, err)
+		return
+	}
+
+	store.DeleteUnifiedPushEndpoint(req.UserID, req.Endpoint)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(SuccessResponse{Success: true})
+}
+
+// handleRotateAccountSecret issues a new account secret for the same user ID, e.g. after the old one
+// leaked. The old secret stops working immediately; the user's other devices receive the new one in-band.
+func handleRotateAccountSecret(w http.ResponseWriter, r *http.Request) {
+	log.Println("[HTTP] Received request for /users/rotate-secret")
+	userId := requestUserID(r)
+	if userId == "" {
+		http.Error(w, "userId is required", http.StatusBadRequest)
+		return
+	}
+	callerDevice, err := authenticateRequest(r, userId)
+	if err != nil {
+		writeAuthError(w, err)
+		return
+	}
+
+	accountSecret, err := rotateAccountSecret(userId, callerDevice)
+	if err == errNoCredentials {
+		writeAuthError(w, err)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to rotate account secret", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(AccountSecretResponse{AccountSecret: accountSecret})
+}
+
+// handleDeleteAccount permanently deletes the calling user's account and all their data (DELETE /users/me).
+func handleDeleteAccount(w http.ResponseWriter, r *http.Request) {
+	log.Println("[HTTP] Received request for /users/me")
+	if r.Method != http.MethodDelete {
+		w.Header().Set("Allow", http.MethodDelete)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userId := requestUserID(r)
+	if userId == "" {
+		http.Error(w, "userId is required", http.StatusBadRequest)
+		return
+	}
+	if _, err := authenticateRequest(r, userId); err != nil {
+		writeAuthError(w, err)
+		return
+	}
+
+	if err := deleteAccount(userId); err != nil {
+		http.Error(w, "Failed to delete account", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(SuccessResponse{Success: true})
+	log.Printf("[HTTP] Account %s deleted at the user's request", userId)
+}
+
+// handleExportAccount returns a JSON archive of everything the server holds about the calling user.
+func handleExportAccount(w http.ResponseWriter, r *http.Request) {
+	log.Println("[HTTP] Received request for /users/me/export")
+	userId := requestUserID(r)
+	if userId == "" {
+		http.Error(w, "userId is required", http.StatusBadRequest)
+		return
+	}
+	if _, err := authenticateRequest(r, userId); err != nil {
+		writeAuthError(w, err)
+		return
+	}
+
+	export, err := exportAccount(userId, timeNow())
+	if err != nil {
+		http.Error(w, "Failed to export account", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", `attachment; filename="plop-export.json"`)
+	json.NewEncoder(w).Encode(export)
+}
+
+// handleCreateReport files an abuse report against another user for the moderators to review.
+func handleCreateReport(w http.ResponseWriter, r *http.Request) {
+	log.Println("[HTTP] Received request for /reports")
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req CreateReportRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.UserID == "" {
+		http.Error(w, "userId is required", http.StatusBadRequest)
+		return
+	}
+	if _, err := authenticateRequest(r, req.UserID); err != nil {
+		writeAuthError(w, err)
+		return
+	}
+
+	if err := validateReport(req.UserID, req.ReportedUserID, req.Reason, req.Details); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	report, err := createReport(req.UserID, req.ReportedUserID, req.Reason, req.Details, timeNow())
+	if err != nil {
+		http.Error(w, "Failed to save report", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(CreateReportResponse{ReportID: report.ID, Status: report.Status})
 }
 
 // handlePing is a simple health check endpoint.
@@ -2,6 +2,7 @@
 package main
 
 import (
+	"encoding/json"
 	"net/http"
 	"net/http/httptest"
 	"strings"
@@ -35,7 +36,16 @@ func TestHandlePing(t *testing.T) {
 }
 
 func TestHandleGenerateUserID(t *testing.T) {
-	req, err := http.NewRequest("GET", "/users/generate-id", nil)
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	setDB(db)
+
+	// Without credentials=true no account secret is issued, so that apps sending no credentials keep working.
+	req, err := http.NewRequest("POST", "/users/generate-id", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -54,6 +64,22 @@ func TestHandleGenerateUserID(t *testing.T) {
 		t.Errorf("handler returned wrong content type: got %v want %v",
 			rr.Header().Get("Content-Type"), "application/json")
 	}
+
+	var resp map[string]string
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil || resp["userId"] == "" || resp["accountSecret"] != "" {
+		t.Errorf("expected a user ID without account secret, got %s", rr.Body.String())
+	}
+
+	mock.ExpectExec("INSERT INTO account_credentials").WillReturnResult(sqlmock.NewResult(1, 1))
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("POST", "/users/generate-id?credentials=true", nil))
+	resp = nil
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil || resp["userId"] == "" || resp["accountSecret"] == "" {
+		t.Errorf("expected a user ID and its account secret, got %s", rr.Body.String())
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("the account secret hash should be stored: %s", err)
+	}
 }
 
 func TestHandleCreateInvitation(t *testing.T) {
@@ -96,12 +122,17 @@ func TestHandleUseInvitation(t *testing.T) {
 	defer db.Close()
 
 	setDB(db)
+	mock.MatchExpectationsInOrder(false) // The invitation is consumed in the background
 
 	rows := sqlmock.NewRows([]string{"code", "creator_user_id", "creator_pseudo", "expires_at"}).
 		AddRow("test-code", "creator-user-id", "creator-pseudo", time.Now().Add(10*time.Minute))
 	mock.ExpectQuery("SELECT code, creator_user_id, creator_pseudo, expires_at FROM invitations").WithArgs("test-code").WillReturnRows(rows)
 	mock.ExpectExec("DELETE FROM invitations").WithArgs("test-code").WillReturnResult(sqlmock.NewResult(1, 1))
 	mock.ExpectQuery("SELECT pseudo FROM user_pseudos").WithArgs("creator-user-id").WillReturnRows(sqlmock.NewRows([]string{"pseudo"}).AddRow("creator-pseudo"))
+	mock.ExpectQuery("SELECT device_id, public_key FROM devices").WithArgs("creator-user-id").
+		WillReturnRows(sqlmock.NewRows([]string{"device_id", "public_key"}).AddRow("creator-phone", "Y3JlYXRvcg=="))
+	mock.ExpectQuery("SELECT device_id, public_key FROM devices").WithArgs("test-user").
+		WillReturnRows(sqlmock.NewRows([]string{"device_id", "public_key"}))
 
 	body := `{"code": "test-code", "userId": "test-user", "pseudo": "test-pseudo"}`
 	req, err := http.NewRequest("POST", "/invitations/use", strings.NewReader(body))
@@ -118,4 +149,89 @@ func TestHandleUseInvitation(t *testing.T) {
 		t.Errorf("handler returned wrong status code: got %v want %v",
 			status, http.StatusOK)
 	}
+	var resp struct {
+		UserID     string      `json:"userId"`
+		DeviceKeys []DeviceKey `json:"deviceKeys"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil || len(resp.DeviceKeys) != 1 || resp.DeviceKeys[0].DeviceID != "creator-phone" {
+		t.Errorf("the creator's device keys should be returned, got %s: %v", rr.Body.String(), err)
+	}
+}
+
+func TestHandleGetPresence(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	setDB(db)
+
+	lastSeen := time.Now().Add(-time.Hour)
+	mock.ExpectQuery("SELECT EXISTS").WithArgs("viewer").WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+	mock.ExpectQuery("SELECT c.contact_id FROM contacts").WithArgs("viewer").
+		WillReturnRows(sqlmock.NewRows([]string{"contact_id"}).AddRow("friend").AddRow("shy-friend"))
+	mock.ExpectQuery("SELECT user_id, visibility, share_last_seen, hidden_from, last_seen FROM user_presence_settings").
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "visibility", "share_last_seen", "hidden_from", "last_seen"}).
+			AddRow("friend", "contacts", true, "{}", lastSeen).
+			AddRow("shy-friend", "nobody", true, "{}", lastSeen).
+			AddRow("stranger", "contacts", true, "{}", lastSeen))
+
+	body := `{"userId": "viewer", "userIds": ["friend", "shy-friend", "stranger"]}`
+	req, err := http.NewRequest("POST", "/users/presence", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(handleGetPresence).ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+
+	var presence map[string]PresenceInfo
+	if err := json.Unmarshal(rr.Body.Bytes(), &presence); err != nil {
+		t.Fatalf("could not decode response: %v", err)
+	}
+	if len(presence) != 1 {
+		t.Fatalf("expected only the visible contact in the response, got %v", presence)
+	}
+	if info, ok := presence["friend"]; !ok || info.Online || info.LastSeen == nil {
+		t.Errorf("unexpected presence for friend: %+v", info)
+	}
+}
+
+func TestHandleUpdateToken(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	setDB(db)
+
+	mock.ExpectQuery("SELECT EXISTS").WithArgs("test-user").WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+	mock.ExpectBegin()
+	mock.ExpectExec("INSERT INTO devices").WithArgs("test-user", legacyDeviceID("fcm-token"), "", "", "", "", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectQuery("SELECT device_id, push_tokens FROM devices").WithArgs("test-user", legacyDeviceID("fcm-token")).
+		WillReturnRows(sqlmock.NewRows([]string{"device_id", "push_tokens"}))
+	mock.ExpectCommit()
+
+	body := `{"userId": "test-user", "token": "fcm-token"}`
+	req, err := http.NewRequest("POST", "/users/update-token", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(handleUpdateToken).ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("token should be saved synchronously on a device: %s", err)
+	}
 }
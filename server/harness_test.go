@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+
+	"plop_server/plopclient"
+)
+
+// The harness runs the whole server in-process: the routes of newMux on an httptest server, the
+// in-memory store, a recording notifier and a clock that only moves when the test says so. Tests
+// drive it like the app would, through the generated REST client and real WebSocket connections.
+
+// frameTimeout is how long a test client waits for a frame before failing.
+const frameTimeout = 2 * time.Second
+
+// testClock is a clock that only moves when the test advances it.
+type testClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *testClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// testServer is an in-process server with its fakes.
+type testServer struct {
+	*httptest.Server
+	t        *testing.T
+	store    *memoryStore
+	notifier *recordingNotifier
+	clock    *testClock
+}
+
+// newTestServer starts a server with empty state. Everything it replaces is restored when the test
+// ends, once the connections are closed and the background tasks they started are done.
+func newTestServer(t *testing.T) *testServer {
+	s := &testServer{
+		t:        t,
+		store:    newMemoryStore(),
+		notifier: newRecordingNotifier(),
+		clock:    &testClock{now: time.Date(2025, 3, 1, 9, 0, 0, 0, time.UTC)},
+	}
+
+	previousStore, previousNow, previousLimiter, previousRecent, previousPseudoLimiter := store, timeNow, plopLimiter, recentPlops, pseudoLimiter
+	backgroundTasks.Wait()
+	store = s.store
+	useNotifier(t, s.notifier)
+	timeNow = s.clock.Now
+	plopLimiter = newPlopRateLimiter()
+	recentPlops = &recentPlopLog{pairs: make(map[string][]ReportedMessage)}
+	pseudoLimiter = &pseudoChangeLimiter{buckets: make(map[string]*tokenBucket)}
+	resetConnectionState()
+
+	s.Server = httptest.NewServer(newMux())
+	t.Cleanup(func() {
+		s.Close()
+		s.waitFor("every connection to be closed", func() bool {
+			clientsMutex.Lock()
+			defer clientsMutex.Unlock()
+			return len(clients) == 0
+		})
+		backgroundTasks.Wait() // The disconnections notify presence changes on this store
+		resetConnectionState()
+		store, timeNow, plopLimiter, recentPlops, pseudoLimiter = previousStore, previousNow, previousLimiter, previousRecent, previousPseudoLimiter
+	})
+	return s
+}
+
+// resetConnectionState forgets the connections, sync codes, link requests and sanctions kept in memory.
+func resetConnectionState() {
+	clientsMutex.Lock()
+	clients = make(map[string]map[*clientConn]*clientInfo)
+	clientsMutex.Unlock()
+	syncCodesMutex.Lock()
+	syncCodes = make(map[string]SyncCode)
+	syncCodesMutex.Unlock()
+	linkRequestsMutex.Lock()
+	linkRequests = make(map[string]*LinkRequest)
+	linkRequestsMutex.Unlock()
+	sanctionCacheMutex.Lock()
+	sanctionCache = make(map[string]cachedSanction)
+	sanctionCacheMutex.Unlock()
+}
+
+// waitFor polls until cond holds. Handlers write to the store and push in the background, so
+// their effects are awaited rather than assumed.
+func (s *testServer) waitFor(what string, cond func() bool) {
+	s.t.Helper()
+	deadline := time.Now().Add(frameTimeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			s.t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// api returns a REST client of the server without credentials.
+func (s *testServer) api() *plopclient.Client {
+	return plopclient.New(s.URL)
+}
+
+// testUser is an account created through the REST API, signed in on one device.
+type testUser struct {
+	ID, Pseudo, AccountSecret string
+	DeviceID, DeviceSecret    string
+	api                       *plopclient.Client // Authenticated with the device credentials
+}
+
+// newUser creates an account and registers its first device, with a push token if one is given.
+func (s *testServer) newUser(pseudo, pushToken string) *testUser {
+	s.t.Helper()
+	ctx := context.Background()
+	api := s.api()
+	account, err := api.GenerateUserID(ctx, plopclient.GenerateUserIDParams{Credentials: "true"})
+	if err != nil {
+		s.t.Fatalf("generate-id failed: %v", err)
+	}
+	api.Credentials = plopclient.Credentials{UserID: account.UserID, AccountSecret: account.AccountSecret}
+	if _, err := api.ChangePseudo(ctx, plopclient.ChangePseudoRequest{UserID: account.UserID, Pseudo: pseudo}); err != nil {
+		s.t.Fatalf("setting the pseudo of %s failed: %v", pseudo, err)
+	}
+	deviceID := "device-" + uuid.New().String()
+	registered, err := api.RegisterDevice(ctx, plopclient.RegisterDeviceRequest{
+		Device:    plopclient.Device{UserID: account.UserID, DeviceID: deviceID, Name: pseudo + "'s phone", Platform: "android"},
+		PushToken: pushToken,
+	})
+	if err != nil || registered.DeviceSecret == "" {
+		s.t.Fatalf("registering the device of %s failed: %+v, %v", pseudo, registered, err)
+	}
+	api.Credentials = plopclient.Credentials{UserID: account.UserID, DeviceID: deviceID, DeviceSecret: registered.DeviceSecret}
+	return &testUser{ID: account.UserID, Pseudo: pseudo, AccountSecret: account.AccountSecret, DeviceID: deviceID, DeviceSecret: registered.DeviceSecret, api: api}
+}
+
+// befriend makes two users contacts with an invitation, like two phones side by side.
+func (s *testServer) befriend(creator, guest *testUser) {
+	s.t.Helper()
+	ctx := context.Background()
+	invitation, err := creator.api.CreateInvitation(ctx, plopclient.CreateInvitationParams{UserID: creator.ID, Pseudo: creator.Pseudo})
+	if err != nil {
+		s.t.Fatalf("creating an invitation failed: %v", err)
+	}
+	s.waitFor("the invitation to be saved", func() bool {
+		_, found, _ := s.store.GetInvitation(invitation.Code)
+		return found
+	})
+	if _, err := guest.api.UseInvitation(ctx, plopclient.UseInvitationRequest{Code: invitation.Code, UserID: guest.ID, Pseudo: guest.Pseudo}); err != nil {
+		s.t.Fatalf("using the invitation failed: %v", err)
+	}
+	s.waitFor("the contacts to be saved", func() bool {
+		mutual, _ := s.store.GetMutualContacts(creator.ID)
+		return len(mutual) == 1
+	})
+}
+
+// testClient is a scripted WebSocket connection of a user.
+type testClient struct {
+	t      *testing.T
+	user   *testUser
+	conn   *websocket.Conn
+	frames chan Message
+	done   chan struct{} // Closed when the connection is closed; err then holds why
+	err    error
+}
+
+// connect opens a WebSocket connection with the user's device credentials and waits until the
+// server registered it.
+func (s *testServer) connect(u *testUser) *testClient {
+	s.t.Helper()
+	conn, err := u.api.Dial(context.Background(), "")
+	if err != nil {
+		s.t.Fatalf("connecting %s failed: %v", u.Pseudo, err)
+	}
+	c := &testClient{t: s.t, user: u, conn: conn, frames: make(chan Message, 64), done: make(chan struct{})}
+	s.t.Cleanup(func() { conn.Close() })
+	go c.read()
+	s.waitFor(u.Pseudo+" to be online", func() bool {
+		clientsMutex.Lock()
+		defer clientsMutex.Unlock()
+		for _, info := range clients[u.ID] {
+			if info.DeviceID == u.DeviceID {
+				return true
+			}
+		}
+		return false
+	})
+	return c
+}
+
+func (c *testClient) read() {
+	defer close(c.done)
+	for {
+		_, data, err := c.conn.ReadMessage()
+		if err != nil {
+			c.err = err
+			return
+		}
+		var msg Message
+		if err := json.Unmarshal(data, &msg); err != nil {
+			c.err = err
+			return
+		}
+		c.frames <- msg
+	}
+}
+
+// send writes a frame.
+func (c *testClient) send(msg Message) {
+	c.t.Helper()
+	if err := c.conn.WriteJSON(msg); err != nil {
+		c.t.Fatalf("%s could not send a %s frame: %v", c.user.Pseudo, msg.Type, err)
+	}
+}
+
+// plop sends a plop to a user and returns its ID.
+func (c *testClient) plop(to *testUser, text string, ttl int64) string {
+	c.t.Helper()
+	id := uuid.New().String()
+	c.send(Message{ID: id, Type: "plop", To: to.ID, Payload: MessagePayload{Text: text}, TTL: ttl})
+	return id
+}
+
+// expect returns the next frame, which must be of the given type.
+func (c *testClient) expect(frameType string) Message {
+	c.t.Helper()
+	select {
+	case msg := <-c.frames:
+		if msg.Type != frameType {
+			c.t.Fatalf("%s expected a %s frame, got %+v", c.user.Pseudo, frameType, msg)
+		}
+		return msg
+	case <-c.done:
+		c.t.Fatalf("%s expected a %s frame, but the connection closed: %v", c.user.Pseudo, frameType, c.err)
+	case <-time.After(frameTimeout):
+		c.t.Fatalf("%s expected a %s frame, got nothing", c.user.Pseudo, frameType)
+	}
+	return Message{}
+}
+
+// expectClosed waits until the server closes the connection with the given close code.
+func (c *testClient) expectClosed(code int) {
+	c.t.Helper()
+	select {
+	case msg := <-c.frames:
+		c.t.Fatalf("%s expected the connection to close, got %+v", c.user.Pseudo, msg)
+	case <-c.done:
+		var closeErr *websocket.CloseError
+		if !errors.As(c.err, &closeErr) || closeErr.Code != code {
+			c.t.Fatalf("%s expected close code %d, got %v", c.user.Pseudo, code, c.err)
+		}
+	case <-time.After(frameTimeout):
+		c.t.Fatalf("%s expected the connection to close", c.user.Pseudo)
+	}
+}
+
+// close disconnects the client and waits until the server noticed.
+func (c *testClient) close(s *testServer) {
+	c.t.Helper()
+	c.conn.Close()
+	s.waitFor(c.user.Pseudo+" to be offline", func() bool { return !isUserOnline(c.user.ID) })
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// --- Health Checks ---
+//
+// /healthz is the liveness probe: it answers as long as the process serves HTTP, whatever its
+// dependencies do, so that a database outage does not get every instance restarted. /readyz is
+// the readiness probe: it fails while the instance should not receive traffic, because the
+// database does not answer, the schema is not migrated, there is no push notifier or the server
+// is draining before a shutdown. Push failures only mark the notifier as degraded: they do not
+// depend on the instance, so taking it out of rotation would not help.
+
+const (
+	healthOK       = "ok"
+	healthDegraded = "degraded"
+	healthFailing  = "failing"
+
+	// readinessTimeout bounds the database check of /readyz.
+	readinessTimeout = 2 * time.Second
+	// shutdownTimeout bounds how long the HTTP requests in progress have to finish once draining is over.
+	shutdownTimeout = 10 * time.Second
+)
+
+var (
+	// schemaReady is set once the store's schema is up to date.
+	schemaReady atomic.Bool
+	// draining is set when the server received a termination signal and is about to shut down.
+	draining atomic.Bool
+	// lastReadiness is the last status returned by /readyz, so that only changes are logged.
+	lastReadiness atomic.Value
+)
+
+// pushOutcomes remembers when a push notification last succeeded and failed.
+var pushOutcomes struct {
+	sync.Mutex
+	lastSuccess time.Time
+	lastFailure time.Time
+}
+
+// recordPushOutcome records the result of sending a push notification. An unregistered token is
+// still an answer of the push service, so it counts as a success.
+func recordPushOutcome(err error) {
+	var unregistered *UnregisteredTokenError
+	pushOutcomes.Lock()
+	defer pushOutcomes.Unlock()
+	if err == nil || errors.As(err, &unregistered) {
+		pushOutcomes.lastSuccess = timeNow()
+	} else {
+		pushOutcomes.lastFailure = timeNow()
+	}
+}
+
+// handleHealthz is the liveness probe.
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, http.StatusOK, HealthResponse{Status: healthOK})
+}
+
+// handleReadyz is the readiness probe. It answers 503 when a component is failing.
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+	defer cancel()
+
+	response := HealthResponse{Status: healthOK, Components: map[string]ComponentHealth{
+		"database":   checkDatabase(ctx),
+		"migrations": timeCheck(checkMigrations),
+		"notifier":   timeCheck(checkNotifier),
+		"draining":   timeCheck(checkDraining),
+	}}
+	var failing []string
+	for name, component := range response.Components {
+		if component.Status == healthFailing {
+			failing = append(failing, name)
+		}
+	}
+	status := http.StatusOK
+	if len(failing) > 0 {
+		response.Status, status = healthFailing, http.StatusServiceUnavailable
+	}
+	if previous, _ := lastReadiness.Swap(response.Status).(string); previous != response.Status {
+		if len(failing) == 0 {
+			log.Println("[HEALTH] The server is ready.")
+		} else {
+			sort.Strings(failing)
+			log.Printf("[HEALTH] The server is not ready: %s failing.", strings.Join(failing, ", "))
+		}
+	}
+	writeHealth(w, status, response)
+}
+
+func writeHealth(w http.ResponseWriter, status int, response HealthResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response)
+}
+
+// timeCheck runs a check and records how long it took.
+func timeCheck(check func() (status, message string)) ComponentHealth {
+	start := time.Now()
+	status, message := check()
+	return ComponentHealth{Status: status, LatencyMs: float64(time.Since(start).Microseconds()) / 1000, Error: message}
+}
+
+// checkDatabase pings the store. The error is logged rather than returned: the probe is public.
+func checkDatabase(ctx context.Context) ComponentHealth {
+	return timeCheck(func() (string, string) {
+		err := store.Ping(ctx)
+		switch {
+		case err == nil:
+			return healthOK, ""
+		case ctx.Err() != nil:
+			log.Printf("[HEALTH] The database did not answer within %v: %v", readinessTimeout, err)
+			return healthFailing, "timed out"
+		default:
+			log.Printf("[HEALTH] The database ping failed: %v", err)
+			return healthFailing, "unreachable"
+		}
+	})
+}
+
+func checkMigrations() (string, string) {
+	if !schemaReady.Load() {
+		return healthFailing, "schema not migrated yet"
+	}
+	return healthOK, ""
+}
+
+func checkNotifier() (string, string) {
+	if notifier == nil {
+		return healthFailing, "no push notifier"
+	}
+	pushOutcomes.Lock()
+	defer pushOutcomes.Unlock()
+	if pushOutcomes.lastFailure.After(pushOutcomes.lastSuccess) {
+		return healthDegraded, "the last push notification failed at " + pushOutcomes.lastFailure.UTC().Format(time.RFC3339)
+	}
+	return healthOK, ""
+}
+
+func checkDraining() (string, string) {
+	if draining.Load() {
+		return healthFailing, "shutting down"
+	}
+	return healthOK, ""
+}
+
+// drainOnSignal waits for SIGTERM or SIGINT, then shuts the server down gracefully: /readyz fails
+// for DRAIN_SECONDS so that load balancers stop sending traffic, then the server stops accepting
+// requests and closes the WebSocket connections, and the apps reconnect to another instance. It
+// returns once the background tasks are done, or after shutdownTimeout.
+func drainOnSignal(server *http.Server) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	received := <-signals
+	signal.Stop(signals)
+
+	delay := time.Duration(getEnvInt("DRAIN_SECONDS", 5)) * time.Second
+	log.Printf("[INFO] Received %v: draining for %v before shutting down.", received, delay)
+	draining.Store(true)
+	time.Sleep(delay)
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("[WARN] HTTP requests still in progress at shutdown: %v", err)
+	}
+	log.Printf("[INFO] Closed %d WebSocket connections.", closeAllConnections(websocket.CloseGoingAway, "server shutting down"))
+
+	// Pending messages and push notifications of the last plops are still being saved and sent.
+	done := make(chan struct{})
+	go func() {
+		backgroundTasks.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(shutdownTimeout):
+		log.Println("[WARN] Background tasks still running at shutdown.")
+	}
+}
+
+// closeAllConnections closes every WebSocket connection with a close code and reason. It returns
+// the number of connections closed.
+func closeAllConnections(code int, reason string) int {
+	clientsMutex.Lock()
+	userIDs := make([]string, 0, len(clients))
+	for userID := range clients {
+		userIDs = append(userIDs, userID)
+	}
+	clientsMutex.Unlock()
+
+	closed := 0
+	for _, userID := range userIDs {
+		closed += closeUserConnections(userID, func(*clientInfo) bool { return true }, code, reason)
+	}
+	return closed
+}
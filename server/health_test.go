@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gorilla/websocket"
+)
+
+// useHealthState resets the state behind /readyz for a test, with the schema migrated.
+func useHealthState(t *testing.T) {
+	previousSchema, previousDraining := schemaReady.Load(), draining.Load()
+	pushOutcomes.Lock()
+	previousSuccess, previousFailure := pushOutcomes.lastSuccess, pushOutcomes.lastFailure
+	pushOutcomes.lastSuccess, pushOutcomes.lastFailure = time.Time{}, time.Time{}
+	pushOutcomes.Unlock()
+	schemaReady.Store(true)
+	draining.Store(false)
+	t.Cleanup(func() {
+		schemaReady.Store(previousSchema)
+		draining.Store(previousDraining)
+		pushOutcomes.Lock()
+		pushOutcomes.lastSuccess, pushOutcomes.lastFailure = previousSuccess, previousFailure
+		pushOutcomes.Unlock()
+	})
+}
+
+// probe calls a health endpoint and decodes its response.
+func probe(t *testing.T, handler http.HandlerFunc, target string) (int, HealthResponse) {
+	t.Helper()
+	rr := httptest.NewRecorder()
+	handler(rr, httptest.NewRequest("GET", target, nil))
+	var response HealthResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatalf("%s: invalid response %q: %v", target, rr.Body.String(), err)
+	}
+	if rr.Header().Get("Cache-Control") != "no-store" {
+		t.Errorf("%s: probes must not be cached", target)
+	}
+	return rr.Code, response
+}
+
+func TestReadiness(t *testing.T) {
+	s := newTestServer(t)
+	useHealthState(t)
+
+	if code, response := probe(t, handleHealthz, "/healthz"); code != http.StatusOK || response.Status != healthOK || response.Components != nil {
+		t.Errorf("/healthz = %d, %+v", code, response)
+	}
+	code, response := probe(t, handleReadyz, "/readyz")
+	if code != http.StatusOK || response.Status != healthOK || len(response.Components) != 4 {
+		t.Fatalf("/readyz = %d, %+v", code, response)
+	}
+	for name, component := range response.Components {
+		if component.Status != healthOK || component.Error != "" {
+			t.Errorf("component %s = %+v, want ok", name, component)
+		}
+	}
+
+	// Push failures do not depend on the instance: the notifier is degraded but the server stays ready.
+	recordPushOutcome(errors.New("quota exceeded"))
+	code, response = probe(t, handleReadyz, "/readyz")
+	if notifier := response.Components["notifier"]; code != http.StatusOK || notifier.Status != healthDegraded || !strings.Contains(notifier.Error, "2025-03-01T09:00:00Z") {
+		t.Errorf("after a push failure /readyz = %d, %+v", code, response.Components["notifier"])
+	}
+	s.clock.Advance(time.Second)
+	recordPushOutcome(&UnregisteredTokenError{Token: "stale"})
+	if _, response := probe(t, handleReadyz, "/readyz"); response.Components["notifier"].Status != healthOK {
+		t.Errorf("an answer of the push service should clear the failure, got %+v", response.Components["notifier"])
+	}
+
+	schemaReady.Store(false)
+	if code, response := probe(t, handleReadyz, "/readyz"); code != http.StatusServiceUnavailable || response.Status != healthFailing || response.Components["migrations"].Status != healthFailing {
+		t.Errorf("without a migrated schema /readyz = %d, %+v", code, response)
+	}
+	schemaReady.Store(true)
+	draining.Store(true)
+	if code, response := probe(t, handleReadyz, "/readyz"); code != http.StatusServiceUnavailable || response.Components["draining"].Status != healthFailing {
+		t.Errorf("while draining /readyz = %d, %+v", code, response)
+	}
+	if code, _ := probe(t, handleHealthz, "/healthz"); code != http.StatusOK {
+		t.Errorf("a draining server is still alive, got %d", code)
+	}
+}
+
+func TestReadinessDatabase(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.MonitorPingsOption(true))
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	setDB(db)
+	useHealthState(t)
+
+	mock.ExpectPing().WillReturnError(errors.New("dial tcp 10.0.0.5:5432: connection refused"))
+	rr := httptest.NewRecorder()
+	handleReadyz(rr, httptest.NewRequest("GET", "/readyz", nil))
+	if rr.Code != http.StatusServiceUnavailable || !strings.Contains(rr.Body.String(), `"database":{"status":"failing"`) {
+		t.Errorf("/readyz with the database down = %d, %s", rr.Code, rr.Body.String())
+	}
+	if strings.Contains(rr.Body.String(), "10.0.0.5") {
+		t.Errorf("the database error must not be exposed: %s", rr.Body.String())
+	}
+
+	mock.ExpectPing()
+	if code, response := probe(t, handleReadyz, "/readyz"); code != http.StatusOK || response.Components["database"].Status != healthOK {
+		t.Errorf("/readyz once the database is back = %d, %+v", code, response)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCloseAllConnections(t *testing.T) {
+	s := newTestServer(t)
+	alice, bob := s.newUser("Alice", ""), s.newUser("Bob", "")
+	aliceWS, bobWS := s.connect(alice), s.connect(bob)
+
+	if closed := closeAllConnections(websocket.CloseGoingAway, "server shutting down"); closed != 2 {
+		t.Errorf("closeAllConnections closed %d connections, want 2", closed)
+	}
+	aliceWS.expectClosed(websocket.CloseGoingAway)
+	bobWS.expectClosed(websocket.CloseGoingAway)
+}
@@ -0,0 +1,217 @@
+// Package openapigen reads the OpenAPI document of the server (openapi.json) and generates a Go
+// client from it. It supports the subset of OpenAPI 3.0 that the document uses.
+package openapigen
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Document is an OpenAPI 3.0 document.
+type Document struct {
+	OpenAPI    string                           `json:"openapi"`
+	Info       Info                             `json:"info"`
+	Paths      map[string]map[string]*Operation `json:"paths"`
+	Components Components                       `json:"components"`
+}
+
+// Info describes the API.
+type Info struct {
+	Title       string `json:"title"`
+	Version     string `json:"version"`
+	Description string `json:"description"`
+}
+
+// Components holds the definitions referenced from the operations.
+type Components struct {
+	Schemas         map[string]*Schema         `json:"schemas"`
+	Parameters      map[string]*Parameter      `json:"parameters"`
+	Responses       map[string]*Response       `json:"responses"`
+	SecuritySchemes map[string]*SecurityScheme `json:"securitySchemes"`
+}
+
+// SecurityScheme is an API key sent in a header.
+type SecurityScheme struct {
+	Type string `json:"type"`
+	In   string `json:"in"`
+	Name string `json:"name"`
+}
+
+// Operation is one method of a path.
+type Operation struct {
+	OperationID string                `json:"operationId"`
+	Summary     string                `json:"summary"`
+	Description string                `json:"description"`
+	WebSocket   bool                  `json:"x-websocket"` // Upgraded to a WebSocket; not part of the generated client
+	Security    []map[string][]string `json:"security"`
+	Parameters  []*Parameter          `json:"parameters"`
+	RequestBody *RequestBody          `json:"requestBody"`
+	Responses   map[string]*Response  `json:"responses"`
+}
+
+// Parameter is a query or path parameter.
+type Parameter struct {
+	Ref         string  `json:"$ref"`
+	Name        string  `json:"name"`
+	In          string  `json:"in"`
+	Description string  `json:"description"`
+	Required    bool    `json:"required"`
+	Schema      *Schema `json:"schema"`
+}
+
+// RequestBody is the body of an operation, by content type.
+type RequestBody struct {
+	Required bool                  `json:"required"`
+	Content  map[string]*MediaType `json:"content"`
+}
+
+// Response is one response of an operation, by content type.
+type Response struct {
+	Ref         string                `json:"$ref"`
+	Description string                `json:"description"`
+	Content     map[string]*MediaType `json:"content"`
+}
+
+// MediaType is the schema of a body.
+type MediaType struct {
+	Schema *Schema `json:"schema"`
+}
+
+// Schema is a JSON schema, as extended by OpenAPI 3.0.
+type Schema struct {
+	Ref                  string     `json:"$ref"`
+	Type                 string     `json:"type"`
+	Format               string     `json:"format"`
+	Description          string     `json:"description"`
+	Enum                 []string   `json:"enum"`
+	Properties           Properties `json:"properties"`
+	Required             []string   `json:"required"`
+	Items                *Schema    `json:"items"`
+	AdditionalProperties *Schema    `json:"additionalProperties"`
+	AllOf                []*Schema  `json:"allOf"`
+	OneOf                []*Schema  `json:"oneOf"`
+	Nullable             bool       `json:"nullable"`
+	ReadOnly             bool       `json:"readOnly"`
+}
+
+// Properties are the properties of an object schema, in the order of the document.
+type Properties struct {
+	Names   []string
+	Schemas map[string]*Schema
+}
+
+// UnmarshalJSON reads the properties while keeping their order.
+func (p *Properties) UnmarshalJSON(data []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return fmt.Errorf("properties must be an object")
+	}
+	p.Schemas = make(map[string]*Schema)
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		name := tok.(string)
+		var s Schema
+		if err := dec.Decode(&s); err != nil {
+			return fmt.Errorf("property %s: %v", name, err)
+		}
+		p.Names = append(p.Names, name)
+		p.Schemas[name] = &s
+	}
+	_, err := dec.Token()
+	return err
+}
+
+// IsRequired reports whether a property of an object schema is required.
+func (s *Schema) IsRequired(name string) bool {
+	for _, required := range s.Required {
+		if required == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Parse reads an OpenAPI 3.0 document.
+func Parse(data []byte) (*Document, error) {
+	var d Document
+	if err := json.Unmarshal(data, &d); err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(d.OpenAPI, "3.0.") {
+		return nil, fmt.Errorf("unsupported OpenAPI version %q", d.OpenAPI)
+	}
+	return &d, nil
+}
+
+const schemaRefPrefix = "#/components/schemas/"
+
+// SchemaName returns the name of the schema a reference points to.
+func SchemaName(ref string) string {
+	return strings.TrimPrefix(ref, schemaRefPrefix)
+}
+
+// Resolve follows a schema reference. Other schemas are returned as is.
+func (d *Document) Resolve(s *Schema) (*Schema, error) {
+	if s.Ref == "" {
+		return s, nil
+	}
+	target, found := d.Components.Schemas[SchemaName(s.Ref)]
+	if !strings.HasPrefix(s.Ref, schemaRefPrefix) || !found {
+		return nil, fmt.Errorf("unknown schema %s", s.Ref)
+	}
+	return target, nil
+}
+
+// ResolveParameter follows a parameter reference.
+func (d *Document) ResolveParameter(p *Parameter) (*Parameter, error) {
+	if p.Ref == "" {
+		return p, nil
+	}
+	target, found := d.Components.Parameters[strings.TrimPrefix(p.Ref, "#/components/parameters/")]
+	if !found {
+		return nil, fmt.Errorf("unknown parameter %s", p.Ref)
+	}
+	return target, nil
+}
+
+// ResolveResponse follows a response reference.
+func (d *Document) ResolveResponse(r *Response) (*Response, error) {
+	if r.Ref == "" {
+		return r, nil
+	}
+	target, found := d.Components.Responses[strings.TrimPrefix(r.Ref, "#/components/responses/")]
+	if !found {
+		return nil, fmt.Errorf("unknown response %s", r.Ref)
+	}
+	return target, nil
+}
+
+// Endpoint is an operation with its path and method.
+type Endpoint struct {
+	Path      string
+	Method    string // Upper case
+	Operation *Operation
+}
+
+// Endpoints lists the operations of the document, sorted by path and method.
+func (d *Document) Endpoints() []Endpoint {
+	var endpoints []Endpoint
+	for path, item := range d.Paths {
+		for method, op := range item {
+			endpoints = append(endpoints, Endpoint{Path: path, Method: strings.ToUpper(method), Operation: op})
+		}
+	}
+	sort.Slice(endpoints, func(i, j int) bool {
+		if endpoints[i].Path != endpoints[j].Path {
+			return endpoints[i].Path < endpoints[j].Path
+		}
+		return endpoints[i].Method < endpoints[j].Method
+	})
+	return endpoints
+}
@@ -0,0 +1,439 @@
+package openapigen
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// initialisms are the words written in upper case in Go names.
+var initialisms = map[string]string{
+	"api":   "API",
+	"id":    "ID",
+	"ids":   "IDs",
+	"json":  "JSON",
+	"ttl":   "TTL",
+	"url":   "URL",
+	"vapid": "VAPID",
+}
+
+// GoName turns a JSON property or operation ID into an exported Go name, e.g. "userIds" into "UserIDs".
+func GoName(name string) string {
+	var b strings.Builder
+	for _, word := range splitWords(name) {
+		if initialism, found := initialisms[strings.ToLower(word)]; found {
+			b.WriteString(initialism)
+			continue
+		}
+		runes := []rune(word)
+		b.WriteRune(unicode.ToUpper(runes[0]))
+		b.WriteString(string(runes[1:]))
+	}
+	return b.String()
+}
+
+// splitWords splits a camelCase, PascalCase or snake_case name into words.
+func splitWords(name string) []string {
+	var words []string
+	runes := []rune(name)
+	start := 0
+	for i := 0; i <= len(runes); i++ {
+		boundary := i == len(runes) || runes[i] == '_' || runes[i] == '-'
+		if !boundary && i > start && unicode.IsUpper(runes[i]) {
+			prev := runes[i-1]
+			nextIsLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			boundary = !unicode.IsUpper(prev) || nextIsLower
+			if boundary {
+				words = append(words, string(runes[start:i]))
+				start = i
+			}
+			continue
+		}
+		if boundary {
+			if i > start {
+				words = append(words, string(runes[start:i]))
+			}
+			start = i + 1
+		}
+	}
+	return words
+}
+
+// lowerFirst lowers the first letter of a sentence, to follow a Go name in a doc comment.
+func lowerFirst(s string) string {
+	runes := []rune(s)
+	if len(runes) == 0 {
+		return s
+	}
+	runes[0] = unicode.ToLower(runes[0])
+	return string(runes)
+}
+
+// generator writes the client of one document.
+type generator struct {
+	doc     *Document
+	buf     bytes.Buffer
+	imports map[string]bool
+}
+
+// Generate returns the Go source of the types and the Client methods described by doc.
+// The Client type itself, with its do and doJSON helpers, is written by hand in the same package.
+func Generate(doc *Document, pkg, source string) ([]byte, error) {
+	g := &generator{doc: doc, imports: map[string]bool{"context": true}}
+
+	var names []string
+	for name := range doc.Components.Schemas {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := g.writeType(name, doc.Components.Schemas[name]); err != nil {
+			return nil, fmt.Errorf("schema %s: %v", name, err)
+		}
+	}
+	for _, e := range doc.Endpoints() {
+		if e.Operation.WebSocket {
+			continue
+		}
+		if err := g.writeMethod(e); err != nil {
+			return nil, fmt.Errorf("%s %s: %v", e.Method, e.Path, err)
+		}
+	}
+
+	var out bytes.Buffer
+	fmt.Fprintf(&out, "// Code generated by openapigen from %s. DO NOT EDIT.\n\npackage %s\n\nimport (\n", source, pkg)
+	var imports []string
+	for imp := range g.imports {
+		imports = append(imports, imp)
+	}
+	sort.Strings(imports)
+	for _, imp := range imports {
+		fmt.Fprintf(&out, "\t%q\n", imp)
+	}
+	out.WriteString(")\n")
+	out.Write(g.buf.Bytes())
+	return format.Source(out.Bytes())
+}
+
+func (g *generator) printf(format string, args ...interface{}) {
+	fmt.Fprintf(&g.buf, format, args...)
+}
+
+// writeComment writes text as a doc comment, one sentence per line kept as is.
+func (g *generator) writeComment(indent, text string) {
+	for _, line := range strings.Split(strings.TrimSpace(text), "\n") {
+		if line == "" {
+			g.printf("%s//\n", indent)
+			continue
+		}
+		g.printf("%s// %s\n", indent, line)
+	}
+}
+
+// writeType writes the Go type of a named schema.
+func (g *generator) writeType(name string, s *Schema) error {
+	g.printf("\n")
+	if s.Description != "" {
+		g.writeComment("", name+" is "+lowerFirst(s.Description))
+	}
+	switch {
+	case len(s.Enum) > 0:
+		g.printf("type %s string\n\n// Values of %s.\nconst (\n", name, name)
+		for _, value := range s.Enum {
+			g.printf("\t%s%s %s = %q\n", name, GoName(value), name, value)
+		}
+		g.printf(")\n")
+		return nil
+	case s.Type == "object" && len(s.Properties.Names) == 0 && s.AdditionalProperties != nil:
+		valueType, err := g.goType(s.AdditionalProperties, true)
+		if err != nil {
+			return err
+		}
+		g.printf("type %s map[string]%s\n", name, valueType)
+		return nil
+	case s.Type == "object" || len(s.AllOf) > 0:
+		g.printf("type %s struct {\n", name)
+		if err := g.writeFields(s); err != nil {
+			return err
+		}
+		g.printf("}\n")
+		return nil
+	}
+	goType, err := g.goType(s, true)
+	if err != nil {
+		return err
+	}
+	g.printf("type %s %s\n", name, goType)
+	return nil
+}
+
+// writeFields writes the fields of an object schema. The references of an allOf are embedded.
+func (g *generator) writeFields(s *Schema) error {
+	for _, part := range s.AllOf {
+		if part.Ref != "" {
+			g.printf("\t%s\n", SchemaName(part.Ref))
+			continue
+		}
+		if err := g.writeFields(part); err != nil {
+			return err
+		}
+	}
+	for _, name := range s.Properties.Names {
+		prop := s.Properties.Schemas[name]
+		required := s.IsRequired(name)
+		goType, err := g.goType(prop, required)
+		if err != nil {
+			return fmt.Errorf("property %s: %v", name, err)
+		}
+		tag := name
+		if !required {
+			tag += ",omitempty"
+		}
+		g.printf("\t%s %s `json:%q`", GoName(name), goType, tag)
+		if prop.Description != "" {
+			g.printf(" // %s", strings.TrimSuffix(prop.Description, "."))
+		}
+		g.printf("\n")
+	}
+	return nil
+}
+
+// isStruct reports whether a schema is generated as a struct.
+func (g *generator) isStruct(s *Schema) (bool, error) {
+	target, err := g.doc.Resolve(s)
+	if err != nil {
+		return false, err
+	}
+	return len(target.Enum) == 0 && (len(target.AllOf) > 0 || target.Type == "object" && len(target.Properties.Names) > 0), nil
+}
+
+// goType returns the Go type of a schema. Optional and nullable structs are pointers.
+func (g *generator) goType(s *Schema, required bool) (string, error) {
+	if len(s.AllOf) == 1 && s.AllOf[0].Ref != "" && s.Type == "" {
+		inner := *s.AllOf[0]
+		inner.Nullable = s.Nullable
+		return g.goType(&inner, required)
+	}
+	if s.Ref != "" {
+		isStruct, err := g.isStruct(s)
+		if err != nil {
+			return "", err
+		}
+		if isStruct && (!required || s.Nullable) {
+			return "*" + SchemaName(s.Ref), nil
+		}
+		return SchemaName(s.Ref), nil
+	}
+	if len(s.OneOf) > 0 {
+		g.imports["encoding/json"] = true
+		return "json.RawMessage", nil
+	}
+	switch s.Type {
+	case "string":
+		switch s.Format {
+		case "date-time":
+			g.imports["time"] = true
+			if s.Nullable {
+				return "*time.Time", nil
+			}
+			return "time.Time", nil
+		case "binary":
+			return "[]byte", nil
+		}
+		return "string", nil
+	case "integer":
+		if s.Format == "int64" {
+			return "int64", nil
+		}
+		return "int", nil
+	case "number":
+		return "float64", nil
+	case "boolean":
+		return "bool", nil
+	case "array":
+		if s.Items == nil {
+			return "", fmt.Errorf("array without items")
+		}
+		item, err := g.goType(s.Items, true)
+		return "[]" + item, err
+	case "object":
+		if s.AdditionalProperties != nil && len(s.Properties.Names) == 0 {
+			value, err := g.goType(s.AdditionalProperties, true)
+			return "map[string]" + value, err
+		}
+		g.imports["encoding/json"] = true
+		return "json.RawMessage", nil
+	}
+	return "", fmt.Errorf("unsupported schema type %q", s.Type)
+}
+
+// writeMethod writes the Client method of an operation, and the type of its query parameters if any.
+func (g *generator) writeMethod(e Endpoint) error {
+	op := e.Operation
+	if op.OperationID == "" {
+		return fmt.Errorf("operationId is required")
+	}
+	name := GoName(op.OperationID)
+
+	args := []string{"ctx context.Context"}
+	path := fmt.Sprintf("%q", e.Path)
+	var query []*Parameter
+	for _, p := range op.Parameters {
+		p, err := g.doc.ResolveParameter(p)
+		if err != nil {
+			return err
+		}
+		switch p.In {
+		case "path":
+			g.imports["net/url"] = true
+			placeholder := "{" + p.Name + "}"
+			path = strings.Replace(path, placeholder, `"+url.PathEscape(`+p.Name+`)+"`, 1)
+			path = strings.TrimSuffix(path, `+""`)
+			args = append(args, p.Name+" string")
+		case "query":
+			query = append(query, p)
+		default:
+			return fmt.Errorf("unsupported parameter location %q", p.In)
+		}
+	}
+	if len(query) > 0 {
+		args = append(args, "params "+name+"Params")
+	}
+
+	bodyArg, bodyType := "nil", ""
+	if op.RequestBody != nil {
+		if media, found := op.RequestBody.Content["application/json"]; found {
+			goType, err := g.goType(media.Schema, true)
+			if err != nil {
+				return err
+			}
+			args = append(args, "body "+goType)
+			bodyArg = "body"
+		} else {
+			args = append(args, "contentType string", "body []byte")
+			bodyType = "contentType"
+		}
+	}
+
+	result, kind, err := g.result(op)
+	if err != nil {
+		return err
+	}
+
+	if len(query) > 0 {
+		g.printf("\n// %sParams are the query parameters of %s.\ntype %sParams struct {\n", name, name, name)
+		for _, p := range query {
+			g.printf("\t%s string", GoName(p.Name))
+			if p.Description != "" {
+				g.printf(" // %s", strings.TrimSuffix(p.Description, "."))
+			}
+			g.printf("\n")
+		}
+		g.printf("}\n")
+	}
+
+	g.printf("\n")
+	g.writeComment("", name+" "+lowerFirst(op.Summary))
+	g.printf("//\n// %s %s\n", e.Method, e.Path)
+	returns := "error"
+	if result != "" {
+		returns = "(" + result + ", error)"
+	}
+	g.printf("func (c *Client) %s(%s) %s {\n", name, strings.Join(args, ", "), returns)
+
+	queryArg := "nil"
+	if len(query) > 0 {
+		g.imports["net/url"] = true
+		queryArg = "query"
+		g.printf("\tquery := url.Values{}\n")
+		for _, p := range query {
+			field := "params." + GoName(p.Name)
+			if p.Required {
+				g.printf("\tquery.Set(%q, %s)\n", p.Name, field)
+			} else {
+				g.printf("\tif %s != \"\" {\n\t\tquery.Set(%q, %s)\n\t}\n", field, p.Name, field)
+			}
+		}
+	}
+
+	switch kind {
+	case resultNone:
+		g.printf("\treturn c.doJSON(ctx, %q, %s, %s, %s, nil)\n", e.Method, path, queryArg, bodyArg)
+	case resultBytes, resultText:
+		contentType, body := `""`, "nil"
+		if bodyType != "" {
+			contentType, body = "contentType", "body"
+		}
+		if kind == resultBytes {
+			g.printf("\treturn c.do(ctx, %q, %s, %s, %s, %s)\n", e.Method, path, queryArg, contentType, body)
+			break
+		}
+		g.printf("\tdata, err := c.do(ctx, %q, %s, %s, %s, %s)\n", e.Method, path, queryArg, contentType, body)
+		g.printf("\tif err != nil {\n\t\treturn \"\", err\n\t}\n")
+		g.printf("\treturn string(data), nil\n")
+	default:
+		outType, ret := strings.TrimPrefix(result, "*"), "out"
+		if kind == resultStruct {
+			ret = "&out"
+		}
+		g.printf("\tvar out %s\n", outType)
+		if bodyType != "" {
+			g.imports["encoding/json"] = true
+			g.printf("\tdata, err := c.do(ctx, %q, %s, %s, contentType, body)\n", e.Method, path, queryArg)
+			g.printf("\tif err != nil {\n\t\treturn nil, err\n\t}\n")
+			g.printf("\tif err := json.Unmarshal(data, &out); err != nil {\n\t\treturn nil, err\n\t}\n")
+		} else {
+			g.printf("\tif err := c.doJSON(ctx, %q, %s, %s, %s, &out); err != nil {\n\t\treturn nil, err\n\t}\n", e.Method, path, queryArg, bodyArg)
+		}
+		g.printf("\treturn %s, nil\n", ret)
+	}
+	g.printf("}\n")
+	return nil
+}
+
+// Kinds of results of a Client method.
+const (
+	resultNone   = iota
+	resultStruct // Returned as a pointer
+	resultValue  // Slices, maps and raw JSON
+	resultBytes
+	resultText
+)
+
+// result returns the Go type returned for the first successful response of an operation.
+func (g *generator) result(op *Operation) (string, int, error) {
+	var codes []string
+	for code := range op.Responses {
+		if strings.HasPrefix(code, "2") {
+			codes = append(codes, code)
+		}
+	}
+	if len(codes) == 0 {
+		return "", 0, fmt.Errorf("no successful response")
+	}
+	sort.Strings(codes)
+	response, err := g.doc.ResolveResponse(op.Responses[codes[0]])
+	if err != nil {
+		return "", 0, err
+	}
+	if media, found := response.Content["application/json"]; found {
+		goType, err := g.goType(media.Schema, true)
+		if err != nil {
+			return "", 0, err
+		}
+		if isStruct, _ := g.isStruct(media.Schema); isStruct && media.Schema.Ref != "" {
+			return "*" + goType, resultStruct, nil
+		}
+		return goType, resultValue, nil
+	}
+	if _, found := response.Content["text/plain"]; found {
+		return "string", resultText, nil
+	}
+	if len(response.Content) > 0 {
+		return "[]byte", resultBytes, nil
+	}
+	return "", resultNone, nil
+}
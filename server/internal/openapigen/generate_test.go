@@ -0,0 +1,92 @@
+package openapigen
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGoName(t *testing.T) {
+	cases := map[string]string{
+		"userId":                "UserID",
+		"userIds":               "UserIDs",
+		"creatorUserID":         "CreatorUserID",
+		"getOpenAPI":            "GetOpenAPI",
+		"getVapidPublicKey":     "GetVAPIDPublicKey",
+		"p256dh":                "P256dh",
+		"inappropriate_pseudo":  "InappropriatePseudo",
+		"ttlSeconds":            "TTLSeconds",
+		"ExpiresAt":             "ExpiresAt",
+		"unregisterUnifiedPush": "UnregisterUnifiedPush",
+	}
+	for in, want := range cases {
+		if got := GoName(in); got != want {
+			t.Errorf("GoName(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+const testDocument = `{
+  "openapi": "3.0.3",
+  "info": {"title": "Test", "version": "1"},
+  "paths": {
+    "/items/get": {
+      "get": {
+        "operationId": "getItem",
+        "summary": "Returns an item.",
+        "parameters": [{"name": "itemId", "in": "query", "required": true, "schema": {"type": "string"}}],
+        "responses": {"200": {"description": "The item.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Item"}}}}}
+      }
+    },
+    "/socket": {"get": {"operationId": "connect", "x-websocket": true, "responses": {"101": {"description": "Upgraded."}}}}
+  },
+  "components": {
+    "schemas": {
+      "Item": {
+        "type": "object",
+        "description": "An item.",
+        "required": ["id"],
+        "properties": {
+          "id": {"type": "string", "description": "Unique ID"},
+          "createdAt": {"type": "string", "format": "date-time"},
+          "state": {"$ref": "#/components/schemas/State"}
+        }
+      },
+      "State": {"type": "string", "description": "The state of an item.", "enum": ["new", "done"]}
+    }
+  }
+}`
+
+func TestGenerate(t *testing.T) {
+	doc, err := Parse([]byte(testDocument))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	source, err := Generate(doc, "client", "test.json")
+	if err != nil {
+		t.Fatalf("Generate failed: %v", err)
+	}
+	code := string(source)
+	for _, want := range []string{
+		"// Code generated by openapigen from test.json. DO NOT EDIT.",
+		"package client",
+		"type Item struct {",
+		"ID        string    `json:\"id\"` // Unique ID",
+		"CreatedAt time.Time `json:\"createdAt,omitempty\"`",
+		"StateDone State = \"done\"",
+		"type GetItemParams struct {",
+		"func (c *Client) GetItem(ctx context.Context, params GetItemParams) (*Item, error) {",
+	} {
+		if !strings.Contains(code, want) {
+			t.Errorf("generated code lacks %q:\n%s", want, code)
+		}
+	}
+	if strings.Contains(code, "Connect(") {
+		t.Error("WebSocket operations should not be generated")
+	}
+}
+
+func TestParseRejectsOtherVersions(t *testing.T) {
+	if _, err := Parse([]byte(`{"openapi": "3.1.0"}`)); err == nil {
+		t.Error("OpenAPI 3.1 documents should be refused")
+	}
+}
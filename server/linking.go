@@ -0,0 +1,166 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// --- Device Linking ---
+//
+// Using a sync code no longer hands over the account: it opens a link request that one of the
+// user's existing devices must approve. The new device polls /sync/status until the request is
+// approved (and receives its credentials), denied or expired.
+
+// linkRequestTimeout is how long existing devices have to answer a link request, and how long
+// the new device then has to collect the outcome.
+const linkRequestTimeout = 2 * time.Minute
+
+var (
+	errLinkRequestNotFound = errors.New("link request not found")
+	errLinkRequestResolved = errors.New("link request was already answered or expired")
+)
+
+// createLinkRequest opens a link request for a device and asks the user's connected devices to approve it.
+func createLinkRequest(device Device, now time.Time) *LinkRequest {
+	lr := &LinkRequest{
+		ID:         uuid.New().String(),
+		UserID:     device.UserID,
+		DeviceID:   device.DeviceID,
+		DeviceName: device.Name,
+		Platform:   device.Platform,
+		Status:     linkStatusPending,
+		ExpiresAt:  now.Add(linkRequestTimeout),
+		device:     device,
+	}
+
+	linkRequestsMutex.Lock()
+	linkRequests[lr.ID] = lr
+	announced := *lr
+	linkRequestsMutex.Unlock()
+
+	log.Printf("[LINK] Device %s (%s) asks to join user %s. Link request %s.", device.DeviceID, device.Platform, device.UserID, lr.ID)
+	broadcastMessageToUser(device.UserID, Message{
+		Type:    "link_request",
+		From:    "server",
+		To:      device.UserID,
+		Payload: MessagePayload{LinkRequest: &announced},
+	}, nil)
+	return lr
+}
+
+// resolveLinkRequest approves or denies a pending link request on behalf of one of the user's devices.
+// Approving registers the new device and issues its credentials.
+func resolveLinkRequest(userID, requestID string, approve bool, now time.Time) (LinkRequest, error) {
+	linkRequestsMutex.Lock()
+	lr, found := linkRequests[requestID]
+	if !found || lr.UserID != userID {
+		linkRequestsMutex.Unlock()
+		return LinkRequest{}, errLinkRequestNotFound
+	}
+	if lr.Status != linkStatusPending || now.After(lr.ExpiresAt) {
+		linkRequestsMutex.Unlock()
+		return LinkRequest{}, errLinkRequestResolved
+	}
+
+	if approve {
+		secret, err := linkDevice(lr.device)
+		if err != nil {
+			linkRequestsMutex.Unlock()
+			log.Printf("[LINK] Could not link device %s to user %s: %v", lr.DeviceID, userID, err)
+			return LinkRequest{}, err
+		}
+		lr.Status, lr.deviceSecret = linkStatusApproved, secret
+	} else {
+		lr.Status = linkStatusDenied
+	}
+	lr.ExpiresAt = now.Add(linkRequestTimeout) // Leave the new device time to collect the outcome
+	resolved := *lr
+	linkRequestsMutex.Unlock()
+
+	log.Printf("[LINK] Link request %s for device %s of user %s %s.", requestID, resolved.DeviceID, userID, resolved.Status)
+	notifyLinkRequestResolved(resolved)
+	return resolved, nil
+}
+
+// collectLinkRequest returns the state of a link request to the new device. Once the request is
+// answered or expired it is forgotten, so the device credentials are handed over only once.
+func collectLinkRequest(requestID string, now time.Time) (LinkRequest, string, bool) {
+	linkRequestsMutex.Lock()
+	defer linkRequestsMutex.Unlock()
+
+	lr, found := linkRequests[requestID]
+	if !found {
+		return LinkRequest{}, "", false
+	}
+	if lr.Status == linkStatusPending && now.After(lr.ExpiresAt) {
+		lr.Status = linkStatusExpired
+	}
+	if lr.Status != linkStatusPending {
+		delete(linkRequests, requestID)
+	}
+	return *lr, lr.deviceSecret, true
+}
+
+// expireLinkRequests expires the pending link requests nobody answered in time and forgets the
+// answered ones the new device never collected.
+func expireLinkRequests(now time.Time) {
+	var expired []LinkRequest
+	linkRequestsMutex.Lock()
+	for id, lr := range linkRequests {
+		if !now.After(lr.ExpiresAt) {
+			continue
+		}
+		if lr.Status == linkStatusPending {
+			lr.Status = linkStatusExpired
+			lr.ExpiresAt = now.Add(linkRequestTimeout)
+			expired = append(expired, *lr)
+			continue
+		}
+		delete(linkRequests, id)
+		log.Printf("[CLEANUP] Deleted link request %s (%s).", id, lr.Status)
+	}
+	linkRequestsMutex.Unlock()
+
+	for _, lr := range expired {
+		log.Printf("[LINK] Link request %s for device %s of user %s expired.", lr.ID, lr.DeviceID, lr.UserID)
+		notifyLinkRequestResolved(lr)
+	}
+}
+
+// notifyLinkRequestResolved tells the user's devices that a link request is closed, so they can dismiss the prompt.
+func notifyLinkRequestResolved(lr LinkRequest) {
+	broadcastMessageToUser(lr.UserID, Message{
+		Type:    "link_request_resolved",
+		From:    "server",
+		To:      lr.UserID,
+		Payload: MessagePayload{LinkRequest: &LinkRequest{ID: lr.ID, DeviceID: lr.DeviceID, Status: lr.Status}},
+	}, nil)
+}
+
+// handleLinkCommand processes the 'link_approve' and 'link_deny' frames sent by an existing device.
+// Success is reported to all devices through 'link_request_resolved'; failures get a 'link_error' reply.
+func handleLinkCommand(conn *clientConn, msg Message) {
+	if msg.Payload.LinkRequest == nil || msg.Payload.LinkRequest.ID == "" {
+		replyLinkError(conn, msg, "payload.linkRequest.id is required")
+		return
+	}
+	_, err := resolveLinkRequest(msg.From, msg.Payload.LinkRequest.ID, msg.Type == "link_approve", timeNow())
+	switch err {
+	case nil:
+	case errLinkRequestNotFound, errLinkRequestResolved, errDeviceRevoked:
+		replyLinkError(conn, msg, err.Error())
+	default:
+		replyLinkError(conn, msg, "failed to link the device")
+	}
+}
+
+// replyLinkError answers a link command that could not be applied.
+func replyLinkError(conn *clientConn, msg Message, text string) {
+	reply := Message{ID: msg.ID, Type: "link_error", From: "server", To: msg.From, Payload: MessagePayload{Text: text, LinkRequest: msg.Payload.LinkRequest}}
+	if err := conn.WriteJSON(reply); err != nil {
+		log.Printf("[ERROR] Failed to send 'link_error' to userId=%s: %v", msg.From, err)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestHandleUseSyncCodeWaitsForApproval(t *testing.T) {
+	syncCodesMutex.Lock()
+	syncCodes["ABC123"] = SyncCode{Code: "ABC123", UserID: "alice", ExpiresAt: time.Now().Add(time.Minute)}
+	syncCodesMutex.Unlock()
+
+	body := `{"code": "ABC123", "deviceId": "new-tablet", "name": "Tablet", "platform": "Android"}`
+	req := httptest.NewRequest("POST", "/sync/use", strings.NewReader(body))
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(handleUseSyncCode).ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusAccepted)
+	}
+	var resp map[string]interface{}
+	json.Unmarshal(rr.Body.Bytes(), &resp)
+	if resp["status"] != linkStatusPending || resp["userId"] != nil {
+		t.Fatalf("the account must not be handed over before approval, got %v", resp)
+	}
+	requestID, _ := resp["requestId"].(string)
+	defer func() {
+		linkRequestsMutex.Lock()
+		delete(linkRequests, requestID)
+		linkRequestsMutex.Unlock()
+	}()
+
+	lr, _, found := collectLinkRequest(requestID, time.Now())
+	if !found || lr.Status != linkStatusPending || lr.DeviceName != "Tablet" || lr.Platform != "android" {
+		t.Errorf("unexpected link request: %+v", lr)
+	}
+}
+
+func TestResolveLinkRequest(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	setDB(db)
+
+	now := time.Now()
+	approved := createLinkRequest(Device{UserID: "alice", DeviceID: "new-tablet", Platform: "android"}, now)
+	denied := createLinkRequest(Device{UserID: "alice", DeviceID: "stranger"}, now)
+
+	mock.ExpectQuery("SELECT secret_hash").WithArgs("alice", "new-tablet").WillReturnRows(sqlmock.NewRows([]string{"secret_hash", "revoked"}))
+	mock.ExpectQuery("SELECT EXISTS").WithArgs("alice").WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+	mock.ExpectBegin()
+	mock.ExpectExec("INSERT INTO devices").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	mock.ExpectExec("UPDATE devices SET secret_hash").WithArgs("alice", "new-tablet", sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+
+	if _, err := resolveLinkRequest("mallory", approved.ID, true, now); err != errLinkRequestNotFound {
+		t.Errorf("another user must not answer the request, got %v", err)
+	}
+	if _, err := resolveLinkRequest("alice", approved.ID, true, now); err != nil {
+		t.Fatalf("approve failed: %v", err)
+	}
+	if _, err := resolveLinkRequest("alice", approved.ID, false, now); err != errLinkRequestResolved {
+		t.Errorf("an answered request cannot be answered again, got %v", err)
+	}
+	if _, err := resolveLinkRequest("alice", denied.ID, false, now); err != nil {
+		t.Fatalf("deny failed: %v", err)
+	}
+
+	lr, secret, found := collectLinkRequest(approved.ID, now)
+	if !found || lr.Status != linkStatusApproved || secret == "" {
+		t.Errorf("approved request should hand over credentials, got %+v (secret %q)", lr, secret)
+	}
+	if _, _, found := collectLinkRequest(approved.ID, now); found {
+		t.Error("credentials must only be collected once")
+	}
+	if lr, secret, _ := collectLinkRequest(denied.ID, now); lr.Status != linkStatusDenied || secret != "" {
+		t.Errorf("denied request: got %+v (secret %q)", lr, secret)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestExpireLinkRequests(t *testing.T) {
+	now := time.Now()
+	lr := createLinkRequest(Device{UserID: "alice", DeviceID: "slow-phone"}, now)
+
+	expireLinkRequests(now.Add(linkRequestTimeout + time.Second))
+	if _, err := resolveLinkRequest("alice", lr.ID, true, now.Add(linkRequestTimeout+2*time.Second)); err != errLinkRequestResolved {
+		t.Errorf("an expired request cannot be approved, got %v", err)
+	}
+	if got, _, found := collectLinkRequest(lr.ID, now.Add(linkRequestTimeout+2*time.Second)); !found || got.Status != linkStatusExpired {
+		t.Errorf("new device should learn the request expired, got %+v", got)
+	}
+}
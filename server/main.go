@@ -3,46 +3,110 @@ package main
 import (
 	"log"
 	"net/http"
+	"os"
 
 	"github.com/rs/cors"
 )
 
+// routes are the public HTTP endpoints. Each of them is documented in openapi.json.
+var routes = []struct {
+	pattern string
+	handler http.HandlerFunc
+}{
+	{"/connect", handleWebSocket},
+	{"/invitations/create", handleCreateInvitation},
+	{"/invitations/use", handleUseInvitation},
+	{"/users/generate-id", handleGenerateUserID},
+	{"/users/get-pseudos", handleGetPseudos},
+	{"/users/pseudo", handleChangePseudo},
+	{"/users/avatar", handleAvatar},
+	{"/users/keys", handleGetDeviceKeys},
+	{"/avatars/", handleGetAvatar},
+	{"/sync/create", handleCreateSyncCode},
+	{"/sync/use", handleUseSyncCode},
+	{"/sync/status", handleSyncStatus},
+	{"/users/update-token", handleUpdateToken},
+	{"/devices/register", handleRegisterDevice},
+	{"/devices/list", handleListDevices},
+	{"/devices/rename", handleRenameDevice},
+	{"/devices/revoke", handleRevokeDevice},
+	{"/users/presence", handleGetPresence},
+	{"/users/presence-settings", handleUpdatePresenceSettings},
+	{"/contacts/sync", handleSyncContacts},
+	{"/schedules/create", handleCreateSchedule},
+	{"/schedules/list", handleListSchedules},
+	{"/schedules/cancel", handleCancelSchedule},
+	{"/webpush/vapid-public-key", handleGetVAPIDPublicKey},
+	{"/webpush/subscribe", handleWebPushSubscribe},
+	{"/webpush/unsubscribe", handleWebPushUnsubscribe},
+	{"/unifiedpush/register", handleUnifiedPushRegister},
+	{"/unifiedpush/unregister", handleUnifiedPushUnregister},
+	{"/users/rotate-secret", handleRotateAccountSecret},
+	{"/users/me", handleDeleteAccount},
+	{"/users/me/export", handleExportAccount},
+	{"/reports", handleCreateReport},
+	{"/openapi.json", handleOpenAPI},
+	{"/ping", handlePing},
+	{"/healthz", handleHealthz},
+	{"/readyz", handleReadyz},
+}
+
+// newMux returns a ServeMux serving all the routes.
+func newMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	for _, route := range routes {
+		mux.HandleFunc(route.pattern, route.handler)
+	}
+	return mux
+}
+
 // main is the entry point of the application.
-// It initializes services, sets up routes, and starts the server.
+// It initializes services, sets up routes, and starts the server. With arguments, it runs an admin command instead.
 func main() {
+	if len(os.Args) > 1 {
+		os.Exit(runAdminCLI(os.Args[1:]))
+	}
+
 	log.Println("[INFO] Starting server...")
 
 	// Initialize external services and database connection
-	initializeFirebase()
-	initDB() // Initializes connection to PostgreSQL
+	initializeNotifier()
+	initializeDataEncryption()
+	initializeStore() // PostgreSQL unless STORE=memory
+	initializeWebPush()
+	initializeBlobStore()
+	loadActiveSanctions()
 
 	// Start background cleanup routines
 	go cleanupExpiredInvitations()
 	go cleanupExpiredSyncCodes()
+	go cleanupExpiredPendingMessages()
+	go cleanupIdleRateLimiters()
+	go cleanupModerationState()
+	go runScheduledPlops()
+	go serveAdminAPI()
 
-	// Create a new ServeMux to register our handlers
-	mux := http.NewServeMux()
-
-	// Register all HTTP handlers
-	mux.HandleFunc("/connect", handleWebSocket)
-	mux.HandleFunc("/invitations/create", handleCreateInvitation)
-	mux.HandleFunc("/invitations/use", handleUseInvitation)
-	mux.HandleFunc("/users/generate-id", handleGenerateUserID)
-	mux.HandleFunc("/users/get-pseudos", handleGetPseudos)
-	mux.HandleFunc("/sync/create", handleCreateSyncCode)
-	mux.HandleFunc("/sync/use", handleUseSyncCode)
-	mux.HandleFunc("/users/update-token", handleUpdateToken)
-	mux.HandleFunc("/ping", handlePing)
+	// Create a new ServeMux with all our handlers
+	mux := newMux()
 
 	// Configure CORS for cross-origin requests
 	handler := cors.New(cors.Options{
 		AllowedOrigins: []string{"*"},
-		AllowedMethods: []string{"GET", "POST", "OPTIONS"},
-		AllowedHeaders: []string{"Content-Type"},
+		AllowedMethods: []string{"GET", "POST", "DELETE", "OPTIONS"},
+		AllowedHeaders: []string{"Content-Type", "X-User-Id", "X-Device-Id", "X-Device-Secret", "X-Account-Secret"},
 	}).Handler(mux)
 
+	server := &http.Server{Addr: ":8080", Handler: handler}
+	stopped := make(chan struct{})
+	go func() {
+		drainOnSignal(server)
+		close(stopped)
+	}()
+
 	log.Println("[INFO] Server started on http://localhost:8080")
-	if err := http.ListenAndServe(":8080", handler); err != nil {
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
 		log.Fatal("[FATAL] ListenAndServe: ", err)
 	}
+	<-stopped
+	log.Println("[INFO] Server stopped.")
 }
@@ -0,0 +1,1013 @@
+package main
+
+import (
+	"context"
+	"log"
+	"maps"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// memoryStore is a Store that keeps everything in process memory, behind a single lock. It follows
+// the semantics of postgresStore (uniqueness, revocation, expiries read from timeNow) so that the
+// handlers behave the same on both. Nothing is encrypted, since nothing is written anywhere.
+type memoryStore struct {
+	mu sync.Mutex
+
+	pseudos        map[string]memoryPseudo             // By user ID
+	avatars        map[string]map[int]string           // By user ID, then size
+	devices        map[string]map[string]*memoryDevice // By user ID, then device ID
+	accountSecrets map[string]string                   // Secret hash by user ID
+	invitations    map[string]Invitation               // By code
+	contacts       map[string]map[string]bool          // Contacts declared by each user
+	pending        map[pendingKey]memoryPending
+	presence       map[string]PresenceSettings
+	schedules      map[string]ScheduledPlop // By ID
+	vapidKey       string
+	webPush        map[string]WebPushSubscription // By endpoint
+	unifiedPush    map[string]memoryEndpoint      // By endpoint
+	bans           map[string]UserBan
+	reports        map[string]Report
+}
+
+type memoryPseudo struct {
+	pseudo, key string
+}
+
+type memoryDevice struct {
+	Device
+	secretHash string
+	revoked    bool
+}
+
+// pendingKey is the primary key of a pending message: one per recipient, sender and type.
+type pendingKey struct {
+	to, from, messageType string
+}
+
+type memoryPending struct {
+	msg       Message
+	expiresAt time.Time // Zero when the message never expires
+}
+
+type memoryEndpoint struct {
+	userID, deviceID string
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		pseudos:        make(map[string]memoryPseudo),
+		avatars:        make(map[string]map[int]string),
+		devices:        make(map[string]map[string]*memoryDevice),
+		accountSecrets: make(map[string]string),
+		invitations:    make(map[string]Invitation),
+		contacts:       make(map[string]map[string]bool),
+		pending:        make(map[pendingKey]memoryPending),
+		presence:       make(map[string]PresenceSettings),
+		schedules:      make(map[string]ScheduledPlop),
+		webPush:        make(map[string]WebPushSubscription),
+		unifiedPush:    make(map[string]memoryEndpoint),
+		bans:           make(map[string]UserBan),
+		reports:        make(map[string]Report),
+	}
+}
+
+// --- Users, pseudos and avatars ---
+
+func (s *memoryStore) GetUserPseudo(userID string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.pseudos[userID].pseudo, nil
+}
+
+func (s *memoryStore) GetUsersPseudos(userIDs []string) (map[string]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pseudos := make(map[string]string)
+	for _, userID := range userIDs {
+		if p, ok := s.pseudos[userID]; ok {
+			pseudos[userID] = p.pseudo
+		}
+	}
+	return pseudos, nil
+}
+
+func (s *memoryStore) SetUserPseudo(userID, pseudo, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for otherID, p := range s.pseudos {
+		if otherID != userID && p.key == key {
+			return errPseudoTaken
+		}
+	}
+	s.pseudos[userID] = memoryPseudo{pseudo: pseudo, key: key}
+	return nil
+}
+
+func (s *memoryStore) GetUserAvatar(userID string) (map[int]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return maps.Clone(s.avatars[userID]), nil
+}
+
+func (s *memoryStore) GetUsersAvatars(userIDs []string) (map[string]map[int]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	avatars := make(map[string]map[int]string)
+	for _, userID := range userIDs {
+		if hashes, ok := s.avatars[userID]; ok {
+			avatars[userID] = maps.Clone(hashes)
+		}
+	}
+	return avatars, nil
+}
+
+func (s *memoryStore) SetUserAvatar(userID string, hashes map[int]string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(hashes) == 0 {
+		delete(s.avatars, userID)
+	} else {
+		s.avatars[userID] = maps.Clone(hashes)
+	}
+	return nil
+}
+
+func (s *memoryStore) DeleteUserAvatar(userID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.avatars, userID)
+	return nil
+}
+
+func (s *memoryStore) AvatarHashInUse(hash string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, hashes := range s.avatars {
+		for _, h := range hashes {
+			if h == hash {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// DeleteUserData mirrors userDataDeletions.
+func (s *memoryStore) DeleteUserData(userID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key := range s.pending {
+		if key.to == userID || key.from == userID {
+			delete(s.pending, key)
+		}
+	}
+	delete(s.devices, userID)
+	delete(s.pseudos, userID)
+	for code, inv := range s.invitations {
+		if inv.CreatorUserID == userID {
+			delete(s.invitations, code)
+		}
+	}
+	delete(s.contacts, userID)
+	for _, contacts := range s.contacts {
+		delete(contacts, userID)
+	}
+	delete(s.presence, userID)
+	for id, ps := range s.presence {
+		ps.HiddenFrom = slices.DeleteFunc(slices.Clone(ps.HiddenFrom), func(hidden string) bool { return hidden == userID })
+		s.presence[id] = ps
+	}
+	for id, sp := range s.schedules {
+		if sp.OwnerID == userID || slices.Equal(sp.RecipientIDs, []string{userID}) {
+			delete(s.schedules, id)
+			continue
+		}
+		sp.RecipientIDs = slices.DeleteFunc(slices.Clone(sp.RecipientIDs), func(recipient string) bool { return recipient == userID })
+		s.schedules[id] = sp
+	}
+	for endpoint, sub := range s.webPush {
+		if sub.UserID == userID {
+			delete(s.webPush, endpoint)
+		}
+	}
+	for endpoint, e := range s.unifiedPush {
+		if e.userID == userID {
+			delete(s.unifiedPush, endpoint)
+		}
+	}
+	delete(s.accountSecrets, userID)
+	delete(s.avatars, userID)
+	for id, r := range s.reports {
+		if r.ReporterID == userID {
+			delete(s.reports, id)
+		}
+	}
+	return nil
+}
+
+// --- Devices and credentials ---
+
+// activeDevice returns a device that was not revoked, or nil. The caller holds s.mu.
+func (s *memoryStore) activeDevice(userID, deviceID string) *memoryDevice {
+	if d := s.devices[userID][deviceID]; d != nil && !d.revoked {
+		return d
+	}
+	return nil
+}
+
+// copyDevice returns a device that does not share its push tokens with the store.
+func copyDevice(d *memoryDevice) Device {
+	device := d.Device
+	device.PushTokens = slices.Clone(d.PushTokens)
+	if device.PushTokens == nil {
+		device.PushTokens = []string{}
+	}
+	return device
+}
+
+func (s *memoryStore) GetUserDevices(userID string) ([]Device, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	devices := []Device{}
+	for _, d := range s.devices[userID] {
+		if !d.revoked {
+			devices = append(devices, copyDevice(d))
+		}
+	}
+	sort.Slice(devices, func(i, j int) bool { return devices[i].LastSeenAt.After(devices[j].LastSeenAt) })
+	return devices, nil
+}
+
+func (s *memoryStore) GetUserDeviceTokens(userID string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tokens := []string{}
+	for _, d := range s.devices[userID] {
+		if !d.revoked {
+			tokens = append(tokens, d.PushTokens...)
+		}
+	}
+	return tokens, nil
+}
+
+// UpsertDevice follows postgresStore.UpsertDevice: empty fields keep their value, revoked devices
+// stay untouched and push tokens move away from the user's other devices.
+func (s *memoryStore) UpsertDevice(d Device) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := timeNow()
+	if s.devices[d.UserID] == nil {
+		s.devices[d.UserID] = make(map[string]*memoryDevice)
+	}
+	existing := s.devices[d.UserID][d.DeviceID]
+	switch {
+	case existing == nil:
+		device := &memoryDevice{Device: d}
+		if device.Platform == "" {
+			device.Platform = "other"
+		}
+		device.PublicKey = ""
+		device.PushTokens = slices.Clone(d.PushTokens)
+		device.CreatedAt, device.LastSeenAt = now, now
+		s.devices[d.UserID][d.DeviceID] = device
+	case existing.revoked:
+		return nil
+	default:
+		for _, field := range []struct {
+			stored *string
+			value  string
+		}{
+			{&existing.Name, d.Name}, {&existing.Platform, d.Platform}, {&existing.AppVersion, d.AppVersion}, {&existing.Locale, d.Locale},
+		} {
+			if field.value != "" {
+				*field.stored = field.value
+			}
+		}
+		if len(d.PushTokens) > 0 {
+			existing.PushTokens = slices.Clone(d.PushTokens)
+		}
+		existing.LastSeenAt = now
+	}
+	if len(d.PushTokens) > 0 {
+		s.removePushTokens(d.UserID, d.DeviceID, d.PushTokens)
+	}
+	return nil
+}
+
+// removePushTokens removes tokens from the devices of a user other than exceptDeviceID. The caller holds s.mu.
+func (s *memoryStore) removePushTokens(userID, exceptDeviceID string, tokens []string) {
+	for deviceID, d := range s.devices[userID] {
+		if deviceID != exceptDeviceID {
+			d.PushTokens = slices.DeleteFunc(d.PushTokens, func(token string) bool { return slices.Contains(tokens, token) })
+		}
+	}
+}
+
+func (s *memoryStore) RenameDevice(userID, deviceID, name string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d := s.activeDevice(userID, deviceID)
+	if d == nil {
+		return false, nil
+	}
+	d.Name = name
+	return true, nil
+}
+
+func (s *memoryStore) TouchDevice(userID, deviceID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if d := s.devices[userID][deviceID]; d != nil {
+		d.LastSeenAt = timeNow()
+	}
+}
+
+func (s *memoryStore) RevokeDevice(userID, deviceID string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d := s.activeDevice(userID, deviceID)
+	if d == nil {
+		return false, nil
+	}
+	d.revoked, d.secretHash, d.PushTokens = true, "", nil
+	for endpoint, sub := range s.webPush {
+		if sub.UserID == userID && sub.DeviceID == deviceID {
+			delete(s.webPush, endpoint)
+		}
+	}
+	for endpoint, e := range s.unifiedPush {
+		if e.userID == userID && e.deviceID == deviceID {
+			delete(s.unifiedPush, endpoint)
+		}
+	}
+	return true, nil
+}
+
+func (s *memoryStore) RemoveDevicePushTokens(userID string, tokens []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.removePushTokens(userID, "", tokens)
+	return nil
+}
+
+func (s *memoryStore) SetDevicePublicKey(userID, deviceID, publicKey string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d := s.activeDevice(userID, deviceID)
+	if d == nil || d.PublicKey == publicKey {
+		return false, nil
+	}
+	d.PublicKey = publicKey
+	return true, nil
+}
+
+func (s *memoryStore) GetDeviceKeys(userID string) ([]DeviceKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := []DeviceKey{}
+	for _, d := range s.devices[userID] {
+		if !d.revoked && d.PublicKey != "" {
+			keys = append(keys, DeviceKey{DeviceID: d.DeviceID, PublicKey: d.PublicKey})
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].DeviceID < keys[j].DeviceID })
+	return keys, nil
+}
+
+func (s *memoryStore) GetDeviceAuth(userID, deviceID string) (secretHash string, revoked bool, found bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d := s.devices[userID][deviceID]
+	if d == nil {
+		return "", false, false, nil
+	}
+	return d.secretHash, d.revoked, true, nil
+}
+
+func (s *memoryStore) SetDeviceSecretHash(userID, deviceID, secretHash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d := s.activeDevice(userID, deviceID)
+	if d == nil {
+		return errDeviceNotFound
+	}
+	d.secretHash = secretHash
+	return nil
+}
+
+func (s *memoryStore) UserHasCredentials(userID string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.accountSecrets[userID]; ok {
+		return true, nil
+	}
+	for _, d := range s.devices[userID] {
+		if d.revoked || d.secretHash != "" {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *memoryStore) GetAccountSecretHash(userID string) (string, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	secretHash, ok := s.accountSecrets[userID]
+	return secretHash, ok, nil
+}
+
+func (s *memoryStore) SetAccountSecretHash(userID, secretHash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.accountSecrets[userID] = secretHash
+	return nil
+}
+
+// --- Invitations and contacts ---
+
+func (s *memoryStore) SaveInvitation(inv Invitation) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exists := s.invitations[inv.Code]; exists {
+		log.Printf("[ERROR] Failed to save invitation %s: the code is already in use", inv.Code)
+		return
+	}
+	s.invitations[inv.Code] = inv
+}
+
+func (s *memoryStore) GetInvitation(code string) (Invitation, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	inv, ok := s.invitations[code]
+	return inv, ok, nil
+}
+
+// sortedInvitations returns the invitations matching keep, soonest expiry first. The caller holds s.mu.
+func (s *memoryStore) sortedInvitations(keep func(Invitation) bool) []Invitation {
+	invitations := []Invitation{}
+	for _, inv := range s.invitations {
+		if keep(inv) {
+			invitations = append(invitations, inv)
+		}
+	}
+	sort.Slice(invitations, func(i, j int) bool { return invitations[i].ExpiresAt.Before(invitations[j].ExpiresAt) })
+	return invitations
+}
+
+func (s *memoryStore) GetInvitationsByCreator(userID string) ([]Invitation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sortedInvitations(func(inv Invitation) bool { return inv.CreatorUserID == userID }), nil
+}
+
+func (s *memoryStore) DeleteInvitation(code string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.invitations, code)
+}
+
+func (s *memoryStore) DeleteExpiredInvitations() {
+	s.PurgeInvitations(false)
+}
+
+// addContact records that userID declared contactID. The caller holds s.mu.
+func (s *memoryStore) addContact(userID, contactID string) {
+	if s.contacts[userID] == nil {
+		s.contacts[userID] = make(map[string]bool)
+	}
+	s.contacts[userID][contactID] = true
+}
+
+func (s *memoryStore) SaveContactPair(userA, userB string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.addContact(userA, userB)
+	s.addContact(userB, userA)
+}
+
+func (s *memoryStore) ReplaceContacts(userID string, contactIDs []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.contacts, userID)
+	for _, contactID := range contactIDs {
+		s.addContact(userID, contactID)
+	}
+	return nil
+}
+
+func (s *memoryStore) GetContactIDs(userID string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	contactIDs := slices.Collect(maps.Keys(s.contacts[userID]))
+	for otherID, contacts := range s.contacts {
+		if contacts[userID] && !s.contacts[userID][otherID] {
+			contactIDs = append(contactIDs, otherID)
+		}
+	}
+	slices.Sort(contactIDs)
+	if contactIDs == nil {
+		contactIDs = []string{}
+	}
+	return contactIDs, nil
+}
+
+func (s *memoryStore) GetMutualContacts(userID string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	contactIDs := []string{}
+	for contactID := range s.contacts[userID] {
+		if s.contacts[contactID][userID] {
+			contactIDs = append(contactIDs, contactID)
+		}
+	}
+	slices.Sort(contactIDs)
+	return contactIDs, nil
+}
+
+// --- Pending messages ---
+
+func (s *memoryStore) SavePendingMessage(msg Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pending := memoryPending{msg: msg}
+	pending.msg.SourceConn = nil
+	if ttl := messageTTL(msg); ttl > 0 {
+		pending.expiresAt = timeNow().Add(ttl)
+	}
+	s.pending[pendingKey{msg.To, msg.From, msg.Type}] = pending
+}
+
+// pendingMessages returns the pending messages matching keep, as read back from the database. The caller holds s.mu.
+func (s *memoryStore) pendingMessages(keep func(pendingKey, memoryPending) bool) []Message {
+	var messages []Message
+	for key, pending := range s.pending {
+		if keep(key, pending) {
+			messages = append(messages, Message{ID: pending.msg.ID, Type: key.messageType, From: key.from, To: key.to, Payload: pending.msg.Payload, IsPending: true})
+		}
+	}
+	sort.Slice(messages, func(i, j int) bool {
+		if messages[i].To != messages[j].To {
+			return messages[i].To < messages[j].To
+		}
+		return messages[i].From+"\x00"+messages[i].Type < messages[j].From+"\x00"+messages[j].Type
+	})
+	return messages
+}
+
+func (s *memoryStore) GetPendingMessages(userID string) ([]Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := timeNow()
+	return s.pendingMessages(func(key pendingKey, pending memoryPending) bool {
+		return key.to == userID && (pending.expiresAt.IsZero() || pending.expiresAt.After(now))
+	}), nil
+}
+
+func (s *memoryStore) GetPendingMessagesInvolving(userID string) ([]Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	messages := s.pendingMessages(func(key pendingKey, _ memoryPending) bool { return key.to == userID || key.from == userID })
+	if messages == nil {
+		messages = []Message{}
+	}
+	return messages, nil
+}
+
+func (s *memoryStore) DeletePendingMessagesForUser(userID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key := range s.pending {
+		if key.to == userID {
+			delete(s.pending, key)
+		}
+	}
+}
+
+func (s *memoryStore) DeleteExpiredPendingMessages() ([]Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := timeNow()
+	expired := s.pendingMessages(func(_ pendingKey, pending memoryPending) bool {
+		return !pending.expiresAt.IsZero() && pending.expiresAt.Before(now)
+	})
+	for _, msg := range expired {
+		delete(s.pending, pendingKey{msg.To, msg.From, msg.Type})
+	}
+	return expired, nil
+}
+
+// --- Presence ---
+
+func (s *memoryStore) GetPresenceSettings(userIDs []string) (map[string]PresenceSettings, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	settings := make(map[string]PresenceSettings)
+	for _, userID := range userIDs {
+		if ps, ok := s.presence[userID]; ok {
+			ps.HiddenFrom = append([]string{}, ps.HiddenFrom...)
+			settings[userID] = ps
+		}
+	}
+	return settings, nil
+}
+
+func (s *memoryStore) SavePresenceSettings(ps PresenceSettings) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ps.HiddenFrom = slices.Clone(ps.HiddenFrom)
+	ps.LastSeen = s.presence[ps.UserID].LastSeen
+	s.presence[ps.UserID] = ps
+	return nil
+}
+
+func (s *memoryStore) UpdateLastSeen(userID string, lastSeen time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ps, ok := s.presence[userID]
+	if !ok {
+		ps = PresenceSettings{UserID: userID, Visibility: presenceVisibilityNobody}
+	}
+	ps.LastSeen = &lastSeen
+	s.presence[userID] = ps
+}
+
+// --- Scheduled plops ---
+
+func (s *memoryStore) SaveScheduledPlop(sp ScheduledPlop) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sp.RecipientIDs = slices.Clone(sp.RecipientIDs)
+	s.schedules[sp.ID] = sp
+	return nil
+}
+
+// sortedSchedules returns the schedules matching keep, soonest first. The caller holds s.mu.
+func (s *memoryStore) sortedSchedules(keep func(ScheduledPlop) bool) []ScheduledPlop {
+	schedules := []ScheduledPlop{}
+	for _, sp := range s.schedules {
+		if keep(sp) {
+			sp.RecipientIDs = slices.Clone(sp.RecipientIDs)
+			schedules = append(schedules, sp)
+		}
+	}
+	sort.Slice(schedules, func(i, j int) bool { return schedules[i].NextFireAt.Before(schedules[j].NextFireAt) })
+	return schedules
+}
+
+func (s *memoryStore) GetScheduledPlopsForUser(ownerID string) ([]ScheduledPlop, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sortedSchedules(func(sp ScheduledPlop) bool { return sp.OwnerID == ownerID }), nil
+}
+
+func (s *memoryStore) CountScheduledPlopsForUser(ownerID string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	count := 0
+	for _, sp := range s.schedules {
+		if sp.OwnerID == ownerID {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (s *memoryStore) DeleteScheduledPlop(id, ownerID string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if sp, ok := s.schedules[id]; !ok || sp.OwnerID != ownerID {
+		return false, nil
+	}
+	delete(s.schedules, id)
+	return true, nil
+}
+
+func (s *memoryStore) ClaimDueScheduledPlops(now time.Time, reschedule func(ScheduledPlop) time.Time) ([]ScheduledPlop, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	due := s.sortedSchedules(func(sp ScheduledPlop) bool { return !sp.NextFireAt.After(now) })
+	if len(due) > 100 {
+		due = due[:100]
+	}
+	for _, sp := range due {
+		if next := reschedule(sp); next.IsZero() {
+			delete(s.schedules, sp.ID)
+		} else {
+			stored := s.schedules[sp.ID]
+			stored.NextFireAt = next
+			s.schedules[sp.ID] = stored
+		}
+	}
+	return due, nil
+}
+
+// --- Web Push and UnifiedPush ---
+
+func (s *memoryStore) GetOrCreateVAPIDPrivateKey(generate func() (string, error)) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.vapidKey == "" {
+		key, err := generate()
+		if err != nil {
+			return "", err
+		}
+		s.vapidKey = key
+	}
+	return s.vapidKey, nil
+}
+
+func (s *memoryStore) SaveWebPushSubscription(sub WebPushSubscription) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if existing, ok := s.webPush[sub.Endpoint]; ok {
+		sub.CreatedAt = existing.CreatedAt
+	}
+	s.webPush[sub.Endpoint] = sub
+	return nil
+}
+
+func (s *memoryStore) GetWebPushSubscriptions(userID string) ([]WebPushSubscription, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var subscriptions []WebPushSubscription
+	for _, sub := range s.webPush {
+		if sub.UserID == userID {
+			subscriptions = append(subscriptions, sub)
+		}
+	}
+	sort.Slice(subscriptions, func(i, j int) bool { return subscriptions[i].Endpoint < subscriptions[j].Endpoint })
+	return subscriptions, nil
+}
+
+func (s *memoryStore) DeleteWebPushSubscription(userID, endpoint string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if sub, ok := s.webPush[endpoint]; ok && sub.UserID == userID {
+		delete(s.webPush, endpoint)
+	}
+}
+
+func (s *memoryStore) SaveUnifiedPushEndpoint(userID, deviceID, endpoint string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.unifiedPush[endpoint] = memoryEndpoint{userID: userID, deviceID: deviceID}
+	return nil
+}
+
+func (s *memoryStore) GetUnifiedPushEndpoints(userID string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var endpoints []string
+	for endpoint, e := range s.unifiedPush {
+		if e.userID == userID {
+			endpoints = append(endpoints, endpoint)
+		}
+	}
+	slices.Sort(endpoints)
+	return endpoints, nil
+}
+
+func (s *memoryStore) DeleteUnifiedPushEndpoint(userID, endpoint string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e, ok := s.unifiedPush[endpoint]; ok && e.userID == userID {
+		delete(s.unifiedPush, endpoint)
+	}
+}
+
+// --- Moderation ---
+
+// activeBan returns the ban of a user if it is still in force. The caller holds s.mu.
+func (s *memoryStore) activeBan(userID string) (UserBan, bool) {
+	ban, ok := s.bans[userID]
+	if !ok || (ban.ExpiresAt != nil && !ban.ExpiresAt.After(timeNow())) {
+		return UserBan{}, false
+	}
+	return ban, true
+}
+
+func (s *memoryStore) GetUserBan(userID string) (UserBan, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ban, ok := s.activeBan(userID)
+	return ban, ok, nil
+}
+
+func (s *memoryStore) GetActiveBans() ([]UserBan, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	bans := []UserBan{}
+	for userID := range s.bans {
+		if ban, ok := s.activeBan(userID); ok {
+			bans = append(bans, ban)
+		}
+	}
+	return bans, nil
+}
+
+func (s *memoryStore) BanUser(ban UserBan) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.bans[ban.UserID] = ban
+	return nil
+}
+
+func (s *memoryStore) SaveReport(report Report) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	report.Messages = slices.Clone(report.Messages)
+	if report.Messages == nil {
+		report.Messages = []ReportedMessage{}
+	}
+	s.reports[report.ID] = report
+	return nil
+}
+
+func (s *memoryStore) GetReport(id string) (Report, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	report, ok := s.reports[id]
+	return report, ok, nil
+}
+
+func (s *memoryStore) GetReports(status string, limit int) ([]Report, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	reports := []Report{}
+	for _, r := range s.reports {
+		if status == "" || r.Status == status {
+			reports = append(reports, r)
+		}
+	}
+	sort.Slice(reports, func(i, j int) bool { return reports[i].CreatedAt.Before(reports[j].CreatedAt) })
+	if len(reports) > limit {
+		reports = reports[:limit]
+	}
+	return reports, nil
+}
+
+func (s *memoryStore) ResolveReport(id, action, note string, resolvedAt time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	report, ok := s.reports[id]
+	if !ok || report.Status != reportStatusOpen {
+		return false, nil
+	}
+	report.Status, report.Action, report.Note, report.ResolvedAt = reportStatusResolved, action, note, &resolvedAt
+	s.reports[id] = report
+	return true, nil
+}
+
+// --- Admin ---
+
+func (s *memoryStore) GetUserSummaries(userID string, limit int) ([]UserSummary, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	known := make(map[string]bool)
+	for _, ids := range [][]string{slices.Collect(maps.Keys(s.pseudos)), slices.Collect(maps.Keys(s.devices)), slices.Collect(maps.Keys(s.accountSecrets))} {
+		for _, id := range ids {
+			if userID == "" || id == userID {
+				known[id] = true
+			}
+		}
+	}
+
+	users := []UserSummary{}
+	for id := range known {
+		u := UserSummary{UserID: id, Pseudo: s.pseudos[id].pseudo, Contacts: len(s.contacts[id])}
+		for _, d := range s.devices[id] {
+			if !d.revoked {
+				u.Devices++
+			}
+			if u.LastSeenAt == nil || d.LastSeenAt.After(*u.LastSeenAt) {
+				lastSeen := d.LastSeenAt
+				u.LastSeenAt = &lastSeen
+			}
+		}
+		if ban, ok := s.activeBan(id); ok {
+			u.BannedAt = &ban.BannedAt
+		}
+		users = append(users, u)
+	}
+	sort.Slice(users, func(i, j int) bool {
+		a, b := users[i].LastSeenAt, users[j].LastSeenAt
+		if (a == nil) != (b == nil) {
+			return b == nil
+		}
+		if a != nil && !a.Equal(*b) {
+			return a.After(*b)
+		}
+		return users[i].UserID < users[j].UserID
+	})
+	if len(users) > limit {
+		users = users[:limit]
+	}
+	return users, nil
+}
+
+func (s *memoryStore) ListInvitations() ([]Invitation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sortedInvitations(func(Invitation) bool { return true }), nil
+}
+
+func (s *memoryStore) PurgeInvitations(all bool) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := timeNow()
+	var purged int64
+	for code, inv := range s.invitations {
+		if all || inv.ExpiresAt.Before(now) {
+			delete(s.invitations, code)
+			purged++
+		}
+	}
+	return purged, nil
+}
+
+func (s *memoryStore) GetPendingStats(top int) (PendingStats, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats := PendingStats{ByType: make(map[string]int), TopRecipients: []PendingDepth{}}
+	depths := make(map[string]*PendingDepth)
+	for key, pending := range s.pending {
+		stats.ByType[key.messageType]++
+		stats.Total++
+		d := depths[key.to]
+		if d == nil {
+			d = &PendingDepth{UserID: key.to}
+			depths[key.to] = d
+		}
+		d.Count++
+		if expiresAt := pending.expiresAt; !expiresAt.IsZero() && (d.NextExpiry == nil || expiresAt.Before(*d.NextExpiry)) {
+			d.NextExpiry = &expiresAt
+		}
+	}
+	for _, d := range depths {
+		stats.TopRecipients = append(stats.TopRecipients, *d)
+	}
+	sort.Slice(stats.TopRecipients, func(i, j int) bool {
+		a, b := stats.TopRecipients[i], stats.TopRecipients[j]
+		if a.Count != b.Count {
+			return a.Count > b.Count
+		}
+		return a.UserID < b.UserID
+	})
+	if len(stats.TopRecipients) > top {
+		stats.TopRecipients = stats.TopRecipients[:top]
+	}
+	return stats, nil
+}
+
+func (s *memoryStore) PruneStaleTokens(cutoff time.Time, dryRun bool) (TokenPruneResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var result TokenPruneResult
+	stale := func(userID, deviceID string) bool {
+		d := s.devices[userID][deviceID]
+		return d != nil && (d.revoked || d.LastSeenAt.Before(cutoff))
+	}
+	for userID, devices := range s.devices {
+		for deviceID, d := range devices {
+			if len(d.PushTokens) > 0 && stale(userID, deviceID) {
+				result.PushTokens++
+				if !dryRun {
+					d.PushTokens = nil
+				}
+			}
+		}
+	}
+	for endpoint, sub := range s.webPush {
+		if sub.DeviceID != "" && stale(sub.UserID, sub.DeviceID) {
+			result.WebPushSubscriptions++
+			if !dryRun {
+				delete(s.webPush, endpoint)
+			}
+		}
+	}
+	for endpoint, e := range s.unifiedPush {
+		if e.deviceID != "" && stale(e.userID, e.deviceID) {
+			result.UnifiedPushEndpoints++
+			if !dryRun {
+				delete(s.unifiedPush, endpoint)
+			}
+		}
+	}
+	return result, nil
+}
+
+// Rekey has nothing to rewrite: the in-memory store never holds encrypted columns.
+func (s *memoryStore) Rekey(dryRun bool) (RekeyResult, error) {
+	if dataKeys == nil {
+		return RekeyResult{}, errEncryptionDisabled
+	}
+	return RekeyResult{}, nil
+}
+
+// Ping always succeeds: the in-memory store cannot be unreachable.
+func (s *memoryStore) Ping(ctx context.Context) error {
+	return nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// useClock sets the server clock to a fixed time for the duration of a test.
+func useClock(t *testing.T, now time.Time) *testClock {
+	clock := &testClock{now: now}
+	previous := timeNow
+	timeNow = clock.Now
+	t.Cleanup(func() { timeNow = previous })
+	return clock
+}
+
+func TestMemoryStoreDevices(t *testing.T) {
+	s := newMemoryStore()
+	clock := useClock(t, time.Date(2025, 3, 1, 9, 0, 0, 0, time.UTC))
+
+	s.UpsertDevice(Device{UserID: "alice", DeviceID: "phone", Name: "Phone", PushTokens: []string{"t1"}})
+	clock.Advance(time.Minute)
+	s.UpsertDevice(Device{UserID: "alice", DeviceID: "tablet", Platform: "ios", PushTokens: []string{"t1"}})
+	clock.Advance(time.Minute)
+	s.UpsertDevice(Device{UserID: "alice", DeviceID: "phone", Locale: "fr"})
+
+	devices, _ := s.GetUserDevices("alice")
+	if len(devices) != 2 || devices[0].DeviceID != "phone" || devices[0].Name != "Phone" || devices[0].Platform != "other" || devices[0].Locale != "fr" {
+		t.Fatalf("empty fields should keep their value, got %+v", devices)
+	}
+	if tokens, _ := s.GetUserDeviceTokens("alice"); !reflect.DeepEqual(tokens, []string{"t1"}) {
+		t.Errorf("a push token should move to the device registering it, got %v", tokens)
+	}
+
+	s.SetDeviceSecretHash("alice", "tablet", "hash")
+	s.SaveUnifiedPushEndpoint("alice", "tablet", "https://push.example.com/1")
+	if revoked, _ := s.RevokeDevice("alice", "tablet"); !revoked {
+		t.Fatal("RevokeDevice should revoke an active device")
+	}
+	if hash, revoked, found, _ := s.GetDeviceAuth("alice", "tablet"); hash != "" || !revoked || !found {
+		t.Errorf("a revoked device keeps its row without credentials, got %q, %t, %t", hash, revoked, found)
+	}
+	if endpoints, _ := s.GetUnifiedPushEndpoints("alice"); len(endpoints) != 0 {
+		t.Errorf("the push endpoints of a revoked device should be dropped, got %v", endpoints)
+	}
+	s.UpsertDevice(Device{UserID: "alice", DeviceID: "tablet", PushTokens: []string{"t2"}})
+	if err := s.SetDeviceSecretHash("alice", "tablet", "again"); err != errDeviceNotFound {
+		t.Errorf("revoked devices cannot be registered again, got %v", err)
+	}
+}
+
+func TestMemoryStorePseudos(t *testing.T) {
+	s := newMemoryStore()
+	if err := s.SetUserPseudo("alice", "Alice", "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetUserPseudo("bob", "ALICE", "alice"); err != errPseudoTaken {
+		t.Errorf("pseudo keys should be unique across users, got %v", err)
+	}
+	if err := s.SetUserPseudo("alice", "ALICE", "alice"); err != nil {
+		t.Errorf("users can change the case of their own pseudo, got %v", err)
+	}
+	if pseudos, _ := s.GetUsersPseudos([]string{"alice", "bob"}); !reflect.DeepEqual(pseudos, map[string]string{"alice": "ALICE"}) {
+		t.Errorf("GetUsersPseudos = %v", pseudos)
+	}
+}
+
+func TestMemoryStorePendingMessages(t *testing.T) {
+	s := newMemoryStore()
+	clock := useClock(t, time.Date(2025, 3, 1, 9, 0, 0, 0, time.UTC))
+
+	s.SavePendingMessage(Message{ID: "m1", To: "bob", From: "alice", Payload: MessagePayload{Text: "first"}, TTL: 60})
+	s.SavePendingMessage(Message{ID: "m2", To: "bob", From: "alice", Payload: MessagePayload{Text: "second"}, TTL: 60})
+	s.SavePendingMessage(Message{ID: "e1", Type: "account_deleted", To: "bob", From: "carol"})
+	pending, _ := s.GetPendingMessages("bob")
+	if len(pending) != 2 || pending[0].ID != "m2" || pending[0].Payload.Text != "second" || !pending[0].IsPending {
+		t.Fatalf("one message per sender and type should be kept, got %+v", pending)
+	}
+
+	clock.Advance(61 * time.Second)
+	if pending, _ := s.GetPendingMessages("bob"); len(pending) != 1 || pending[0].ID != "e1" {
+		t.Errorf("expired messages must not be delivered, got %+v", pending)
+	}
+	if expired, _ := s.DeleteExpiredPendingMessages(); len(expired) != 1 || expired[0].ID != "m2" || expired[0].From != "alice" {
+		t.Errorf("DeleteExpiredPendingMessages = %+v", expired)
+	}
+	if err := s.DeleteUserData("carol"); err != nil {
+		t.Fatal(err)
+	}
+	if pending, _ := s.GetPendingMessagesInvolving("bob"); len(pending) != 0 {
+		t.Errorf("the messages of a deleted user should be gone, got %+v", pending)
+	}
+}
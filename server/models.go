@@ -2,8 +2,6 @@ package main
 
 import (
 	"time"
-
-	"github.com/gorilla/websocket"
 )
 type MessagePayload struct {
 	Text      string  `json:"text"`
@@ -12,18 +10,32 @@ type MessagePayload struct {
 	RecipientID string      `json:"recipientId,omitempty"`
 	UserID string      `json:"userId,omitempty"`
 	Pseudo string      `json:"pseudo,omitempty"`
+	MessageID    string `json:"messageId,omitempty"`    // ID of the message a server status frame refers to
+	RetryAfterMs int64  `json:"retryAfterMs,omitempty"` // Set on 'rate_limited' frames
+	Status       string     `json:"status,omitempty"`   // Set on 'presence' frames ("online" / "offline")
+	LastSeen     *time.Time `json:"lastSeen,omitempty"` // Set on 'presence' frames when the user shares it
+	Schedule     *ScheduledPlop  `json:"schedule,omitempty"`  // Set on 'schedule_*' commands and replies
+	Schedules    []ScheduledPlop `json:"schedules,omitempty"` // Set on 'schedule_list' replies
+	DeviceID     string          `json:"deviceId,omitempty"`  // Set on 'device_revoked' events
+	LinkRequest  *LinkRequest    `json:"linkRequest,omitempty"` // Set on 'link_*' frames
+	AccountSecret string         `json:"accountSecret,omitempty"` // Set on 'account_secret_rotated' events sent to connected devices
+	Avatar        map[int]string `json:"avatar,omitempty"`        // Set on 'avatar_changed' events: blob hash per size
+	Envelope      *EncryptedEnvelope `json:"envelope,omitempty"`   // End-to-end encrypted content of a plop; Text and coordinates are then empty
+	DeviceKeys    []DeviceKey        `json:"deviceKeys,omitempty"` // Set on 'new_contact' and 'device_keys_changed' events
 	// Add other fields from your payload as needed
 }
 // Message defines the structure for all real-time communications.
 type Message struct {
+	ID        string      `json:"id,omitempty"` // Client-generated message ID, echoed back in status frames
 	Type      string      `json:"type"`
 	To        string      `json:"to,omitempty"`
 	From      string      `json:"from,omitempty"`
 	Payload   MessagePayload `json:"payload"` // Changed from interface{} or string
 	IsDefault bool        `json:"isDefault,omitempty"`
 	IsPending bool        `json:"isPending,omitempty"`
+	TTL       int64       `json:"ttl,omitempty"` // Seconds the message stays deliverable; 0 means the server default
 	// SourceConn is used internally to avoid echoing messages back to the sender.
-	SourceConn *websocket.Conn `json:"-"`
+	SourceConn *clientConn `json:"-"`
 }
 
 // Invitation represents a time-limited code to connect two users.
@@ -40,3 +52,422 @@ type SyncCode struct {
 	UserID    string
 	ExpiresAt time.Time
 }
+
+// Link request statuses.
+const (
+	linkStatusPending  = "pending"
+	linkStatusApproved = "approved"
+	linkStatusDenied   = "denied"
+	linkStatusExpired  = "expired"
+)
+
+// LinkRequest is a new device waiting for one of the user's existing devices to approve it.
+type LinkRequest struct {
+	ID         string    `json:"id"`
+	UserID     string    `json:"-"`
+	DeviceID   string    `json:"deviceId,omitempty"`
+	DeviceName string    `json:"deviceName,omitempty"`
+	Platform   string    `json:"platform,omitempty"`
+	Status     string    `json:"status,omitempty"`
+	ExpiresAt  time.Time `json:"expiresAt"`
+
+	device       Device // Registered on approval
+	deviceSecret string // Issued on approval, handed over once to the new device
+}
+
+// Presence visibility levels. Presence is opt-in: users start with presenceVisibilityNobody.
+const (
+	presenceVisibilityNobody   = "nobody"
+	presenceVisibilityContacts = "contacts"
+)
+
+// PresenceSettings holds a user's presence privacy choices and their last-seen timestamp.
+type PresenceSettings struct {
+	UserID        string     `json:"userId"`
+	Visibility    string     `json:"visibility"`
+	ShareLastSeen bool       `json:"shareLastSeen"`
+	HiddenFrom    []string   `json:"hiddenFrom"`
+	LastSeen      *time.Time `json:"lastSeen,omitempty"`
+}
+
+// PresenceInfo is what a viewer is allowed to know about a contact's presence.
+type PresenceInfo struct {
+	Online   bool       `json:"online"`
+	LastSeen *time.Time `json:"lastSeen,omitempty"`
+}
+
+// ScheduledPlop is a plop sent later by the server, either once (FireAt) or on a recurring cron schedule (Cron).
+type ScheduledPlop struct {
+	ID           string         `json:"id"`
+	OwnerID      string         `json:"ownerId"`
+	RecipientIDs []string       `json:"recipientIds"`
+	Payload      MessagePayload `json:"payload"`
+	// FireAt is only used when creating a one-shot schedule. It is either RFC 3339 or a local
+	// "2006-01-02T15:04" time interpreted in Timezone.
+	FireAt     string    `json:"fireAt,omitempty"`
+	Cron       string    `json:"cron,omitempty"`
+	Timezone   string    `json:"timezone"`
+	NextFireAt time.Time `json:"nextFireAt"`
+	CreatedAt  time.Time `json:"createdAt"`
+}
+
+// WebPushSubscription is a browser push subscription (PushSubscription in the Push API) for one device.
+type WebPushSubscription struct {
+	UserID    string    `json:"userId"`
+	DeviceID  string    `json:"deviceId,omitempty"`
+	Endpoint  string    `json:"endpoint"`
+	P256dh    string    `json:"p256dh"`
+	Auth      string    `json:"auth"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// Device is one installation of the app linked to a user account.
+type Device struct {
+	UserID     string    `json:"userId"`
+	DeviceID   string    `json:"deviceId"`
+	Name       string    `json:"name"`
+	Platform   string    `json:"platform"`
+	AppVersion string    `json:"appVersion"`
+	Locale     string    `json:"locale"`
+	PublicKey  string    `json:"publicKey,omitempty"` // X25519 public key, base64; see e2e.go
+	PushTokens []string  `json:"-"` // Never sent back to clients
+	CreatedAt  time.Time `json:"createdAt"`
+	LastSeenAt time.Time `json:"lastSeenAt"`
+}
+
+// DeviceKey is the public key of one of a user's devices, as shared with their contacts.
+type DeviceKey struct {
+	DeviceID  string `json:"deviceId"`
+	PublicKey string `json:"publicKey"`
+}
+
+// EncryptedEnvelope carries the content of an end-to-end encrypted plop. The server relays and queues it
+// as is: every field is opaque to it, it only checks the sizes.
+type EncryptedEnvelope struct {
+	Algorithm      string            `json:"alg"`            // Scheme chosen by the clients, e.g. "x25519-hkdf-aes256gcm"
+	SenderDeviceID string            `json:"senderDeviceId"` // Device whose key the recipients use to open the keys below
+	Keys           map[string]string `json:"keys"`           // Content key wrapped for each recipient device, base64, by device ID
+	Nonce          string            `json:"nonce"`          // base64
+	Ciphertext     string            `json:"ciphertext"`     // base64
+}
+
+// UserProfile is what /users/get-pseudos returns for a user when avatars are requested.
+type UserProfile struct {
+	Pseudo string         `json:"pseudo"`
+	Avatar map[int]string `json:"avatar,omitempty"` // Blob hash per size, in pixels
+}
+
+// DeviceExport is a device as included in an account export, push tokens included.
+type DeviceExport struct {
+	Device
+	PushTokens []string `json:"pushTokens"`
+}
+
+// AccountExport is everything the server holds about a user, as returned by /users/me/export.
+type AccountExport struct {
+	ExportedAt           time.Time             `json:"exportedAt"`
+	UserID               string                `json:"userId"`
+	Pseudo               string                `json:"pseudo"`
+	Avatar               map[int]string        `json:"avatar,omitempty"`
+	Devices              []DeviceExport        `json:"devices"`
+	Contacts             []string              `json:"contacts"`
+	PresenceSettings     *PresenceSettings     `json:"presenceSettings"`
+	Invitations          []Invitation          `json:"invitations"`
+	PendingMessages      []Message             `json:"pendingMessages"`
+	ScheduledPlops       []ScheduledPlop       `json:"scheduledPlops"`
+	WebPushSubscriptions []WebPushSubscription `json:"webPushSubscriptions"`
+	UnifiedPushEndpoints []string              `json:"unifiedPushEndpoints"`
+}
+
+// UserBan records that an operator banned or suspended a user. Sanctioned users cannot connect or plop.
+type UserBan struct {
+	UserID    string     `json:"userId"`
+	Reason    string     `json:"reason"`
+	BannedAt  time.Time  `json:"bannedAt"`
+	ExpiresAt *time.Time `json:"expiresAt"` // Set for a suspension, nil for a permanent ban
+}
+
+// Report statuses and the moderation actions that resolve a report.
+const (
+	reportStatusOpen     = "open"
+	reportStatusResolved = "resolved"
+
+	moderationDismiss = "dismiss"
+	moderationWarn    = "warn"
+	moderationSuspend = "suspend"
+	moderationBan     = "ban"
+)
+
+// ReportedMessage is the metadata of a plop attached to a report. The content is never recorded.
+type ReportedMessage struct {
+	MessageID   string    `json:"messageId"`
+	SentAt      time.Time `json:"sentAt"`
+	RateLimited bool      `json:"rateLimited,omitempty"` // The plop was dropped by the rate limiter
+}
+
+// Report is an abuse report filed by a user against another.
+type Report struct {
+	ID         string            `json:"id"`
+	ReporterID string            `json:"reporterId"`
+	ReportedID string            `json:"reportedId"`
+	Reason     string            `json:"reason"`
+	Details    string            `json:"details"`
+	Messages   []ReportedMessage `json:"messages"` // Recent plops from the reported user to the reporter
+	Status     string            `json:"status"`
+	Action     string            `json:"action,omitempty"` // Set once resolved
+	Note       string            `json:"note,omitempty"`   // Moderator note, also sent with a warning
+	CreatedAt  time.Time         `json:"createdAt"`
+	ResolvedAt *time.Time        `json:"resolvedAt,omitempty"`
+}
+
+// UserSummary is the overview of a user shown by the admin commands.
+type UserSummary struct {
+	UserID     string     `json:"userId"`
+	Pseudo     string     `json:"pseudo"`
+	Devices    int        `json:"devices"` // Active devices only
+	Contacts   int        `json:"contacts"`
+	LastSeenAt *time.Time `json:"lastSeenAt"` // Most recent connection of any device
+	BannedAt   *time.Time `json:"bannedAt"`
+}
+
+// PendingDepth is the number of pending messages waiting for one recipient.
+type PendingDepth struct {
+	UserID     string     `json:"userId"`
+	Count      int        `json:"count"`
+	NextExpiry *time.Time `json:"nextExpiry"` // Earliest expiry among the queued messages
+}
+
+// PendingStats summarizes the pending message queue.
+type PendingStats struct {
+	Total         int            `json:"total"`
+	ByType        map[string]int `json:"byType"` // "" is a plop
+	TopRecipients []PendingDepth `json:"topRecipients"`
+}
+
+// TokenPruneResult counts the push registrations removed by a prune.
+type TokenPruneResult struct {
+	PushTokens           int64 `json:"pushTokens"` // Devices whose tokens were cleared
+	WebPushSubscriptions int64 `json:"webPushSubscriptions"`
+	UnifiedPushEndpoints int64 `json:"unifiedPushEndpoints"`
+}
+
+// RekeyResult counts the rows rewritten under the active data key by a rekey.
+type RekeyResult struct {
+	Pseudos           int `json:"pseudos"`
+	Devices           int `json:"devices"` // Devices whose push tokens were rewritten
+	PendingMessages   int `json:"pendingMessages"`
+	Invitations       int `json:"invitations"`
+	PushSubscriptions int `json:"pushSubscriptions"` // Web Push subscriptions and UnifiedPush endpoints
+}
+
+// ConnectionInfo describes one live WebSocket connection, as listed by the admin API.
+type ConnectionInfo struct {
+	ID          string    `json:"id"`
+	DeviceID    string    `json:"deviceId"`
+	ConnectedAt time.Time `json:"connectedAt"`
+	RemoteAddr  string    `json:"remoteAddr"`
+}
+
+// ConnectedUser is a user with at least one live connection, as listed by the admin API.
+type ConnectedUser struct {
+	UserID      string           `json:"userId"`
+	Devices     int              `json:"devices"` // Distinct devices; connections without device credentials count as one
+	Connections []ConnectionInfo `json:"connections"`
+}
+
+// --- REST API ---
+// Request and response bodies of the HTTP endpoints, as documented in openapi.json.
+
+// GenerateUserIDResponse is returned by /users/generate-id.
+type GenerateUserIDResponse struct {
+	UserID        string `json:"userId"`
+	AccountSecret string `json:"accountSecret,omitempty"` // Only with credentials=true, and only ever returned here; see /users/rotate-secret
+}
+
+// CreateInvitationResponse is returned by /invitations/create.
+type CreateInvitationResponse struct {
+	Code            string `json:"code"`
+	ValidityMinutes int    `json:"validityMinutes"`
+}
+
+// UseInvitationRequest is the body of /invitations/use.
+type UseInvitationRequest struct {
+	Code   string `json:"code"`
+	UserID string `json:"userId"`
+	Pseudo string `json:"pseudo"`
+}
+
+// UseInvitationResponse is the creator of a used invitation.
+type UseInvitationResponse struct {
+	UserID     string      `json:"userId"`
+	Pseudo     string      `json:"pseudo"`
+	DeviceKeys []DeviceKey `json:"deviceKeys"`
+}
+
+// GetPseudosRequest is the body of /users/get-pseudos.
+type GetPseudosRequest struct {
+	UserIDs        []string `json:"userIds"`
+	IncludeAvatars bool     `json:"includeAvatars"`
+}
+
+// AvatarResponse is returned by an avatar upload.
+type AvatarResponse struct {
+	Avatar map[int]string `json:"avatar"` // Blob hash per size, in pixels
+}
+
+// ChangePseudoRequest is the body of /users/pseudo.
+type ChangePseudoRequest struct {
+	UserID string `json:"userId"`
+	Pseudo string `json:"pseudo"`
+}
+
+// PseudoResponse is the pseudo a user ends up with, once normalized.
+type PseudoResponse struct {
+	Pseudo string `json:"pseudo"`
+}
+
+// SyncCodeResponse is returned by /sync/create.
+type SyncCodeResponse struct {
+	Code string `json:"code"`
+}
+
+// UseSyncCodeRequest is the body of /sync/use: the code and the new device.
+type UseSyncCodeRequest struct {
+	Code string `json:"code"`
+	Device
+}
+
+// UseSyncCodeResponse is the link request created by /sync/use.
+type UseSyncCodeResponse struct {
+	RequestID string    `json:"requestId"`
+	Status    string    `json:"status"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// SyncStatusResponse is returned by /sync/status. The account and device credentials are only set once approved.
+type SyncStatusResponse struct {
+	Status       string `json:"status"`
+	UserID       string `json:"userId,omitempty"`
+	Pseudo       string `json:"pseudo,omitempty"`
+	DeviceSecret string `json:"deviceSecret,omitempty"`
+}
+
+// UpdateTokenRequest is the body of /users/update-token.
+type UpdateTokenRequest struct {
+	UserID     string `json:"userId"`
+	Token      string `json:"token"`
+	DeviceID   string `json:"deviceId"`
+	Platform   string `json:"platform"`
+	AppVersion string `json:"appVersion"`
+	Locale     string `json:"locale"`
+}
+
+// RegisterDeviceRequest is the body of /devices/register.
+type RegisterDeviceRequest struct {
+	Device
+	PushToken string `json:"pushToken"`
+}
+
+// RegisterDeviceResponse is returned by /devices/register. New devices get their secret here, once.
+type RegisterDeviceResponse struct {
+	Success      bool   `json:"success"`
+	DeviceSecret string `json:"deviceSecret,omitempty"`
+}
+
+// SuccessResponse is returned by the endpoints that have nothing else to say.
+type SuccessResponse struct {
+	Success bool `json:"success"`
+}
+
+// RevokeDeviceRequest is the body of /devices/revoke.
+type RevokeDeviceRequest struct {
+	UserID   string `json:"userId"`
+	DeviceID string `json:"deviceId"`
+}
+
+// SyncContactsRequest is the body of /contacts/sync.
+type SyncContactsRequest struct {
+	UserID     string   `json:"userId"`
+	ContactIDs []string `json:"contactIds"`
+}
+
+// PresenceRequest is the body of /users/presence.
+type PresenceRequest struct {
+	UserID  string   `json:"userId"`
+	UserIDs []string `json:"userIds"`
+}
+
+// CancelScheduleRequest is the body of /schedules/cancel.
+type CancelScheduleRequest struct {
+	UserID string `json:"userId"`
+	ID     string `json:"id"`
+}
+
+// VAPIDPublicKeyResponse is returned by /webpush/vapid-public-key.
+type VAPIDPublicKeyResponse struct {
+	PublicKey string `json:"publicKey"`
+}
+
+// PushSubscriptionJSON is the JSON form of a browser's PushSubscription.
+type PushSubscriptionJSON struct {
+	Endpoint string               `json:"endpoint"`
+	Keys     PushSubscriptionKeys `json:"keys"`
+}
+
+// PushSubscriptionKeys are the keys of a browser push subscription, base64url.
+type PushSubscriptionKeys struct {
+	P256dh string `json:"p256dh"`
+	Auth   string `json:"auth"`
+}
+
+// WebPushSubscribeRequest is the body of /webpush/subscribe.
+type WebPushSubscribeRequest struct {
+	UserID       string               `json:"userId"`
+	DeviceID     string               `json:"deviceId"`
+	Subscription PushSubscriptionJSON `json:"subscription"`
+}
+
+// EndpointRequest is the body of /webpush/unsubscribe and /unifiedpush/unregister.
+type EndpointRequest struct {
+	UserID   string `json:"userId"`
+	Endpoint string `json:"endpoint"`
+}
+
+// UnifiedPushRegisterRequest is the body of /unifiedpush/register.
+type UnifiedPushRegisterRequest struct {
+	UserID   string `json:"userId"`
+	DeviceID string `json:"deviceId"`
+	Endpoint string `json:"endpoint"`
+}
+
+// AccountSecretResponse is returned by /users/rotate-secret.
+type AccountSecretResponse struct {
+	AccountSecret string `json:"accountSecret"`
+}
+
+// CreateReportRequest is the body of /reports.
+type CreateReportRequest struct {
+	UserID         string `json:"userId"`
+	ReportedUserID string `json:"reportedUserId"`
+	Reason         string `json:"reason"`
+	Details        string `json:"details"`
+}
+
+// CreateReportResponse is returned by /reports.
+type CreateReportResponse struct {
+	ReportID string `json:"reportId"`
+	Status   string `json:"status"`
+}
+
+// HealthResponse is returned by /healthz and /readyz.
+type HealthResponse struct {
+	Status     string                     `json:"status"`               // "ok" or "failing"
+	Components map[string]ComponentHealth `json:"components,omitempty"` // Only on /readyz
+}
+
+// ComponentHealth is the state of one of the checks of /readyz.
+type ComponentHealth struct {
+	Status    string  `json:"status"` // "ok", "degraded" or "failing"
+	LatencyMs float64 `json:"latencyMs"`
+	Error     string  `json:"error,omitempty"`
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+// --- Abuse Reports & Moderation ---
+//
+// Users report abusive contacts with POST /reports. The server attaches the metadata of the recent plops
+// the reported user sent to the reporter, never their content. Operators review open reports through the
+// admin API and resolve them by dismissing them, warning the reported user, suspending or banning them.
+
+const (
+	// recentPlopsPerPair and recentPlopRetention bound the plop metadata kept for reports.
+	recentPlopsPerPair  = 50
+	recentPlopRetention = 7 * 24 * time.Hour
+	maxReportDetails    = 1000
+
+	// sanctionCacheTTL is how long a ban lookup is trusted, so that bans applied by another instance
+	// or the admin CLI take effect within that delay.
+	sanctionCacheTTL = time.Minute
+)
+
+// WebSocket close codes sent to sanctioned users.
+const (
+	closeCodeSuspended = 4005
+	closeCodeBanned    = 4006
+)
+
+// reportReasons are the reasons a user can give when reporting someone.
+var reportReasons = map[string]bool{"harassment": true, "spam": true, "inappropriate_pseudo": true, "other": true}
+
+var (
+	errReportNotFound       = errors.New("report not found or already resolved")
+	errInvalidModeration    = errors.New("action must be one of dismiss, warn, suspend or ban")
+	errSuspensionNeedsLimit = errors.New("a suspension needs a positive duration")
+)
+
+// recentPlops keeps the metadata of the plops each sender recently sent to each recipient. Ephemeral state.
+var recentPlops = &recentPlopLog{pairs: make(map[string][]ReportedMessage)}
+
+// recentPlopLog is a bounded log of plop metadata per sender/recipient pair.
+type recentPlopLog struct {
+	mu    sync.Mutex
+	pairs map[string][]ReportedMessage
+}
+
+func recentPlopKey(from, to string) string {
+	return from + "\x00" + to
+}
+
+// record appends a plop to the log of its pair, dropping the oldest entry when the log is full.
+func (l *recentPlopLog) record(from, to string, m ReportedMessage) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	key := recentPlopKey(from, to)
+	entries := append(l.pairs[key], m)
+	if len(entries) > recentPlopsPerPair {
+		entries = entries[len(entries)-recentPlopsPerPair:]
+	}
+	l.pairs[key] = entries
+}
+
+// since returns a copy of the plops from a sender to a recipient sent after cutoff.
+func (l *recentPlopLog) since(from, to string, cutoff time.Time) []ReportedMessage {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	messages := []ReportedMessage{}
+	for _, m := range l.pairs[recentPlopKey(from, to)] {
+		if m.SentAt.After(cutoff) {
+			messages = append(messages, m)
+		}
+	}
+	return messages
+}
+
+// evictBefore forgets the pairs whose last plop is older than cutoff and returns how many were removed.
+func (l *recentPlopLog) evictBefore(cutoff time.Time) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	evicted := 0
+	for key, entries := range l.pairs {
+		if len(entries) == 0 || entries[len(entries)-1].SentAt.Before(cutoff) {
+			delete(l.pairs, key)
+			evicted++
+		}
+	}
+	return evicted
+}
+
+// validateReport checks a report before it is filed.
+func validateReport(reporterID, reportedID, reason, details string) error {
+	switch {
+	case reportedID == "" || reportedID == reporterID:
+		return errors.New("reportedUserId must be another user")
+	case !reportReasons[reason]:
+		return errors.New("reason must be one of harassment, spam, inappropriate_pseudo or other")
+	case utf8.RuneCountInString(strings.TrimSpace(details)) > maxReportDetails:
+		return fmt.Errorf("details must be at most %d characters", maxReportDetails)
+	}
+	return nil
+}
+
+// createReport validates and stores a report, attaching the recent plops of the reported user to the reporter.
+func createReport(reporterID, reportedID, reason, details string, now time.Time) (Report, error) {
+	if err := validateReport(reporterID, reportedID, reason, details); err != nil {
+		return Report{}, err
+	}
+
+	report := Report{
+		ID:         uuid.New().String(),
+		ReporterID: reporterID,
+		ReportedID: reportedID,
+		Reason:     reason,
+		Details:    strings.TrimSpace(details),
+		Messages:   recentPlops.since(reportedID, reporterID, now.Add(-recentPlopRetention)),
+		Status:     reportStatusOpen,
+		CreatedAt:  now,
+	}
+	if err := store.SaveReport(report); err != nil {
+		return Report{}, err
+	}
+	log.Printf("[MODERATION] User %s reported user %s for %s (report %s, %d recent plop(s)).", reporterID, reportedID, reason, report.ID, len(report.Messages))
+	return report, nil
+}
+
+// resolveReport applies a moderation action to the user a report is about and closes the report.
+// suspendFor is only used by the suspend action.
+func resolveReport(id, action, note string, suspendFor time.Duration, now time.Time) (Report, error) {
+	switch action {
+	case moderationDismiss, moderationWarn, moderationBan:
+	case moderationSuspend:
+		if suspendFor <= 0 {
+			return Report{}, errSuspensionNeedsLimit
+		}
+	default:
+		return Report{}, errInvalidModeration
+	}
+
+	report, found, err := store.GetReport(id)
+	if err != nil {
+		return Report{}, err
+	}
+	if !found || report.Status != reportStatusOpen {
+		return Report{}, errReportNotFound
+	}
+	resolved, err := store.ResolveReport(id, action, note, now)
+	if err != nil {
+		return Report{}, err
+	}
+	if !resolved {
+		return Report{}, errReportNotFound // Resolved concurrently by another moderator
+	}
+
+	switch action {
+	case moderationWarn:
+		sendServerEvent(Message{Type: "moderation_warning", From: "server", To: report.ReportedID, Payload: MessagePayload{Text: note}})
+	case moderationSuspend, moderationBan:
+		ban := UserBan{UserID: report.ReportedID, Reason: fmt.Sprintf("report %s: %s", id, report.Reason), BannedAt: now}
+		if action == moderationSuspend {
+			expiresAt := now.Add(suspendFor)
+			ban.ExpiresAt = &expiresAt
+		}
+		if err := applySanction(ban); err != nil {
+			return Report{}, err
+		}
+	}
+
+	report.Status, report.Action, report.Note, report.ResolvedAt = reportStatusResolved, action, note, &now
+	log.Printf("[MODERATION] Report %s against user %s resolved: %s.", id, report.ReportedID, action)
+	return report, nil
+}
+
+// applySanction stores a ban or suspension and closes the user's open connections with the matching close frame.
+func applySanction(ban UserBan) error {
+	if err := store.BanUser(ban); err != nil {
+		return err
+	}
+	cacheSanction(ban.UserID, cachedSanction{ban: ban, sanctioned: true, checkedAt: timeNow()})
+
+	code, reason := sanctionCloseFrame(ban)
+	closed := closeUserConnections(ban.UserID, func(*clientInfo) bool { return true }, code, reason)
+	log.Printf("[MODERATION] User %s sanctioned (%s). Closed %d open connection(s).", ban.UserID, reason, closed)
+	return nil
+}
+
+// cachedSanction is the result of a ban lookup.
+type cachedSanction struct {
+	ban        UserBan
+	sanctioned bool
+	checkedAt  time.Time
+}
+
+func cacheSanction(userID string, cached cachedSanction) {
+	sanctionCacheMutex.Lock()
+	sanctionCache[userID] = cached
+	sanctionCacheMutex.Unlock()
+}
+
+// sanctionFor returns the ban or suspension of a user, if it is still in force. Lookups are cached
+// for sanctionCacheTTL; when the store fails, the last known answer is used.
+func sanctionFor(userID string, now time.Time) (UserBan, bool) {
+	sanctionCacheMutex.Lock()
+	cached, found := sanctionCache[userID]
+	sanctionCacheMutex.Unlock()
+	if !found || now.Sub(cached.checkedAt) >= sanctionCacheTTL {
+		ban, sanctioned, err := store.GetUserBan(userID)
+		if err != nil {
+			log.Printf("[MODERATION] Could not check the sanctions of user %s, using the last known ones: %v", userID, err)
+		} else {
+			cached = cachedSanction{ban: ban, sanctioned: sanctioned, checkedAt: now}
+			cacheSanction(userID, cached)
+		}
+	}
+	if !cached.sanctioned || (cached.ban.ExpiresAt != nil && now.After(*cached.ban.ExpiresAt)) {
+		return UserBan{}, false
+	}
+	return cached.ban, true
+}
+
+// loadActiveSanctions fills the cache with the bans and suspensions in force when the server starts.
+func loadActiveSanctions() {
+	bans, err := store.GetActiveBans()
+	if err != nil {
+		log.Printf("[ERROR] Could not load the active sanctions: %v", err)
+		return
+	}
+	now := timeNow()
+	for _, ban := range bans {
+		cacheSanction(ban.UserID, cachedSanction{ban: ban, sanctioned: true, checkedAt: now})
+	}
+	log.Printf("[MODERATION] Loaded %d active ban(s) and suspension(s).", len(bans))
+}
+
+// refuseSanctioned answers 403 to a request of a suspended or banned user and reports whether it did.
+func refuseSanctioned(w http.ResponseWriter, userID string) bool {
+	ban, sanctioned := sanctionFor(userID, timeNow())
+	if !sanctioned {
+		return false
+	}
+	_, reason := sanctionCloseFrame(ban)
+	http.Error(w, "Account "+reason, http.StatusForbidden)
+	return true
+}
+
+// sanctionCloseFrame returns the WebSocket close code and reason telling a client it is banned or suspended.
+func sanctionCloseFrame(ban UserBan) (int, string) {
+	if ban.ExpiresAt == nil {
+		return closeCodeBanned, "banned"
+	}
+	return closeCodeSuspended, "suspended until " + ban.ExpiresAt.UTC().Format(time.RFC3339)
+}
+
+// closeWithSanction closes a single connection of a sanctioned user with the matching close frame.
+func closeWithSanction(conn *clientConn, ban UserBan) {
+	code, reason := sanctionCloseFrame(ban)
+	if err := conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(time.Second)); err != nil {
+		log.Printf("[WS] Could not send close frame to sanctioned userId=%s: %v", ban.UserID, err)
+	}
+	conn.Close()
+}
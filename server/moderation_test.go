@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gorilla/websocket"
+
+	"plop_server/plopclient"
+)
+
+func TestRecentPlopLog(t *testing.T) {
+	plops := &recentPlopLog{pairs: make(map[string][]ReportedMessage)}
+	now := time.Now()
+	for i := 0; i < recentPlopsPerPair+5; i++ {
+		plops.record("mallory", "alice", ReportedMessage{MessageID: "m", SentAt: now.Add(time.Duration(i) * time.Second)})
+	}
+	plops.record("mallory", "bob", ReportedMessage{MessageID: "old", SentAt: now.Add(-2 * recentPlopRetention)})
+
+	if got := plops.since("mallory", "alice", now.Add(-time.Hour)); len(got) != recentPlopsPerPair {
+		t.Errorf("expected the log to keep the last %d plops, got %d", recentPlopsPerPair, len(got))
+	}
+	if got := plops.since("alice", "mallory", now.Add(-time.Hour)); len(got) != 0 {
+		t.Errorf("plops in the other direction must not be attached, got %v", got)
+	}
+	if evicted := plops.evictBefore(now.Add(-recentPlopRetention)); evicted != 1 {
+		t.Errorf("expected the stale pair to be evicted, got %d", evicted)
+	}
+}
+
+func TestCreateReport(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	setDB(db)
+
+	for _, c := range []struct{ reported, reason string }{{"", "spam"}, {"alice", "spam"}, {"mallory", "boredom"}} {
+		if _, err := createReport("alice", c.reported, c.reason, "", time.Now()); err == nil {
+			t.Errorf("report against %q for %q should be refused", c.reported, c.reason)
+		}
+	}
+
+	now := time.Now()
+	recentPlops.record("mallory", "alice", ReportedMessage{MessageID: "plop-1", SentAt: now.Add(-time.Minute)})
+	defer recentPlops.evictBefore(now.Add(time.Hour))
+
+	mock.ExpectExec("INSERT INTO reports").
+		WithArgs(sqlmock.AnyArg(), "alice", "mallory", "harassment", "keeps plopping at night", sqlmock.AnyArg(), reportStatusOpen, now).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	report, err := createReport("alice", "mallory", "harassment", " keeps plopping at night ", now)
+	if err != nil {
+		t.Fatalf("createReport failed: %v", err)
+	}
+	if len(report.Messages) != 1 || report.Messages[0].MessageID != "plop-1" {
+		t.Errorf("the recent plop should be attached, got %+v", report.Messages)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestResolveReportSuspends(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	setDB(db)
+	defer func() {
+		sanctionCacheMutex.Lock()
+		delete(sanctionCache, "mallory")
+		sanctionCacheMutex.Unlock()
+	}()
+
+	dial := newTestClientDialer(t, "mallory")
+	phone := dial("phone")
+
+	now := time.Now()
+	reportRows := sqlmock.NewRows([]string{"id", "reporter_id", "reported_id", "reason", "details", "messages", "status", "action", "note", "created_at", "resolved_at"}).
+		AddRow("r1", "alice", "mallory", "harassment", "", []byte("[]"), reportStatusOpen, "", "", now, nil)
+	mock.ExpectQuery("SELECT id, reporter_id").WithArgs("r1").WillReturnRows(reportRows)
+	mock.ExpectExec("UPDATE reports SET status").WithArgs("r1", reportStatusResolved, moderationSuspend, "", now, reportStatusOpen).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO user_bans").WithArgs("mallory", sqlmock.AnyArg(), now, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+
+	if _, err := resolveReport("r1", moderationSuspend, "", 0, now); err != errSuspensionNeedsLimit {
+		t.Errorf("a suspension without duration should be refused, got %v", err)
+	}
+	report, err := resolveReport("r1", moderationSuspend, "", 24*time.Hour, now)
+	if err != nil || report.Status != reportStatusResolved {
+		t.Fatalf("resolveReport() = %+v, %v", report, err)
+	}
+
+	phone.SetReadDeadline(time.Now().Add(time.Second))
+	if _, _, err := phone.ReadMessage(); !websocket.IsCloseError(err, closeCodeSuspended) {
+		t.Errorf("expected close code %d, got %v", closeCodeSuspended, err)
+	}
+	if _, sanctioned := sanctionFor("mallory", now); !sanctioned {
+		t.Error("the suspension should be in force")
+	}
+	if _, sanctioned := sanctionFor("mallory", now.Add(25*time.Hour)); sanctioned {
+		t.Error("the suspension should end after its duration")
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSanctionsFromTheStore(t *testing.T) {
+	s := newTestServer(t)
+	ctx := context.Background()
+	alice, bob := s.newUser("Alice", ""), s.newUser("Bob", "")
+
+	// A ban written by the admin CLI or another instance is seen once the cached answer is stale.
+	if err := s.store.BanUser(UserBan{UserID: alice.ID, Reason: "spam", BannedAt: s.clock.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	s.clock.Advance(sanctionCacheTTL)
+	_, err := alice.api.CreateInvitation(ctx, plopclient.CreateInvitationParams{UserID: alice.ID, Pseudo: alice.Pseudo})
+	var apiErr *plopclient.APIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusForbidden {
+		t.Errorf("a banned user should not create invitations, got %v", err)
+	}
+
+	// The sanctions in force are loaded at startup, without a lookup per user.
+	until := s.clock.Now().Add(time.Hour)
+	s.store.BanUser(UserBan{UserID: bob.ID, Reason: "harassment", BannedAt: s.clock.Now(), ExpiresAt: &until})
+	resetConnectionState()
+	loadActiveSanctions()
+	sanctionCacheMutex.Lock()
+	cached := sanctionCache[bob.ID]
+	sanctionCacheMutex.Unlock()
+	if !cached.sanctioned || cached.ban.ExpiresAt == nil || !cached.ban.ExpiresAt.Equal(until) {
+		t.Errorf("the suspension of bob was not loaded: %+v", cached)
+	}
+}
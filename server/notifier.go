@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// --- Push Notifications ---
+
+// PushNotification is the content of a push notification, independent of the delivery service.
+type PushNotification struct {
+	SenderID  string
+	Title     string
+	Body      string
+	IsDefault bool
+	TTL       time.Duration // Zero means the service default
+}
+
+// Notifier delivers push notifications to the devices of offline users.
+type Notifier interface {
+	// Name identifies the implementation in logs.
+	Name() string
+	// Send pushes a notification to one device token. It returns an *UnregisteredTokenError
+	// when the token is no longer valid and should be forgotten.
+	Send(ctx context.Context, token string, n PushNotification) error
+}
+
+// UnregisteredTokenError reports that a push token is no longer valid for delivery.
+type UnregisteredTokenError struct {
+	Token string
+	Err   error
+}
+
+func (e *UnregisteredTokenError) Error() string {
+	return fmt.Sprintf("push token is unregistered: %v", e.Err)
+}
+
+func (e *UnregisteredTokenError) Unwrap() error {
+	return e.Err
+}
+
+// notifier is the push notification service in use, chosen at startup by initializeNotifier.
+var notifier Notifier = noopNotifier{}
+
+// noopNotifier drops every notification. It lets the server run without any push credentials (dev, CI).
+type noopNotifier struct{}
+
+func (noopNotifier) Name() string { return "noop" }
+
+func (noopNotifier) Send(ctx context.Context, token string, n PushNotification) error {
+	debugLog("[PUSH] noop notifier dropping notification from %s", n.SenderID)
+	return nil
+}
+
+// initializeNotifier selects the push notification service from the NOTIFIER environment variable:
+// "fcm" (default) for Firebase Cloud Messaging or "noop" to disable push notifications.
+func initializeNotifier() {
+	kind := getEnv("NOTIFIER", "fcm")
+	switch kind {
+	case "fcm":
+		fcm, err := newFCMNotifier()
+		if err != nil {
+			log.Fatalf("[FATAL] Could not initialize the FCM notifier (set NOTIFIER=noop to run without push notifications): %v", err)
+		}
+		notifier = fcm
+	case "noop":
+		notifier = noopNotifier{}
+	default:
+		log.Fatalf("[FATAL] Unknown NOTIFIER %q, expected 'fcm' or 'noop'", kind)
+	}
+	log.Printf("[INFO] Push notifications will be sent with the '%s' notifier.", notifier.Name())
+}
+
+// buildPushNotification prepares the notification announcing a message, titled with the sender's pseudo.
+// Encrypted plops get a generic notification: push services learn neither the content nor the sender's pseudo.
+func buildPushNotification(msg Message) PushNotification {
+	if msg.Payload.Envelope != nil {
+		return PushNotification{
+			SenderID:  msg.From,
+			Title:     encryptedPushTitle,
+			Body:      encryptedPushBody,
+			IsDefault: msg.IsDefault,
+			TTL:       messageTTL(msg),
+		}
+	}
+	senderPseudo, err := store.GetUserPseudo(msg.From)
+	if err != nil {
+		log.Printf("[PUSH] Error getting pseudo for user %s: %v. Using fallback.", msg.From, err)
+		senderPseudo = "Someone" // Fallback pseudo
+	}
+	if senderPseudo == "" {
+		senderPseudo = "Someone"
+	}
+
+	notificationBody := extractPayloadText(msg.Payload)
+	if notificationBody == "" {
+		notificationBody = "Plop"
+	}
+
+	return PushNotification{
+		SenderID:  msg.From,
+		Title:     senderPseudo,
+		Body:      notificationBody,
+		IsDefault: msg.IsDefault,
+		TTL:       messageTTL(msg),
+	}
+}
+
+// sendPushNotification sends a push notification to every device of an offline user.
+func sendPushNotification(msg Message) {
+	log.Printf("[PUSH] Attempting to send push notification from %s to %s with the '%s' notifier.", msg.From, msg.To, notifier.Name())
+
+	deviceTokens, err := store.GetUserDeviceTokens(msg.To)
+	if err != nil {
+		log.Printf("[PUSH] Error getting device tokens for user %s: %v", msg.To, err)
+		return
+	}
+
+	if len(deviceTokens) == 0 {
+		log.Printf("[PUSH] No push tokens found for user %s. Aborting push notification.", msg.To)
+		return
+	}
+
+	notification := buildPushNotification(msg)
+
+	ctx := context.Background()
+	var tokensToRemove []string
+	for _, token := range deviceTokens {
+		err := notifier.Send(ctx, token, notification)
+		recordPushOutcome(err)
+		var unregistered *UnregisteredTokenError
+		switch {
+		case errors.As(err, &unregistered):
+			log.Printf("[INFO] Invalid push token of user %s detected. Scheduling for removal.", msg.To)
+			tokensToRemove = append(tokensToRemove, token)
+		case err != nil:
+			log.Printf("[ERROR] Push send failed for user %s: %v", msg.To, err)
+		default:
+			log.Printf("[PUSH] Push notification sent successfully for user %s.", msg.To)
+		}
+	}
+
+	if len(tokensToRemove) > 0 {
+		removeInvalidTokens(msg.To, tokensToRemove)
+	}
+}
+
+// removeInvalidTokens cleans up push tokens that are no longer valid from the database.
+func removeInvalidTokens(userID string, tokensToRemove []string) {
+	log.Printf("[INFO] Removing %d invalid tokens for user %s.", len(tokensToRemove), userID)
+	if err := store.RemoveDevicePushTokens(userID, tokensToRemove); err != nil {
+		log.Printf("[ERROR] Could not remove invalid tokens for user %s: %v", userID, err)
+	}
+}
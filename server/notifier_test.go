@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+)
+
+// recordingNotifier is a Notifier fake that records every notification and
+// reports the tokens listed in 'unregistered' as no longer valid.
+type recordingNotifier struct {
+	mu           sync.Mutex
+	sent         map[string][]PushNotification
+	unregistered map[string]bool
+}
+
+func newRecordingNotifier(unregisteredTokens ...string) *recordingNotifier {
+	n := &recordingNotifier{sent: make(map[string][]PushNotification), unregistered: make(map[string]bool)}
+	for _, token := range unregisteredTokens {
+		n.unregistered[token] = true
+	}
+	return n
+}
+
+func (n *recordingNotifier) Name() string { return "recording" }
+
+func (n *recordingNotifier) Send(ctx context.Context, token string, notification PushNotification) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.unregistered[token] {
+		return &UnregisteredTokenError{Token: token, Err: errors.New("unregistered")}
+	}
+	n.sent[token] = append(n.sent[token], notification)
+	return nil
+}
+
+func (n *recordingNotifier) sentTo(token string) []PushNotification {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.sent[token]
+}
+
+// useNotifier swaps the global notifier for the duration of a test.
+func useNotifier(t *testing.T, n Notifier) {
+	previous := notifier
+	notifier = n
+	t.Cleanup(func() { notifier = previous })
+}
+
+func TestSendPushNotification(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	setDB(db)
+
+	recorder := newRecordingNotifier("stale-token")
+	useNotifier(t, recorder)
+
+	mock.ExpectQuery("SELECT push_tokens FROM devices").WithArgs("bob").
+		WillReturnRows(sqlmock.NewRows([]string{"push_tokens"}).
+			AddRow(pq.Array([]string{"good-token"})).
+			AddRow(pq.Array([]string{"stale-token"})))
+	mock.ExpectQuery("SELECT pseudo FROM user_pseudos").WithArgs("alice").
+		WillReturnRows(sqlmock.NewRows([]string{"pseudo"}).AddRow("Alice"))
+	// The stale token triggers a cleanup of that token only.
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT device_id, push_tokens FROM devices").WithArgs("bob", "").
+		WillReturnRows(sqlmock.NewRows([]string{"device_id", "push_tokens"}).
+			AddRow("phone", pq.Array([]string{"good-token"})).
+			AddRow("tablet", pq.Array([]string{"stale-token", "other-token"})))
+	mock.ExpectExec("UPDATE devices SET push_tokens").
+		WithArgs("bob", "tablet", pq.Array([]string{"other-token"})).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	sendPushNotification(Message{From: "alice", To: "bob", Payload: MessagePayload{Text: "J'arrive"}})
+
+	sent := recorder.sentTo("good-token")
+	if len(sent) != 1 {
+		t.Fatalf("expected 1 notification for good-token, got %d", len(sent))
+	}
+	if sent[0].Title != "Alice" || sent[0].Body != "J'arrive" || sent[0].SenderID != "alice" {
+		t.Errorf("unexpected notification: %+v", sent[0])
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unregistered token should trigger a token cleanup: %s", err)
+	}
+}
+
+func TestUnregisteredTokenErrorUnwrap(t *testing.T) {
+	cause := errors.New("NotRegistered")
+	var err error = &UnregisteredTokenError{Token: "t", Err: cause}
+
+	var unregistered *UnregisteredTokenError
+	if !errors.As(err, &unregistered) || unregistered.Token != "t" {
+		t.Error("errors.As should find the UnregisteredTokenError")
+	}
+	if !errors.Is(err, cause) {
+		t.Error("UnregisteredTokenError should unwrap to its cause")
+	}
+}
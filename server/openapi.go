@@ -0,0 +1,24 @@
+package main
+
+import (
+	_ "embed"
+	"log"
+	"net/http"
+)
+
+// --- API Documentation ---
+//
+// openapi.json documents every route of main.go, with the request and response types of models.go.
+// Tests check it against both. The Go client in plopclient is generated from it:
+//
+//go:generate go run ./cmd/openapigen -spec openapi.json -package plopclient -out plopclient/api.gen.go
+
+//go:embed openapi.json
+var openAPIDocument []byte
+
+// handleOpenAPI serves the OpenAPI document of the REST API.
+func handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	log.Println("[HTTP] Received request for /openapi.json")
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPIDocument)
+}
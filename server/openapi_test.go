@@ -0,0 +1,547 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+
+	"plop_server/internal/openapigen"
+	"plop_server/plopclient"
+)
+
+func loadOpenAPIDocument(t *testing.T) *openapigen.Document {
+	t.Helper()
+	doc, err := openapigen.Parse(openAPIDocument)
+	if err != nil {
+		t.Fatalf("openapi.json is invalid: %v", err)
+	}
+	return doc
+}
+
+// flattenSchema resolves a schema and merges its allOf parts into a single object schema.
+func flattenSchema(doc *openapigen.Document, s *openapigen.Schema) (*openapigen.Schema, error) {
+	if len(s.AllOf) == 1 && s.AllOf[0].Ref != "" && s.Type == "" {
+		return flattenSchema(doc, s.AllOf[0])
+	}
+	s, err := doc.Resolve(s)
+	if err != nil || len(s.AllOf) == 0 {
+		return s, err
+	}
+	merged := &openapigen.Schema{Type: "object", Properties: openapigen.Properties{Schemas: make(map[string]*openapigen.Schema)}}
+	for _, part := range append(append([]*openapigen.Schema{}, s.AllOf...), &openapigen.Schema{Properties: s.Properties, Required: s.Required}) {
+		part, err := flattenSchema(doc, part)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range part.Properties.Names {
+			merged.Properties.Names = append(merged.Properties.Names, name)
+			merged.Properties.Schemas[name] = part.Properties.Schemas[name]
+		}
+		merged.Required = append(merged.Required, part.Required...)
+	}
+	return merged, nil
+}
+
+// validateJSON checks a decoded JSON value against a schema. Objects with properties are closed:
+// a field the document does not list is an error, so that undocumented fields cannot creep in.
+func validateJSON(doc *openapigen.Document, s *openapigen.Schema, v interface{}, path string) error {
+	if v == nil {
+		if s.Nullable {
+			return nil
+		}
+		if resolved, err := doc.Resolve(s); err == nil && resolved.Nullable {
+			return nil
+		}
+		return fmt.Errorf("%s: null is not allowed", path)
+	}
+	s, err := flattenSchema(doc, s)
+	if err != nil {
+		return err
+	}
+	if len(s.OneOf) > 0 {
+		for _, option := range s.OneOf {
+			if validateJSON(doc, option, v, path) == nil {
+				return nil
+			}
+		}
+		return fmt.Errorf("%s: %v matches none of the oneOf schemas", path, v)
+	}
+
+	switch s.Type {
+	case "string":
+		str, ok := v.(string)
+		if !ok {
+			return fmt.Errorf("%s: want a string, got %v", path, v)
+		}
+		if len(s.Enum) > 0 && !contains(s.Enum, str) {
+			return fmt.Errorf("%s: %q is not one of %v", path, str, s.Enum)
+		}
+		if s.Format == "date-time" {
+			if _, err := time.Parse(time.RFC3339Nano, str); err != nil {
+				return fmt.Errorf("%s: %q is not a date-time", path, str)
+			}
+		}
+	case "integer", "number":
+		n, ok := v.(float64)
+		if !ok || s.Type == "integer" && n != math.Trunc(n) {
+			return fmt.Errorf("%s: want an %s, got %v", path, s.Type, v)
+		}
+	case "boolean":
+		if _, ok := v.(bool); !ok {
+			return fmt.Errorf("%s: want a boolean, got %v", path, v)
+		}
+	case "array":
+		items, ok := v.([]interface{})
+		if !ok {
+			return fmt.Errorf("%s: want an array, got %v", path, v)
+		}
+		for i, item := range items {
+			if err := validateJSON(doc, s.Items, item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+	case "object":
+		fields, ok := v.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s: want an object, got %v", path, v)
+		}
+		for _, name := range s.Required {
+			if _, found := fields[name]; !found {
+				return fmt.Errorf("%s: required property %s is missing", path, name)
+			}
+		}
+		for name, value := range fields {
+			prop, documented := s.Properties.Schemas[name]
+			switch {
+			case documented:
+			case s.AdditionalProperties != nil:
+				prop = s.AdditionalProperties
+			case len(s.Properties.Names) > 0:
+				return fmt.Errorf("%s: property %s is not documented", path, name)
+			default:
+				continue
+			}
+			if err := validateJSON(doc, prop, value, path+"."+name); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("%s: unsupported schema type %q", path, s.Type)
+	}
+	return nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// jsonFields returns the JSON fields of a struct type, with the fields of embedded structs.
+func jsonFields(t reflect.Type) map[string]reflect.Type {
+	fields := make(map[string]reflect.Type)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		switch {
+		case name == "-" || !f.IsExported():
+		case f.Anonymous && name == "":
+			for embeddedName, embeddedType := range jsonFields(f.Type) {
+				if _, shadowed := fields[embeddedName]; !shadowed {
+					fields[embeddedName] = embeddedType
+				}
+			}
+		case name == "":
+			fields[f.Name] = f.Type
+		default:
+			fields[name] = f.Type
+		}
+	}
+	return fields
+}
+
+// checkGoType checks that a Go type encodes to JSON matching a schema.
+func checkGoType(doc *openapigen.Document, s *openapigen.Schema, t reflect.Type, path string) error {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	s, err := flattenSchema(doc, s)
+	if err != nil {
+		return err
+	}
+	kindMatches := map[string]bool{
+		"string":  t.Kind() == reflect.String || t == reflect.TypeOf(time.Time{}),
+		"integer": t.Kind() >= reflect.Int && t.Kind() <= reflect.Int64,
+		"number":  t.Kind() == reflect.Float64,
+		"boolean": t.Kind() == reflect.Bool,
+		"array":   t.Kind() == reflect.Slice,
+		"object":  t.Kind() == reflect.Struct || t.Kind() == reflect.Map,
+	}
+	if !kindMatches[s.Type] {
+		return fmt.Errorf("%s: %s does not encode as %s", path, t, s.Type)
+	}
+	if (t == reflect.TypeOf(time.Time{})) != (s.Format == "date-time") {
+		return fmt.Errorf("%s: %s and format %q do not match", path, t, s.Format)
+	}
+	switch {
+	case s.Type == "array":
+		return checkGoType(doc, s.Items, t.Elem(), path+"[]")
+	case s.Type == "object" && t.Kind() == reflect.Map:
+		if s.AdditionalProperties == nil {
+			return fmt.Errorf("%s: maps must be documented with additionalProperties", path)
+		}
+		return checkGoType(doc, s.AdditionalProperties, t.Elem(), path+"{}")
+	case s.Type == "object":
+		fields := jsonFields(t)
+		var documented []string
+		for name, prop := range s.Properties.Schemas {
+			documented = append(documented, name)
+			fieldType, found := fields[name]
+			if !found {
+				return fmt.Errorf("%s: property %s is not a field of %s", path, name, t)
+			}
+			if prop.Ref != "" {
+				continue // Checked with its own schema
+			}
+			if err := checkGoType(doc, prop, fieldType, path+"."+name); err != nil {
+				return err
+			}
+		}
+		if len(documented) != len(fields) {
+			var missing []string
+			for name := range fields {
+				if _, found := s.Properties.Schemas[name]; !found {
+					missing = append(missing, name)
+				}
+			}
+			sort.Strings(missing)
+			return fmt.Errorf("%s: fields %v of %s are not documented", path, missing, t)
+		}
+	}
+	return nil
+}
+
+func TestOpenAPIDocumentsEveryRoute(t *testing.T) {
+	doc := loadOpenAPIDocument(t)
+
+	documented := func(pattern string) bool {
+		for path := range doc.Paths {
+			if path == pattern || strings.HasSuffix(pattern, "/") && strings.HasPrefix(path, pattern+"{") {
+				return true
+			}
+		}
+		return false
+	}
+	for _, route := range routes {
+		if !documented(route.pattern) {
+			t.Errorf("route %s is not documented in openapi.json", route.pattern)
+		}
+	}
+
+	operationIDs := make(map[string]bool)
+	for _, e := range doc.Endpoints() {
+		served := false
+		for _, route := range routes {
+			if e.Path == route.pattern || strings.HasSuffix(route.pattern, "/") && strings.HasPrefix(e.Path, route.pattern) {
+				served = true
+			}
+		}
+		if !served {
+			t.Errorf("%s %s is documented but not served", e.Method, e.Path)
+		}
+		if e.Operation.OperationID == "" || operationIDs[e.Operation.OperationID] {
+			t.Errorf("%s %s needs a unique operationId", e.Method, e.Path)
+		}
+		operationIDs[e.Operation.OperationID] = true
+		for code, response := range e.Operation.Responses {
+			if _, err := doc.ResolveResponse(response); err != nil {
+				t.Errorf("%s %s response %s: %v", e.Method, e.Path, code, err)
+			}
+		}
+		for _, p := range e.Operation.Parameters {
+			if _, err := doc.ResolveParameter(p); err != nil {
+				t.Errorf("%s %s: %v", e.Method, e.Path, err)
+			}
+		}
+	}
+}
+
+func TestOpenAPISchemasMatchModels(t *testing.T) {
+	doc := loadOpenAPIDocument(t)
+	models := map[string]interface{}{
+		"AccountExport":              AccountExport{},
+		"AccountSecretResponse":      AccountSecretResponse{},
+		"AvatarHashes":               map[int]string{},
+		"AvatarResponse":             AvatarResponse{},
+		"CancelScheduleRequest":      CancelScheduleRequest{},
+		"ChangePseudoRequest":        ChangePseudoRequest{},
+		"CreateInvitationResponse":   CreateInvitationResponse{},
+		"CreateReportRequest":        CreateReportRequest{},
+		"ComponentHealth":            ComponentHealth{},
+		"CreateReportResponse":       CreateReportResponse{},
+		"Device":                     Device{},
+		"DeviceExport":               DeviceExport{},
+		"DeviceKey":                  DeviceKey{},
+		"EncryptedEnvelope":          EncryptedEnvelope{},
+		"EndpointRequest":            EndpointRequest{},
+		"GenerateUserIDResponse":     GenerateUserIDResponse{},
+		"GetPseudosRequest":          GetPseudosRequest{},
+		"HealthResponse":             HealthResponse{},
+		"Invitation":                 Invitation{},
+		"LinkRequest":                LinkRequest{},
+		"LinkStatus":                 linkStatusPending,
+		"Message":                    Message{},
+		"MessagePayload":             MessagePayload{},
+		"PresenceInfo":               PresenceInfo{},
+		"PresenceRequest":            PresenceRequest{},
+		"PresenceSettings":           PresenceSettings{},
+		"PseudoResponse":             PseudoResponse{},
+		"PushSubscriptionJSON":       PushSubscriptionJSON{},
+		"PushSubscriptionKeys":       PushSubscriptionKeys{},
+		"RegisterDeviceRequest":      RegisterDeviceRequest{},
+		"RegisterDeviceResponse":     RegisterDeviceResponse{},
+		"RevokeDeviceRequest":        RevokeDeviceRequest{},
+		"ScheduledPlop":              ScheduledPlop{},
+		"SuccessResponse":            SuccessResponse{},
+		"SyncCodeResponse":           SyncCodeResponse{},
+		"SyncContactsRequest":        SyncContactsRequest{},
+		"SyncStatusResponse":         SyncStatusResponse{},
+		"UnifiedPushRegisterRequest": UnifiedPushRegisterRequest{},
+		"UpdateTokenRequest":         UpdateTokenRequest{},
+		"UseInvitationRequest":       UseInvitationRequest{},
+		"UseInvitationResponse":      UseInvitationResponse{},
+		"UseSyncCodeRequest":         UseSyncCodeRequest{},
+		"UseSyncCodeResponse":        UseSyncCodeResponse{},
+		"UserProfile":                UserProfile{},
+		"VAPIDPublicKeyResponse":     VAPIDPublicKeyResponse{},
+		"WebPushSubscribeRequest":    WebPushSubscribeRequest{},
+		"WebPushSubscription":        WebPushSubscription{},
+	}
+	for name, schema := range doc.Components.Schemas {
+		model, found := models[name]
+		if !found {
+			t.Errorf("schema %s is not mapped to a Go type", name)
+			continue
+		}
+		if err := checkGoType(doc, schema, reflect.TypeOf(model), name); err != nil {
+			t.Error(err)
+		}
+	}
+	for name := range models {
+		if _, found := doc.Components.Schemas[name]; !found {
+			t.Errorf("%s is not documented in openapi.json", name)
+		}
+	}
+}
+
+// checkResponse checks that a response is documented for an operation and matches its schema.
+func checkResponse(t *testing.T, doc *openapigen.Document, method, path string, rr *httptest.ResponseRecorder) {
+	t.Helper()
+	op := doc.Paths[path][strings.ToLower(method)]
+	if op == nil {
+		t.Fatalf("%s %s is not documented", method, path)
+	}
+	response, found := op.Responses[fmt.Sprint(rr.Code)]
+	if !found {
+		t.Fatalf("%s %s: status %d is not documented (body %q)", method, path, rr.Code, rr.Body.String())
+	}
+	response, err := doc.ResolveResponse(response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(response.Content) == 0 {
+		return
+	}
+	contentType, _, _ := mime.ParseMediaType(rr.Header().Get("Content-Type"))
+	media, found := response.Content[contentType]
+	if !found {
+		t.Fatalf("%s %s: content type %q of status %d is not documented", method, path, contentType, rr.Code)
+	}
+	if contentType != "application/json" {
+		return
+	}
+	var body interface{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+		t.Fatalf("%s %s: invalid JSON %q: %v", method, path, rr.Body.String(), err)
+	}
+	if err := validateJSON(doc, media.Schema, body, "response"); err != nil {
+		t.Errorf("%s %s: %v\n%s", method, path, err, rr.Body.String())
+	}
+}
+
+func TestOpenAPIResponsesMatchHandlers(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	setDB(db)
+	previousVAPIDKey := vapidKey
+	vapidKey = nil
+	t.Cleanup(func() { vapidKey = previousVAPIDKey })
+
+	doc := loadOpenAPIDocument(t)
+	mux := newMux()
+	noCredentials := func(userID string) {
+		mock.ExpectQuery("SELECT EXISTS").WithArgs(userID).WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+	}
+	now := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	key := strings.Repeat("A", 43) + "="
+
+	var syncCode, requestID string
+	steps := []struct {
+		method, target, path, body string
+		expect                     func()
+		status                     int
+		read                       func(body []byte)
+	}{
+		{method: "POST", target: "/users/generate-id", path: "/users/generate-id", status: http.StatusOK},
+		{method: "POST", target: "/users/generate-id?credentials=true", path: "/users/generate-id", status: http.StatusOK,
+			expect: func() {
+				mock.ExpectExec("INSERT INTO account_credentials").WillReturnResult(sqlmock.NewResult(0, 1))
+			}},
+		{method: "GET", target: "/sync/create?userId=alice", path: "/sync/create", status: http.StatusOK,
+			expect: func() { noCredentials("alice") },
+			read: func(body []byte) {
+				var resp SyncCodeResponse
+				json.Unmarshal(body, &resp)
+				syncCode = resp.Code
+			}},
+		{method: "POST", target: "/sync/use", path: "/sync/use", status: http.StatusAccepted,
+			body: `{"code":"%SYNC_CODE%","deviceId":"tablet","name":"Tablet","platform":"android"}`,
+			read: func(body []byte) {
+				var resp UseSyncCodeResponse
+				json.Unmarshal(body, &resp)
+				requestID = resp.RequestID
+			}},
+		{method: "GET", target: "/sync/status?requestId=%REQUEST_ID%", path: "/sync/status", status: http.StatusOK},
+		{method: "GET", target: "/sync/status?requestId=unknown", path: "/sync/status", status: http.StatusNotFound},
+		{method: "GET", target: "/users/keys?userId=alice&contactId=alice", path: "/users/keys", status: http.StatusOK,
+			expect: func() {
+				noCredentials("alice")
+				mock.ExpectQuery("SELECT device_id, public_key FROM devices").WithArgs("alice").
+					WillReturnRows(sqlmock.NewRows([]string{"device_id", "public_key"}).AddRow("phone", key))
+			}},
+		{method: "GET", target: "/devices/list?userId=alice", path: "/devices/list", status: http.StatusOK,
+			expect: func() {
+				noCredentials("alice")
+				mock.ExpectQuery("SELECT user_id, device_id, name").WithArgs("alice").
+					WillReturnRows(sqlmock.NewRows([]string{"user_id", "device_id", "name", "platform", "app_version", "locale", "public_key", "push_tokens", "created_at", "last_seen_at"}).
+						AddRow("alice", "phone", "Phone", "android", "1.2.0", "fr", key, pq.Array([]string{"fcm-token"}), now, now))
+			}},
+		{method: "POST", target: "/users/presence", path: "/users/presence", status: http.StatusOK,
+			body: `{"userId":"alice","userIds":["bob"]}`,
+			expect: func() {
+				noCredentials("alice")
+				mock.ExpectQuery("SELECT c.contact_id FROM contacts").WithArgs("alice").
+					WillReturnRows(sqlmock.NewRows([]string{"contact_id"}).AddRow("bob"))
+				mock.ExpectQuery("SELECT user_id, visibility").
+					WillReturnRows(sqlmock.NewRows([]string{"user_id", "visibility", "share_last_seen", "hidden_from", "last_seen"}).
+						AddRow("bob", presenceVisibilityContacts, true, "{}", now))
+			}},
+		{method: "GET", target: "/schedules/list?userId=alice", path: "/schedules/list", status: http.StatusOK,
+			expect: func() {
+				noCredentials("alice")
+				mock.ExpectQuery("SELECT id, owner_id").WithArgs("alice").
+					WillReturnRows(sqlmock.NewRows([]string{"id", "owner_id", "recipient_ids", "message_payload", "cron_expr", "timezone", "next_fire_at", "created_at"}))
+			}},
+		{method: "POST", target: "/reports", path: "/reports", status: http.StatusBadRequest,
+			body:   `{"userId":"alice","reportedUserId":"bob","reason":"boredom"}`,
+			expect: func() { noCredentials("alice") }},
+		{method: "POST", target: "/invitations/use", path: "/invitations/use", status: http.StatusBadRequest, body: `{`},
+		{method: "GET", target: "/webpush/vapid-public-key", path: "/webpush/vapid-public-key", status: http.StatusServiceUnavailable},
+		{method: "GET", target: "/openapi.json", path: "/openapi.json", status: http.StatusOK},
+		{method: "GET", target: "/ping", path: "/ping", status: http.StatusOK},
+		{method: "GET", target: "/healthz", path: "/healthz", status: http.StatusOK},
+		{method: "GET", target: "/readyz", path: "/readyz", status: http.StatusServiceUnavailable}, // The schema was never migrated
+	}
+	for _, step := range steps {
+		if step.expect != nil {
+			step.expect()
+		}
+		target := strings.ReplaceAll(step.target, "%REQUEST_ID%", requestID)
+		body := strings.ReplaceAll(step.body, "%SYNC_CODE%", syncCode)
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest(step.method, target, strings.NewReader(body)))
+		if rr.Code != step.status {
+			t.Fatalf("%s %s: got status %d, want %d (%s)", step.method, target, rr.Code, step.status, rr.Body.String())
+		}
+		checkResponse(t, doc, step.method, step.path, rr)
+		if step.read != nil {
+			step.read(rr.Body.Bytes())
+		}
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestGeneratedClientIsUpToDate(t *testing.T) {
+	source, err := openapigen.Generate(loadOpenAPIDocument(t), "plopclient", "openapi.json")
+	if err != nil {
+		t.Fatalf("Generate failed: %v", err)
+	}
+	current, err := os.ReadFile("plopclient/api.gen.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(source, current) {
+		t.Error("plopclient/api.gen.go is out of date with openapi.json: run go generate")
+	}
+}
+
+func TestGeneratedClient(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	setDB(db)
+
+	server := httptest.NewServer(newMux())
+	defer server.Close()
+	client := plopclient.New(server.URL)
+	client.Credentials = plopclient.Credentials{UserID: "alice", AccountSecret: "secret"}
+	ctx := context.Background()
+
+	if pong, err := client.Ping(ctx); pong != "pong" || err != nil {
+		t.Errorf("Ping() = %q, %v", pong, err)
+	}
+
+	mock.ExpectQuery("SELECT secret_hash FROM account_credentials").WithArgs("alice").
+		WillReturnRows(sqlmock.NewRows([]string{"secret_hash"}).AddRow(hashSecret("secret")))
+	sync, err := client.CreateSyncCode(ctx, plopclient.CreateSyncCodeParams{UserID: "alice"})
+	if err != nil || len(sync.Code) != 6 {
+		t.Fatalf("CreateSyncCode() = %+v, %v", sync, err)
+	}
+
+	link, err := client.UseSyncCode(ctx, plopclient.UseSyncCodeRequest{Code: sync.Code, Device: plopclient.Device{DeviceID: "tablet", Platform: "android"}})
+	if err != nil || link.Status != plopclient.LinkStatusPending {
+		t.Fatalf("UseSyncCode() = %+v, %v", link, err)
+	}
+
+	_, err = client.UseSyncCode(ctx, plopclient.UseSyncCodeRequest{Code: sync.Code, Device: plopclient.Device{DeviceID: "tablet"}})
+	if apiErr, ok := err.(*plopclient.APIError); !ok || apiErr.StatusCode != http.StatusNotFound || apiErr.Message != "Sync code is invalid or has expired" {
+		t.Errorf("a used sync code should be refused with a 404, got %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,860 @@
+// Code generated by openapigen from openapi.json. DO NOT EDIT.
+
+package plopclient
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+	"time"
+)
+
+// AccountExport is everything the server holds about a user.
+type AccountExport struct {
+	ExportedAt           time.Time             `json:"exportedAt"`
+	UserID               string                `json:"userId"`
+	Pseudo               string                `json:"pseudo"`
+	Avatar               AvatarHashes          `json:"avatar,omitempty"`
+	Devices              []DeviceExport        `json:"devices"`
+	Contacts             []string              `json:"contacts"`
+	PresenceSettings     *PresenceSettings     `json:"presenceSettings"`
+	Invitations          []Invitation          `json:"invitations"`
+	PendingMessages      []Message             `json:"pendingMessages"`
+	ScheduledPlops       []ScheduledPlop       `json:"scheduledPlops"`
+	WebPushSubscriptions []WebPushSubscription `json:"webPushSubscriptions"`
+	UnifiedPushEndpoints []string              `json:"unifiedPushEndpoints"`
+}
+
+// AccountSecretResponse is a new account secret.
+type AccountSecretResponse struct {
+	AccountSecret string `json:"accountSecret"`
+}
+
+// AvatarHashes is the avatar blob hash for each size, in pixels.
+type AvatarHashes map[string]string
+
+// AvatarResponse is the avatar of a user after an upload.
+type AvatarResponse struct {
+	Avatar AvatarHashes `json:"avatar"`
+}
+
+// CancelScheduleRequest is the body of /schedules/cancel.
+type CancelScheduleRequest struct {
+	UserID string `json:"userId"`
+	ID     string `json:"id"`
+}
+
+// ChangePseudoRequest is the body of /users/pseudo.
+type ChangePseudoRequest struct {
+	UserID string `json:"userId"`
+	Pseudo string `json:"pseudo"`
+}
+
+// ComponentHealth is the state of one of the components checked by /readyz.
+type ComponentHealth struct {
+	Status    string  `json:"status"`    // Degraded components do not fail the probe
+	LatencyMs float64 `json:"latencyMs"` // How long the check took
+	Error     string  `json:"error,omitempty"`
+}
+
+// CreateInvitationResponse is a new invitation code.
+type CreateInvitationResponse struct {
+	Code            string `json:"code"`
+	ValidityMinutes int    `json:"validityMinutes"`
+}
+
+// CreateReportRequest is the body of /reports.
+type CreateReportRequest struct {
+	UserID         string `json:"userId"`
+	ReportedUserID string `json:"reportedUserId"`
+	Reason         string `json:"reason"`
+	Details        string `json:"details,omitempty"`
+}
+
+// CreateReportResponse is a new abuse report.
+type CreateReportResponse struct {
+	ReportID string `json:"reportId"`
+	Status   string `json:"status"`
+}
+
+// Device is one installation of the app linked to a user account.
+type Device struct {
+	UserID     string    `json:"userId"`
+	DeviceID   string    `json:"deviceId"`
+	Name       string    `json:"name,omitempty"`
+	Platform   string    `json:"platform,omitempty"` // android, ios, web, linux, macos, windows or unknown
+	AppVersion string    `json:"appVersion,omitempty"`
+	Locale     string    `json:"locale,omitempty"`
+	PublicKey  string    `json:"publicKey,omitempty"` // X25519 public key, base64
+	CreatedAt  time.Time `json:"createdAt,omitempty"`
+	LastSeenAt time.Time `json:"lastSeenAt,omitempty"`
+}
+
+// DeviceExport is a device as included in an account export, push tokens included.
+type DeviceExport struct {
+	Device
+	PushTokens []string `json:"pushTokens"`
+}
+
+// DeviceKey is the public key of one of a user's devices.
+type DeviceKey struct {
+	DeviceID  string `json:"deviceId"`
+	PublicKey string `json:"publicKey"`
+}
+
+// EncryptedEnvelope is the content of an end-to-end encrypted plop. It is opaque to the server.
+type EncryptedEnvelope struct {
+	Alg            string            `json:"alg"` // Scheme chosen by the clients, e.g. 'x25519-hkdf-aes256gcm'
+	SenderDeviceID string            `json:"senderDeviceId"`
+	Keys           map[string]string `json:"keys"` // Content key wrapped for each recipient device, base64, by device ID
+	Nonce          string            `json:"nonce"`
+	Ciphertext     string            `json:"ciphertext"`
+}
+
+// EndpointRequest is the body of /webpush/unsubscribe and /unifiedpush/unregister.
+type EndpointRequest struct {
+	UserID   string `json:"userId"`
+	Endpoint string `json:"endpoint"`
+}
+
+// GenerateUserIDResponse is a new account: its user ID and, with credentials=true, its account secret.
+type GenerateUserIDResponse struct {
+	UserID        string `json:"userId"`
+	AccountSecret string `json:"accountSecret,omitempty"` // Only with credentials=true, and only ever returned here; see /users/rotate-secret
+}
+
+// GetPseudosRequest is the body of /users/get-pseudos.
+type GetPseudosRequest struct {
+	UserIDs        []string `json:"userIds"`
+	IncludeAvatars bool     `json:"includeAvatars,omitempty"`
+}
+
+// HealthResponse is the result of a health probe.
+type HealthResponse struct {
+	Status     string                     `json:"status"`
+	Components map[string]ComponentHealth `json:"components,omitempty"` // By component: database, migrations, notifier and draining. Only on /readyz
+}
+
+// Invitation is an invitation code created by a user.
+type Invitation struct {
+	Code          string    `json:"Code"`
+	CreatorUserID string    `json:"CreatorUserID"`
+	CreatorPseudo string    `json:"CreatorPseudo"`
+	ExpiresAt     time.Time `json:"ExpiresAt"`
+}
+
+// LinkRequest is a new device waiting for one of the user's devices to approve it.
+type LinkRequest struct {
+	ID         string     `json:"id"`
+	DeviceID   string     `json:"deviceId,omitempty"`
+	DeviceName string     `json:"deviceName,omitempty"`
+	Platform   string     `json:"platform,omitempty"`
+	Status     LinkStatus `json:"status,omitempty"`
+	ExpiresAt  time.Time  `json:"expiresAt"`
+}
+
+// LinkStatus is the status of a link request.
+type LinkStatus string
+
+// Values of LinkStatus.
+const (
+	LinkStatusPending  LinkStatus = "pending"
+	LinkStatusApproved LinkStatus = "approved"
+	LinkStatusDenied   LinkStatus = "denied"
+	LinkStatusExpired  LinkStatus = "expired"
+)
+
+// Message is a WebSocket frame, in both directions. Plops have an empty type; the other types are commands, replies and server events such as 'new_contact', 'presence', 'device_keys_changed' or 'rate_limited'.
+type Message struct {
+	ID        string         `json:"id,omitempty"` // Client-generated message ID, echoed back in status frames
+	Type      string         `json:"type"`
+	To        string         `json:"to,omitempty"`
+	From      string         `json:"from,omitempty"`
+	Payload   MessagePayload `json:"payload"`
+	IsDefault bool           `json:"isDefault,omitempty"`
+	IsPending bool           `json:"isPending,omitempty"`
+	TTL       int64          `json:"ttl,omitempty"` // Seconds the message stays deliverable; 0 means the server default
+}
+
+// MessagePayload is the payload of a Message. Which fields are set depends on the message type.
+type MessagePayload struct {
+	Text          string             `json:"text"`
+	Latitude      float64            `json:"latitude,omitempty"`
+	Longitude     float64            `json:"longitude,omitempty"`
+	RecipientID   string             `json:"recipientId,omitempty"`
+	UserID        string             `json:"userId,omitempty"`
+	Pseudo        string             `json:"pseudo,omitempty"`
+	MessageID     string             `json:"messageId,omitempty"`    // ID of the message a server status frame refers to
+	RetryAfterMs  int64              `json:"retryAfterMs,omitempty"` // Set on 'rate_limited' frames
+	Status        string             `json:"status,omitempty"`       // Set on 'presence' frames: 'online' or 'offline'
+	LastSeen      *time.Time         `json:"lastSeen,omitempty"`
+	Schedule      *ScheduledPlop     `json:"schedule,omitempty"`
+	Schedules     []ScheduledPlop    `json:"schedules,omitempty"`
+	DeviceID      string             `json:"deviceId,omitempty"` // Set on 'device_revoked' events
+	LinkRequest   *LinkRequest       `json:"linkRequest,omitempty"`
+	AccountSecret string             `json:"accountSecret,omitempty"` // Set on 'account_secret_rotated' events
+	Avatar        AvatarHashes       `json:"avatar,omitempty"`
+	Envelope      *EncryptedEnvelope `json:"envelope,omitempty"`
+	DeviceKeys    []DeviceKey        `json:"deviceKeys,omitempty"`
+}
+
+// PresenceInfo is what a viewer is allowed to know about the presence of a contact.
+type PresenceInfo struct {
+	Online   bool       `json:"online"`
+	LastSeen *time.Time `json:"lastSeen,omitempty"`
+}
+
+// PresenceRequest is the body of /users/presence.
+type PresenceRequest struct {
+	UserID  string   `json:"userId"`
+	UserIDs []string `json:"userIds"`
+}
+
+// PresenceSettings is who can see the presence of a user, and their last-seen timestamp.
+type PresenceSettings struct {
+	UserID        string     `json:"userId"`
+	Visibility    string     `json:"visibility"`
+	ShareLastSeen bool       `json:"shareLastSeen,omitempty"`
+	HiddenFrom    []string   `json:"hiddenFrom,omitempty"`
+	LastSeen      *time.Time `json:"lastSeen,omitempty"`
+}
+
+// PseudoResponse is the pseudo a user ends up with, once normalized.
+type PseudoResponse struct {
+	Pseudo string `json:"pseudo"`
+}
+
+// PushSubscriptionJSON is the JSON form of a browser's PushSubscription.
+type PushSubscriptionJSON struct {
+	Endpoint string               `json:"endpoint"`
+	Keys     PushSubscriptionKeys `json:"keys"`
+}
+
+// PushSubscriptionKeys is the keys of a browser push subscription, base64url.
+type PushSubscriptionKeys struct {
+	P256dh string `json:"p256dh"`
+	Auth   string `json:"auth"`
+}
+
+// RegisterDeviceRequest is the body of /devices/register: the device and its push token.
+type RegisterDeviceRequest struct {
+	Device
+	PushToken string `json:"pushToken,omitempty"` // FCM token of the device
+}
+
+// RegisterDeviceResponse is the result of /devices/register. New devices get their secret here, once.
+type RegisterDeviceResponse struct {
+	Success      bool   `json:"success"`
+	DeviceSecret string `json:"deviceSecret,omitempty"` // Issued to new devices, once
+}
+
+// RevokeDeviceRequest is the body of /devices/revoke.
+type RevokeDeviceRequest struct {
+	UserID   string `json:"userId"`
+	DeviceID string `json:"deviceId"`
+}
+
+// ScheduledPlop is a plop sent later by the server, either once (fireAt) or on a recurring cron schedule (cron).
+type ScheduledPlop struct {
+	ID           string         `json:"id,omitempty"`
+	OwnerID      string         `json:"ownerId"`
+	RecipientIDs []string       `json:"recipientIds"` // Contacts of the owner, at most 20. Those who are no longer contacts when the schedule fires are skipped
+	Payload      MessagePayload `json:"payload"`
+	FireAt       string         `json:"fireAt,omitempty"` // For a one-shot schedule: RFC 3339, or a local '2006-01-02T15:04' time in timezone
+	Cron         string         `json:"cron,omitempty"`   // For a recurring schedule: a 5-field cron expression firing at most once every 15 minutes
+	Timezone     string         `json:"timezone,omitempty"`
+	NextFireAt   time.Time      `json:"nextFireAt,omitempty"`
+	CreatedAt    time.Time      `json:"createdAt,omitempty"`
+}
+
+// SuccessResponse is the result of the endpoints that have nothing else to say.
+type SuccessResponse struct {
+	Success bool `json:"success"`
+}
+
+// SyncCodeResponse is a new sync code.
+type SyncCodeResponse struct {
+	Code string `json:"code"`
+}
+
+// SyncContactsRequest is the body of /contacts/sync.
+type SyncContactsRequest struct {
+	UserID     string   `json:"userId"`
+	ContactIDs []string `json:"contactIds"`
+}
+
+// SyncStatusResponse is the status of a link request. The account and the device secret are only set once it is approved.
+type SyncStatusResponse struct {
+	Status       LinkStatus `json:"status"`
+	UserID       string     `json:"userId,omitempty"`
+	Pseudo       string     `json:"pseudo,omitempty"`
+	DeviceSecret string     `json:"deviceSecret,omitempty"`
+}
+
+// UnifiedPushRegisterRequest is the body of /unifiedpush/register.
+type UnifiedPushRegisterRequest struct {
+	UserID   string `json:"userId"`
+	DeviceID string `json:"deviceId,omitempty"`
+	Endpoint string `json:"endpoint"`
+}
+
+// UpdateTokenRequest is the body of /users/update-token.
+type UpdateTokenRequest struct {
+	UserID     string `json:"userId"`
+	Token      string `json:"token"`
+	DeviceID   string `json:"deviceId,omitempty"`
+	Platform   string `json:"platform,omitempty"`
+	AppVersion string `json:"appVersion,omitempty"`
+	Locale     string `json:"locale,omitempty"`
+}
+
+// UseInvitationRequest is the body of /invitations/use.
+type UseInvitationRequest struct {
+	Code   string `json:"code"`
+	UserID string `json:"userId"`
+	Pseudo string `json:"pseudo,omitempty"` // Pseudo shown to the creator of the invitation
+}
+
+// UseInvitationResponse is the creator of a used invitation, with the keys of their devices.
+type UseInvitationResponse struct {
+	UserID     string      `json:"userId"`
+	Pseudo     string      `json:"pseudo"`
+	DeviceKeys []DeviceKey `json:"deviceKeys"`
+}
+
+// UseSyncCodeRequest is a sync code and the new device.
+type UseSyncCodeRequest struct {
+	Device
+	Code string `json:"code"`
+}
+
+// UseSyncCodeResponse is the link request created by /sync/use.
+type UseSyncCodeResponse struct {
+	RequestID string     `json:"requestId"`
+	Status    LinkStatus `json:"status"`
+	ExpiresAt time.Time  `json:"expiresAt"`
+}
+
+// UserProfile is what /users/get-pseudos returns for a user when avatars are requested.
+type UserProfile struct {
+	Pseudo string       `json:"pseudo"`
+	Avatar AvatarHashes `json:"avatar,omitempty"`
+}
+
+// VAPIDPublicKeyResponse is the VAPID public key of the server.
+type VAPIDPublicKeyResponse struct {
+	PublicKey string `json:"publicKey"` // Uncompressed P-256 point, base64url
+}
+
+// WebPushSubscribeRequest is the body of /webpush/subscribe.
+type WebPushSubscribeRequest struct {
+	UserID       string               `json:"userId"`
+	DeviceID     string               `json:"deviceId,omitempty"`
+	Subscription PushSubscriptionJSON `json:"subscription"`
+}
+
+// WebPushSubscription is a browser push subscription of one device.
+type WebPushSubscription struct {
+	UserID    string    `json:"userId"`
+	DeviceID  string    `json:"deviceId,omitempty"`
+	Endpoint  string    `json:"endpoint"`
+	P256dh    string    `json:"p256dh"`
+	Auth      string    `json:"auth"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// GetAvatar returns an avatar blob. Blobs never change and can be cached forever.
+//
+// GET /avatars/{hash}
+func (c *Client) GetAvatar(ctx context.Context, hash string) ([]byte, error) {
+	return c.do(ctx, "GET", "/avatars/"+url.PathEscape(hash), nil, "", nil)
+}
+
+// SyncContacts replaces the contacts a user declares on the server.
+//
+// POST /contacts/sync
+func (c *Client) SyncContacts(ctx context.Context, body SyncContactsRequest) (*SuccessResponse, error) {
+	var out SuccessResponse
+	if err := c.doJSON(ctx, "POST", "/contacts/sync", nil, body, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// ListDevicesParams are the query parameters of ListDevices.
+type ListDevicesParams struct {
+	UserID string
+}
+
+// ListDevices lists the devices of a user.
+//
+// GET /devices/list
+func (c *Client) ListDevices(ctx context.Context, params ListDevicesParams) ([]Device, error) {
+	query := url.Values{}
+	query.Set("userId", params.UserID)
+	var out []Device
+	if err := c.doJSON(ctx, "GET", "/devices/list", query, nil, &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// RegisterDevice registers a device or refreshes its details, push token and public key.
+//
+// POST /devices/register
+func (c *Client) RegisterDevice(ctx context.Context, body RegisterDeviceRequest) (*RegisterDeviceResponse, error) {
+	var out RegisterDeviceResponse
+	if err := c.doJSON(ctx, "POST", "/devices/register", nil, body, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// RenameDevice changes the display name of a device.
+//
+// POST /devices/rename
+func (c *Client) RenameDevice(ctx context.Context, body Device) (*SuccessResponse, error) {
+	var out SuccessResponse
+	if err := c.doJSON(ctx, "POST", "/devices/rename", nil, body, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// RevokeDevice signs a device out remotely, e.g. a lost phone.
+//
+// POST /devices/revoke
+func (c *Client) RevokeDevice(ctx context.Context, body RevokeDeviceRequest) (*SuccessResponse, error) {
+	var out SuccessResponse
+	if err := c.doJSON(ctx, "POST", "/devices/revoke", nil, body, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// GetLiveness tells whether the process is alive. It answers as long as it serves HTTP, whatever its dependencies do.
+//
+// GET /healthz
+func (c *Client) GetLiveness(ctx context.Context) (*HealthResponse, error) {
+	var out HealthResponse
+	if err := c.doJSON(ctx, "GET", "/healthz", nil, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// CreateInvitationParams are the query parameters of CreateInvitation.
+type CreateInvitationParams struct {
+	UserID string
+	Pseudo string // Pseudo shown to the user of the invitation
+}
+
+// CreateInvitation creates an invitation code another user can use to become a contact.
+//
+// POST /invitations/create
+func (c *Client) CreateInvitation(ctx context.Context, params CreateInvitationParams) (*CreateInvitationResponse, error) {
+	query := url.Values{}
+	query.Set("userId", params.UserID)
+	query.Set("pseudo", params.Pseudo)
+	var out CreateInvitationResponse
+	if err := c.doJSON(ctx, "POST", "/invitations/create", query, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// UseInvitation uses an invitation code. Its creator gets a 'new_contact' event.
+//
+// POST /invitations/use
+func (c *Client) UseInvitation(ctx context.Context, body UseInvitationRequest) (*UseInvitationResponse, error) {
+	var out UseInvitationResponse
+	if err := c.doJSON(ctx, "POST", "/invitations/use", nil, body, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// GetOpenAPI returns this document.
+//
+// GET /openapi.json
+func (c *Client) GetOpenAPI(ctx context.Context) (json.RawMessage, error) {
+	var out json.RawMessage
+	if err := c.doJSON(ctx, "GET", "/openapi.json", nil, nil, &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// Ping checks that the server is up.
+//
+// GET /ping
+func (c *Client) Ping(ctx context.Context) (string, error) {
+	data, err := c.do(ctx, "GET", "/ping", nil, "", nil)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// GetReadiness tells whether the server can receive traffic, checking the database, the schema migrations, the push notifier and whether it is draining.
+//
+// GET /readyz
+func (c *Client) GetReadiness(ctx context.Context) (*HealthResponse, error) {
+	var out HealthResponse
+	if err := c.doJSON(ctx, "GET", "/readyz", nil, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// CreateReport reports another user to the moderators.
+//
+// POST /reports
+func (c *Client) CreateReport(ctx context.Context, body CreateReportRequest) (*CreateReportResponse, error) {
+	var out CreateReportResponse
+	if err := c.doJSON(ctx, "POST", "/reports", nil, body, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// CancelSchedule deletes a scheduled plop.
+//
+// POST /schedules/cancel
+func (c *Client) CancelSchedule(ctx context.Context, body CancelScheduleRequest) (*SuccessResponse, error) {
+	var out SuccessResponse
+	if err := c.doJSON(ctx, "POST", "/schedules/cancel", nil, body, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// CreateSchedule creates a one-shot or recurring scheduled plop.
+//
+// POST /schedules/create
+func (c *Client) CreateSchedule(ctx context.Context, body ScheduledPlop) (*ScheduledPlop, error) {
+	var out ScheduledPlop
+	if err := c.doJSON(ctx, "POST", "/schedules/create", nil, body, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// ListSchedulesParams are the query parameters of ListSchedules.
+type ListSchedulesParams struct {
+	UserID string
+}
+
+// ListSchedules lists the scheduled plops created by a user.
+//
+// GET /schedules/list
+func (c *Client) ListSchedules(ctx context.Context, params ListSchedulesParams) ([]ScheduledPlop, error) {
+	query := url.Values{}
+	query.Set("userId", params.UserID)
+	var out []ScheduledPlop
+	if err := c.doJSON(ctx, "GET", "/schedules/list", query, nil, &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// CreateSyncCodeParams are the query parameters of CreateSyncCode.
+type CreateSyncCodeParams struct {
+	UserID string
+}
+
+// CreateSyncCode creates a code to link a new device to the account.
+//
+// GET /sync/create
+func (c *Client) CreateSyncCode(ctx context.Context, params CreateSyncCodeParams) (*SyncCodeResponse, error) {
+	query := url.Values{}
+	query.Set("userId", params.UserID)
+	var out SyncCodeResponse
+	if err := c.doJSON(ctx, "GET", "/sync/create", query, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// GetSyncStatusParams are the query parameters of GetSyncStatus.
+type GetSyncStatusParams struct {
+	RequestID string
+}
+
+// GetSyncStatus returns the status of a link request.
+//
+// GET /sync/status
+func (c *Client) GetSyncStatus(ctx context.Context, params GetSyncStatusParams) (*SyncStatusResponse, error) {
+	query := url.Values{}
+	query.Set("requestId", params.RequestID)
+	var out SyncStatusResponse
+	if err := c.doJSON(ctx, "GET", "/sync/status", query, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// UseSyncCode uses a sync code from a new device.
+//
+// POST /sync/use
+func (c *Client) UseSyncCode(ctx context.Context, body UseSyncCodeRequest) (*UseSyncCodeResponse, error) {
+	var out UseSyncCodeResponse
+	if err := c.doJSON(ctx, "POST", "/sync/use", nil, body, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// RegisterUnifiedPush registers the UnifiedPush distributor endpoint of a device.
+//
+// POST /unifiedpush/register
+func (c *Client) RegisterUnifiedPush(ctx context.Context, body UnifiedPushRegisterRequest) (*SuccessResponse, error) {
+	var out SuccessResponse
+	if err := c.doJSON(ctx, "POST", "/unifiedpush/register", nil, body, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// UnregisterUnifiedPush removes a UnifiedPush endpoint of the user.
+//
+// POST /unifiedpush/unregister
+func (c *Client) UnregisterUnifiedPush(ctx context.Context, body EndpointRequest) (*SuccessResponse, error) {
+	var out SuccessResponse
+	if err := c.doJSON(ctx, "POST", "/unifiedpush/unregister", nil, body, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// DeleteAvatarParams are the query parameters of DeleteAvatar.
+type DeleteAvatarParams struct {
+	UserID string // The calling user, when not sent in the X-User-Id header
+}
+
+// DeleteAvatar removes the avatar of the calling user.
+//
+// DELETE /users/avatar
+func (c *Client) DeleteAvatar(ctx context.Context, params DeleteAvatarParams) (*SuccessResponse, error) {
+	query := url.Values{}
+	if params.UserID != "" {
+		query.Set("userId", params.UserID)
+	}
+	var out SuccessResponse
+	if err := c.doJSON(ctx, "DELETE", "/users/avatar", query, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// UploadAvatarParams are the query parameters of UploadAvatar.
+type UploadAvatarParams struct {
+	UserID string // The calling user, when not sent in the X-User-Id header
+}
+
+// UploadAvatar sets the avatar of the calling user.
+//
+// POST /users/avatar
+func (c *Client) UploadAvatar(ctx context.Context, params UploadAvatarParams, contentType string, body []byte) (*AvatarResponse, error) {
+	query := url.Values{}
+	if params.UserID != "" {
+		query.Set("userId", params.UserID)
+	}
+	var out AvatarResponse
+	data, err := c.do(ctx, "POST", "/users/avatar", query, contentType, body)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// GenerateUserIDParams are the query parameters of GenerateUserID.
+type GenerateUserIDParams struct {
+	Credentials string // 'true' to get an account secret, for clients that send credentials
+}
+
+// GenerateUserID creates an account.
+//
+// POST /users/generate-id
+func (c *Client) GenerateUserID(ctx context.Context, params GenerateUserIDParams) (*GenerateUserIDResponse, error) {
+	query := url.Values{}
+	if params.Credentials != "" {
+		query.Set("credentials", params.Credentials)
+	}
+	var out GenerateUserIDResponse
+	if err := c.doJSON(ctx, "POST", "/users/generate-id", query, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// GetPseudos returns the pseudos of a list of users.
+//
+// POST /users/get-pseudos
+func (c *Client) GetPseudos(ctx context.Context, body GetPseudosRequest) (map[string]json.RawMessage, error) {
+	var out map[string]json.RawMessage
+	if err := c.doJSON(ctx, "POST", "/users/get-pseudos", nil, body, &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// GetDeviceKeysParams are the query parameters of GetDeviceKeys.
+type GetDeviceKeysParams struct {
+	UserID    string
+	ContactID string // A contact of the user, or the user themselves
+}
+
+// GetDeviceKeys returns the device public keys of a contact, to encrypt plops for them.
+//
+// GET /users/keys
+func (c *Client) GetDeviceKeys(ctx context.Context, params GetDeviceKeysParams) ([]DeviceKey, error) {
+	query := url.Values{}
+	query.Set("userId", params.UserID)
+	query.Set("contactId", params.ContactID)
+	var out []DeviceKey
+	if err := c.doJSON(ctx, "GET", "/users/keys", query, nil, &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// DeleteAccountParams are the query parameters of DeleteAccount.
+type DeleteAccountParams struct {
+	UserID string // The calling user, when not sent in the X-User-Id header
+}
+
+// DeleteAccount permanently deletes the calling user's account and all their data.
+//
+// DELETE /users/me
+func (c *Client) DeleteAccount(ctx context.Context, params DeleteAccountParams) (*SuccessResponse, error) {
+	query := url.Values{}
+	if params.UserID != "" {
+		query.Set("userId", params.UserID)
+	}
+	var out SuccessResponse
+	if err := c.doJSON(ctx, "DELETE", "/users/me", query, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// ExportAccountParams are the query parameters of ExportAccount.
+type ExportAccountParams struct {
+	UserID string // The calling user, when not sent in the X-User-Id header
+}
+
+// ExportAccount returns everything the server holds about the calling user.
+//
+// GET /users/me/export
+func (c *Client) ExportAccount(ctx context.Context, params ExportAccountParams) (*AccountExport, error) {
+	query := url.Values{}
+	if params.UserID != "" {
+		query.Set("userId", params.UserID)
+	}
+	var out AccountExport
+	if err := c.doJSON(ctx, "GET", "/users/me/export", query, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// GetPresence returns the presence of the requested users the requester is allowed to see.
+//
+// POST /users/presence
+func (c *Client) GetPresence(ctx context.Context, body PresenceRequest) (map[string]PresenceInfo, error) {
+	var out map[string]PresenceInfo
+	if err := c.doJSON(ctx, "POST", "/users/presence", nil, body, &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// UpdatePresenceSettings saves who can see the presence and last-seen timestamp of a user.
+//
+// POST /users/presence-settings
+func (c *Client) UpdatePresenceSettings(ctx context.Context, body PresenceSettings) (*SuccessResponse, error) {
+	var out SuccessResponse
+	if err := c.doJSON(ctx, "POST", "/users/presence-settings", nil, body, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// ChangePseudo changes the pseudo of a user.
+//
+// POST /users/pseudo
+func (c *Client) ChangePseudo(ctx context.Context, body ChangePseudoRequest) (*PseudoResponse, error) {
+	var out PseudoResponse
+	if err := c.doJSON(ctx, "POST", "/users/pseudo", nil, body, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// RotateAccountSecretParams are the query parameters of RotateAccountSecret.
+type RotateAccountSecretParams struct {
+	UserID string // The calling user, when not sent in the X-User-Id header
+}
+
+// RotateAccountSecret issues a new account secret.
+//
+// POST /users/rotate-secret
+func (c *Client) RotateAccountSecret(ctx context.Context, params RotateAccountSecretParams) (*AccountSecretResponse, error) {
+	query := url.Values{}
+	if params.UserID != "" {
+		query.Set("userId", params.UserID)
+	}
+	var out AccountSecretResponse
+	if err := c.doJSON(ctx, "POST", "/users/rotate-secret", query, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// UpdateToken saves the FCM token of a device.
+//
+// POST /users/update-token
+func (c *Client) UpdateToken(ctx context.Context, body UpdateTokenRequest) (*SuccessResponse, error) {
+	var out SuccessResponse
+	if err := c.doJSON(ctx, "POST", "/users/update-token", nil, body, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// SubscribeWebPush registers a browser push subscription for a device.
+//
+// POST /webpush/subscribe
+func (c *Client) SubscribeWebPush(ctx context.Context, body WebPushSubscribeRequest) (*SuccessResponse, error) {
+	var out SuccessResponse
+	if err := c.doJSON(ctx, "POST", "/webpush/subscribe", nil, body, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// UnsubscribeWebPush removes a browser push subscription of the user.
+//
+// POST /webpush/unsubscribe
+func (c *Client) UnsubscribeWebPush(ctx context.Context, body EndpointRequest) (*SuccessResponse, error) {
+	var out SuccessResponse
+	if err := c.doJSON(ctx, "POST", "/webpush/unsubscribe", nil, body, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// GetVAPIDPublicKey returns the VAPID public key browsers use as applicationServerKey.
+//
+// GET /webpush/vapid-public-key
+func (c *Client) GetVAPIDPublicKey(ctx context.Context) (*VAPIDPublicKeyResponse, error) {
+	var out VAPIDPublicKeyResponse
+	if err := c.doJSON(ctx, "GET", "/webpush/vapid-public-key", nil, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
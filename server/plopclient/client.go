@@ -0,0 +1,118 @@
+// Package plopclient is a Go client for the REST API of the Plop server.
+//
+// The types and the methods of Client are generated from the server's OpenAPI document
+// (openapi.json) into api.gen.go; run `go generate` in the server directory after changing it.
+// Real-time frames go through the WebSocket connection opened by Client.Dial.
+package plopclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// maxErrorBody caps how much of an error response is kept in an APIError.
+const maxErrorBody = 4096
+
+// Credentials authenticate the requests of a Client. Requests carry the device credentials when
+// both are set, and the account secret otherwise.
+type Credentials struct {
+	UserID        string
+	DeviceID      string
+	DeviceSecret  string
+	AccountSecret string
+}
+
+// Client calls the REST API of a Plop server.
+type Client struct {
+	BaseURL     string // e.g. "https://plop.example.com"
+	HTTPClient  *http.Client
+	Credentials Credentials
+}
+
+// New returns a client for the server at baseURL.
+func New(baseURL string) *Client {
+	return &Client{BaseURL: strings.TrimSuffix(baseURL, "/"), HTTPClient: http.DefaultClient}
+}
+
+// APIError is a response with an error status. The server describes errors in plain text.
+type APIError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("plop server: %d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+}
+
+// do sends a request and returns the body of a successful response.
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, contentType string, body []byte) ([]byte, error) {
+	target := c.BaseURL + path
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target, reader)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	c.authenticate(req)
+
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+		return nil, &APIError{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(message))}
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// doJSON sends in (if not nil) as JSON and decodes the response into out (if not nil).
+func (c *Client) doJSON(ctx context.Context, method, path string, query url.Values, in, out interface{}) error {
+	var body []byte
+	contentType := ""
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return err
+		}
+		contentType = "application/json"
+	}
+	data, err := c.do(ctx, method, path, query, contentType, body)
+	if err != nil || out == nil {
+		return err
+	}
+	return json.Unmarshal(data, out)
+}
+
+// authenticate sets the credential headers of a request.
+func (c *Client) authenticate(req *http.Request) {
+	creds := c.Credentials
+	if creds.UserID != "" {
+		req.Header.Set("X-User-Id", creds.UserID)
+	}
+	if creds.DeviceID != "" && creds.DeviceSecret != "" {
+		req.Header.Set("X-Device-Id", creds.DeviceID)
+		req.Header.Set("X-Device-Secret", creds.DeviceSecret)
+	} else if creds.AccountSecret != "" {
+		req.Header.Set("X-Account-Secret", creds.AccountSecret)
+	}
+}
@@ -0,0 +1,61 @@
+package plopclient
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+// Close codes the server sends when it disconnects a client on purpose. A client should not
+// reconnect after any of them without new credentials.
+const (
+	CloseDeviceRevoked      = 4001 // The device was signed out remotely
+	CloseAccountDeleted     = 4002 // The account was deleted
+	CloseCredentialsRotated = 4003 // The account secret was rotated
+	CloseAdminDisconnect    = 4004 // An operator closed the connection
+	CloseSuspended          = 4005 // The user is suspended; the reason says until when
+	CloseBanned             = 4006 // The user is banned
+)
+
+// WebSocketURL returns the URL of the real-time endpoint (/connect) for the client's user.
+// The pseudo, if any, is adopted by the server like the app's.
+func (c *Client) WebSocketURL(pseudo string) (string, error) {
+	u, err := url.Parse(c.BaseURL + "/connect")
+	if err != nil {
+		return "", err
+	}
+	switch u.Scheme {
+	case "http":
+		u.Scheme = "ws"
+	case "https":
+		u.Scheme = "wss"
+	}
+	query := url.Values{"userId": {c.Credentials.UserID}}
+	if pseudo != "" {
+		query.Set("pseudo", pseudo)
+	}
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+// Dial opens the WebSocket connection of the client's user, authenticated with its credentials.
+// Frames are JSON Messages in both directions. A refused handshake is returned as an *APIError.
+func (c *Client) Dial(ctx context.Context, pseudo string) (*websocket.Conn, error) {
+	target, err := c.WebSocketURL(pseudo)
+	if err != nil {
+		return nil, err
+	}
+	req := &http.Request{Header: make(http.Header)}
+	c.authenticate(req)
+	conn, resp, err := websocket.DefaultDialer.DialContext(ctx, target, req.Header)
+	if err == websocket.ErrBadHandshake && resp != nil {
+		defer resp.Body.Close()
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+		return nil, &APIError{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(message))}
+	}
+	return conn, err
+}
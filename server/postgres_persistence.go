@@ -1,11 +1,15 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"fmt"
 	"log"
 	"os"
+	"slices"
+	"strconv"
+	"time"
 
 	"github.com/lib/pq"
 	_ "github.com/lib/pq"
@@ -43,6 +47,11 @@ func initDB() {
 	createTables()
 }
 
+// Ping checks that the database answers.
+func (postgresStore) Ping(ctx context.Context) error {
+	return db.PingContext(ctx)
+}
+
 // getEnv retrieves an environment variable or returns a default value.
 func getEnv(key, fallback string) string {
 	if value, ok := os.LookupEnv(key); ok {
@@ -52,6 +61,17 @@ func getEnv(key, fallback string) string {
 	return fallback
 }
 
+// getEnvInt retrieves an integer environment variable or returns a default value if it is unset or invalid.
+func getEnvInt(key string, fallback int) int {
+	value := getEnv(key, strconv.Itoa(fallback))
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		log.Printf("[WARN] Environment variable %s=%q is not an integer, using fallback: %d", key, value, fallback)
+		return fallback
+	}
+	return parsed
+}
+
 // createTables ensures all necessary tables exist in the database.
 func createTables() {
 	log.Println("[DEBUG] Attempting to create/verify database tables...")
@@ -63,10 +83,18 @@ func createTables() {
         PRIMARY KEY (recipient_id, sender_id)
     );`
 
-	createUserDeviceTokensTable := `
-    CREATE TABLE IF NOT EXISTS user_device_tokens (
-        user_id TEXT PRIMARY KEY,
-        tokens TEXT[] NOT NULL
+	createDevicesTable := `
+    CREATE TABLE IF NOT EXISTS devices (
+        user_id TEXT NOT NULL,
+        device_id TEXT NOT NULL,
+        name TEXT NOT NULL DEFAULT '',
+        platform TEXT NOT NULL DEFAULT 'other',
+        app_version TEXT NOT NULL DEFAULT '',
+        locale TEXT NOT NULL DEFAULT '',
+        push_tokens TEXT[] NOT NULL DEFAULT '{}',
+        created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+        last_seen_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+        PRIMARY KEY (user_id, device_id)
     );`
 
 	createUserPseudosTable := `
@@ -83,11 +111,111 @@ func createTables() {
         expires_at TIMESTAMPTZ NOT NULL
     );`
 
+	createContactsTable := `
+    CREATE TABLE IF NOT EXISTS contacts (
+        user_id TEXT NOT NULL,
+        contact_id TEXT NOT NULL,
+        PRIMARY KEY (user_id, contact_id)
+    );`
+
+	createUserPresenceSettingsTable := `
+    CREATE TABLE IF NOT EXISTS user_presence_settings (
+        user_id TEXT PRIMARY KEY,
+        visibility TEXT NOT NULL DEFAULT 'nobody',
+        share_last_seen BOOLEAN NOT NULL DEFAULT FALSE,
+        hidden_from TEXT[] NOT NULL DEFAULT '{}',
+        last_seen TIMESTAMPTZ
+    );`
+
+	createScheduledPlopsTable := `
+    CREATE TABLE IF NOT EXISTS scheduled_plops (
+        id TEXT PRIMARY KEY,
+        owner_id TEXT NOT NULL,
+        recipient_ids TEXT[] NOT NULL,
+        message_payload JSONB NOT NULL,
+        cron_expr TEXT NOT NULL DEFAULT '',
+        timezone TEXT NOT NULL,
+        next_fire_at TIMESTAMPTZ NOT NULL,
+        created_at TIMESTAMPTZ NOT NULL
+    );`
+
+	createVAPIDKeysTable := `
+    CREATE TABLE IF NOT EXISTS vapid_keys (
+        id SMALLINT PRIMARY KEY,
+        private_key TEXT NOT NULL
+    );`
+
+	createWebPushSubscriptionsTable := `
+    CREATE TABLE IF NOT EXISTS web_push_subscriptions (
+        endpoint TEXT PRIMARY KEY,
+        user_id TEXT NOT NULL,
+        device_id TEXT NOT NULL DEFAULT '',
+        p256dh TEXT NOT NULL,
+        auth TEXT NOT NULL,
+        created_at TIMESTAMPTZ NOT NULL
+    );`
+
+	createUnifiedPushEndpointsTable := `
+    CREATE TABLE IF NOT EXISTS unifiedpush_endpoints (
+        endpoint TEXT PRIMARY KEY,
+        user_id TEXT NOT NULL,
+        device_id TEXT NOT NULL DEFAULT '',
+        created_at TIMESTAMPTZ NOT NULL
+    );`
+
+	createAccountCredentialsTable := `
+    CREATE TABLE IF NOT EXISTS account_credentials (
+        user_id TEXT PRIMARY KEY,
+        secret_hash TEXT NOT NULL,
+        rotated_at TIMESTAMPTZ NOT NULL
+    );`
+
+	createUserAvatarsTable := `
+    CREATE TABLE IF NOT EXISTS user_avatars (
+        user_id TEXT NOT NULL,
+        size INTEGER NOT NULL,
+        hash TEXT NOT NULL,
+        updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+        PRIMARY KEY (user_id, size)
+    );`
+
+	createUserBansTable := `
+    CREATE TABLE IF NOT EXISTS user_bans (
+        user_id TEXT PRIMARY KEY,
+        reason TEXT NOT NULL DEFAULT '',
+        banned_at TIMESTAMPTZ NOT NULL
+    );`
+
+	createReportsTable := `
+    CREATE TABLE IF NOT EXISTS reports (
+        id TEXT PRIMARY KEY,
+        reporter_id TEXT NOT NULL,
+        reported_id TEXT NOT NULL,
+        reason TEXT NOT NULL,
+        details TEXT NOT NULL DEFAULT '',
+        messages JSONB NOT NULL DEFAULT '[]',
+        status TEXT NOT NULL,
+        action TEXT NOT NULL DEFAULT '',
+        note TEXT NOT NULL DEFAULT '',
+        created_at TIMESTAMPTZ NOT NULL,
+        resolved_at TIMESTAMPTZ
+    );`
+
 	tables := map[string]string{
 		"pending_messages":     createPendingMessagesTable,
-		"user_device_tokens":   createUserDeviceTokensTable,
+		"devices":              createDevicesTable,
 		"user_pseudos":         createUserPseudosTable,
 		"invitations":          createInvitationsTable,
+		"contacts":             createContactsTable,
+		"user_presence_settings": createUserPresenceSettingsTable,
+		"scheduled_plops":        createScheduledPlopsTable,
+		"vapid_keys":             createVAPIDKeysTable,
+		"web_push_subscriptions": createWebPushSubscriptionsTable,
+		"unifiedpush_endpoints":  createUnifiedPushEndpointsTable,
+		"account_credentials":    createAccountCredentialsTable,
+		"user_avatars":           createUserAvatarsTable,
+		"user_bans":              createUserBansTable,
+		"reports":                createReportsTable,
 	}
 
 	for name, query := range tables {
@@ -96,30 +224,264 @@ func createTables() {
 			log.Fatalf("[FATAL] Could not create table %s: %v", name, err)
 		}
 	}
+
+	// Columns added after a table was first released. They must stay additive and idempotent.
+	migrations := []string{
+		`ALTER TABLE pending_messages ADD COLUMN IF NOT EXISTS message_id TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE pending_messages ADD COLUMN IF NOT EXISTS expires_at TIMESTAMPTZ`,
+		// The per-user token array was replaced by the devices table: each legacy token becomes its own device.
+		`DO $$ BEGIN
+            IF EXISTS (SELECT 1 FROM information_schema.tables WHERE table_name = 'user_device_tokens') THEN
+                INSERT INTO devices (user_id, device_id, push_tokens)
+                SELECT user_id, 'legacy-' || md5(token), ARRAY[token] FROM user_device_tokens, unnest(tokens) AS token
+                ON CONFLICT DO NOTHING;
+                DROP TABLE user_device_tokens;
+            END IF;
+        END $$`,
+		`ALTER TABLE devices ADD COLUMN IF NOT EXISTS secret_hash TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE devices ADD COLUMN IF NOT EXISTS revoked_at TIMESTAMPTZ`,
+		// Server events (e.g. 'account_deleted') are queued next to plops: one pending message per sender and type.
+		`ALTER TABLE pending_messages ADD COLUMN IF NOT EXISTS message_type TEXT NOT NULL DEFAULT ''`,
+		`DO $$ BEGIN
+            IF NOT EXISTS (SELECT 1 FROM information_schema.key_column_usage
+                           WHERE table_name = 'pending_messages' AND constraint_name = 'pending_messages_pkey' AND column_name = 'message_type') THEN
+                ALTER TABLE pending_messages DROP CONSTRAINT pending_messages_pkey;
+                ALTER TABLE pending_messages ADD PRIMARY KEY (recipient_id, sender_id, message_type);
+            END IF;
+        END $$`,
+		// Pseudos are unique case-insensitively. Rows saved before validation existed have no key until they change.
+		`ALTER TABLE user_pseudos ADD COLUMN IF NOT EXISTS pseudo_key TEXT`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS user_pseudos_pseudo_key ON user_pseudos (pseudo_key)`,
+		// Avatar blobs are shared by content, so they are only deleted once no row references them.
+		`CREATE INDEX IF NOT EXISTS user_avatars_hash ON user_avatars (hash)`,
+		// A ban with an expiry is a suspension.
+		`ALTER TABLE user_bans ADD COLUMN IF NOT EXISTS expires_at TIMESTAMPTZ`,
+		// Devices publish a public key so that contacts can encrypt plops for them.
+		`ALTER TABLE devices ADD COLUMN IF NOT EXISTS public_key TEXT NOT NULL DEFAULT ''`,
+		// Push endpoints are stored encrypted and looked up by blind index. Rows saved before have no key until a rekey.
+		`ALTER TABLE web_push_subscriptions ADD COLUMN IF NOT EXISTS endpoint_key TEXT`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS web_push_subscriptions_endpoint_key ON web_push_subscriptions (endpoint_key)`,
+		`ALTER TABLE unifiedpush_endpoints ADD COLUMN IF NOT EXISTS endpoint_key TEXT`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS unifiedpush_endpoints_endpoint_key ON unifiedpush_endpoints (endpoint_key)`,
+	}
+	for _, query := range migrations {
+		log.Printf("[DEBUG] Executing migration: %s", query)
+		if _, err := db.Exec(query); err != nil {
+			log.Fatalf("[FATAL] Could not apply migration %q: %v", query, err)
+		}
+	}
 	log.Println("[INFO] Database tables verified/created successfully.")
+	schemaReady.Store(true)
 }
 
 // --- Data Getters (On-Demand) ---
 
-// dbGetUserDeviceTokens retrieves all FCM tokens for a specific user.
-func dbGetUserDeviceTokens(userID string) ([]string, error) {
+// GetUserDeviceTokens retrieves the push tokens of all the active devices of a specific user.
+func (postgresStore) GetUserDeviceTokens(userID string) ([]string, error) {
 	log.Printf("[DEBUG] dbGetUserDeviceTokens called for userID: %s", userID)
-	var tokens []string
-	err := db.QueryRow("SELECT tokens FROM user_device_tokens WHERE user_id = $1", userID).Scan(pq.Array(&tokens))
+	rows, err := db.Query("SELECT push_tokens FROM devices WHERE user_id = $1 AND revoked_at IS NULL", userID)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			log.Printf("[INFO] No device tokens found for user %s. Returning empty slice.", userID)
-			return []string{}, nil // Return empty slice, not nil, for consistency
-		}
 		log.Printf("[ERROR] Failed to query device tokens for user %s: %v", userID, err)
 		return nil, err
 	}
-	log.Printf("[DEBUG] Successfully retrieved %d device token(s) for user %s: %v", len(tokens), userID, tokens)
+	defer rows.Close()
+
+	tokens := []string{}
+	for rows.Next() {
+		var deviceTokens []string
+		if err := rows.Scan(pq.Array(&deviceTokens)); err != nil {
+			log.Printf("[ERROR] Failed to scan device tokens row for user %s: %v", userID, err)
+			continue
+		}
+		tokens = append(tokens, decryptPushTokens(userID, deviceTokens)...)
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("[ERROR] Error during device tokens rows iteration for user %s: %v", userID, err)
+		return nil, err
+	}
+	log.Printf("[DEBUG] Successfully retrieved %d device token(s) for user %s", len(tokens), userID)
 	return tokens, nil
 }
 
-// dbGetUserPseudo retrieves the pseudo for a specific user.
-func dbGetUserPseudo(userID string) (string, error) {
+// deviceColumns lists the devices columns in the order expected by scanDevice.
+const deviceColumns = "user_id, device_id, name, platform, app_version, locale, public_key, push_tokens, created_at, last_seen_at"
+
+// scanDevice reads one devices row.
+func scanDevice(scanner interface{ Scan(dest ...interface{}) error }) (Device, error) {
+	var d Device
+	err := scanner.Scan(&d.UserID, &d.DeviceID, &d.Name, &d.Platform, &d.AppVersion, &d.Locale, &d.PublicKey, pq.Array(&d.PushTokens), &d.CreatedAt, &d.LastSeenAt)
+	d.PushTokens = decryptPushTokens(d.UserID, d.PushTokens)
+	return d, err
+}
+
+// encryptPushTokens returns the stored form of a user's push tokens.
+func encryptPushTokens(userID string, tokens []string) ([]string, error) {
+	stored := make([]string, 0, len(tokens))
+	for _, token := range tokens {
+		value, err := encryptColumn(token, pushTokenContext(userID))
+		if err != nil {
+			log.Printf("[ERROR] Failed to encrypt a push token of user %s: %v", userID, err)
+			return nil, err
+		}
+		stored = append(stored, value)
+	}
+	return stored, nil
+}
+
+// decryptPushTokens returns the push tokens of a user from their stored form, skipping those that cannot be read.
+func decryptPushTokens(userID string, stored []string) []string {
+	tokens := make([]string, 0, len(stored))
+	for _, value := range stored {
+		token, err := decryptColumn(value, pushTokenContext(userID))
+		if err != nil {
+			log.Printf("[ERROR] Failed to decrypt a push token of user %s: %v", userID, err)
+			continue
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens
+}
+
+// encryptWebPushSubscription returns the stored form of a browser push subscription: its endpoint and keys encrypted.
+func encryptWebPushSubscription(sub WebPushSubscription) (WebPushSubscription, error) {
+	stored := sub
+	var err error
+	if stored.Endpoint, err = encryptColumn(sub.Endpoint, webPushContext("endpoint", sub.UserID)); err != nil {
+		return WebPushSubscription{}, err
+	}
+	if stored.P256dh, err = encryptColumn(sub.P256dh, webPushContext("p256dh", sub.UserID)); err != nil {
+		return WebPushSubscription{}, err
+	}
+	if stored.Auth, err = encryptColumn(sub.Auth, webPushContext("auth", sub.UserID)); err != nil {
+		return WebPushSubscription{}, err
+	}
+	return stored, nil
+}
+
+// decryptWebPushSubscription reverses encryptWebPushSubscription in place.
+func decryptWebPushSubscription(sub *WebPushSubscription) error {
+	var err error
+	if sub.Endpoint, err = decryptColumn(sub.Endpoint, webPushContext("endpoint", sub.UserID)); err != nil {
+		return err
+	}
+	if sub.P256dh, err = decryptColumn(sub.P256dh, webPushContext("p256dh", sub.UserID)); err != nil {
+		return err
+	}
+	sub.Auth, err = decryptColumn(sub.Auth, webPushContext("auth", sub.UserID))
+	return err
+}
+
+// removePushTokensTx removes the given push tokens from the devices of a user other than exceptDeviceID.
+// Stored tokens are encrypted with random nonces, so they are compared here rather than in SQL.
+// It returns how many devices were updated.
+func removePushTokensTx(tx *sql.Tx, userID, exceptDeviceID string, tokens []string) (int, error) {
+	rows, err := tx.Query("SELECT device_id, push_tokens FROM devices WHERE user_id = $1 AND device_id <> $2 AND cardinality(push_tokens) > 0 FOR UPDATE", userID, exceptDeviceID)
+	if err != nil {
+		return 0, err
+	}
+	updates := make(map[string][]string)
+	for rows.Next() {
+		var deviceID string
+		var stored []string
+		if err := rows.Scan(&deviceID, pq.Array(&stored)); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		kept := make([]string, 0, len(stored))
+		for _, value := range stored {
+			if token, err := decryptColumn(value, pushTokenContext(userID)); err == nil && slices.Contains(tokens, token) {
+				continue
+			}
+			kept = append(kept, value)
+		}
+		if len(kept) < len(stored) {
+			updates[deviceID] = kept
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for deviceID, kept := range updates {
+		if _, err := tx.Exec("UPDATE devices SET push_tokens = $3 WHERE user_id = $1 AND device_id = $2", userID, deviceID, pq.Array(kept)); err != nil {
+			return 0, err
+		}
+	}
+	return len(updates), nil
+}
+
+// GetUserDevices retrieves the active (non-revoked) devices of a user, most recently seen first.
+func (postgresStore) GetUserDevices(userID string) ([]Device, error) {
+	log.Printf("[DEBUG] dbGetUserDevices called for userID: %s", userID)
+	rows, err := db.Query("SELECT "+deviceColumns+" FROM devices WHERE user_id = $1 AND revoked_at IS NULL ORDER BY last_seen_at DESC", userID)
+	if err != nil {
+		log.Printf("[ERROR] Failed to query devices for user %s: %v", userID, err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	devices := []Device{}
+	for rows.Next() {
+		d, err := scanDevice(rows)
+		if err != nil {
+			log.Printf("[ERROR] Failed to scan device row for user %s: %v", userID, err)
+			continue
+		}
+		devices = append(devices, d)
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("[ERROR] Error during devices rows iteration for user %s: %v", userID, err)
+		return nil, err
+	}
+	return devices, nil
+}
+
+// GetDeviceAuth retrieves the credentials state of a device: its secret hash (empty if none was issued)
+// and whether it was revoked.
+func (postgresStore) GetDeviceAuth(userID, deviceID string) (secretHash string, revoked bool, found bool, err error) {
+	err = db.QueryRow("SELECT secret_hash, revoked_at IS NOT NULL FROM devices WHERE user_id = $1 AND device_id = $2", userID, deviceID).Scan(&secretHash, &revoked)
+	if err == sql.ErrNoRows {
+		return "", false, false, nil
+	}
+	if err != nil {
+		log.Printf("[ERROR] Failed to query credentials of device %s of user %s: %v", deviceID, userID, err)
+		return "", false, false, err
+	}
+	return secretHash, revoked, true, nil
+}
+
+// UserHasCredentials reports whether a user has an account secret or a device that was given credentials.
+// Revoked devices count: revoking the last one must not let the user ID alone open the account again.
+func (postgresStore) UserHasCredentials(userID string) (bool, error) {
+	var exists bool
+	query := `
+    SELECT EXISTS (SELECT 1 FROM account_credentials WHERE user_id = $1)
+        OR EXISTS (SELECT 1 FROM devices WHERE user_id = $1 AND (secret_hash <> '' OR revoked_at IS NOT NULL));`
+	err := db.QueryRow(query, userID).Scan(&exists)
+	if err != nil {
+		log.Printf("[ERROR] Failed to check device credentials of user %s: %v", userID, err)
+		return false, err
+	}
+	return exists, nil
+}
+
+// GetAccountSecretHash retrieves the hash of a user's account secret, if one was issued.
+func (postgresStore) GetAccountSecretHash(userID string) (string, bool, error) {
+	var secretHash string
+	err := db.QueryRow("SELECT secret_hash FROM account_credentials WHERE user_id = $1", userID).Scan(&secretHash)
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	}
+	if err != nil {
+		log.Printf("[ERROR] Failed to query account secret of user %s: %v", userID, err)
+		return "", false, err
+	}
+	return secretHash, true, nil
+}
+
+// GetUserPseudo retrieves the pseudo for a specific user.
+func (postgresStore) GetUserPseudo(userID string) (string, error) {
 	log.Printf("[DEBUG] dbGetUserPseudo called for userID: %s", userID)
 	var pseudo string
 	err := db.QueryRow("SELECT pseudo FROM user_pseudos WHERE user_id = $1", userID).Scan(&pseudo)
@@ -131,12 +493,65 @@ func dbGetUserPseudo(userID string) (string, error) {
 		log.Printf("[ERROR] Failed to query pseudo for user %s: %v", userID, err)
 		return "", err
 	}
-	log.Printf("[DEBUG] Successfully retrieved pseudo for user %s: %s", userID, pseudo)
+	if pseudo, err = decryptColumn(pseudo, pseudoContext(userID)); err != nil {
+		log.Printf("[ERROR] Failed to decrypt pseudo of user %s: %v", userID, err)
+		return "", err
+	}
+	log.Printf("[DEBUG] Successfully retrieved pseudo for user %s.", userID)
 	return pseudo, nil
 }
 
-// dbGetUsersPseudos retrieves pseudos for a list of user IDs.
-func dbGetUsersPseudos(userIDs []string) (map[string]string, error) {
+// GetUserAvatar retrieves the avatar blob hash per size of a user. The map is empty when they have no avatar.
+func (s postgresStore) GetUserAvatar(userID string) (map[int]string, error) {
+	avatars, err := s.GetUsersAvatars([]string{userID})
+	if err != nil {
+		return nil, err
+	}
+	return avatars[userID], nil
+}
+
+// GetUsersAvatars retrieves the avatar blob hashes of a list of user IDs. Users without an avatar are left out.
+func (postgresStore) GetUsersAvatars(userIDs []string) (map[string]map[int]string, error) {
+	log.Printf("[DEBUG] dbGetUsersAvatars called for %d userIDs", len(userIDs))
+	avatars := make(map[string]map[int]string)
+	if len(userIDs) == 0 {
+		return avatars, nil
+	}
+
+	rows, err := db.Query("SELECT user_id, size, hash FROM user_avatars WHERE user_id = ANY($1)", pq.Array(userIDs))
+	if err != nil {
+		log.Printf("[ERROR] Failed to query avatars for userIDs %v: %v", userIDs, err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var userID, hash string
+		var size int
+		if err := rows.Scan(&userID, &size, &hash); err != nil {
+			log.Printf("[ERROR] Failed to scan avatar row: %v", err)
+			return nil, err
+		}
+		if avatars[userID] == nil {
+			avatars[userID] = make(map[int]string)
+		}
+		avatars[userID][size] = hash
+	}
+	return avatars, rows.Err()
+}
+
+// AvatarHashInUse reports whether any user's avatar still references a blob.
+func (postgresStore) AvatarHashInUse(hash string) (bool, error) {
+	var inUse bool
+	if err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM user_avatars WHERE hash = $1)", hash).Scan(&inUse); err != nil {
+		log.Printf("[ERROR] Failed to check whether avatar blob %s is in use: %v", hash, err)
+		return false, err
+	}
+	return inUse, nil
+}
+
+// GetUsersPseudos retrieves pseudos for a list of user IDs.
+func (postgresStore) GetUsersPseudos(userIDs []string) (map[string]string, error) {
 	log.Printf("[DEBUG] dbGetUsersPseudos called for %d userIDs: %v", len(userIDs), userIDs)
 	pseudos := make(map[string]string)
 	if len(userIDs) == 0 {
@@ -158,6 +573,10 @@ func dbGetUsersPseudos(userIDs []string) (map[string]string, error) {
 			log.Printf("[ERROR] Failed to scan pseudo row during dbGetUsersPseudos: %v", err)
 			continue // Skip this row and try the next
 		}
+		if pseudo, err = decryptColumn(pseudo, pseudoContext(userID)); err != nil {
+			log.Printf("[ERROR] Failed to decrypt pseudo of user %s: %v", userID, err)
+			continue
+		}
 		pseudos[userID] = pseudo
 		count++
 	}
@@ -170,8 +589,8 @@ func dbGetUsersPseudos(userIDs []string) (map[string]string, error) {
 	return pseudos, nil
 }
 
-// dbGetInvitation retrieves an invitation by its code.
-func dbGetInvitation(code string) (Invitation, bool, error) {
+// GetInvitation retrieves an invitation by its code.
+func (postgresStore) GetInvitation(code string) (Invitation, bool, error) {
 	log.Printf("[DEBUG] dbGetInvitation called for code: %s", code)
 	var inv Invitation
 	err := db.QueryRow("SELECT code, creator_user_id, creator_pseudo, expires_at FROM invitations WHERE code = $1", code).Scan(&inv.Code, &inv.CreatorUserID, &inv.CreatorPseudo, &inv.ExpiresAt)
@@ -183,187 +602,1630 @@ func dbGetInvitation(code string) (Invitation, bool, error) {
 		log.Printf("[ERROR] Failed to query invitation %s: %v", code, err)
 		return Invitation{}, false, err
 	}
-	log.Printf("[DEBUG] Successfully retrieved invitation for code %s: %+v", code, inv)
+	if inv.CreatorPseudo, err = decryptColumn(inv.CreatorPseudo, invitationPseudoContext(code)); err != nil {
+		log.Printf("[ERROR] Failed to decrypt creator pseudo of invitation %s: %v", code, err)
+		return Invitation{}, false, err
+	}
+	log.Printf("[DEBUG] Successfully retrieved invitation %s of user %s.", code, inv.CreatorUserID)
 	return inv, true, nil
 }
 
-// --- Data Savers/Deleters ---
-
-// dbSaveUserPseudo saves or updates a user's pseudo in the database.
-func dbSaveUserPseudo(userID, pseudo string) {
-	log.Printf("[DEBUG] dbSaveUserPseudo called for userID: %s, pseudo: %s", userID, pseudo)
+// GetMutualContacts retrieves the contacts of a user who also have that user in their own contacts.
+func (postgresStore) GetMutualContacts(userID string) ([]string, error) {
+	log.Printf("[DEBUG] dbGetMutualContacts called for userID: %s", userID)
 	query := `
-    INSERT INTO user_pseudos (user_id, pseudo)
-    VALUES ($1, $2)
-    ON CONFLICT (user_id) DO UPDATE SET pseudo = $2;`
-	res, err := db.Exec(query, userID, pseudo)
+    SELECT c.contact_id FROM contacts c
+    JOIN contacts r ON r.user_id = c.contact_id AND r.contact_id = c.user_id
+    WHERE c.user_id = $1;`
+	rows, err := db.Query(query, userID)
 	if err != nil {
-		log.Printf("[ERROR] Failed to save pseudo for user %s: %v", userID, err)
-		return
+		log.Printf("[ERROR] Failed to query mutual contacts for user %s: %v", userID, err)
+		return nil, err
 	}
-	rowsAffected, _ := res.RowsAffected()
-	log.Printf("[INFO] Successfully saved pseudo for user %s. Rows affected: %d", userID, rowsAffected)
-}
-
-// dbSaveUserDeviceTokens saves or updates a user's FCM tokens in the database.
-func dbSaveUserDeviceTokens(userID string, tokens []string) {
-	log.Printf("[DEBUG] dbSaveUserDeviceTokens called for userID: %s. Input tokens: %#v (is nil: %t, length: %d)", userID, tokens, tokens == nil, len(tokens))
+	defer rows.Close()
 
-	// Defensive check: Ensure tokens is not nil, convert to empty slice if it is,
-	// to prevent "violates not-null constraint" if the input `tokens` slice is nil.
-	actualTokens := tokens
-	if actualTokens == nil {
-		log.Printf("[WARN] dbSaveUserDeviceTokens received nil tokens slice for userID: %s. Converting to empty slice before DB operation.", userID)
-		actualTokens = []string{}
+	contactIDs := []string{}
+	for rows.Next() {
+		var contactID string
+		if err := rows.Scan(&contactID); err != nil {
+			log.Printf("[ERROR] Failed to scan contact row for user %s: %v", userID, err)
+			continue
+		}
+		contactIDs = append(contactIDs, contactID)
 	}
-
-	query := `
-    INSERT INTO user_device_tokens (user_id, tokens)
-    VALUES ($1, $2)
-    ON CONFLICT (user_id) DO UPDATE SET tokens = $2;`
-	res, err := db.Exec(query, userID, pq.Array(actualTokens))
-	if err != nil {
-		// The error message you provided is already logged here by default.
-		// "Failed to save device tokens for user %s: %v"
-		log.Printf("[ERROR] Failed to save device tokens for user %s with tokens %#v: %v", userID, actualTokens, err)
-		return
+	if err := rows.Err(); err != nil {
+		log.Printf("[ERROR] Error during contacts rows iteration for user %s: %v", userID, err)
+		return nil, err
 	}
-	rowsAffected, _ := res.RowsAffected()
-	log.Printf("[INFO] Successfully saved/updated device tokens for user %s. Tokens: %#v. Rows affected: %d", userID, actualTokens, rowsAffected)
+	log.Printf("[DEBUG] dbGetMutualContacts retrieved %d contacts for user %s.", len(contactIDs), userID)
+	return contactIDs, nil
 }
 
-// dbSaveInvitation adds a new invitation to the database.
-func dbSaveInvitation(inv Invitation) {
-	log.Printf("[DEBUG] dbSaveInvitation called for invitation: %+v", inv)
-	query := `
-    INSERT INTO invitations (code, creator_user_id, creator_pseudo, expires_at)
-    VALUES ($1, $2, $3, $4);`
-	res, err := db.Exec(query, inv.Code, inv.CreatorUserID, inv.CreatorPseudo, inv.ExpiresAt)
+// GetContactIDs retrieves every user linked to a user as a contact, in either direction.
+func (postgresStore) GetContactIDs(userID string) ([]string, error) {
+	log.Printf("[DEBUG] dbGetContactIDs called for userID: %s", userID)
+	rows, err := db.Query("SELECT contact_id FROM contacts WHERE user_id = $1 UNION SELECT user_id FROM contacts WHERE contact_id = $1", userID)
 	if err != nil {
-		log.Printf("[ERROR] Failed to save invitation %s: %v", inv.Code, err)
-		return
+		log.Printf("[ERROR] Failed to query contacts of user %s: %v", userID, err)
+		return nil, err
 	}
-	rowsAffected, _ := res.RowsAffected()
-	log.Printf("[INFO] Successfully saved invitation %s. Rows affected: %d", inv.Code, rowsAffected)
-}
+	defer rows.Close()
 
-// dbDeleteInvitation removes an invitation from the database.
-func dbDeleteInvitation(code string) {
-	log.Printf("[DEBUG] dbDeleteInvitation called for code: %s", code)
-	res, err := db.Exec("DELETE FROM invitations WHERE code = $1", code)
-	if err != nil {
-		log.Printf("[ERROR] Failed to delete invitation %s: %v", code, err)
-		return
+	contactIDs := []string{}
+	for rows.Next() {
+		var contactID string
+		if err := rows.Scan(&contactID); err != nil {
+			log.Printf("[ERROR] Failed to scan contact row for user %s: %v", userID, err)
+			continue
+		}
+		contactIDs = append(contactIDs, contactID)
 	}
-	rowsAffected, _ := res.RowsAffected()
-	log.Printf("[INFO] Attempted to delete invitation %s. Rows affected: %d", code, rowsAffected)
+	if err := rows.Err(); err != nil {
+		log.Printf("[ERROR] Error during contacts rows iteration for user %s: %v", userID, err)
+		return nil, err
+	}
+	return contactIDs, nil
 }
 
-// dbSavePendingMessage stores an offline message in the database.
-func dbSavePendingMessage(msg Message) {
-	log.Printf("[DEBUG] dbSavePendingMessage called for message to: %s, from: %s, payload type: %T", msg.To, msg.From, msg.Payload)
-	payloadBytes, err := json.Marshal(msg.Payload)
+// GetInvitationsByCreator retrieves the invitations created by a user that were not used yet.
+func (postgresStore) GetInvitationsByCreator(userID string) ([]Invitation, error) {
+	log.Printf("[DEBUG] dbGetInvitationsByCreator called for userID: %s", userID)
+	rows, err := db.Query("SELECT code, creator_user_id, creator_pseudo, expires_at FROM invitations WHERE creator_user_id = $1 ORDER BY expires_at", userID)
 	if err != nil {
-		log.Printf("[ERROR] Failed to marshal payload for pending message to %s from %s: %v", msg.To, msg.From, err)
-		return
+		log.Printf("[ERROR] Failed to query invitations of user %s: %v", userID, err)
+		return nil, err
 	}
-	// log.Printf("[DEBUG] Marshalled payload for pending message: %s", string(payloadBytes)) // Be cautious with logging full payloads
+	defer rows.Close()
 
-	query := `
-    INSERT INTO pending_messages (recipient_id, sender_id, message_payload)
-    VALUES ($1, $2, $3)
-    ON CONFLICT (recipient_id, sender_id) DO UPDATE SET message_payload = $3;`
-	res, err := db.Exec(query, msg.To, msg.From, payloadBytes)
-	if err != nil {
-		log.Printf("[ERROR] Failed to save pending message for %s from %s: %v", msg.To, msg.From, err)
-		return
+	invitations := []Invitation{}
+	for rows.Next() {
+		var inv Invitation
+		if err := rows.Scan(&inv.Code, &inv.CreatorUserID, &inv.CreatorPseudo, &inv.ExpiresAt); err != nil {
+			log.Printf("[ERROR] Failed to scan invitation row for user %s: %v", userID, err)
+			continue
+		}
+		if inv.CreatorPseudo, err = decryptColumn(inv.CreatorPseudo, invitationPseudoContext(inv.Code)); err != nil {
+			log.Printf("[ERROR] Failed to decrypt creator pseudo of invitation %s: %v", inv.Code, err)
+			continue
+		}
+		invitations = append(invitations, inv)
 	}
-	rowsAffected, _ := res.RowsAffected()
-	log.Printf("[INFO] Successfully saved pending message for %s from %s. Rows affected: %d", msg.To, msg.From, rowsAffected)
+	if err := rows.Err(); err != nil {
+		log.Printf("[ERROR] Error during invitations rows iteration for user %s: %v", userID, err)
+		return nil, err
+	}
+	return invitations, nil
 }
 
-// dbDeletePendingMessagesForUser removes all pending messages for a user from the database.
-func dbDeletePendingMessagesForUser(userID string) {
-	log.Printf("[DEBUG] dbDeletePendingMessagesForUser called for userID: %s", userID)
-	res, err := db.Exec("DELETE FROM pending_messages WHERE recipient_id = $1", userID)
+// GetPendingMessagesInvolving retrieves the pending messages a user sent or is waiting to receive.
+func (postgresStore) GetPendingMessagesInvolving(userID string) ([]Message, error) {
+	log.Printf("[DEBUG] dbGetPendingMessagesInvolving called for userID: %s", userID)
+	rows, err := db.Query("SELECT recipient_id, sender_id, message_type, message_payload, message_id FROM pending_messages WHERE recipient_id = $1 OR sender_id = $1", userID)
 	if err != nil {
-		log.Printf("[ERROR] Failed to delete pending messages for user %s: %v", userID, err)
-		return
+		log.Printf("[ERROR] Failed to query pending messages involving user %s: %v", userID, err)
+		return nil, err
 	}
-	rowsAffected, _ := res.RowsAffected()
-	log.Printf("[INFO] Attempted to delete pending messages for user %s. Rows affected: %d", userID, rowsAffected)
-}
+	defer rows.Close()
 
-// dbDeleteExpiredInvitations removes all expired invitations from the database.
-func dbDeleteExpiredInvitations() {
-	log.Println("[DEBUG] dbDeleteExpiredInvitations called.")
-	res, err := db.Exec("DELETE FROM invitations WHERE expires_at < NOW()")
-	if err != nil {
-		log.Printf("[ERROR] Failed to delete expired invitations: %v", err)
-		return
+	messages := []Message{}
+	for rows.Next() {
+		var msg Message
+		var payloadBytes []byte
+		if err := rows.Scan(&msg.To, &msg.From, &msg.Type, &payloadBytes, &msg.ID); err != nil {
+			log.Printf("[ERROR] Failed to scan pending message row for user %s: %v", userID, err)
+			continue
+		}
+		if payloadBytes, err = decryptJSONColumn(payloadBytes, pendingPayloadContext(msg.To)); err != nil {
+			log.Printf("[ERROR] Failed to decrypt pending message payload for user %s: %v", userID, err)
+			continue
+		}
+		if err := json.Unmarshal(payloadBytes, &msg.Payload); err != nil {
+			log.Printf("[ERROR] Failed to unmarshal pending message payload for user %s: %v", userID, err)
+			continue
+		}
+		msg.IsPending = true
+		messages = append(messages, msg)
 	}
-	rowsAffected, _ := res.RowsAffected()
-	if rowsAffected > 0 {
-		log.Printf("[INFO][CLEANUP] Deleted %d expired invitations from database.", rowsAffected)
-	} else {
-		log.Println("[DEBUG] No expired invitations found to delete.")
+	if err := rows.Err(); err != nil {
+		log.Printf("[ERROR] Error during pending messages rows iteration for user %s: %v", userID, err)
+		return nil, err
 	}
+	return messages, nil
 }
 
-// --- Business Logic Wrappers ---
+// GetPresenceSettings retrieves the presence settings for a list of user IDs.
+// Users without a row are absent from the returned map and must be treated as not sharing their presence.
+func (postgresStore) GetPresenceSettings(userIDs []string) (map[string]PresenceSettings, error) {
+	log.Printf("[DEBUG] dbGetPresenceSettings called for %d userIDs", len(userIDs))
+	settings := make(map[string]PresenceSettings)
+	if len(userIDs) == 0 {
+		return settings, nil
+	}
 
-// dbSendPendingMessages queries and delivers stored offline messages from the database.
-func dbSendPendingMessages(userID string, conn connection) {
-	log.Printf("[DEBUG] dbSendPendingMessages called for userID: %s", userID)
-	rows, err := db.Query("SELECT sender_id, message_payload FROM pending_messages WHERE recipient_id = $1", userID)
+	rows, err := db.Query("SELECT user_id, visibility, share_last_seen, hidden_from, last_seen FROM user_presence_settings WHERE user_id = ANY($1)", pq.Array(userIDs))
 	if err != nil {
-		log.Printf("[ERROR] Failed to query pending messages for user %s: %v", userID, err)
-		return
+		log.Printf("[ERROR] Failed to query presence settings for userIDs %v: %v", userIDs, err)
+		return nil, err
 	}
 	defer rows.Close()
 
-	var messagesToSend []Message
-	log.Printf("[DEBUG] Iterating over pending message rows for user %s...", userID)
 	for rows.Next() {
-		var senderID string
-		var payloadBytes []byte
-		if err := rows.Scan(&senderID, &payloadBytes); err != nil {
-			log.Printf("[ERROR] Failed to scan pending message row for user %s: %v", userID, err)
+		var ps PresenceSettings
+		var lastSeen sql.NullTime
+		if err := rows.Scan(&ps.UserID, &ps.Visibility, &ps.ShareLastSeen, pq.Array(&ps.HiddenFrom), &lastSeen); err != nil {
+			log.Printf("[ERROR] Failed to scan presence settings row: %v", err)
 			continue
 		}
-		// log.Printf("[DEBUG] Scanned pending message from %s, payload bytes length: %d", senderID, len(payloadBytes))
-
-        var msgPayload MessagePayload // Declare as the specific struct type
-        if err := json.Unmarshal(payloadBytes, &msgPayload); err != nil { // Unmarshal directly into it
-            log.Printf("[ERROR] Failed to unmarshal pending message payload for user %s from sender %s into MessagePayload: %v", userID, senderID, err)
-            continue
-        }
-		messagesToSend = append(messagesToSend, Message{From: senderID, To: userID, Payload: msgPayload, IsPending: true})
+		if lastSeen.Valid {
+			ps.LastSeen = &lastSeen.Time
+		}
+		settings[ps.UserID] = ps
 	}
-
 	if err := rows.Err(); err != nil {
-        log.Printf("[ERROR] Error during pending message rows iteration for user %s: %v", userID, err)
-        return
-    }
-
-	if len(messagesToSend) == 0 {
-		log.Printf("[INFO] No pending messages found in DB for user %s.", userID)
-		return
+		log.Printf("[ERROR] Error during presence settings rows iteration: %v", err)
+		return nil, err
 	}
+	return settings, nil
+}
 
-	log.Printf("[INFO] Found %d pending messages in DB for user %s. Attempting to send.", len(messagesToSend), userID)
+// scheduledPlopColumns lists the scheduled_plops columns in the order expected by scanScheduledPlop.
+const scheduledPlopColumns = "id, owner_id, recipient_ids, message_payload, cron_expr, timezone, next_fire_at, created_at"
 
-	for i, msg := range messagesToSend {
-		log.Printf("[DEBUG] Attempting to send pending message %d/%d from %s to %s via connection.", i+1, len(messagesToSend), msg.From, userID)
-		if err := conn.WriteJSON(msg); err != nil {
-			log.Printf("[ERROR] Failed to send pending message from %s to %s: %v. Message will remain in DB for next attempt.", msg.From, userID, err)
-			return // Stop trying to send further messages on this connection if one fails
-		}
-		log.Printf("[INFO] Successfully sent pending message %d/%d from %s to %s.", i+1, len(messagesToSend), msg.From, userID)
+// scanScheduledPlop reads one scheduled_plops row.
+func scanScheduledPlop(scanner interface{ Scan(dest ...interface{}) error }) (ScheduledPlop, error) {
+	var sp ScheduledPlop
+	var payloadBytes []byte
+	if err := scanner.Scan(&sp.ID, &sp.OwnerID, pq.Array(&sp.RecipientIDs), &payloadBytes, &sp.Cron, &sp.Timezone, &sp.NextFireAt, &sp.CreatedAt); err != nil {
+		return sp, err
 	}
+	if err := json.Unmarshal(payloadBytes, &sp.Payload); err != nil {
+		return sp, err
+	}
+	return sp, nil
+}
 
-	log.Printf("[INFO] All %d pending messages for %s sent successfully. Clearing them from DB.", len(messagesToSend), userID)
-	go dbDeletePendingMessagesForUser(userID) // This is asynchronous
+// GetScheduledPlopsForUser retrieves all the schedules created by a user, soonest first.
+func (postgresStore) GetScheduledPlopsForUser(ownerID string) ([]ScheduledPlop, error) {
+	log.Printf("[DEBUG] dbGetScheduledPlopsForUser called for ownerID: %s", ownerID)
+	rows, err := db.Query("SELECT "+scheduledPlopColumns+" FROM scheduled_plops WHERE owner_id = $1 ORDER BY next_fire_at", ownerID)
+	if err != nil {
+		log.Printf("[ERROR] Failed to query scheduled plops for user %s: %v", ownerID, err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	schedules := []ScheduledPlop{}
+	for rows.Next() {
+		sp, err := scanScheduledPlop(rows)
+		if err != nil {
+			log.Printf("[ERROR] Failed to scan scheduled plop row for user %s: %v", ownerID, err)
+			continue
+		}
+		schedules = append(schedules, sp)
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("[ERROR] Error during scheduled plops rows iteration for user %s: %v", ownerID, err)
+		return nil, err
+	}
+	return schedules, nil
+}
+
+// CountScheduledPlopsForUser returns how many schedules a user currently has.
+func (postgresStore) CountScheduledPlopsForUser(ownerID string) (int, error) {
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM scheduled_plops WHERE owner_id = $1", ownerID).Scan(&count); err != nil {
+		log.Printf("[ERROR] Failed to count scheduled plops for user %s: %v", ownerID, err)
+		return 0, err
+	}
+	return count, nil
+}
+
+// GetOrCreateVAPIDPrivateKey returns the stored VAPID private key, storing a new one from 'generate' if none exists.
+// Concurrent first starts agree on a single key thanks to ON CONFLICT DO NOTHING.
+func (postgresStore) GetOrCreateVAPIDPrivateKey(generate func() (string, error)) (string, error) {
+	var key string
+	err := db.QueryRow("SELECT private_key FROM vapid_keys WHERE id = 1").Scan(&key)
+	if err == nil {
+		return key, nil
+	}
+	if err != sql.ErrNoRows {
+		log.Printf("[ERROR] Failed to query VAPID key: %v", err)
+		return "", err
+	}
+
+	generated, err := generate()
+	if err != nil {
+		return "", err
+	}
+	if _, err := db.Exec("INSERT INTO vapid_keys (id, private_key) VALUES (1, $1) ON CONFLICT (id) DO NOTHING", generated); err != nil {
+		log.Printf("[ERROR] Failed to save VAPID key: %v", err)
+		return "", err
+	}
+	log.Println("[INFO] Generated and stored a new VAPID key pair.")
+	if err := db.QueryRow("SELECT private_key FROM vapid_keys WHERE id = 1").Scan(&key); err != nil {
+		log.Printf("[ERROR] Failed to read back VAPID key: %v", err)
+		return "", err
+	}
+	return key, nil
+}
+
+// GetWebPushSubscriptions retrieves all browser push subscriptions of a user.
+func (postgresStore) GetWebPushSubscriptions(userID string) ([]WebPushSubscription, error) {
+	log.Printf("[DEBUG] dbGetWebPushSubscriptions called for userID: %s", userID)
+	rows, err := db.Query("SELECT user_id, device_id, endpoint, p256dh, auth, created_at FROM web_push_subscriptions WHERE user_id = $1", userID)
+	if err != nil {
+		log.Printf("[ERROR] Failed to query web push subscriptions for user %s: %v", userID, err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var subscriptions []WebPushSubscription
+	for rows.Next() {
+		var sub WebPushSubscription
+		if err := rows.Scan(&sub.UserID, &sub.DeviceID, &sub.Endpoint, &sub.P256dh, &sub.Auth, &sub.CreatedAt); err != nil {
+			log.Printf("[ERROR] Failed to scan web push subscription row for user %s: %v", userID, err)
+			continue
+		}
+		if err := decryptWebPushSubscription(&sub); err != nil {
+			log.Printf("[ERROR] Failed to decrypt web push subscription of user %s: %v", userID, err)
+			continue
+		}
+		subscriptions = append(subscriptions, sub)
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("[ERROR] Error during web push subscriptions rows iteration for user %s: %v", userID, err)
+		return nil, err
+	}
+	return subscriptions, nil
+}
+
+// GetUnifiedPushEndpoints retrieves all UnifiedPush endpoints of a user.
+func (postgresStore) GetUnifiedPushEndpoints(userID string) ([]string, error) {
+	log.Printf("[DEBUG] dbGetUnifiedPushEndpoints called for userID: %s", userID)
+	rows, err := db.Query("SELECT endpoint FROM unifiedpush_endpoints WHERE user_id = $1", userID)
+	if err != nil {
+		log.Printf("[ERROR] Failed to query UnifiedPush endpoints for user %s: %v", userID, err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var endpoints []string
+	for rows.Next() {
+		var endpoint string
+		if err := rows.Scan(&endpoint); err != nil {
+			log.Printf("[ERROR] Failed to scan UnifiedPush endpoint row for user %s: %v", userID, err)
+			continue
+		}
+		if endpoint, err = decryptColumn(endpoint, unifiedPushContext(userID)); err != nil {
+			log.Printf("[ERROR] Failed to decrypt UnifiedPush endpoint of user %s: %v", userID, err)
+			continue
+		}
+		endpoints = append(endpoints, endpoint)
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("[ERROR] Error during UnifiedPush endpoints rows iteration for user %s: %v", userID, err)
+		return nil, err
+	}
+	return endpoints, nil
+}
+
+// --- Data Savers/Deleters ---
+
+// SetUserPseudo stores a user's pseudo with its case-insensitive key. It returns errPseudoTaken
+// when another user already holds the same key.
+func (postgresStore) SetUserPseudo(userID, pseudo, key string) error {
+	log.Printf("[DEBUG] dbSetUserPseudo called for userID: %s", userID)
+	stored, err := encryptColumn(pseudo, pseudoContext(userID))
+	if err != nil {
+		log.Printf("[ERROR] Failed to encrypt pseudo of user %s: %v", userID, err)
+		return err
+	}
+	query := `
+    INSERT INTO user_pseudos (user_id, pseudo, pseudo_key)
+    VALUES ($1, $2, $3)
+    ON CONFLICT (user_id) DO UPDATE SET pseudo = $2, pseudo_key = $3;`
+	if _, err := db.Exec(query, userID, stored, key); err != nil {
+		if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" { // unique_violation
+			return errPseudoTaken
+		}
+		log.Printf("[ERROR] Failed to save pseudo for user %s: %v", userID, err)
+		return err
+	}
+	log.Printf("[INFO] Successfully saved pseudo for user %s.", userID)
+	return nil
+}
+
+// SetUserAvatar replaces the avatar blob hashes of a user.
+func (postgresStore) SetUserAvatar(userID string, hashes map[int]string) error {
+	log.Printf("[DEBUG] dbSetUserAvatar called for userID: %s", userID)
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("[ERROR] Failed to begin transaction to save avatar of user %s: %v", userID, err)
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM user_avatars WHERE user_id = $1", userID); err != nil {
+		log.Printf("[ERROR] Failed to clear avatar of user %s: %v", userID, err)
+		return err
+	}
+	for size, hash := range hashes {
+		if _, err := tx.Exec("INSERT INTO user_avatars (user_id, size, hash, updated_at) VALUES ($1, $2, $3, NOW())", userID, size, hash); err != nil {
+			log.Printf("[ERROR] Failed to save the %dpx avatar of user %s: %v", size, userID, err)
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("[ERROR] Failed to commit avatar of user %s: %v", userID, err)
+		return err
+	}
+	return nil
+}
+
+// DeleteUserAvatar removes the avatar of a user.
+func (postgresStore) DeleteUserAvatar(userID string) error {
+	log.Printf("[DEBUG] dbDeleteUserAvatar called for userID: %s", userID)
+	if _, err := db.Exec("DELETE FROM user_avatars WHERE user_id = $1", userID); err != nil {
+		log.Printf("[ERROR] Failed to delete avatar of user %s: %v", userID, err)
+		return err
+	}
+	return nil
+}
+
+// UpsertDevice registers a device or refreshes its details. Empty fields keep their stored value,
+// and a push token moves to this device if another device of the same user held it.
+func (postgresStore) UpsertDevice(d Device) error {
+	log.Printf("[DEBUG] dbUpsertDevice called for userID: %s, deviceID: %s, platform: %s", d.UserID, d.DeviceID, d.Platform)
+	pushTokens, err := encryptPushTokens(d.UserID, d.PushTokens)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("[ERROR] Failed to begin transaction to upsert device %s of user %s: %v", d.DeviceID, d.UserID, err)
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `
+    INSERT INTO devices (user_id, device_id, name, platform, app_version, locale, push_tokens, created_at, last_seen_at)
+    VALUES ($1, $2, $3, COALESCE(NULLIF($4, ''), 'other'), $5, $6, $7, NOW(), NOW())
+    ON CONFLICT (user_id, device_id) DO UPDATE SET
+        name = COALESCE(NULLIF($3, ''), devices.name),
+        platform = COALESCE(NULLIF($4, ''), devices.platform),
+        app_version = COALESCE(NULLIF($5, ''), devices.app_version),
+        locale = COALESCE(NULLIF($6, ''), devices.locale),
+        push_tokens = CASE WHEN cardinality($7::TEXT[]) > 0 THEN $7::TEXT[] ELSE devices.push_tokens END,
+        last_seen_at = NOW()
+    WHERE devices.revoked_at IS NULL;`
+	if _, err := tx.Exec(query, d.UserID, d.DeviceID, d.Name, d.Platform, d.AppVersion, d.Locale, pq.Array(pushTokens)); err != nil {
+		log.Printf("[ERROR] Failed to upsert device %s of user %s: %v", d.DeviceID, d.UserID, err)
+		return err
+	}
+	if len(d.PushTokens) > 0 {
+		if _, err := removePushTokensTx(tx, d.UserID, d.DeviceID, d.PushTokens); err != nil {
+			log.Printf("[ERROR] Failed to move push tokens to device %s of user %s: %v", d.DeviceID, d.UserID, err)
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("[ERROR] Failed to commit device %s of user %s: %v", d.DeviceID, d.UserID, err)
+		return err
+	}
+	log.Printf("[INFO] Successfully upserted device %s of user %s.", d.DeviceID, d.UserID)
+	return nil
+}
+
+// SetDevicePublicKey stores the public key of an active device. It reports whether the key changed.
+func (postgresStore) SetDevicePublicKey(userID, deviceID, publicKey string) (bool, error) {
+	log.Printf("[DEBUG] dbSetDevicePublicKey called for userID: %s, deviceID: %s", userID, deviceID)
+	res, err := db.Exec("UPDATE devices SET public_key = $3 WHERE user_id = $1 AND device_id = $2 AND revoked_at IS NULL AND public_key <> $3", userID, deviceID, publicKey)
+	if err != nil {
+		log.Printf("[ERROR] Failed to store public key of device %s of user %s: %v", deviceID, userID, err)
+		return false, err
+	}
+	rowsAffected, _ := res.RowsAffected()
+	return rowsAffected > 0, nil
+}
+
+// GetDeviceKeys retrieves the public keys of the active devices of a user that published one.
+func (postgresStore) GetDeviceKeys(userID string) ([]DeviceKey, error) {
+	log.Printf("[DEBUG] dbGetDeviceKeys called for userID: %s", userID)
+	rows, err := db.Query("SELECT device_id, public_key FROM devices WHERE user_id = $1 AND revoked_at IS NULL AND public_key <> '' ORDER BY device_id", userID)
+	if err != nil {
+		log.Printf("[ERROR] Failed to query device keys of user %s: %v", userID, err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []DeviceKey{}
+	for rows.Next() {
+		var key DeviceKey
+		if err := rows.Scan(&key.DeviceID, &key.PublicKey); err != nil {
+			log.Printf("[ERROR] Failed to scan device key row for user %s: %v", userID, err)
+			continue
+		}
+		keys = append(keys, key)
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("[ERROR] Error during device keys rows iteration for user %s: %v", userID, err)
+		return nil, err
+	}
+	return keys, nil
+}
+
+// RenameDevice changes the display name of a device. It reports whether the device exists.
+func (postgresStore) RenameDevice(userID, deviceID, name string) (bool, error) {
+	log.Printf("[DEBUG] dbRenameDevice called for userID: %s, deviceID: %s", userID, deviceID)
+	res, err := db.Exec("UPDATE devices SET name = $3 WHERE user_id = $1 AND device_id = $2 AND revoked_at IS NULL", userID, deviceID, name)
+	if err != nil {
+		log.Printf("[ERROR] Failed to rename device %s of user %s: %v", deviceID, userID, err)
+		return false, err
+	}
+	rowsAffected, _ := res.RowsAffected()
+	return rowsAffected > 0, nil
+}
+
+// TouchDevice records that a device was just seen online.
+func (postgresStore) TouchDevice(userID, deviceID string) {
+	if _, err := db.Exec("UPDATE devices SET last_seen_at = NOW() WHERE user_id = $1 AND device_id = $2", userID, deviceID); err != nil {
+		log.Printf("[ERROR] Failed to update last seen of device %s of user %s: %v", deviceID, userID, err)
+	}
+}
+
+// SetDeviceSecretHash stores the hash of a new device secret, replacing any previous one.
+func (postgresStore) SetDeviceSecretHash(userID, deviceID, secretHash string) error {
+	log.Printf("[DEBUG] dbSetDeviceSecretHash called for userID: %s, deviceID: %s", userID, deviceID)
+	res, err := db.Exec("UPDATE devices SET secret_hash = $3 WHERE user_id = $1 AND device_id = $2 AND revoked_at IS NULL", userID, deviceID, secretHash)
+	if err != nil {
+		log.Printf("[ERROR] Failed to store credentials of device %s of user %s: %v", deviceID, userID, err)
+		return err
+	}
+	if rowsAffected, _ := res.RowsAffected(); rowsAffected == 0 {
+		return errDeviceNotFound
+	}
+	return nil
+}
+
+// SetAccountSecretHash stores the hash of a new account secret, invalidating the previous one.
+func (postgresStore) SetAccountSecretHash(userID, secretHash string) error {
+	log.Printf("[DEBUG] dbSetAccountSecretHash called for userID: %s", userID)
+	query := `
+    INSERT INTO account_credentials (user_id, secret_hash, rotated_at)
+    VALUES ($1, $2, NOW())
+    ON CONFLICT (user_id) DO UPDATE SET secret_hash = $2, rotated_at = NOW();`
+	if _, err := db.Exec(query, userID, secretHash); err != nil {
+		log.Printf("[ERROR] Failed to store account secret of user %s: %v", userID, err)
+		return err
+	}
+	return nil
+}
+
+// RevokeDevice marks a device as revoked, dropping its credentials and every push endpoint it registered.
+// The row is kept so that the device ID cannot be registered again. It reports whether an active device was revoked.
+func (postgresStore) RevokeDevice(userID, deviceID string) (bool, error) {
+	log.Printf("[DEBUG] dbRevokeDevice called for userID: %s, deviceID: %s", userID, deviceID)
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("[ERROR] Failed to begin transaction to revoke device %s of user %s: %v", deviceID, userID, err)
+		return false, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`
+    UPDATE devices SET revoked_at = NOW(), secret_hash = '', push_tokens = '{}'
+    WHERE user_id = $1 AND device_id = $2 AND revoked_at IS NULL;`, userID, deviceID)
+	if err != nil {
+		log.Printf("[ERROR] Failed to revoke device %s of user %s: %v", deviceID, userID, err)
+		return false, err
+	}
+	if rowsAffected, _ := res.RowsAffected(); rowsAffected == 0 {
+		return false, nil
+	}
+	for _, query := range []string{
+		"DELETE FROM web_push_subscriptions WHERE user_id = $1 AND device_id = $2",
+		"DELETE FROM unifiedpush_endpoints WHERE user_id = $1 AND device_id = $2",
+	} {
+		if _, err := tx.Exec(query, userID, deviceID); err != nil {
+			log.Printf("[ERROR] Failed to remove push endpoints of revoked device %s of user %s: %v", deviceID, userID, err)
+			return false, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("[ERROR] Failed to commit revocation of device %s of user %s: %v", deviceID, userID, err)
+		return false, err
+	}
+	log.Printf("[INFO] Device %s of user %s revoked.", deviceID, userID)
+	return true, nil
+}
+
+// RemoveDevicePushTokens removes the given push tokens from every device of a user in a single transaction.
+func (postgresStore) RemoveDevicePushTokens(userID string, tokens []string) error {
+	log.Printf("[DEBUG] dbRemoveDevicePushTokens called for userID: %s with %d token(s)", userID, len(tokens))
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("[ERROR] Failed to begin transaction to remove push tokens for user %s: %v", userID, err)
+		return err
+	}
+	defer tx.Rollback()
+
+	updated, err := removePushTokensTx(tx, userID, "", tokens)
+	if err != nil {
+		log.Printf("[ERROR] Failed to remove push tokens for user %s: %v", userID, err)
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("[ERROR] Failed to commit push token removal for user %s: %v", userID, err)
+		return err
+	}
+	log.Printf("[INFO] Removed push tokens from %d device(s) of user %s.", updated, userID)
+	return nil
+}
+
+// SaveInvitation adds a new invitation to the database.
+func (postgresStore) SaveInvitation(inv Invitation) {
+	log.Printf("[DEBUG] dbSaveInvitation called for invitation %s of user %s", inv.Code, inv.CreatorUserID)
+	creatorPseudo, err := encryptColumn(inv.CreatorPseudo, invitationPseudoContext(inv.Code))
+	if err != nil {
+		log.Printf("[ERROR] Failed to encrypt creator pseudo of invitation %s: %v", inv.Code, err)
+		return
+	}
+	query := `
+    INSERT INTO invitations (code, creator_user_id, creator_pseudo, expires_at)
+    VALUES ($1, $2, $3, $4);`
+	res, err := db.Exec(query, inv.Code, inv.CreatorUserID, creatorPseudo, inv.ExpiresAt)
+	if err != nil {
+		log.Printf("[ERROR] Failed to save invitation %s: %v", inv.Code, err)
+		return
+	}
+	rowsAffected, _ := res.RowsAffected()
+	log.Printf("[INFO] Successfully saved invitation %s. Rows affected: %d", inv.Code, rowsAffected)
+}
+
+// DeleteInvitation removes an invitation from the database.
+func (postgresStore) DeleteInvitation(code string) {
+	log.Printf("[DEBUG] dbDeleteInvitation called for code: %s", code)
+	res, err := db.Exec("DELETE FROM invitations WHERE code = $1", code)
+	if err != nil {
+		log.Printf("[ERROR] Failed to delete invitation %s: %v", code, err)
+		return
+	}
+	rowsAffected, _ := res.RowsAffected()
+	log.Printf("[INFO] Attempted to delete invitation %s. Rows affected: %d", code, rowsAffected)
+}
+
+// SavePendingMessage stores an offline message in the database.
+// Messages with a TTL get an expiry date after which they are purged instead of delivered.
+func (postgresStore) SavePendingMessage(msg Message) {
+	log.Printf("[DEBUG] dbSavePendingMessage called for message to: %s, from: %s, payload type: %T", msg.To, msg.From, msg.Payload)
+	payloadBytes, err := json.Marshal(msg.Payload)
+	if err != nil {
+		log.Printf("[ERROR] Failed to marshal payload for pending message to %s from %s: %v", msg.To, msg.From, err)
+		return
+	}
+	if payloadBytes, err = encryptJSONColumn(payloadBytes, pendingPayloadContext(msg.To)); err != nil {
+		log.Printf("[ERROR] Failed to encrypt payload for pending message to %s from %s: %v", msg.To, msg.From, err)
+		return
+	}
+	// log.Printf("[DEBUG] Marshalled payload for pending message: %s", string(payloadBytes)) // Be cautious with logging full payloads
+
+	var expiresAt sql.NullTime
+	if ttl := messageTTL(msg); ttl > 0 {
+		expiresAt = sql.NullTime{Time: time.Now().Add(ttl), Valid: true}
+	}
+
+	query := `
+    INSERT INTO pending_messages (recipient_id, sender_id, message_type, message_payload, message_id, expires_at)
+    VALUES ($1, $2, $3, $4, $5, $6)
+    ON CONFLICT (recipient_id, sender_id, message_type) DO UPDATE SET message_payload = $4, message_id = $5, expires_at = $6;`
+	res, err := db.Exec(query, msg.To, msg.From, msg.Type, payloadBytes, msg.ID, expiresAt)
+	if err != nil {
+		log.Printf("[ERROR] Failed to save pending message for %s from %s: %v", msg.To, msg.From, err)
+		return
+	}
+	rowsAffected, _ := res.RowsAffected()
+	log.Printf("[INFO] Successfully saved pending message for %s from %s. Rows affected: %d", msg.To, msg.From, rowsAffected)
+}
+
+// SaveContactPair records that two users are contacts of each other.
+func (postgresStore) SaveContactPair(userA, userB string) {
+	log.Printf("[DEBUG] dbSaveContactPair called for %s <-> %s", userA, userB)
+	query := `
+    INSERT INTO contacts (user_id, contact_id)
+    VALUES ($1, $2), ($2, $1)
+    ON CONFLICT DO NOTHING;`
+	res, err := db.Exec(query, userA, userB)
+	if err != nil {
+		log.Printf("[ERROR] Failed to save contact pair %s <-> %s: %v", userA, userB, err)
+		return
+	}
+	rowsAffected, _ := res.RowsAffected()
+	log.Printf("[INFO] Successfully saved contact pair %s <-> %s. Rows affected: %d", userA, userB, rowsAffected)
+}
+
+// ReplaceContacts replaces the whole contact list declared by a user.
+func (postgresStore) ReplaceContacts(userID string, contactIDs []string) error {
+	log.Printf("[DEBUG] dbReplaceContacts called for userID: %s with %d contacts", userID, len(contactIDs))
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("[ERROR] Failed to begin transaction to replace contacts for user %s: %v", userID, err)
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM contacts WHERE user_id = $1", userID); err != nil {
+		log.Printf("[ERROR] Failed to clear contacts for user %s: %v", userID, err)
+		return err
+	}
+	if len(contactIDs) > 0 {
+		query := `
+        INSERT INTO contacts (user_id, contact_id)
+        SELECT $1, unnest($2::TEXT[])
+        ON CONFLICT DO NOTHING;`
+		if _, err := tx.Exec(query, userID, pq.Array(contactIDs)); err != nil {
+			log.Printf("[ERROR] Failed to insert contacts for user %s: %v", userID, err)
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("[ERROR] Failed to commit contacts for user %s: %v", userID, err)
+		return err
+	}
+	log.Printf("[INFO] Successfully replaced contacts for user %s (%d contacts).", userID, len(contactIDs))
+	return nil
+}
+
+// SavePresenceSettings saves or updates a user's presence privacy settings, keeping their last-seen timestamp.
+func (postgresStore) SavePresenceSettings(ps PresenceSettings) error {
+	log.Printf("[DEBUG] dbSavePresenceSettings called for userID: %s, visibility: %s", ps.UserID, ps.Visibility)
+	hiddenFrom := ps.HiddenFrom
+	if hiddenFrom == nil {
+		hiddenFrom = []string{}
+	}
+	query := `
+    INSERT INTO user_presence_settings (user_id, visibility, share_last_seen, hidden_from)
+    VALUES ($1, $2, $3, $4)
+    ON CONFLICT (user_id) DO UPDATE SET visibility = $2, share_last_seen = $3, hidden_from = $4;`
+	if _, err := db.Exec(query, ps.UserID, ps.Visibility, ps.ShareLastSeen, pq.Array(hiddenFrom)); err != nil {
+		log.Printf("[ERROR] Failed to save presence settings for user %s: %v", ps.UserID, err)
+		return err
+	}
+	log.Printf("[INFO] Successfully saved presence settings for user %s.", ps.UserID)
+	return nil
+}
+
+// UpdateLastSeen records when a user's last connection went away.
+func (postgresStore) UpdateLastSeen(userID string, lastSeen time.Time) {
+	log.Printf("[DEBUG] dbUpdateLastSeen called for userID: %s", userID)
+	query := `
+    INSERT INTO user_presence_settings (user_id, last_seen)
+    VALUES ($1, $2)
+    ON CONFLICT (user_id) DO UPDATE SET last_seen = $2;`
+	if _, err := db.Exec(query, userID, lastSeen); err != nil {
+		log.Printf("[ERROR] Failed to update last seen for user %s: %v", userID, err)
+	}
+}
+
+// SaveScheduledPlop inserts a new schedule.
+func (postgresStore) SaveScheduledPlop(sp ScheduledPlop) error {
+	log.Printf("[DEBUG] dbSaveScheduledPlop called for schedule %s of user %s", sp.ID, sp.OwnerID)
+	payloadBytes, err := json.Marshal(sp.Payload)
+	if err != nil {
+		log.Printf("[ERROR] Failed to marshal payload for schedule %s: %v", sp.ID, err)
+		return err
+	}
+	query := `
+    INSERT INTO scheduled_plops (id, owner_id, recipient_ids, message_payload, cron_expr, timezone, next_fire_at, created_at)
+    VALUES ($1, $2, $3, $4, $5, $6, $7, $8);`
+	if _, err := db.Exec(query, sp.ID, sp.OwnerID, pq.Array(sp.RecipientIDs), payloadBytes, sp.Cron, sp.Timezone, sp.NextFireAt, sp.CreatedAt); err != nil {
+		log.Printf("[ERROR] Failed to save schedule %s: %v", sp.ID, err)
+		return err
+	}
+	log.Printf("[INFO] Successfully saved schedule %s for user %s, next fire at %s.", sp.ID, sp.OwnerID, sp.NextFireAt)
+	return nil
+}
+
+// DeleteScheduledPlop removes a schedule owned by the given user. It reports whether a row was deleted.
+func (postgresStore) DeleteScheduledPlop(id, ownerID string) (bool, error) {
+	log.Printf("[DEBUG] dbDeleteScheduledPlop called for schedule %s of user %s", id, ownerID)
+	res, err := db.Exec("DELETE FROM scheduled_plops WHERE id = $1 AND owner_id = $2", id, ownerID)
+	if err != nil {
+		log.Printf("[ERROR] Failed to delete schedule %s: %v", id, err)
+		return false, err
+	}
+	rowsAffected, _ := res.RowsAffected()
+	return rowsAffected > 0, nil
+}
+
+// ClaimDueScheduledPlops atomically takes the schedules due at 'now' and moves them forward:
+// recurring schedules get their next fire time from 'reschedule', one-shot ones (zero time) are deleted.
+// Rows are locked with SKIP LOCKED, so concurrent server instances never claim the same occurrence.
+func (postgresStore) ClaimDueScheduledPlops(now time.Time, reschedule func(ScheduledPlop) time.Time) ([]ScheduledPlop, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("[ERROR] Failed to begin transaction to claim due schedules: %v", err)
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query("SELECT "+scheduledPlopColumns+" FROM scheduled_plops WHERE next_fire_at <= $1 ORDER BY next_fire_at LIMIT 100 FOR UPDATE SKIP LOCKED", now)
+	if err != nil {
+		log.Printf("[ERROR] Failed to query due schedules: %v", err)
+		return nil, err
+	}
+	var due []ScheduledPlop
+	for rows.Next() {
+		sp, err := scanScheduledPlop(rows)
+		if err != nil {
+			log.Printf("[ERROR] Failed to scan due schedule row: %v", err)
+			continue
+		}
+		due = append(due, sp)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		log.Printf("[ERROR] Error during due schedules rows iteration: %v", err)
+		return nil, err
+	}
+
+	for _, sp := range due {
+		next := reschedule(sp)
+		if next.IsZero() {
+			_, err = tx.Exec("DELETE FROM scheduled_plops WHERE id = $1", sp.ID)
+		} else {
+			_, err = tx.Exec("UPDATE scheduled_plops SET next_fire_at = $2 WHERE id = $1", sp.ID, next)
+		}
+		if err != nil {
+			log.Printf("[ERROR] Failed to advance schedule %s: %v", sp.ID, err)
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Printf("[ERROR] Failed to commit claimed schedules: %v", err)
+		return nil, err
+	}
+	return due, nil
+}
+
+// SaveWebPushSubscription saves or updates a browser push subscription. An endpoint belongs to a single user.
+func (postgresStore) SaveWebPushSubscription(sub WebPushSubscription) error {
+	log.Printf("[DEBUG] dbSaveWebPushSubscription called for userID: %s, device: %s", sub.UserID, sub.DeviceID)
+	stored, err := encryptWebPushSubscription(sub)
+	if err != nil {
+		log.Printf("[ERROR] Failed to encrypt web push subscription of user %s: %v", sub.UserID, err)
+		return err
+	}
+	query := `
+    INSERT INTO web_push_subscriptions (endpoint, endpoint_key, user_id, device_id, p256dh, auth, created_at)
+    VALUES ($1, $2, $3, $4, $5, $6, $7)
+    ON CONFLICT (endpoint_key) DO UPDATE SET endpoint = $1, user_id = $3, device_id = $4, p256dh = $5, auth = $6;`
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("[ERROR] Failed to begin transaction to save web push subscription for user %s: %v", sub.UserID, err)
+		return err
+	}
+	defer tx.Rollback()
+
+	// A row saved in clear before endpoints were encrypted has no key to conflict on.
+	if _, err := tx.Exec("DELETE FROM web_push_subscriptions WHERE endpoint = $1", sub.Endpoint); err != nil {
+		log.Printf("[ERROR] Failed to replace web push subscription for user %s: %v", sub.UserID, err)
+		return err
+	}
+	if _, err := tx.Exec(query, stored.Endpoint, blindIndex(sub.Endpoint), sub.UserID, sub.DeviceID, stored.P256dh, stored.Auth, sub.CreatedAt); err != nil {
+		log.Printf("[ERROR] Failed to save web push subscription for user %s: %v", sub.UserID, err)
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("[ERROR] Failed to commit web push subscription for user %s: %v", sub.UserID, err)
+		return err
+	}
+	log.Printf("[INFO] Successfully saved web push subscription for user %s.", sub.UserID)
+	return nil
+}
+
+// DeleteWebPushSubscription removes a browser push subscription of a user.
+func (postgresStore) DeleteWebPushSubscription(userID, endpoint string) {
+	res, err := db.Exec("DELETE FROM web_push_subscriptions WHERE user_id = $1 AND (endpoint_key = $2 OR endpoint = $3)", userID, blindIndex(endpoint), endpoint)
+	if err != nil {
+		log.Printf("[ERROR] Failed to delete web push subscription: %v", err)
+		return
+	}
+	rowsAffected, _ := res.RowsAffected()
+	log.Printf("[INFO] Attempted to delete web push subscription. Rows affected: %d", rowsAffected)
+}
+
+// SaveUnifiedPushEndpoint saves or updates the UnifiedPush endpoint of a user's device.
+func (postgresStore) SaveUnifiedPushEndpoint(userID, deviceID, endpoint string) error {
+	log.Printf("[DEBUG] dbSaveUnifiedPushEndpoint called for userID: %s, device: %s", userID, deviceID)
+	stored, err := encryptColumn(endpoint, unifiedPushContext(userID))
+	if err != nil {
+		log.Printf("[ERROR] Failed to encrypt UnifiedPush endpoint of user %s: %v", userID, err)
+		return err
+	}
+	query := `
+    INSERT INTO unifiedpush_endpoints (endpoint, endpoint_key, user_id, device_id, created_at)
+    VALUES ($1, $2, $3, $4, NOW())
+    ON CONFLICT (endpoint_key) DO UPDATE SET endpoint = $1, user_id = $3, device_id = $4;`
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("[ERROR] Failed to begin transaction to save UnifiedPush endpoint for user %s: %v", userID, err)
+		return err
+	}
+	defer tx.Rollback()
+
+	// A row saved in clear before endpoints were encrypted has no key to conflict on.
+	if _, err := tx.Exec("DELETE FROM unifiedpush_endpoints WHERE endpoint = $1", endpoint); err != nil {
+		log.Printf("[ERROR] Failed to replace UnifiedPush endpoint for user %s: %v", userID, err)
+		return err
+	}
+	if _, err := tx.Exec(query, stored, blindIndex(endpoint), userID, deviceID); err != nil {
+		log.Printf("[ERROR] Failed to save UnifiedPush endpoint for user %s: %v", userID, err)
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("[ERROR] Failed to commit UnifiedPush endpoint for user %s: %v", userID, err)
+		return err
+	}
+	log.Printf("[INFO] Successfully saved UnifiedPush endpoint for user %s.", userID)
+	return nil
+}
+
+// DeleteUnifiedPushEndpoint removes a UnifiedPush endpoint of a user.
+func (postgresStore) DeleteUnifiedPushEndpoint(userID, endpoint string) {
+	res, err := db.Exec("DELETE FROM unifiedpush_endpoints WHERE user_id = $1 AND (endpoint_key = $2 OR endpoint = $3)", userID, blindIndex(endpoint), endpoint)
+	if err != nil {
+		log.Printf("[ERROR] Failed to delete UnifiedPush endpoint: %v", err)
+		return
+	}
+	rowsAffected, _ := res.RowsAffected()
+	log.Printf("[INFO] Attempted to delete UnifiedPush endpoint. Rows affected: %d", rowsAffected)
+}
+
+// userDataDeletions are the statements that erase a user ($1) from every table, including the
+// references other users hold to them. New tables holding user data must be added here. Bans and
+// the reports filed against the user are moderation records and are kept: deleting the account must
+// not lift a sanction.
+var userDataDeletions = []string{
+	"DELETE FROM pending_messages WHERE recipient_id = $1 OR sender_id = $1",
+	"DELETE FROM devices WHERE user_id = $1",
+	"DELETE FROM user_pseudos WHERE user_id = $1",
+	"DELETE FROM invitations WHERE creator_user_id = $1",
+	"DELETE FROM contacts WHERE user_id = $1 OR contact_id = $1",
+	"DELETE FROM user_presence_settings WHERE user_id = $1",
+	"UPDATE user_presence_settings SET hidden_from = array_remove(hidden_from, $1) WHERE $1 = ANY(hidden_from)",
+	"DELETE FROM scheduled_plops WHERE owner_id = $1 OR recipient_ids = ARRAY[$1]",
+	"UPDATE scheduled_plops SET recipient_ids = array_remove(recipient_ids, $1) WHERE $1 = ANY(recipient_ids)",
+	"DELETE FROM web_push_subscriptions WHERE user_id = $1",
+	"DELETE FROM unifiedpush_endpoints WHERE user_id = $1",
+	"DELETE FROM account_credentials WHERE user_id = $1",
+	"DELETE FROM user_avatars WHERE user_id = $1",
+	"DELETE FROM reports WHERE reporter_id = $1",
+}
+
+// DeleteUserData erases everything stored about a user in a single transaction.
+func (postgresStore) DeleteUserData(userID string) error {
+	log.Printf("[DEBUG] dbDeleteUserData called for userID: %s", userID)
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("[ERROR] Failed to begin transaction to delete user %s: %v", userID, err)
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, query := range userDataDeletions {
+		if _, err := tx.Exec(query, userID); err != nil {
+			log.Printf("[ERROR] Failed to delete data of user %s (%s): %v", userID, query, err)
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("[ERROR] Failed to commit deletion of user %s: %v", userID, err)
+		return err
+	}
+	log.Printf("[INFO] All data of user %s deleted.", userID)
+	return nil
+}
+
+// DeletePendingMessagesForUser removes all pending messages for a user from the database.
+func (postgresStore) DeletePendingMessagesForUser(userID string) {
+	log.Printf("[DEBUG] dbDeletePendingMessagesForUser called for userID: %s", userID)
+	res, err := db.Exec("DELETE FROM pending_messages WHERE recipient_id = $1", userID)
+	if err != nil {
+		log.Printf("[ERROR] Failed to delete pending messages for user %s: %v", userID, err)
+		return
+	}
+	rowsAffected, _ := res.RowsAffected()
+	log.Printf("[INFO] Attempted to delete pending messages for user %s. Rows affected: %d", userID, rowsAffected)
+}
+
+// DeleteExpiredInvitations removes all expired invitations from the database.
+func (postgresStore) DeleteExpiredInvitations() {
+	log.Println("[DEBUG] dbDeleteExpiredInvitations called.")
+	res, err := db.Exec("DELETE FROM invitations WHERE expires_at < NOW()")
+	if err != nil {
+		log.Printf("[ERROR] Failed to delete expired invitations: %v", err)
+		return
+	}
+	rowsAffected, _ := res.RowsAffected()
+	if rowsAffected > 0 {
+		log.Printf("[INFO][CLEANUP] Deleted %d expired invitations from database.", rowsAffected)
+	} else {
+		log.Println("[DEBUG] No expired invitations found to delete.")
+	}
+}
+
+// DeleteExpiredPendingMessages removes the pending messages whose TTL elapsed and returns them,
+// so their senders can be told they were never delivered.
+func (postgresStore) DeleteExpiredPendingMessages() ([]Message, error) {
+	log.Println("[DEBUG] dbDeleteExpiredPendingMessages called.")
+	rows, err := db.Query("DELETE FROM pending_messages WHERE expires_at < NOW() RETURNING recipient_id, sender_id, message_id, message_type")
+	if err != nil {
+		log.Printf("[ERROR] Failed to delete expired pending messages: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var expired []Message
+	for rows.Next() {
+		var msg Message
+		if err := rows.Scan(&msg.To, &msg.From, &msg.ID, &msg.Type); err != nil {
+			log.Printf("[ERROR] Failed to scan expired pending message row: %v", err)
+			continue
+		}
+		expired = append(expired, msg)
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("[ERROR] Error during expired pending messages rows iteration: %v", err)
+		return expired, err
+	}
+	if len(expired) > 0 {
+		log.Printf("[INFO][CLEANUP] Deleted %d expired pending messages from database.", len(expired))
+	}
+	return expired, nil
+}
+
+// GetPendingMessages returns the offline messages waiting for a user, expired ones excluded.
+func (postgresStore) GetPendingMessages(userID string) ([]Message, error) {
+	log.Printf("[DEBUG] dbGetPendingMessages called for userID: %s", userID)
+	rows, err := db.Query("SELECT sender_id, message_type, message_payload, message_id FROM pending_messages WHERE recipient_id = $1 AND (expires_at IS NULL OR expires_at > NOW())", userID)
+	if err != nil {
+		log.Printf("[ERROR] Failed to query pending messages for user %s: %v", userID, err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var messages []Message
+	for rows.Next() {
+		var senderID, messageType, messageID string
+		var payloadBytes []byte
+		if err := rows.Scan(&senderID, &messageType, &payloadBytes, &messageID); err != nil {
+			log.Printf("[ERROR] Failed to scan pending message row for user %s: %v", userID, err)
+			continue
+		}
+		if payloadBytes, err = decryptJSONColumn(payloadBytes, pendingPayloadContext(userID)); err != nil {
+			log.Printf("[ERROR] Failed to decrypt pending message payload for user %s from sender %s: %v", userID, senderID, err)
+			continue
+		}
+		var msgPayload MessagePayload
+		if err := json.Unmarshal(payloadBytes, &msgPayload); err != nil {
+			log.Printf("[ERROR] Failed to unmarshal pending message payload for user %s from sender %s into MessagePayload: %v", userID, senderID, err)
+			continue
+		}
+		messages = append(messages, Message{ID: messageID, Type: messageType, From: senderID, To: userID, Payload: msgPayload, IsPending: true})
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("[ERROR] Error during pending message rows iteration for user %s: %v", userID, err)
+		return nil, err
+	}
+	return messages, nil
+}
+
+// --- Admin Queries ---
+//
+// Used by the admin subcommands of the server binary (see admin_cli.go).
+
+// userSummaryQuery lists every known user ($1 = '') or a single one, most recently seen first.
+const userSummaryQuery = `
+    SELECT u.user_id, COALESCE(p.pseudo, ''),
+        (SELECT COUNT(*) FROM devices d WHERE d.user_id = u.user_id AND d.revoked_at IS NULL),
+        (SELECT COUNT(*) FROM contacts c WHERE c.user_id = u.user_id),
+        (SELECT MAX(d.last_seen_at) FROM devices d WHERE d.user_id = u.user_id),
+        b.banned_at
+    FROM (SELECT user_id FROM user_pseudos UNION SELECT user_id FROM devices UNION SELECT user_id FROM account_credentials) u
+    LEFT JOIN user_pseudos p ON p.user_id = u.user_id
+    LEFT JOIN user_bans b ON b.user_id = u.user_id AND (b.expires_at IS NULL OR b.expires_at > NOW())
+    WHERE $1 = '' OR u.user_id = $1
+    ORDER BY 5 DESC NULLS LAST, u.user_id
+    LIMIT $2;`
+
+// GetUserSummaries lists up to limit users, or only userID when it is set.
+func (postgresStore) GetUserSummaries(userID string, limit int) ([]UserSummary, error) {
+	log.Printf("[DEBUG] dbGetUserSummaries called for userID: '%s', limit: %d", userID, limit)
+	rows, err := db.Query(userSummaryQuery, userID, limit)
+	if err != nil {
+		log.Printf("[ERROR] Failed to query user summaries: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []UserSummary{}
+	for rows.Next() {
+		var u UserSummary
+		var lastSeen, bannedAt sql.NullTime
+		if err := rows.Scan(&u.UserID, &u.Pseudo, &u.Devices, &u.Contacts, &lastSeen, &bannedAt); err != nil {
+			log.Printf("[ERROR] Failed to scan user summary row: %v", err)
+			return nil, err
+		}
+		if pseudo, err := decryptColumn(u.Pseudo, pseudoContext(u.UserID)); err == nil {
+			u.Pseudo = pseudo
+		} else {
+			log.Printf("[ERROR] Failed to decrypt pseudo of user %s: %v", u.UserID, err)
+			u.Pseudo = "(unreadable)"
+		}
+		if lastSeen.Valid {
+			u.LastSeenAt = &lastSeen.Time
+		}
+		if bannedAt.Valid {
+			u.BannedAt = &bannedAt.Time
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+// GetUserBan returns the active ban or suspension of a user, if any.
+func (postgresStore) GetUserBan(userID string) (UserBan, bool, error) {
+	ban := UserBan{UserID: userID}
+	var expiresAt sql.NullTime
+	err := db.QueryRow("SELECT reason, banned_at, expires_at FROM user_bans WHERE user_id = $1 AND (expires_at IS NULL OR expires_at > NOW())", userID).
+		Scan(&ban.Reason, &ban.BannedAt, &expiresAt)
+	if err == sql.ErrNoRows {
+		return UserBan{}, false, nil
+	}
+	if err != nil {
+		log.Printf("[ERROR] Failed to query ban of user %s: %v", userID, err)
+		return UserBan{}, false, err
+	}
+	if expiresAt.Valid {
+		ban.ExpiresAt = &expiresAt.Time
+	}
+	return ban, true, nil
+}
+
+// GetActiveBans returns the bans and suspensions in force.
+func (postgresStore) GetActiveBans() ([]UserBan, error) {
+	rows, err := db.Query("SELECT user_id, reason, banned_at, expires_at FROM user_bans WHERE expires_at IS NULL OR expires_at > NOW()")
+	if err != nil {
+		log.Printf("[ERROR] Failed to query active bans: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+	bans := []UserBan{}
+	for rows.Next() {
+		var ban UserBan
+		var expiresAt sql.NullTime
+		if err := rows.Scan(&ban.UserID, &ban.Reason, &ban.BannedAt, &expiresAt); err != nil {
+			return nil, err
+		}
+		if expiresAt.Valid {
+			ban.ExpiresAt = &expiresAt.Time
+		}
+		bans = append(bans, ban)
+	}
+	return bans, rows.Err()
+}
+
+// BanUser bans or suspends a user, replacing any previous sanction.
+func (postgresStore) BanUser(ban UserBan) error {
+	log.Printf("[DEBUG] dbBanUser called for userID: %s", ban.UserID)
+	query := `
+    INSERT INTO user_bans (user_id, reason, banned_at, expires_at)
+    VALUES ($1, $2, $3, $4)
+    ON CONFLICT (user_id) DO UPDATE SET reason = $2, banned_at = $3, expires_at = $4;`
+	if _, err := db.Exec(query, ban.UserID, ban.Reason, ban.BannedAt, ban.ExpiresAt); err != nil {
+		log.Printf("[ERROR] Failed to ban user %s: %v", ban.UserID, err)
+		return err
+	}
+	return nil
+}
+
+// SaveReport stores a new abuse report.
+func (postgresStore) SaveReport(report Report) error {
+	log.Printf("[DEBUG] dbSaveReport called for report %s against user %s", report.ID, report.ReportedID)
+	messages, err := json.Marshal(report.Messages)
+	if err != nil {
+		return err
+	}
+	query := `
+    INSERT INTO reports (id, reporter_id, reported_id, reason, details, messages, status, created_at)
+    VALUES ($1, $2, $3, $4, $5, $6, $7, $8);`
+	if _, err := db.Exec(query, report.ID, report.ReporterID, report.ReportedID, report.Reason, report.Details, messages, report.Status, report.CreatedAt); err != nil {
+		log.Printf("[ERROR] Failed to save report %s: %v", report.ID, err)
+		return err
+	}
+	return nil
+}
+
+const reportColumns = "id, reporter_id, reported_id, reason, details, messages, status, action, note, created_at, resolved_at"
+
+func scanReport(scanner interface{ Scan(dest ...interface{}) error }) (Report, error) {
+	var r Report
+	var messages []byte
+	var resolvedAt sql.NullTime
+	if err := scanner.Scan(&r.ID, &r.ReporterID, &r.ReportedID, &r.Reason, &r.Details, &messages, &r.Status, &r.Action, &r.Note, &r.CreatedAt, &resolvedAt); err != nil {
+		return r, err
+	}
+	if err := json.Unmarshal(messages, &r.Messages); err != nil {
+		return r, err
+	}
+	if resolvedAt.Valid {
+		r.ResolvedAt = &resolvedAt.Time
+	}
+	return r, nil
+}
+
+// GetReport retrieves a report by ID.
+func (postgresStore) GetReport(id string) (Report, bool, error) {
+	report, err := scanReport(db.QueryRow("SELECT "+reportColumns+" FROM reports WHERE id = $1", id))
+	if err == sql.ErrNoRows {
+		return Report{}, false, nil
+	}
+	if err != nil {
+		log.Printf("[ERROR] Failed to query report %s: %v", id, err)
+		return Report{}, false, err
+	}
+	return report, true, nil
+}
+
+// GetReports lists up to limit reports with the given status (all of them if empty), oldest first.
+func (postgresStore) GetReports(status string, limit int) ([]Report, error) {
+	rows, err := db.Query("SELECT "+reportColumns+" FROM reports WHERE $1 = '' OR status = $1 ORDER BY created_at LIMIT $2", status, limit)
+	if err != nil {
+		log.Printf("[ERROR] Failed to query reports: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	reports := []Report{}
+	for rows.Next() {
+		report, err := scanReport(rows)
+		if err != nil {
+			log.Printf("[ERROR] Failed to scan report row: %v", err)
+			return nil, err
+		}
+		reports = append(reports, report)
+	}
+	return reports, rows.Err()
+}
+
+// ResolveReport marks an open report as resolved. It returns false if the report is unknown or already resolved.
+func (postgresStore) ResolveReport(id, action, note string, resolvedAt time.Time) (bool, error) {
+	res, err := db.Exec("UPDATE reports SET status = $2, action = $3, note = $4, resolved_at = $5 WHERE id = $1 AND status = $6",
+		id, reportStatusResolved, action, note, resolvedAt, reportStatusOpen)
+	if err != nil {
+		log.Printf("[ERROR] Failed to resolve report %s: %v", id, err)
+		return false, err
+	}
+	rowsAffected, _ := res.RowsAffected()
+	return rowsAffected > 0, nil
+}
+
+// ListInvitations lists every stored invitation, expired ones included, soonest expiry first.
+func (postgresStore) ListInvitations() ([]Invitation, error) {
+	rows, err := db.Query("SELECT code, creator_user_id, creator_pseudo, expires_at FROM invitations ORDER BY expires_at")
+	if err != nil {
+		log.Printf("[ERROR] Failed to query invitations: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	invitations := []Invitation{}
+	for rows.Next() {
+		var inv Invitation
+		if err := rows.Scan(&inv.Code, &inv.CreatorUserID, &inv.CreatorPseudo, &inv.ExpiresAt); err != nil {
+			log.Printf("[ERROR] Failed to scan invitation row: %v", err)
+			return nil, err
+		}
+		if inv.CreatorPseudo, err = decryptColumn(inv.CreatorPseudo, invitationPseudoContext(inv.Code)); err != nil {
+			log.Printf("[ERROR] Failed to decrypt creator pseudo of invitation %s: %v", inv.Code, err)
+			return nil, err
+		}
+		invitations = append(invitations, inv)
+	}
+	return invitations, rows.Err()
+}
+
+// PurgeInvitations deletes the expired invitations, or all of them, and returns how many were removed.
+func (postgresStore) PurgeInvitations(all bool) (int64, error) {
+	res, err := db.Exec("DELETE FROM invitations WHERE $1 OR expires_at < NOW()", all)
+	if err != nil {
+		log.Printf("[ERROR] Failed to purge invitations: %v", err)
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// GetPendingStats summarizes the pending message queue, with the top recipients by depth.
+func (postgresStore) GetPendingStats(top int) (PendingStats, error) {
+	stats := PendingStats{ByType: make(map[string]int), TopRecipients: []PendingDepth{}}
+
+	rows, err := db.Query("SELECT message_type, COUNT(*) FROM pending_messages GROUP BY message_type")
+	if err != nil {
+		log.Printf("[ERROR] Failed to count pending messages: %v", err)
+		return stats, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var messageType string
+		var count int
+		if err := rows.Scan(&messageType, &count); err != nil {
+			return stats, err
+		}
+		stats.ByType[messageType] = count
+		stats.Total += count
+	}
+	if err := rows.Err(); err != nil {
+		return stats, err
+	}
+
+	depths, err := db.Query(`
+    SELECT recipient_id, COUNT(*), MIN(expires_at) FROM pending_messages
+    GROUP BY recipient_id ORDER BY 2 DESC, recipient_id LIMIT $1`, top)
+	if err != nil {
+		log.Printf("[ERROR] Failed to query pending message depths: %v", err)
+		return stats, err
+	}
+	defer depths.Close()
+	for depths.Next() {
+		var d PendingDepth
+		var nextExpiry sql.NullTime
+		if err := depths.Scan(&d.UserID, &d.Count, &nextExpiry); err != nil {
+			return stats, err
+		}
+		if nextExpiry.Valid {
+			d.NextExpiry = &nextExpiry.Time
+		}
+		stats.TopRecipients = append(stats.TopRecipients, d)
+	}
+	return stats, depths.Err()
+}
+
+// PruneStaleTokens removes the push registrations of devices that are revoked or were not seen since
+// cutoff. With dryRun, the changes are counted and rolled back.
+func (postgresStore) PruneStaleTokens(cutoff time.Time, dryRun bool) (TokenPruneResult, error) {
+	var result TokenPruneResult
+	tx, err := db.Begin()
+	if err != nil {
+		return result, err
+	}
+	defer tx.Rollback()
+
+	staleDevice := `(SELECT user_id, device_id FROM devices WHERE revoked_at IS NOT NULL OR last_seen_at < $1)`
+	statements := []struct {
+		query string
+		count *int64
+	}{
+		{`UPDATE devices SET push_tokens = '{}' WHERE cardinality(push_tokens) > 0 AND (revoked_at IS NOT NULL OR last_seen_at < $1)`, &result.PushTokens},
+		{`DELETE FROM web_push_subscriptions WHERE device_id <> '' AND (user_id, device_id) IN ` + staleDevice, &result.WebPushSubscriptions},
+		{`DELETE FROM unifiedpush_endpoints WHERE device_id <> '' AND (user_id, device_id) IN ` + staleDevice, &result.UnifiedPushEndpoints},
+	}
+	for _, st := range statements {
+		res, err := tx.Exec(st.query, cutoff)
+		if err != nil {
+			log.Printf("[ERROR] Failed to prune stale push registrations: %v", err)
+			return result, err
+		}
+		*st.count, _ = res.RowsAffected()
+	}
+	if dryRun {
+		return result, nil
+	}
+	return result, tx.Commit()
+}
+
+// Rekey rewrites the encrypted columns that are stored in clear or under another key than the active one,
+// and recomputes the pseudo keys. A dry run only counts the rows to rewrite.
+func (postgresStore) Rekey(dryRun bool) (RekeyResult, error) {
+	var result RekeyResult
+	if dataKeys == nil {
+		return result, errEncryptionDisabled
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return result, err
+	}
+	defer tx.Rollback()
+
+	if result.Pseudos, err = rekeyPseudosTx(tx, dryRun); err != nil {
+		log.Printf("[ERROR] Failed to rekey pseudos: %v", err)
+		return result, err
+	}
+	if result.Devices, err = rekeyPushTokensTx(tx, dryRun); err != nil {
+		log.Printf("[ERROR] Failed to rekey push tokens: %v", err)
+		return result, err
+	}
+	if result.PendingMessages, err = rekeyPendingMessagesTx(tx, dryRun); err != nil {
+		log.Printf("[ERROR] Failed to rekey pending messages: %v", err)
+		return result, err
+	}
+	if result.Invitations, err = rekeyInvitationsTx(tx, dryRun); err != nil {
+		log.Printf("[ERROR] Failed to rekey invitations: %v", err)
+		return result, err
+	}
+	webPush, err := rekeyWebPushSubscriptionsTx(tx, dryRun)
+	if err != nil {
+		log.Printf("[ERROR] Failed to rekey web push subscriptions: %v", err)
+		return result, err
+	}
+	unifiedPush, err := rekeyUnifiedPushEndpointsTx(tx, dryRun)
+	if err != nil {
+		log.Printf("[ERROR] Failed to rekey UnifiedPush endpoints: %v", err)
+		return result, err
+	}
+	result.PushSubscriptions = webPush + unifiedPush
+	if dryRun {
+		return result, nil
+	}
+	return result, tx.Commit()
+}
+
+func rekeyPseudosTx(tx *sql.Tx, dryRun bool) (int, error) {
+	rows, err := tx.Query("SELECT user_id, pseudo, COALESCE(pseudo_key, '') FROM user_pseudos FOR UPDATE")
+	if err != nil {
+		return 0, err
+	}
+	type update struct{ userID, pseudo, key string }
+	var updates []update
+	for rows.Next() {
+		var userID, stored, key string
+		if err := rows.Scan(&userID, &stored, &key); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		pseudo, err := decryptColumn(stored, pseudoContext(userID))
+		if err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("pseudo of user %s: %w", userID, err)
+		}
+		if needsRekey(stored) || key != pseudoKey(pseudo) {
+			updates = append(updates, update{userID, pseudo, pseudoKey(pseudo)})
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil || dryRun {
+		return len(updates), err
+	}
+
+	for _, u := range updates {
+		stored, err := encryptColumn(u.pseudo, pseudoContext(u.userID))
+		if err != nil {
+			return 0, err
+		}
+		if _, err := tx.Exec("UPDATE user_pseudos SET pseudo = $2, pseudo_key = $3 WHERE user_id = $1", u.userID, stored, u.key); err != nil {
+			return 0, err
+		}
+	}
+	return len(updates), nil
+}
+
+func rekeyPushTokensTx(tx *sql.Tx, dryRun bool) (int, error) {
+	rows, err := tx.Query("SELECT user_id, device_id, push_tokens FROM devices WHERE cardinality(push_tokens) > 0 FOR UPDATE")
+	if err != nil {
+		return 0, err
+	}
+	type update struct {
+		userID, deviceID string
+		tokens           []string
+	}
+	var updates []update
+	for rows.Next() {
+		var u update
+		var stored []string
+		if err := rows.Scan(&u.userID, &u.deviceID, pq.Array(&stored)); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if !slices.ContainsFunc(stored, needsRekey) {
+			continue
+		}
+		for _, value := range stored {
+			token, err := decryptColumn(value, pushTokenContext(u.userID))
+			if err != nil {
+				rows.Close()
+				return 0, fmt.Errorf("push token of device %s of user %s: %w", u.deviceID, u.userID, err)
+			}
+			u.tokens = append(u.tokens, token)
+		}
+		updates = append(updates, u)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil || dryRun {
+		return len(updates), err
+	}
+
+	for _, u := range updates {
+		stored, err := encryptPushTokens(u.userID, u.tokens)
+		if err != nil {
+			return 0, err
+		}
+		if _, err := tx.Exec("UPDATE devices SET push_tokens = $3 WHERE user_id = $1 AND device_id = $2", u.userID, u.deviceID, pq.Array(stored)); err != nil {
+			return 0, err
+		}
+	}
+	return len(updates), nil
+}
+
+func rekeyPendingMessagesTx(tx *sql.Tx, dryRun bool) (int, error) {
+	rows, err := tx.Query("SELECT recipient_id, sender_id, message_type, message_payload FROM pending_messages FOR UPDATE")
+	if err != nil {
+		return 0, err
+	}
+	type update struct {
+		recipientID, senderID, messageType string
+		payload                            []byte
+	}
+	var updates []update
+	for rows.Next() {
+		var u update
+		var stored []byte
+		if err := rows.Scan(&u.recipientID, &u.senderID, &u.messageType, &stored); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		var sealed string
+		if json.Unmarshal(stored, &sealed) == nil && !needsRekey(sealed) {
+			continue // Already encrypted under the active key
+		}
+		if u.payload, err = decryptJSONColumn(stored, pendingPayloadContext(u.recipientID)); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("pending message from %s to %s: %w", u.senderID, u.recipientID, err)
+		}
+		updates = append(updates, u)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil || dryRun {
+		return len(updates), err
+	}
+
+	for _, u := range updates {
+		stored, err := encryptJSONColumn(u.payload, pendingPayloadContext(u.recipientID))
+		if err != nil {
+			return 0, err
+		}
+		if _, err := tx.Exec("UPDATE pending_messages SET message_payload = $4 WHERE recipient_id = $1 AND sender_id = $2 AND message_type = $3",
+			u.recipientID, u.senderID, u.messageType, stored); err != nil {
+			return 0, err
+		}
+	}
+	return len(updates), nil
+}
+
+func rekeyInvitationsTx(tx *sql.Tx, dryRun bool) (int, error) {
+	rows, err := tx.Query("SELECT code, creator_pseudo FROM invitations FOR UPDATE")
+	if err != nil {
+		return 0, err
+	}
+	type update struct{ code, pseudo string }
+	var updates []update
+	for rows.Next() {
+		var code, stored string
+		if err := rows.Scan(&code, &stored); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if !needsRekey(stored) {
+			continue
+		}
+		pseudo, err := decryptColumn(stored, invitationPseudoContext(code))
+		if err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("invitation %s: %w", code, err)
+		}
+		updates = append(updates, update{code, pseudo})
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil || dryRun {
+		return len(updates), err
+	}
+
+	for _, u := range updates {
+		stored, err := encryptColumn(u.pseudo, invitationPseudoContext(u.code))
+		if err != nil {
+			return 0, err
+		}
+		if _, err := tx.Exec("UPDATE invitations SET creator_pseudo = $2 WHERE code = $1", u.code, stored); err != nil {
+			return 0, err
+		}
+	}
+	return len(updates), nil
+}
+
+func rekeyWebPushSubscriptionsTx(tx *sql.Tx, dryRun bool) (int, error) {
+	rows, err := tx.Query("SELECT endpoint, COALESCE(endpoint_key, ''), user_id, p256dh, auth FROM web_push_subscriptions FOR UPDATE")
+	if err != nil {
+		return 0, err
+	}
+	type update struct {
+		storedEndpoint string
+		sub            WebPushSubscription
+	}
+	var updates []update
+	for rows.Next() {
+		var u update
+		var key string
+		if err := rows.Scan(&u.storedEndpoint, &key, &u.sub.UserID, &u.sub.P256dh, &u.sub.Auth); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		u.sub.Endpoint = u.storedEndpoint
+		if !needsRekey(u.sub.Endpoint) && !needsRekey(u.sub.P256dh) && !needsRekey(u.sub.Auth) && key != "" {
+			continue
+		}
+		if err := decryptWebPushSubscription(&u.sub); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("web push subscription of user %s: %w", u.sub.UserID, err)
+		}
+		updates = append(updates, u)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil || dryRun {
+		return len(updates), err
+	}
+
+	for _, u := range updates {
+		stored, err := encryptWebPushSubscription(u.sub)
+		if err != nil {
+			return 0, err
+		}
+		if _, err := tx.Exec("UPDATE web_push_subscriptions SET endpoint = $2, endpoint_key = $3, p256dh = $4, auth = $5 WHERE endpoint = $1",
+			u.storedEndpoint, stored.Endpoint, blindIndex(u.sub.Endpoint), stored.P256dh, stored.Auth); err != nil {
+			return 0, err
+		}
+	}
+	return len(updates), nil
+}
+
+func rekeyUnifiedPushEndpointsTx(tx *sql.Tx, dryRun bool) (int, error) {
+	rows, err := tx.Query("SELECT endpoint, COALESCE(endpoint_key, ''), user_id FROM unifiedpush_endpoints FOR UPDATE")
+	if err != nil {
+		return 0, err
+	}
+	type update struct{ stored, endpoint, userID string }
+	var updates []update
+	for rows.Next() {
+		var u update
+		var key string
+		if err := rows.Scan(&u.stored, &key, &u.userID); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if !needsRekey(u.stored) && key != "" {
+			continue
+		}
+		if u.endpoint, err = decryptColumn(u.stored, unifiedPushContext(u.userID)); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("UnifiedPush endpoint of user %s: %w", u.userID, err)
+		}
+		updates = append(updates, u)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil || dryRun {
+		return len(updates), err
+	}
+
+	for _, u := range updates {
+		stored, err := encryptColumn(u.endpoint, unifiedPushContext(u.userID))
+		if err != nil {
+			return 0, err
+		}
+		if _, err := tx.Exec("UPDATE unifiedpush_endpoints SET endpoint = $2, endpoint_key = $3 WHERE endpoint = $1",
+			u.stored, stored, blindIndex(u.endpoint)); err != nil {
+			return 0, err
+		}
+	}
+	return len(updates), nil
 }
 
 // --- Utility ---
@@ -373,6 +2235,10 @@ type connection interface {
 	WriteJSON(v interface{}) error
 }
 
+// setDB points the server at a database, and so back to the PostgreSQL store. It first waits for
+// the background tasks still using the previous one.
 func setDB(newDB *sql.DB) {
+	backgroundTasks.Wait()
 	db = newDB
+	store = postgresStore{}
 }
\ No newline at end of file
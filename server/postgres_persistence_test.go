@@ -16,11 +16,12 @@ func TestDbGetUserDeviceTokens(t *testing.T) {
 
 	setDB(db)
 
-	rows := sqlmock.NewRows([]string{"tokens"}).
-		AddRow(pq.Array([]string{"token1", "token2"}))
-	mock.ExpectQuery("SELECT tokens FROM user_device_tokens").WithArgs("test-user").WillReturnRows(rows)
+	rows := sqlmock.NewRows([]string{"push_tokens"}).
+		AddRow(pq.Array([]string{"token1"})).
+		AddRow(pq.Array([]string{"token2"}))
+	mock.ExpectQuery("SELECT push_tokens FROM devices").WithArgs("test-user").WillReturnRows(rows)
 
-	tokens, err := dbGetUserDeviceTokens("test-user")
+	tokens, err := store.GetUserDeviceTokens("test-user")
 	if err != nil {
 		t.Errorf("error was not expected while getting device tokens: %s", err)
 	}
@@ -29,3 +30,25 @@ func TestDbGetUserDeviceTokens(t *testing.T) {
 		t.Errorf("expected 2 tokens, got %d", len(tokens))
 	}
 }
+
+func TestDbDeleteExpiredPendingMessages(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	setDB(db)
+
+	rows := sqlmock.NewRows([]string{"recipient_id", "sender_id", "message_id", "message_type"}).
+		AddRow("bob", "alice", "msg-1", "plop")
+	mock.ExpectQuery("DELETE FROM pending_messages WHERE expires_at").WillReturnRows(rows)
+
+	expired, err := store.DeleteExpiredPendingMessages()
+	if err != nil {
+		t.Fatalf("error was not expected while deleting expired messages: %s", err)
+	}
+	if len(expired) != 1 || expired[0].From != "alice" || expired[0].To != "bob" || expired[0].ID != "msg-1" {
+		t.Errorf("unexpected expired messages: %+v", expired)
+	}
+}
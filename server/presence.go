@@ -0,0 +1,94 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// --- Presence ---
+
+// presenceVisibleTo reports whether viewerID may see the presence of the user owning 'settings'.
+// Presence is opt-in and only ever shown to mutual contacts the user has not hidden it from.
+func presenceVisibleTo(settings PresenceSettings, viewerID string, isMutualContact bool) bool {
+	if settings.Visibility != presenceVisibilityContacts || !isMutualContact {
+		return false
+	}
+	for _, hiddenID := range settings.HiddenFrom {
+		if hiddenID == viewerID {
+			return false
+		}
+	}
+	return true
+}
+
+// isUserOnline reports whether a user currently has at least one open connection.
+func isUserOnline(userID string) bool {
+	clientsMutex.Lock()
+	defer clientsMutex.Unlock()
+	return len(clients[userID]) > 0
+}
+
+// buildPresenceInfo returns what a viewer is allowed to know about a user's presence.
+func buildPresenceInfo(settings PresenceSettings, online bool) PresenceInfo {
+	info := PresenceInfo{Online: online}
+	if !online && settings.ShareLastSeen {
+		info.LastSeen = settings.LastSeen
+	}
+	return info
+}
+
+// notifyPresenceChange pushes a 'presence' frame to every online contact allowed to see the user's presence.
+// It is called when a user's first connection opens (online) or their last connection closes (offline).
+func notifyPresenceChange(userID string, online bool, at time.Time) {
+	if !online {
+		store.UpdateLastSeen(userID, at)
+		if isUserOnline(userID) {
+			log.Printf("[PRESENCE] User %s reconnected before the offline notification was sent. Skipping.", userID)
+			return
+		}
+	}
+
+	settingsByUser, err := store.GetPresenceSettings([]string{userID})
+	if err != nil {
+		log.Printf("[PRESENCE] Could not load presence settings for user %s: %v", userID, err)
+		return
+	}
+	settings, found := settingsByUser[userID]
+	if !found || settings.Visibility == presenceVisibilityNobody {
+		log.Printf("[PRESENCE] User %s does not share presence. No notification sent.", userID)
+		return
+	}
+	settings.LastSeen = &at
+
+	contactIDs, err := store.GetMutualContacts(userID)
+	if err != nil {
+		log.Printf("[PRESENCE] Could not load contacts of user %s: %v", userID, err)
+		return
+	}
+
+	status := "offline"
+	if online {
+		status = "online"
+	}
+	info := buildPresenceInfo(settings, online)
+	presenceMsg := Message{
+		Type: "presence",
+		From: userID,
+		Payload: MessagePayload{
+			UserID:   userID,
+			Status:   status,
+			LastSeen: info.LastSeen,
+		},
+	}
+
+	notified := 0
+	for _, contactID := range contactIDs {
+		if !presenceVisibleTo(settings, contactID, true) {
+			continue
+		}
+		presenceMsg.To = contactID
+		broadcastMessageToUser(contactID, presenceMsg, nil)
+		notified++
+	}
+	log.Printf("[PRESENCE] User %s is now %s. Notified %d contact(s).", userID, status, notified)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPresenceVisibleTo(t *testing.T) {
+	shared := PresenceSettings{UserID: "alice", Visibility: presenceVisibilityContacts, HiddenFrom: []string{"mallory"}}
+
+	tests := []struct {
+		name      string
+		settings  PresenceSettings
+		viewerID  string
+		isContact bool
+		expected  bool
+	}{
+		{"mutual contact", shared, "bob", true, true},
+		{"not a contact", shared, "bob", false, false},
+		{"hidden contact", shared, "mallory", true, false},
+		{"presence not shared", PresenceSettings{UserID: "alice", Visibility: presenceVisibilityNobody}, "bob", true, false},
+		{"no settings saved", PresenceSettings{}, "bob", true, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if result := presenceVisibleTo(tt.settings, tt.viewerID, tt.isContact); result != tt.expected {
+				t.Errorf("presenceVisibleTo() returned %t, want %t", result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestBuildPresenceInfo(t *testing.T) {
+	lastSeen := time.Now().Add(-time.Hour)
+
+	info := buildPresenceInfo(PresenceSettings{ShareLastSeen: true, LastSeen: &lastSeen}, false)
+	if info.Online || info.LastSeen == nil || !info.LastSeen.Equal(lastSeen) {
+		t.Errorf("offline user sharing last seen: got %+v", info)
+	}
+
+	info = buildPresenceInfo(PresenceSettings{ShareLastSeen: false, LastSeen: &lastSeen}, false)
+	if info.LastSeen != nil {
+		t.Errorf("last seen should be hidden when not shared, got %v", info.LastSeen)
+	}
+
+	info = buildPresenceInfo(PresenceSettings{ShareLastSeen: true, LastSeen: &lastSeen}, true)
+	if !info.Online || info.LastSeen != nil {
+		t.Errorf("online user should not report last seen: got %+v", info)
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"math"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+)
+
+// --- Pseudos ---
+
+const (
+	minPseudoLength = 3
+	maxPseudoLength = 32
+	// pseudoChangeBurst and pseudoChangeRefillInterval bound how often a user can change their pseudo.
+	pseudoChangeBurst          = 3
+	pseudoChangeRefillInterval = 8 * time.Hour
+)
+
+var (
+	errPseudoTaken       = errors.New("pseudo is already taken")
+	errPseudoRateLimited = errors.New("pseudo was changed too many times, try again later")
+)
+
+// pseudoLimiter rate-limits pseudo changes per user. Like plopLimiter, it is ephemeral state.
+var pseudoLimiter = &pseudoChangeLimiter{buckets: make(map[string]*tokenBucket)}
+
+// pseudoChangeLimiter keeps one token bucket per user.
+type pseudoChangeLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+// allow consumes a token for userID if one is available, or returns how long to wait.
+func (l *pseudoChangeLimiter) allow(userID string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	bucket, found := l.buckets[userID]
+	if !found {
+		bucket = newTokenBucket(pseudoChangeBurst, pseudoChangeRefillInterval, now)
+		l.buckets[userID] = bucket
+	}
+	bucket.advance(now)
+	if wait := bucket.wait(); wait > 0 {
+		return false, wait
+	}
+	bucket.tokens--
+	return true, 0
+}
+
+// refund gives back the token of a change that could not be stored, so that a taken pseudo or a
+// database error does not count against the quota.
+func (l *pseudoChangeLimiter) refund(userID string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if bucket, found := l.buckets[userID]; found {
+		bucket.tokens = math.Min(bucket.capacity, bucket.tokens+1)
+	}
+}
+
+// evictIdle forgets the buckets that refilled completely and returns how many were removed.
+func (l *pseudoChangeLimiter) evictIdle(now time.Time) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	evicted := 0
+	for userID, bucket := range l.buckets {
+		bucket.advance(now)
+		if bucket.isFull() {
+			delete(l.buckets, userID)
+			evicted++
+		}
+	}
+	return evicted
+}
+
+// normalizePseudo validates a pseudo and returns its canonical form: NFKC-normalized, trimmed, with
+// runs of whitespace collapsed to a single space. Control, format and private-use characters are refused.
+func normalizePseudo(raw string) (string, error) {
+	if !utf8.ValidString(raw) {
+		return "", errors.New("pseudo is not valid UTF-8")
+	}
+	pseudo := strings.Join(strings.Fields(norm.NFKC.String(raw)), " ")
+	for _, r := range pseudo {
+		if !unicode.In(r, unicode.L, unicode.M, unicode.N, unicode.P, unicode.S, unicode.Zs) {
+			return "", errors.New("pseudo contains forbidden characters")
+		}
+	}
+	switch length := utf8.RuneCountInString(pseudo); {
+	case length < minPseudoLength:
+		return "", errors.New("pseudo is too short")
+	case length > maxPseudoLength:
+		return "", errors.New("pseudo is too long")
+	}
+	return pseudo, nil
+}
+
+// pseudoKey returns the case-insensitive form of a normalized pseudo, used to enforce uniqueness.
+// With encryption at rest, it is a blind index so that the stored key does not reveal the pseudo.
+func pseudoKey(pseudo string) string {
+	return blindIndex(norm.NFKC.String(cases.Fold().String(pseudo)))
+}
+
+// changePseudo validates and stores a new pseudo for a user, then tells their contacts and other devices
+// with a 'pseudo_changed' event (queued for offline contacts). Setting the current pseudo again is a no-op.
+// When the change is rate-limited, it also returns how long to wait.
+func changePseudo(userID, raw string, now time.Time) (string, time.Duration, error) {
+	pseudo, err := normalizePseudo(raw)
+	if err != nil {
+		return "", 0, err
+	}
+	current, err := store.GetUserPseudo(userID)
+	if err != nil {
+		return "", 0, err
+	}
+	if current == pseudo {
+		return pseudo, 0, nil
+	}
+	if allowed, retryAfter := pseudoLimiter.allow(userID, now); !allowed {
+		return "", retryAfter, errPseudoRateLimited
+	}
+	if err := store.SetUserPseudo(userID, pseudo, pseudoKey(pseudo)); err != nil {
+		pseudoLimiter.refund(userID)
+		return "", 0, err
+	}
+	log.Printf("[PSEUDO] User %s changed their pseudo.", userID)
+
+	contactIDs, err := store.GetContactIDs(userID)
+	if err != nil {
+		log.Printf("[PSEUDO] Could not notify the contacts of user %s of their new pseudo: %v", userID, err)
+	}
+	payload := MessagePayload{UserID: userID, Pseudo: pseudo}
+	for _, contactID := range contactIDs {
+		sendServerEvent(Message{Type: "pseudo_changed", From: userID, To: contactID, Payload: payload})
+	}
+	broadcastMessageToUser(userID, Message{Type: "pseudo_changed", From: "server", To: userID, Payload: payload}, nil)
+	return pseudo, 0, nil
+}
+
+// adoptConnectionPseudo applies the pseudo older clients send when connecting, to users who have none yet:
+// a device reconnecting with a stale cached pseudo must not revert a change made on another device. It goes
+// through the same validation, uniqueness and rate limiting as an explicit change; refusals are only logged.
+func adoptConnectionPseudo(userID, raw string) {
+	current, err := store.GetUserPseudo(userID)
+	if err != nil || current != "" {
+		return
+	}
+	if _, _, err := changePseudo(userID, raw, timeNow()); err != nil {
+		log.Printf("[WS] Ignoring the pseudo sent by userId=%s on connection: %v", userID, err)
+	}
+}
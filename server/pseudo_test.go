@@ -0,0 +1,152 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+)
+
+func TestNormalizePseudo(t *testing.T) {
+	valid := map[string]string{
+		"  Alice  ":           "Alice",
+		"Jean   Pierre":       "Jean Pierre",
+		"\uff22\uff4f\uff42":  "Bob", // Fullwidth letters
+		"Zoé":                 "Zoé",
+		"Zoe\u0301":           "Zoé", // Decomposed accent
+		"ninja_42 \U0001f977": "ninja_42 \U0001f977",
+		"\tTab\nNew line ":    "Tab New line",
+	}
+	for raw, want := range valid {
+		got, err := normalizePseudo(raw)
+		if err != nil || got != want {
+			t.Errorf("normalizePseudo(%q) = %q, %v; want %q", raw, got, err, want)
+		}
+	}
+
+	invalid := []string{
+		"",
+		"ab",
+		strings.Repeat("x", maxPseudoLength+1),
+		"Ali\u200bce", // Zero-width space
+		"Bob\x00",
+		"priv\ue000ate",
+		"\xff\xfe",
+	}
+	for _, raw := range invalid {
+		if got, err := normalizePseudo(raw); err == nil {
+			t.Errorf("normalizePseudo(%q) = %q, expected an error", raw, got)
+		}
+	}
+}
+
+func TestPseudoKey(t *testing.T) {
+	if pseudoKey("Alice") != pseudoKey("ALICE") || pseudoKey("Straße") != pseudoKey("STRASSE") {
+		t.Error("pseudo keys should be case-insensitive")
+	}
+	if pseudoKey("Alice") == pseudoKey("Alicia") {
+		t.Error("different pseudos must have different keys")
+	}
+}
+
+func TestPseudoChangeLimiter(t *testing.T) {
+	limiter := &pseudoChangeLimiter{buckets: make(map[string]*tokenBucket)}
+	now := time.Now()
+	for i := 0; i < pseudoChangeBurst; i++ {
+		if allowed, _ := limiter.allow("alice", now); !allowed {
+			t.Fatalf("change %d should be allowed", i+1)
+		}
+	}
+	allowed, retryAfter := limiter.allow("alice", now)
+	if allowed || retryAfter != pseudoChangeRefillInterval {
+		t.Errorf("change past the burst: allowed=%v retryAfter=%v", allowed, retryAfter)
+	}
+	if allowed, _ := limiter.allow("alice", now.Add(pseudoChangeRefillInterval)); !allowed {
+		t.Error("a token should be back after the refill interval")
+	}
+	limiter.refund("alice")
+	if allowed, _ := limiter.allow("alice", now.Add(pseudoChangeRefillInterval)); !allowed {
+		t.Error("a refunded token should be usable again")
+	}
+	if evicted := limiter.evictIdle(now.Add(pseudoChangeBurst * pseudoChangeRefillInterval * 2)); evicted != 1 {
+		t.Errorf("expected the refilled bucket to be evicted, got %d", evicted)
+	}
+}
+
+func TestChangePseudo(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	setDB(db)
+	previousLimiter := pseudoLimiter
+	pseudoLimiter = &pseudoChangeLimiter{buckets: make(map[string]*tokenBucket)}
+	defer func() { pseudoLimiter = previousLimiter }()
+
+	currentPseudo := func(pseudo string) {
+		mock.ExpectQuery("SELECT pseudo FROM user_pseudos").WithArgs("alice").WillReturnRows(sqlmock.NewRows([]string{"pseudo"}).AddRow(pseudo))
+	}
+
+	// Taken by someone else.
+	currentPseudo("Alice")
+	mock.ExpectExec("INSERT INTO user_pseudos").WithArgs("alice", "Bob", pseudoKey("Bob")).WillReturnError(&pq.Error{Code: "23505"})
+	if _, _, err := changePseudo("alice", "Bob", time.Now()); err != errPseudoTaken {
+		t.Errorf("expected errPseudoTaken, got %v", err)
+	}
+	if bucket := pseudoLimiter.buckets["alice"]; bucket == nil || !bucket.isFull() {
+		t.Error("a taken pseudo should not count against the quota")
+	}
+
+	// Unchanged: nothing is written.
+	currentPseudo("Alice")
+	if pseudo, _, err := changePseudo("alice", " Alice ", time.Now()); err != nil || pseudo != "Alice" {
+		t.Errorf("setting the same pseudo again should be a no-op, got %q, %v", pseudo, err)
+	}
+
+	// Changed: the offline contact gets the event through the pending queue.
+	currentPseudo("Alice")
+	mock.ExpectExec("INSERT INTO user_pseudos").WithArgs("alice", "Alicia", pseudoKey("Alicia")).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("SELECT contact_id FROM contacts").WithArgs("alice").WillReturnRows(sqlmock.NewRows([]string{"contact_id"}).AddRow("bob"))
+	mock.ExpectExec("INSERT INTO pending_messages").WithArgs("bob", "alice", "pseudo_changed", sqlmock.AnyArg(), "", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	if pseudo, _, err := changePseudo("alice", "Alicia", time.Now()); err != nil || pseudo != "Alicia" {
+		t.Errorf("changePseudo() = %q, %v", pseudo, err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAdoptConnectionPseudo(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	setDB(db)
+	previousLimiter := pseudoLimiter
+	pseudoLimiter = &pseudoChangeLimiter{buckets: make(map[string]*tokenBucket)}
+	defer func() { pseudoLimiter = previousLimiter }()
+
+	// A device reconnecting with a stale pseudo: the stored one wins, and the quota is untouched.
+	mock.ExpectQuery("SELECT pseudo FROM user_pseudos").WithArgs("alice").WillReturnRows(sqlmock.NewRows([]string{"pseudo"}).AddRow("Alicia"))
+	adoptConnectionPseudo("alice", "Alice")
+	if bucket := pseudoLimiter.buckets["alice"]; bucket != nil {
+		t.Error("an ignored pseudo should not count against the quota")
+	}
+
+	// A user without a pseudo adopts it.
+	mock.ExpectQuery("SELECT pseudo FROM user_pseudos").WithArgs("bob").WillReturnRows(sqlmock.NewRows([]string{"pseudo"}))
+	mock.ExpectQuery("SELECT pseudo FROM user_pseudos").WithArgs("bob").WillReturnRows(sqlmock.NewRows([]string{"pseudo"}))
+	mock.ExpectExec("INSERT INTO user_pseudos").WithArgs("bob", "Bob", pseudoKey("Bob")).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("SELECT contact_id FROM contacts").WithArgs("bob").WillReturnRows(sqlmock.NewRows([]string{"contact_id"}))
+	adoptConnectionPseudo("bob", "Bob")
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
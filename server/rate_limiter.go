@@ -0,0 +1,142 @@
+package main
+
+import (
+	"log"
+	"math"
+	"sync"
+	"time"
+)
+
+// --- Plop Rate Limiting ---
+
+const (
+	// senderBurst and senderRefillInterval bound how many plops a single user can send overall.
+	senderBurst          = 20
+	senderRefillInterval = 500 * time.Millisecond
+	// pairBurst and pairRefillInterval bound how many plops a user can send to one given recipient.
+	pairBurst          = 3
+	pairRefillInterval = 1 * time.Second
+	// rateLimiterEvictionInterval is how often idle buckets are removed from memory.
+	rateLimiterEvictionInterval = 1 * time.Minute
+)
+
+// tokenBucket is a classic token bucket: it holds up to 'capacity' tokens and
+// regains one token every 'refill' interval.
+type tokenBucket struct {
+	capacity float64
+	refill   time.Duration
+	tokens   float64
+	last     time.Time
+}
+
+func newTokenBucket(capacity int, refill time.Duration, now time.Time) *tokenBucket {
+	return &tokenBucket{capacity: float64(capacity), refill: refill, tokens: float64(capacity), last: now}
+}
+
+// advance refills the bucket according to the time elapsed since the last update.
+func (b *tokenBucket) advance(now time.Time) {
+	if now.After(b.last) {
+		b.tokens = math.Min(b.capacity, b.tokens+float64(now.Sub(b.last))/float64(b.refill))
+		b.last = now
+	}
+}
+
+// wait returns how long until the bucket holds at least one token (zero if it already does).
+func (b *tokenBucket) wait() time.Duration {
+	if b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration(math.Ceil((1 - b.tokens) * float64(b.refill)))
+}
+
+// isFull reports whether the bucket is back to full capacity, meaning it can be forgotten.
+func (b *tokenBucket) isFull() bool {
+	return b.tokens >= b.capacity
+}
+
+// plopRateLimiter keeps one bucket per sender and one bucket per (sender, recipient) pair,
+// so plopping several friends in a row is fine while hammering one friend is not.
+type plopRateLimiter struct {
+	mu      sync.Mutex
+	senders map[string]*tokenBucket
+	pairs   map[string]*tokenBucket
+}
+
+func newPlopRateLimiter() *plopRateLimiter {
+	return &plopRateLimiter{
+		senders: make(map[string]*tokenBucket),
+		pairs:   make(map[string]*tokenBucket),
+	}
+}
+
+// allow consumes a token from both the sender and the pair bucket if both have one.
+// When the plop is refused, it returns how long the sender should wait before retrying.
+func (l *plopRateLimiter) allow(from, to string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	sender, found := l.senders[from]
+	if !found {
+		sender = newTokenBucket(senderBurst, senderRefillInterval, now)
+		l.senders[from] = sender
+	}
+	pairKey := from + "|" + to
+	pair, found := l.pairs[pairKey]
+	if !found {
+		pair = newTokenBucket(pairBurst, pairRefillInterval, now)
+		l.pairs[pairKey] = pair
+	}
+
+	sender.advance(now)
+	pair.advance(now)
+
+	retryAfter := sender.wait()
+	if pairWait := pair.wait(); pairWait > retryAfter {
+		retryAfter = pairWait
+	}
+	if retryAfter > 0 {
+		return false, retryAfter
+	}
+
+	sender.tokens--
+	pair.tokens--
+	return true, 0
+}
+
+// retryAfterMillis converts a wait to the retryAfterMs of a 'rate_limited' frame. It rounds up, so that
+// clients never retry too early, and is at least 1, so that the field is never omitted.
+func retryAfterMillis(wait time.Duration) int64 {
+	return max(1, (wait + time.Millisecond - 1).Milliseconds())
+}
+
+// evictIdle forgets every bucket that has refilled completely, as it behaves exactly like a new one.
+// It returns the number of buckets removed.
+func (l *plopRateLimiter) evictIdle(now time.Time) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	evicted := 0
+	for _, buckets := range []map[string]*tokenBucket{l.senders, l.pairs} {
+		for key, bucket := range buckets {
+			bucket.advance(now)
+			if bucket.isFull() {
+				delete(buckets, key)
+				evicted++
+			}
+		}
+	}
+	return evicted
+}
+
+// cleanupIdleRateLimiters periodically evicts idle rate-limiter buckets from memory.
+func cleanupIdleRateLimiters() {
+	log.Println("[CLEANUP] Starting idle rate limiter cleanup routine...")
+	ticker := time.NewTicker(rateLimiterEvictionInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		now := timeNow()
+		if evicted := plopLimiter.evictIdle(now) + pseudoLimiter.evictIdle(now); evicted > 0 {
+			log.Printf("[CLEANUP] Evicted %d idle rate limiter buckets.", evicted)
+		}
+	}
+}
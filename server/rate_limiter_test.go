@@ -0,0 +1,79 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPlopRateLimiterPerPair(t *testing.T) {
+	limiter := newPlopRateLimiter()
+	now := time.Now()
+
+	for i := 0; i < pairBurst; i++ {
+		if allowed, _ := limiter.allow("alice", "bob", now); !allowed {
+			t.Fatalf("plop %d to bob should be allowed within the pair burst", i+1)
+		}
+	}
+
+	allowed, retryAfter := limiter.allow("alice", "bob", now)
+	if allowed {
+		t.Fatal("plop beyond the pair burst should be refused")
+	}
+	if retryAfter <= 0 || retryAfter > pairRefillInterval {
+		t.Errorf("unexpected retryAfter %v, want in (0, %v]", retryAfter, pairRefillInterval)
+	}
+
+	// Plopping another friend right away must still work.
+	if allowed, _ := limiter.allow("alice", "carol", now); !allowed {
+		t.Error("plop to a different recipient should not be limited by the alice->bob pair")
+	}
+
+	if allowed, _ := limiter.allow("alice", "bob", now.Add(retryAfter)); !allowed {
+		t.Error("plop should be allowed again after waiting retryAfter")
+	}
+}
+
+func TestPlopRateLimiterPerSender(t *testing.T) {
+	limiter := newPlopRateLimiter()
+	now := time.Now()
+
+	for i := 0; i < senderBurst; i++ {
+		recipient := string(rune('a' + i))
+		if allowed, _ := limiter.allow("alice", recipient, now); !allowed {
+			t.Fatalf("plop %d should be allowed within the sender burst", i+1)
+		}
+	}
+	if allowed, _ := limiter.allow("alice", "zz", now); allowed {
+		t.Error("plop beyond the sender burst should be refused, even to a new recipient")
+	}
+}
+
+func TestPlopRateLimiterEvictIdle(t *testing.T) {
+	limiter := newPlopRateLimiter()
+	now := time.Now()
+	limiter.allow("alice", "bob", now)
+
+	if evicted := limiter.evictIdle(now); evicted != 0 {
+		t.Errorf("buckets that were just used should not be evicted, got %d evictions", evicted)
+	}
+	if evicted := limiter.evictIdle(now.Add(time.Hour)); evicted != 2 {
+		t.Errorf("expected sender and pair buckets to be evicted, got %d", evicted)
+	}
+	if len(limiter.senders) != 0 || len(limiter.pairs) != 0 {
+		t.Error("limiter maps should be empty after eviction")
+	}
+}
+
+func TestRetryAfterMillis(t *testing.T) {
+	for wait, want := range map[time.Duration]int64{
+		0:                                    1,
+		300 * time.Microsecond:               1,
+		time.Millisecond:                     1,
+		time.Millisecond + time.Nanosecond:   2,
+		2*time.Second + 400*time.Microsecond: 2001,
+	} {
+		if got := retryAfterMillis(wait); got != want {
+			t.Errorf("retryAfterMillis(%v) = %d, want %d", wait, got, want)
+		}
+	}
+}
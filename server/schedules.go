@@ -0,0 +1,238 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"time"
+	_ "time/tzdata" // Embed the timezone database: the container image does not ship one.
+
+	"github.com/google/uuid"
+)
+
+// --- Scheduled Plops ---
+
+const (
+	maxSchedulesPerUser = 50
+	// maxScheduleRecipients keeps a firing within the sender's burst: scheduled plops go through the rate limiter too.
+	maxScheduleRecipients   = senderBurst
+	defaultScheduleTimezone = "UTC"
+	// minScheduleInterval is the shortest time allowed between two occurrences of a recurring schedule.
+	minScheduleInterval = 15 * time.Minute
+	// scheduleIntervalSamples is how many occurrences are compared to find the shortest interval: enough
+	// to cover two days of a schedule that respects minScheduleInterval.
+	scheduleIntervalSamples = 2*24*int(time.Hour/minScheduleInterval) + 2
+)
+
+// localFireAtLayouts are the accepted formats for a one-shot FireAt without a UTC offset.
+var localFireAtLayouts = []string{"2006-01-02T15:04:05", "2006-01-02T15:04", "2006-01-02 15:04"}
+
+var (
+	// errTooManySchedules is returned when a user reached maxSchedulesPerUser.
+	errTooManySchedules = errors.New("too many scheduled plops")
+	// errScheduleTooFrequent is returned for a cron expression firing more often than minScheduleInterval.
+	errScheduleTooFrequent = fmt.Errorf("recurring schedules must fire at most once every %d minutes", int(minScheduleInterval.Minutes()))
+)
+
+// parseFireAt parses a one-shot fire time, either absolute (RFC 3339) or local to loc.
+func parseFireAt(value string, loc *time.Location) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	for _, layout := range localFireAtLayouts {
+		if t, err := time.ParseInLocation(layout, value, loc); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("fireAt %q is neither RFC 3339 nor a local 'YYYY-MM-DDTHH:MM' time", value)
+}
+
+// nextScheduledFire returns when a recurring schedule fires after 'after', in its own timezone.
+// It returns the zero time for one-shot schedules, which never fire again.
+func nextScheduledFire(sp ScheduledPlop, after time.Time) time.Time {
+	if sp.Cron == "" {
+		return time.Time{}
+	}
+	cron, err := parseCron(sp.Cron)
+	if err != nil {
+		log.Printf("[SCHEDULER] Schedule %s has an invalid cron expression %q: %v", sp.ID, sp.Cron, err)
+		return time.Time{}
+	}
+	loc, err := time.LoadLocation(sp.Timezone)
+	if err != nil {
+		log.Printf("[SCHEDULER] Schedule %s has an invalid timezone %q: %v", sp.ID, sp.Timezone, err)
+		return time.Time{}
+	}
+	return cron.next(after.In(loc))
+}
+
+// prepareScheduledPlop validates a schedule request and fills in its ID, owner and first fire time.
+func prepareScheduledPlop(ownerID string, req ScheduledPlop, now time.Time) (ScheduledPlop, error) {
+	if len(req.RecipientIDs) == 0 || len(req.RecipientIDs) > maxScheduleRecipients {
+		return req, fmt.Errorf("a schedule needs between 1 and %d recipients", maxScheduleRecipients)
+	}
+	if err := preparePlopPayload(&req.Payload); err != nil {
+		return req, err
+	}
+	if (req.FireAt == "") == (req.Cron == "") {
+		return req, errors.New("exactly one of 'fireAt' or 'cron' is required")
+	}
+	if req.Timezone == "" {
+		req.Timezone = defaultScheduleTimezone
+	}
+	loc, err := time.LoadLocation(req.Timezone)
+	if err != nil {
+		return req, fmt.Errorf("unknown timezone %q", req.Timezone)
+	}
+
+	req.ID = uuid.New().String()
+	req.OwnerID = ownerID
+	req.CreatedAt = now
+	if req.Cron != "" {
+		cron, err := parseCron(req.Cron)
+		if err != nil {
+			return req, err
+		}
+		req.NextFireAt = cron.next(now.In(loc))
+		if req.NextFireAt.IsZero() {
+			return req, fmt.Errorf("cron expression %q never fires", req.Cron)
+		}
+		if firesTooOften(cron, req.NextFireAt) {
+			return req, errScheduleTooFrequent
+		}
+	} else {
+		fireAt, err := parseFireAt(req.FireAt, loc)
+		if err != nil {
+			return req, err
+		}
+		if !fireAt.After(now) {
+			return req, errors.New("fireAt must be in the future")
+		}
+		req.NextFireAt = fireAt
+		req.FireAt = ""
+	}
+	return req, nil
+}
+
+// firesTooOften reports whether two occurrences of a cron schedule, starting at first, are less than
+// minScheduleInterval apart.
+func firesTooOften(cron *cronSchedule, first time.Time) bool {
+	previous := first
+	for range scheduleIntervalSamples {
+		next := cron.next(previous)
+		if next.IsZero() {
+			return false
+		}
+		if next.Sub(previous) < minScheduleInterval {
+			return true
+		}
+		previous = next
+	}
+	return false
+}
+
+// createScheduledPlop validates and persists a new schedule for ownerID. Every recipient must be a contact.
+func createScheduledPlop(ownerID string, req ScheduledPlop) (ScheduledPlop, error) {
+	sp, err := prepareScheduledPlop(ownerID, req, timeNow())
+	if err != nil {
+		return sp, err
+	}
+	contactIDs, err := store.GetContactIDs(ownerID)
+	if err != nil {
+		return sp, err
+	}
+	for _, recipientID := range sp.RecipientIDs {
+		if !slices.Contains(contactIDs, recipientID) {
+			return sp, fmt.Errorf("recipient %s is not a contact", recipientID)
+		}
+	}
+	count, err := store.CountScheduledPlopsForUser(ownerID)
+	if err != nil {
+		return sp, err
+	}
+	if count >= maxSchedulesPerUser {
+		return sp, errTooManySchedules
+	}
+	if err := store.SaveScheduledPlop(sp); err != nil {
+		return sp, err
+	}
+	log.Printf("[SCHEDULER] Schedule %s created by %s for %d recipient(s), next fire at %s.", sp.ID, ownerID, len(sp.RecipientIDs), sp.NextFireAt)
+	return sp, nil
+}
+
+// fireScheduledPlop sends one occurrence of a schedule to its recipients that are still contacts of the owner.
+// Like live plops, it goes through the rate limiter: the plops it refuses are dropped from this occurrence.
+func fireScheduledPlop(sp ScheduledPlop) {
+	now := timeNow()
+	if _, sanctioned := sanctionFor(sp.OwnerID, now); sanctioned {
+		log.Printf("[SCHEDULER] Skipping schedule %s: user %s is suspended or banned.", sp.ID, sp.OwnerID)
+		return
+	}
+	contactIDs, err := store.GetContactIDs(sp.OwnerID)
+	if err != nil {
+		log.Printf("[SCHEDULER] Skipping schedule %s: could not load the contacts of user %s: %v", sp.ID, sp.OwnerID, err)
+		return
+	}
+	log.Printf("[SCHEDULER] Firing schedule %s of user %s to %d recipient(s).", sp.ID, sp.OwnerID, len(sp.RecipientIDs))
+	for _, recipientID := range sp.RecipientIDs {
+		if !slices.Contains(contactIDs, recipientID) {
+			log.Printf("[SCHEDULER] Schedule %s: %s is no longer a contact of %s, skipping.", sp.ID, recipientID, sp.OwnerID)
+			continue
+		}
+		msg := Message{
+			ID:      uuid.New().String(),
+			Type:    "plop",
+			From:    sp.OwnerID,
+			To:      recipientID,
+			Payload: sp.Payload,
+		}
+		allowed, retryAfter := plopLimiter.allow(msg.From, msg.To, now)
+		recentPlops.record(msg.From, msg.To, ReportedMessage{MessageID: msg.ID, SentAt: now, RateLimited: !allowed})
+		if !allowed {
+			log.Printf("[SCHEDULER] Schedule %s: plop from %s to %s dropped by the rate limiter, retry after %v.", sp.ID, msg.From, msg.To, retryAfter)
+			continue
+		}
+		sendDirectMessage(msg)
+	}
+}
+
+// handleScheduleCommand answers the 'schedule_create', 'schedule_list' and 'schedule_cancel' WebSocket commands.
+func handleScheduleCommand(conn *clientConn, msg Message) {
+	reply := Message{ID: msg.ID, From: "server", To: msg.From}
+	switch msg.Type {
+	case "schedule_create":
+		if msg.Payload.Schedule == nil {
+			reply.Type, reply.Payload.Text = "schedule_error", "payload.schedule is required"
+			break
+		}
+		sp, err := createScheduledPlop(msg.From, *msg.Payload.Schedule)
+		if err != nil {
+			reply.Type, reply.Payload.Text = "schedule_error", err.Error()
+			break
+		}
+		reply.Type, reply.Payload.Schedule = "schedule_created", &sp
+	case "schedule_list":
+		schedules, err := store.GetScheduledPlopsForUser(msg.From)
+		if err != nil {
+			reply.Type, reply.Payload.Text = "schedule_error", "failed to list schedules"
+			break
+		}
+		reply.Type, reply.Payload.Schedules = "schedule_list", schedules
+	case "schedule_cancel":
+		if msg.Payload.Schedule == nil || msg.Payload.Schedule.ID == "" {
+			reply.Type, reply.Payload.Text = "schedule_error", "payload.schedule.id is required"
+			break
+		}
+		deleted, err := store.DeleteScheduledPlop(msg.Payload.Schedule.ID, msg.From)
+		if err != nil || !deleted {
+			reply.Type, reply.Payload.Text = "schedule_error", "schedule not found"
+			break
+		}
+		reply.Type, reply.Payload.Schedule = "schedule_cancelled", &ScheduledPlop{ID: msg.Payload.Schedule.ID}
+	}
+
+	if err := conn.WriteJSON(reply); err != nil {
+		log.Printf("[ERROR] Failed to send '%s' to userId=%s: %v", reply.Type, msg.From, err)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestPrepareScheduledPlopOneShot(t *testing.T) {
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	req := ScheduledPlop{RecipientIDs: []string{"me"}, FireAt: "2026-10-19T18:00", Timezone: "Europe/Paris"}
+
+	sp, err := prepareScheduledPlop("me", req, now)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := time.Date(2026, 10, 19, 16, 0, 0, 0, time.UTC) // 18:00 in Paris (CEST)
+	if !sp.NextFireAt.Equal(expected) {
+		t.Errorf("NextFireAt = %s, want %s", sp.NextFireAt, expected)
+	}
+	if sp.ID == "" || sp.OwnerID != "me" {
+		t.Errorf("ID and OwnerID should be set, got %+v", sp)
+	}
+	if next := nextScheduledFire(sp, sp.NextFireAt); !next.IsZero() {
+		t.Errorf("one-shot schedules should not fire again, got %s", next)
+	}
+}
+
+func TestPrepareScheduledPlopRecurring(t *testing.T) {
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC) // A Monday
+	req := ScheduledPlop{RecipientIDs: []string{"team-a", "team-b"}, Cron: "0 9 * * 1", Timezone: "Europe/Paris"}
+
+	sp, err := prepareScheduledPlop("lead", req, now)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := time.Date(2026, 10, 26, 8, 0, 0, 0, time.UTC) // 9:00 in Paris after the switch to CET
+	if !sp.NextFireAt.Equal(expected) {
+		t.Errorf("NextFireAt = %s, want %s", sp.NextFireAt, expected)
+	}
+	if next := nextScheduledFire(sp, sp.NextFireAt); !next.Equal(expected.AddDate(0, 0, 7)) {
+		t.Errorf("next occurrence = %s, want %s", next, expected.AddDate(0, 0, 7))
+	}
+	if _, err := prepareScheduledPlop("lead", ScheduledPlop{RecipientIDs: []string{"team-a"}, Cron: "*/15 * * * *"}, now); err != nil {
+		t.Errorf("a schedule firing every %v should be accepted, got %v", minScheduleInterval, err)
+	}
+}
+
+func TestPrepareScheduledPlopValidation(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name string
+		req  ScheduledPlop
+	}{
+		{"no recipients", ScheduledPlop{Cron: "* * * * *"}},
+		{"neither fireAt nor cron", ScheduledPlop{RecipientIDs: []string{"a"}}},
+		{"both fireAt and cron", ScheduledPlop{RecipientIDs: []string{"a"}, Cron: "* * * * *", FireAt: "2099-01-01T00:00"}},
+		{"unknown timezone", ScheduledPlop{RecipientIDs: []string{"a"}, Cron: "* * * * *", Timezone: "Mars/Olympus"}},
+		{"fireAt in the past", ScheduledPlop{RecipientIDs: []string{"a"}, FireAt: "2000-01-01T00:00:00Z"}},
+		{"invalid cron", ScheduledPlop{RecipientIDs: []string{"a"}, Cron: "every monday"}},
+		{"every minute", ScheduledPlop{RecipientIDs: []string{"a"}, Cron: "* * * * *"}},
+		{"twice in five minutes", ScheduledPlop{RecipientIDs: []string{"a"}, Cron: "0,5 9 * * *"}},
+		{"across the hour", ScheduledPlop{RecipientIDs: []string{"a"}, Cron: "0,59 * * * *"}},
+		{"too many recipients", ScheduledPlop{RecipientIDs: make([]string, maxScheduleRecipients+1), Cron: "0 9 * * *"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := prepareScheduledPlop("me", tt.req, now); err == nil {
+				t.Error("expected a validation error")
+			}
+		})
+	}
+}
+
+func TestFireScheduledPlop(t *testing.T) {
+	s := newTestServer(t)
+	alice, bob, carol := s.newUser("Alice", ""), s.newUser("Bob", ""), s.newUser("Carol", "")
+	s.befriend(alice, bob)
+	bobWS := s.connect(bob)
+
+	if _, err := createScheduledPlop(alice.ID, ScheduledPlop{RecipientIDs: []string{bob.ID, carol.ID}, Cron: "0 9 * * *"}); err == nil {
+		t.Error("a schedule to someone who is not a contact should be refused")
+	}
+
+	// Carol could only be a recipient of a schedule created before she was removed from alice's contacts.
+	sp := ScheduledPlop{ID: "morning", OwnerID: alice.ID, RecipientIDs: []string{bob.ID, carol.ID}}
+	for i := 1; i <= pairBurst+1; i++ {
+		sp.Payload.Text = fmt.Sprintf("plop %d", i)
+		fireScheduledPlop(sp)
+	}
+	for i := 1; i <= pairBurst; i++ {
+		if plop := bobWS.expect("plop"); plop.From != alice.ID || plop.Payload.Text != fmt.Sprintf("plop %d", i) {
+			t.Errorf("bob received %+v, want plop %d", plop, i)
+		}
+	}
+
+	// The occurrence over the pair burst was dropped, not delayed.
+	s.clock.Advance(pairRefillInterval)
+	sp.Payload.Text = "later"
+	fireScheduledPlop(sp)
+	if plop := bobWS.expect("plop"); plop.Payload.Text != "later" {
+		t.Errorf("bob received %q, want the occurrence fired once the rate limit was lifted", plop.Payload.Text)
+	}
+	if pending, _ := s.store.GetPendingMessages(carol.ID); len(pending) != 0 {
+		t.Errorf("carol is not a contact of alice but was sent %d plop(s)", len(pending))
+	}
+}
@@ -10,38 +10,110 @@ import (
 
 // --- Global State & Mutexes ---
 
-// clients maps a userID to a set of their active WebSocket connections.
+// clientInfo describes one active WebSocket connection.
+type clientInfo struct {
+	ID          string // Identifies the connection in the admin API
+	DeviceID    string // Empty for clients connecting without device credentials
+	ConnectedAt time.Time
+	RemoteAddr  string
+}
+
+// clientWriteTimeout bounds a write to a client, so that a stuck connection cannot hold its write lock forever.
+const clientWriteTimeout = 10 * time.Second
+
+// clientConn is the WebSocket connection of a client. A gorilla connection supports one writer at a time,
+// while its read loop, broadcasts, the scheduler and presence updates all write to it: data frames go
+// through writeMu. Close and WriteControl are safe to call concurrently and need no lock.
+type clientConn struct {
+	*websocket.Conn
+	writeMu sync.Mutex
+}
+
+func newClientConn(conn *websocket.Conn) *clientConn {
+	return &clientConn{Conn: conn}
+}
+
+// WriteJSON sends v as a JSON text frame.
+func (c *clientConn) WriteJSON(v interface{}) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.Conn.SetWriteDeadline(time.Now().Add(clientWriteTimeout))
+	return c.Conn.WriteJSON(v)
+}
+
+// WriteMessage sends a data frame.
+func (c *clientConn) WriteMessage(messageType int, data []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.Conn.SetWriteDeadline(time.Now().Add(clientWriteTimeout))
+	return c.Conn.WriteMessage(messageType, data)
+}
+
+// clients maps a userID to their active WebSocket connections.
 // This remains in memory as it represents the current live connections, which is ephemeral state.
-var clients = make(map[string]map[*websocket.Conn]bool)
+var clients = make(map[string]map[*clientConn]*clientInfo)
 var clientsMutex = &sync.Mutex{}
 
 // syncCodes stores active synchronization codes. These are short-lived and can remain in memory.
 var syncCodes = make(map[string]SyncCode)
 var syncCodesMutex = &sync.Mutex{}
 
-// userLastMessageTime is used for message rate-limiting/cooldown. This is also ephemeral state.
-var userLastMessageTime = make(map[string]time.Time)
-var userLastMessageMutex = &sync.Mutex{}
+// linkRequests stores the devices waiting for approval after using a sync code, keyed by request ID.
+var linkRequests = make(map[string]*LinkRequest)
+var linkRequestsMutex = &sync.Mutex{}
+
+// sanctionCache caches the ban lookups of users, sanctioned or not, so plops can be refused without a
+// database query each time. Entries are trusted for sanctionCacheTTL. Connections are checked against
+// the database when they open.
+var sanctionCache = make(map[string]cachedSanction)
+var sanctionCacheMutex = &sync.Mutex{}
+
+// plopLimiter rate-limits plops per sender and per sender/recipient pair. This is also ephemeral state.
+var plopLimiter = newPlopRateLimiter()
 
 // --- Background Cleanup Routines ---
 
+// schedulerTickInterval is how often the scheduler looks for due scheduled plops.
+const schedulerTickInterval = 15 * time.Second
+
 // cleanupExpiredInvitations periodically removes expired invitation codes from the database.
 func cleanupExpiredInvitations() {
 	log.Println("[CLEANUP] Starting expired invitations cleanup routine...")
 	ticker := time.NewTicker(1 * time.Minute)
 	defer ticker.Stop()
 	for range ticker.C {
-		dbDeleteExpiredInvitations()
+		store.DeleteExpiredInvitations()
+	}
+}
+
+// cleanupExpiredPendingMessages periodically purges pending messages whose TTL elapsed
+// and tells their senders they expired undelivered.
+func cleanupExpiredPendingMessages() {
+	log.Println("[CLEANUP] Starting expired pending messages cleanup routine...")
+	ticker := time.NewTicker(1 * time.Minute)
+	defer ticker.Stop()
+	for range ticker.C {
+		purgeExpiredPendingMessages()
 	}
 }
 
-// cleanupExpiredSyncCodes periodically removes expired sync codes from memory.
+// purgeExpiredPendingMessages runs one pass of cleanupExpiredPendingMessages.
+func purgeExpiredPendingMessages() {
+	expired, _ := store.DeleteExpiredPendingMessages()
+	for _, msg := range expired {
+		if msg.Type == "" || msg.Type == "plop" { // Server events expire silently
+			notifyMessageExpired(msg)
+		}
+	}
+}
+
+// cleanupExpiredSyncCodes periodically removes expired sync codes and link requests from memory.
 func cleanupExpiredSyncCodes() {
 	log.Println("[CLEANUP] Starting expired sync codes cleanup routine...")
 	ticker := time.NewTicker(1 * time.Minute)
 	defer ticker.Stop()
 	for range ticker.C {
-		now := time.Now()
+		now := timeNow()
 		syncCodesMutex.Lock()
 		for code, sc := range syncCodes {
 			if now.After(sc.ExpiresAt) {
@@ -50,5 +122,46 @@ func cleanupExpiredSyncCodes() {
 			}
 		}
 		syncCodesMutex.Unlock()
+		expireLinkRequests(now)
+	}
+}
+
+// cleanupModerationState periodically forgets the plop metadata kept for reports once it is too old,
+// and the ban lookups that are no longer trusted.
+func cleanupModerationState() {
+	log.Println("[CLEANUP] Starting moderation state cleanup routine...")
+	ticker := time.NewTicker(10 * time.Minute)
+	defer ticker.Stop()
+	for range ticker.C {
+		now := timeNow()
+		if evicted := recentPlops.evictBefore(now.Add(-recentPlopRetention)); evicted > 0 {
+			log.Printf("[CLEANUP] Forgot the recent plops of %d sender/recipient pair(s).", evicted)
+		}
+		sanctionCacheMutex.Lock()
+		for userID, cached := range sanctionCache {
+			if now.Sub(cached.checkedAt) >= sanctionCacheTTL {
+				delete(sanctionCache, userID)
+			}
+		}
+		sanctionCacheMutex.Unlock()
+	}
+}
+
+// runScheduledPlops periodically fires the schedules that are due.
+func runScheduledPlops() {
+	log.Println("[SCHEDULER] Starting scheduled plops routine...")
+	ticker := time.NewTicker(schedulerTickInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		now := timeNow()
+		due, err := store.ClaimDueScheduledPlops(now, func(sp ScheduledPlop) time.Time {
+			return nextScheduledFire(sp, now)
+		})
+		if err != nil {
+			continue
+		}
+		for _, sp := range due {
+			fireScheduledPlop(sp)
+		}
 	}
 }
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// --- Storage ---
+
+// Store persists everything that outlives a connection. PostgreSQL (postgres_persistence.go) is the
+// production store; the in-memory one (memory_store.go) runs the server without a database, for
+// development and end-to-end tests. Methods that return nothing log their errors.
+type Store interface {
+	// Users, pseudos and avatars
+	GetUserPseudo(userID string) (string, error)
+	GetUsersPseudos(userIDs []string) (map[string]string, error)
+	SetUserPseudo(userID, pseudo, key string) error // key is the normalized pseudo, unique across users
+	GetUserAvatar(userID string) (map[int]string, error)
+	GetUsersAvatars(userIDs []string) (map[string]map[int]string, error)
+	SetUserAvatar(userID string, hashes map[int]string) error
+	DeleteUserAvatar(userID string) error
+	AvatarHashInUse(hash string) (bool, error)
+	DeleteUserData(userID string) error
+
+	// Devices and credentials
+	GetUserDevices(userID string) ([]Device, error)
+	GetUserDeviceTokens(userID string) ([]string, error)
+	UpsertDevice(d Device) error
+	RenameDevice(userID, deviceID, name string) (bool, error)
+	TouchDevice(userID, deviceID string)
+	RevokeDevice(userID, deviceID string) (bool, error)
+	RemoveDevicePushTokens(userID string, tokens []string) error
+	SetDevicePublicKey(userID, deviceID, publicKey string) (bool, error)
+	GetDeviceKeys(userID string) ([]DeviceKey, error)
+	GetDeviceAuth(userID, deviceID string) (secretHash string, revoked bool, found bool, err error)
+	SetDeviceSecretHash(userID, deviceID, secretHash string) error
+	UserHasCredentials(userID string) (bool, error)
+	GetAccountSecretHash(userID string) (string, bool, error)
+	SetAccountSecretHash(userID, secretHash string) error
+
+	// Invitations and contacts
+	SaveInvitation(inv Invitation)
+	GetInvitation(code string) (Invitation, bool, error)
+	GetInvitationsByCreator(userID string) ([]Invitation, error)
+	DeleteInvitation(code string)
+	DeleteExpiredInvitations()
+	SaveContactPair(userA, userB string)
+	ReplaceContacts(userID string, contactIDs []string) error
+	GetContactIDs(userID string) ([]string, error)
+	GetMutualContacts(userID string) ([]string, error)
+
+	// Pending messages
+	SavePendingMessage(msg Message)
+	GetPendingMessages(userID string) ([]Message, error)
+	GetPendingMessagesInvolving(userID string) ([]Message, error)
+	DeletePendingMessagesForUser(userID string)
+	DeleteExpiredPendingMessages() ([]Message, error)
+
+	// Presence
+	GetPresenceSettings(userIDs []string) (map[string]PresenceSettings, error)
+	SavePresenceSettings(ps PresenceSettings) error
+	UpdateLastSeen(userID string, lastSeen time.Time)
+
+	// Scheduled plops
+	SaveScheduledPlop(sp ScheduledPlop) error
+	GetScheduledPlopsForUser(ownerID string) ([]ScheduledPlop, error)
+	CountScheduledPlopsForUser(ownerID string) (int, error)
+	DeleteScheduledPlop(id, ownerID string) (bool, error)
+	ClaimDueScheduledPlops(now time.Time, reschedule func(ScheduledPlop) time.Time) ([]ScheduledPlop, error)
+
+	// Web Push and UnifiedPush
+	GetOrCreateVAPIDPrivateKey(generate func() (string, error)) (string, error)
+	SaveWebPushSubscription(sub WebPushSubscription) error
+	GetWebPushSubscriptions(userID string) ([]WebPushSubscription, error)
+	DeleteWebPushSubscription(userID, endpoint string)
+	SaveUnifiedPushEndpoint(userID, deviceID, endpoint string) error
+	GetUnifiedPushEndpoints(userID string) ([]string, error)
+	DeleteUnifiedPushEndpoint(userID, endpoint string)
+
+	// Moderation
+	GetUserBan(userID string) (UserBan, bool, error)
+	GetActiveBans() ([]UserBan, error)
+	BanUser(ban UserBan) error
+	SaveReport(report Report) error
+	GetReport(id string) (Report, bool, error)
+	GetReports(status string, limit int) ([]Report, error)
+	ResolveReport(id, action, note string, resolvedAt time.Time) (bool, error)
+
+	// Admin
+	GetUserSummaries(userID string, limit int) ([]UserSummary, error)
+	ListInvitations() ([]Invitation, error)
+	PurgeInvitations(all bool) (int64, error)
+	GetPendingStats(top int) (PendingStats, error)
+	PruneStaleTokens(cutoff time.Time, dryRun bool) (TokenPruneResult, error)
+	Rekey(dryRun bool) (RekeyResult, error)
+
+	// Health
+	Ping(ctx context.Context) error // Checks that the store answers, for /readyz
+}
+
+// postgresStore is the Store backed by the PostgreSQL database in db.
+type postgresStore struct{}
+
+// store is the storage in use, chosen at startup by initializeStore.
+var store Store = postgresStore{}
+
+// timeNow is the server's clock. Tests replace it to control expiries, rate limits and schedules.
+var timeNow = time.Now
+
+// initializeStore selects the storage from the STORE environment variable: "postgres" (default)
+// or "memory", which keeps everything in memory and loses it on restart.
+func initializeStore() {
+	kind := getEnv("STORE", "postgres")
+	switch kind {
+	case "postgres":
+		initDB()
+		store = postgresStore{}
+	case "memory":
+		store = newMemoryStore()
+		schemaReady.Store(true) // Nothing to migrate
+		log.Println("[WARN] Using the in-memory store: nothing survives a restart.")
+	default:
+		log.Fatalf("[FATAL] Unknown STORE %q, expected 'postgres' or 'memory'", kind)
+	}
+}
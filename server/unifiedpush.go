@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// --- UnifiedPush ---
+
+const unifiedPushMaxAttempts = 4
+
+// unifiedPushBaseBackoff is the delay before the first retry; it doubles on every attempt.
+var unifiedPushBaseBackoff = 1 * time.Second
+
+// unifiedPushClient is the HTTP client used to reach UnifiedPush distributors. Endpoints are chosen by
+// clients, so it checks the address it actually connects to: a host resolving to a private address,
+// at registration or later, cannot make the server reach its own network.
+var unifiedPushClient = &http.Client{
+	Timeout: 10 * time.Second,
+	Transport: &http.Transport{
+		DialContext:         (&net.Dialer{Timeout: 5 * time.Second, Control: refusePrivateDistributor}).DialContext,
+		TLSHandshakeTimeout: 5 * time.Second,
+		ForceAttemptHTTP2:   true,
+		MaxIdleConns:        100,
+		IdleConnTimeout:     90 * time.Second,
+	},
+}
+
+// unifiedPushAllowHTTP allows plain http:// endpoints, for self-hosted distributors on a trusted network.
+var unifiedPushAllowHTTP = getEnv("UNIFIEDPUSH_ALLOW_HTTP", "") == "true"
+
+// unifiedPushAllowPrivate allows endpoints on private and loopback addresses, for distributors hosted next to the server.
+var unifiedPushAllowPrivate = getEnv("UNIFIEDPUSH_ALLOW_PRIVATE_NETWORKS", "") == "true"
+
+var errPrivateEndpoint = errors.New("endpoint must not be on a private network")
+
+// cgnatPrefix is the shared address space of carrier-grade NAT (RFC 6598), private but not covered by netip.
+var cgnatPrefix = netip.MustParsePrefix("100.64.0.0/10")
+
+// isPrivateAddress reports whether an address is loopback, private, link-local or otherwise not on the public Internet.
+func isPrivateAddress(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	return addr.IsLoopback() || addr.IsPrivate() || addr.IsLinkLocalUnicast() || addr.IsLinkLocalMulticast() ||
+		addr.IsInterfaceLocalMulticast() || addr.IsMulticast() || addr.IsUnspecified() || cgnatPrefix.Contains(addr)
+}
+
+// refusePrivateAddress is the dialer hook of the clients reaching endpoints chosen by clients, called
+// with the resolved address of every connection.
+func refusePrivateAddress(network, address string, _ syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+	if isPrivateAddress(addrPort.Addr()) {
+		return errPrivateEndpoint
+	}
+	return nil
+}
+
+// refusePrivateDistributor is the dialer hook of unifiedPushClient: refusePrivateAddress, unless
+// UNIFIEDPUSH_ALLOW_PRIVATE_NETWORKS is set.
+func refusePrivateDistributor(network, address string, c syscall.RawConn) error {
+	if unifiedPushAllowPrivate {
+		return nil
+	}
+	return refusePrivateAddress(network, address, c)
+}
+
+// withoutURL drops the URL from an HTTP client error: push endpoints are secrets and must not end up in logs.
+func withoutURL(err error) error {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return fmt.Errorf("%s: %w", urlErr.Op, urlErr.Err)
+	}
+	return err
+}
+
+// retryableError marks a delivery failure worth retrying, optionally after a server-provided delay.
+type retryableError struct {
+	err        error
+	retryAfter time.Duration
+}
+
+func (e *retryableError) Error() string { return e.err.Error() }
+
+func (e *retryableError) Unwrap() error { return e.err }
+
+// validateUnifiedPushEndpoint checks that a distributor endpoint is an absolute https URL. Endpoints naming
+// a private address are refused early; names resolving to one are refused by unifiedPushClient.
+func validateUnifiedPushEndpoint(endpoint string) error {
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" {
+		return errors.New("endpoint must be an absolute URL")
+	}
+	if u.Scheme != "https" && !(unifiedPushAllowHTTP && u.Scheme == "http") {
+		return errors.New("endpoint must be an https URL")
+	}
+	if unifiedPushAllowPrivate {
+		return nil
+	}
+	return refusePrivateHost(u)
+}
+
+// refusePrivateHost refuses endpoint URLs naming localhost or a private address. Names resolving to
+// one are only caught when connecting, by refusePrivateAddress.
+func refusePrivateHost(u *url.URL) error {
+	host := strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return errPrivateEndpoint
+	}
+	if addr, err := netip.ParseAddr(host); err == nil && isPrivateAddress(addr) {
+		return errPrivateEndpoint
+	}
+	return nil
+}
+
+// postUnifiedPush makes a single delivery attempt to a distributor endpoint.
+func postUnifiedPush(ctx context.Context, endpoint string, body []byte, ttl time.Duration) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Urgency", "high")
+	if ttl > 0 {
+		req.Header.Set("TTL", strconv.FormatInt(int64(ttl.Seconds()), 10))
+	}
+
+	resp, err := unifiedPushClient.Do(req)
+	if err != nil {
+		return &retryableError{err: withoutURL(err)}
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+		return &UnregisteredTokenError{Token: endpoint, Err: fmt.Errorf("distributor answered %s", resp.Status)}
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		retryAfter := time.Duration(0)
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+			retryAfter = time.Duration(seconds) * time.Second
+		}
+		return &retryableError{err: fmt.Errorf("distributor answered %s", resp.Status), retryAfter: retryAfter}
+	case resp.StatusCode >= 300:
+		return fmt.Errorf("distributor answered %s", resp.Status)
+	}
+	return nil
+}
+
+// sendUnifiedPush delivers a notification to a UnifiedPush endpoint in the background and calls done with
+// the outcome. Transient failures (network errors, 429 and 5xx) are retried with exponential backoff on
+// timers, so no goroutine waits them out. done gets an *UnregisteredTokenError when the distributor
+// reports the endpoint as gone.
+func sendUnifiedPush(endpoint string, n PushNotification, done func(error)) {
+	body, err := json.Marshal(map[string]interface{}{
+		"title":     n.Title,
+		"body":      n.Body,
+		"isDefault": n.IsDefault,
+	})
+	if err != nil {
+		done(err)
+		return
+	}
+
+	var attempt func(number int, backoff time.Duration)
+	attempt = func(number int, backoff time.Duration) {
+		err := postUnifiedPush(context.Background(), endpoint, body, n.TTL)
+		var retryable *retryableError
+		if !errors.As(err, &retryable) || number == unifiedPushMaxAttempts {
+			done(err)
+			return
+		}
+
+		wait := max(backoff, retryable.retryAfter)
+		log.Printf("[UNIFIEDPUSH] Attempt %d/%d failed: %v. Retrying in %v.", number, unifiedPushMaxAttempts, err, wait)
+		backgroundTasks.Add(1) // Still held by this attempt: a shutdown waiting for the tasks waits for the retry too
+		time.AfterFunc(wait, func() {
+			defer backgroundTasks.Done()
+			attempt(number+1, backoff*2)
+		})
+	}
+	goBackground(func() { attempt(1, unifiedPushBaseBackoff) })
+}
+
+// sendUnifiedPushNotifications sends a notification to every UnifiedPush endpoint of an offline user.
+// Distributors are third parties: like push services for encrypted plops, they get a generic notification
+// that names neither the sender nor the content, and the app fetches the plop itself.
+func sendUnifiedPushNotifications(msg Message) {
+	endpoints, err := store.GetUnifiedPushEndpoints(msg.To)
+	if err != nil || len(endpoints) == 0 {
+		return
+	}
+	log.Printf("[UNIFIEDPUSH] Sending push notification from %s to %d UnifiedPush endpoint(s) of %s.", msg.From, len(endpoints), msg.To)
+
+	notification := PushNotification{Title: encryptedPushTitle, Body: encryptedPushBody, IsDefault: msg.IsDefault, TTL: messageTTL(msg)}
+	for _, endpoint := range endpoints {
+		sendUnifiedPush(endpoint, notification, func(err error) {
+			var unregistered *UnregisteredTokenError
+			switch {
+			case errors.As(err, &unregistered):
+				log.Printf("[INFO] A UnifiedPush endpoint of user %s is gone. Removing it.", msg.To)
+				store.DeleteUnifiedPushEndpoint(msg.To, endpoint)
+			case err != nil:
+				log.Printf("[ERROR] UnifiedPush send failed for user %s: %v", msg.To, err)
+			default:
+				log.Printf("[UNIFIEDPUSH] Push notification sent successfully for user %s.", msg.To)
+			}
+		})
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// useFastUnifiedPushBackoff shortens retry delays for the duration of a test.
+func useFastUnifiedPushBackoff(t *testing.T) {
+	previous := unifiedPushBaseBackoff
+	unifiedPushBaseBackoff = time.Millisecond
+	t.Cleanup(func() { unifiedPushBaseBackoff = previous })
+}
+
+// useLocalDistributors lets the UnifiedPush client reach test servers on the loopback address.
+func useLocalDistributors(t *testing.T) {
+	previous := unifiedPushAllowPrivate
+	unifiedPushAllowPrivate = true
+	t.Cleanup(func() { unifiedPushAllowPrivate = previous })
+}
+
+// sendUnifiedPushAndWait delivers a notification and returns the outcome once the retries are over.
+func sendUnifiedPushAndWait(endpoint string, n PushNotification) error {
+	outcome := make(chan error, 1)
+	sendUnifiedPush(endpoint, n, func(err error) { outcome <- err })
+	return <-outcome
+}
+
+func TestSendUnifiedPushRetriesTransientFailures(t *testing.T) {
+	useFastUnifiedPushBackoff(t)
+	useLocalDistributors(t)
+
+	var attempts int32
+	var payload map[string]interface{}
+	distributor := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&attempts, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		json.NewDecoder(r.Body).Decode(&payload)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer distributor.Close()
+
+	err := sendUnifiedPushAndWait(distributor.URL+"/up/abc", PushNotification{SenderID: "alice", Title: "Plop", Body: "You received a plop"})
+	if err != nil {
+		t.Fatalf("delivery should succeed after retries, got %v", err)
+	}
+	if attempts != 3 {
+		t.Errorf("expected 3 attempts, got %d", attempts)
+	}
+	if payload["title"] != "Plop" || payload["senderId"] != nil {
+		t.Errorf("unexpected payload: %v", payload)
+	}
+}
+
+func TestSendUnifiedPushGivesUp(t *testing.T) {
+	useFastUnifiedPushBackoff(t)
+	useLocalDistributors(t)
+
+	var attempts int32
+	distributor := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer distributor.Close()
+
+	if err := sendUnifiedPushAndWait(distributor.URL, PushNotification{}); err == nil {
+		t.Error("delivery should fail when the distributor keeps failing")
+	}
+	if attempts != unifiedPushMaxAttempts {
+		t.Errorf("expected %d attempts, got %d", unifiedPushMaxAttempts, attempts)
+	}
+}
+
+func TestSendUnifiedPushGoneEndpoint(t *testing.T) {
+	useLocalDistributors(t)
+	var attempts int32
+	distributor := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer distributor.Close()
+
+	err := sendUnifiedPushAndWait(distributor.URL, PushNotification{})
+	var unregistered *UnregisteredTokenError
+	if !errors.As(err, &unregistered) {
+		t.Errorf("404 should be reported as an unregistered endpoint, got %v", err)
+	}
+	if attempts != 1 {
+		t.Errorf("a gone endpoint should not be retried, got %d attempts", attempts)
+	}
+}
+
+func TestSendUnifiedPushNotificationsIsGeneric(t *testing.T) {
+	s := newTestServer(t)
+	useLocalDistributors(t)
+	alice, bob := s.newUser("Alice", ""), s.newUser("Bob", "")
+
+	bodies := make(chan string, 1)
+	distributor := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body strings.Builder
+		io.Copy(&body, r.Body)
+		bodies <- body.String()
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer distributor.Close()
+	s.store.SaveUnifiedPushEndpoint(bob.ID, bob.DeviceID, distributor.URL+"/up/bob")
+
+	sendUnifiedPushNotifications(Message{From: alice.ID, To: bob.ID, Payload: MessagePayload{Text: "at the station"}})
+	body := <-bodies
+	for _, secret := range []string{alice.ID, alice.Pseudo, "station"} {
+		if strings.Contains(body, secret) {
+			t.Errorf("the distributor should not learn %q, got %s", secret, body)
+		}
+	}
+}
+
+func TestValidateUnifiedPushEndpoint(t *testing.T) {
+	if err := validateUnifiedPushEndpoint("https://ntfy.sh/upABC"); err != nil {
+		t.Errorf("https endpoint should be valid: %v", err)
+	}
+	for _, endpoint := range []string{
+		"http://ntfy.local/up", "ntfy.sh/up", "ftp://example.com",
+		"https://127.0.0.1/up", "https://localhost:8080/up", "https://10.0.0.5/up", "https://192.168.1.1/up",
+		"https://169.254.169.254/latest/meta-data", "https://[::1]/up", "https://[::ffff:10.0.0.1]/up", "https://100.64.0.1/up",
+	} {
+		if err := validateUnifiedPushEndpoint(endpoint); err == nil {
+			t.Errorf("endpoint %q should be rejected", endpoint)
+		}
+	}
+}
+
+func TestUnifiedPushClientRefusesPrivateAddresses(t *testing.T) {
+	var attempts int32
+	distributor := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+	}))
+	defer distributor.Close()
+
+	// The name passes validation, but the dialer sees where it resolves to.
+	endpoint := strings.Replace(distributor.URL, "127.0.0.1", "localtest.invalid", 1)
+	previous := unifiedPushClient.Transport
+	unifiedPushClient.Transport = &http.Transport{
+		DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			_, port, _ := net.SplitHostPort(address)
+			dialer := &net.Dialer{Control: refusePrivateAddress}
+			return dialer.DialContext(ctx, network, net.JoinHostPort("127.0.0.1", port)) // A rebinding DNS answer
+		},
+	}
+	t.Cleanup(func() { unifiedPushClient.Transport = previous })
+
+	if err := postUnifiedPush(context.Background(), endpoint, []byte("{}"), 0); !errors.Is(err, errPrivateEndpoint) {
+		t.Errorf("a host resolving to a loopback address should be refused, got %v", err)
+	}
+	if attempts != 0 {
+		t.Errorf("the distributor should not have been reached, got %d request(s)", attempts)
+	}
+}
@@ -4,10 +4,24 @@ import (
 	"crypto/rand"
 	"log"
 	"os"
+	"sync"
 )
 
 // --- Utility Functions ---
 
+// backgroundTasks tracks the goroutines requests leave running, like store writes and push
+// notifications, so that a shutdown or a test can wait for them.
+var backgroundTasks sync.WaitGroup
+
+// goBackground runs task in a goroutine tracked by backgroundTasks.
+func goBackground(task func()) {
+	backgroundTasks.Add(1)
+	go func() {
+		defer backgroundTasks.Done()
+		task()
+	}()
+}
+
 // debugLog prints a log message only if the DEBUG environment variable is set.
 func debugLog(format string, v ...interface{}) {
 	if os.Getenv("DEBUG") != "" {
@@ -37,6 +51,11 @@ func intPtr(i int) *int {
 // extractPayloadText safely gets the text content from a message payload.
 func extractPayloadText(payload interface{}) string {
 	switch p := payload.(type) {
+	case MessagePayload:
+		if p.Text != "" {
+			return p.Text
+		}
+		return "Plop"
 	case map[string]interface{}:
 		if text, ok := p["text"].(string); ok {
 			return text
@@ -28,6 +28,8 @@ func TestExtractPayloadText(t *testing.T) {
 		{"map with text", map[string]interface{}{"text": "hello"}, "hello"},
 		{"map without text", map[string]interface{}{"foo": "bar"}, "Plop"},
 		{"string payload", "world", "world"},
+		{"message payload with text", MessagePayload{Text: "J'arrive"}, "J'arrive"},
+		{"message payload without text", MessagePayload{Latitude: 1}, "Plop"},
 		{"other type", 123, "Plop"},
 	}
 
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// --- Web Push (RFC 8030 / RFC 8291 / RFC 8292) ---
+
+const (
+	webPushRecordSize  = 4096
+	webPushDefaultTTL  = 28 * 24 * time.Hour
+	vapidTokenValidity = 12 * time.Hour
+)
+
+// vapidKey is the server's VAPID key pair, identifying it to browser push services.
+var vapidKey *ecdsa.PrivateKey
+
+// vapidSubject is the contact URI (mailto: or https:) sent to push services in VAPID tokens.
+var vapidSubject string
+
+// webPushClient is the HTTP client used to reach push services. Subscription endpoints are chosen by
+// clients, so like unifiedPushClient it refuses to connect to private addresses: browsers only ever
+// use public push services.
+var webPushClient = &http.Client{
+	Timeout: 10 * time.Second,
+	Transport: &http.Transport{
+		DialContext:         (&net.Dialer{Timeout: 5 * time.Second, Control: refusePrivateAddress}).DialContext,
+		TLSHandshakeTimeout: 5 * time.Second,
+		ForceAttemptHTTP2:   true,
+		MaxIdleConns:        100,
+		IdleConnTimeout:     90 * time.Second,
+	},
+}
+
+// validateWebPushEndpoint checks that a subscription endpoint is an absolute https URL outside private networks.
+func validateWebPushEndpoint(endpoint string) error {
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" || u.Scheme != "https" {
+		return errors.New("subscription.endpoint must be an https URL")
+	}
+	return refusePrivateHost(u)
+}
+
+// initializeWebPush loads the VAPID key pair from the VAPID_PRIVATE_KEY environment variable
+// (raw base64url P-256 scalar) or from the database, generating and storing one on first start.
+func initializeWebPush() {
+	log.Println("[INFO] Initializing Web Push...")
+	vapidSubject = getEnv("VAPID_SUBJECT", "mailto:webpush@localhost")
+
+	encoded := getEnv("VAPID_PRIVATE_KEY", "")
+	if encoded == "" {
+		var err error
+		encoded, err = store.GetOrCreateVAPIDPrivateKey(generateVAPIDPrivateKey)
+		if err != nil {
+			log.Fatalf("[FATAL] Could not load the VAPID key: %v", err)
+		}
+	}
+
+	key, err := parseVAPIDPrivateKey(encoded)
+	if err != nil {
+		log.Fatalf("[FATAL] Invalid VAPID private key: %v", err)
+	}
+	vapidKey = key
+	log.Printf("[INFO] Web Push initialized. VAPID public key: %s", vapidPublicKeyString())
+}
+
+// generateVAPIDPrivateKey returns a new raw base64url-encoded P-256 private key.
+func generateVAPIDPrivateKey() (string, error) {
+	key, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(key.Bytes()), nil
+}
+
+// parseVAPIDPrivateKey decodes a raw base64url-encoded P-256 private key, the format used by most Web Push tools.
+func parseVAPIDPrivateKey(encoded string) (*ecdsa.PrivateKey, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	ecdhKey, err := ecdh.P256().NewPrivateKey(raw)
+	if err != nil {
+		return nil, err
+	}
+	publicBytes := ecdhKey.PublicKey().Bytes() // 0x04 || X || Y
+	return &ecdsa.PrivateKey{
+		PublicKey: ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(publicBytes[1:33]),
+			Y:     new(big.Int).SetBytes(publicBytes[33:65]),
+		},
+		D: new(big.Int).SetBytes(raw),
+	}, nil
+}
+
+// vapidPublicKeyString returns the VAPID public key as browsers expect it for applicationServerKey.
+func vapidPublicKeyString() string {
+	publicKey, err := vapidKey.PublicKey.ECDH()
+	if err != nil {
+		return ""
+	}
+	return base64.RawURLEncoding.EncodeToString(publicKey.Bytes())
+}
+
+// vapidAuthorization builds the RFC 8292 Authorization header value for a push service endpoint.
+func vapidAuthorization(endpoint string, now time.Time) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"typ":"JWT","alg":"ES256"}`))
+	claims, err := json.Marshal(map[string]interface{}{
+		"aud": u.Scheme + "://" + u.Host,
+		"exp": now.Add(vapidTokenValidity).Unix(),
+		"sub": vapidSubject,
+	})
+	if err != nil {
+		return "", err
+	}
+	signingInput := header + "." + base64.RawURLEncoding.EncodeToString(claims)
+
+	digest := sha256.Sum256([]byte(signingInput))
+	r, s, err := ecdsa.Sign(rand.Reader, vapidKey, digest[:])
+	if err != nil {
+		return "", err
+	}
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
+
+	token := signingInput + "." + base64.RawURLEncoding.EncodeToString(signature)
+	return fmt.Sprintf("vapid t=%s, k=%s", token, vapidPublicKeyString()), nil
+}
+
+// decodeWebPushKey decodes a subscription key, which browsers encode in base64url with or without padding.
+func decodeWebPushKey(value string) ([]byte, error) {
+	if decoded, err := base64.RawURLEncoding.DecodeString(value); err == nil {
+		return decoded, nil
+	}
+	return base64.URLEncoding.DecodeString(value)
+}
+
+// encryptWebPushPayload encrypts a payload for one subscription with the RFC 8291 'aes128gcm' scheme.
+func encryptWebPushPayload(sub WebPushSubscription, plaintext []byte) ([]byte, error) {
+	uaPublicBytes, err := decodeWebPushKey(sub.P256dh)
+	if err != nil {
+		return nil, fmt.Errorf("invalid p256dh key: %w", err)
+	}
+	authSecret, err := decodeWebPushKey(sub.Auth)
+	if err != nil {
+		return nil, fmt.Errorf("invalid auth secret: %w", err)
+	}
+	uaPublic, err := ecdh.P256().NewPublicKey(uaPublicBytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid p256dh key: %w", err)
+	}
+	if len(plaintext)+1+aes.BlockSize > webPushRecordSize {
+		return nil, errors.New("web push payload is too large")
+	}
+
+	asPrivate, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	asPublicBytes := asPrivate.PublicKey().Bytes()
+	ecdhSecret, err := asPrivate.ECDH(uaPublic)
+	if err != nil {
+		return nil, err
+	}
+
+	// IKM = HKDF(auth_secret, ecdh_secret, "WebPush: info" || 0x00 || ua_public || as_public, 32)
+	prkKey, err := hkdf.Extract(sha256.New, ecdhSecret, authSecret)
+	if err != nil {
+		return nil, err
+	}
+	keyInfo := "WebPush: info\x00" + string(uaPublicBytes) + string(asPublicBytes)
+	ikm, err := hkdf.Expand(sha256.New, prkKey, keyInfo, 32)
+	if err != nil {
+		return nil, err
+	}
+
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	prk, err := hkdf.Extract(sha256.New, ikm, salt)
+	if err != nil {
+		return nil, err
+	}
+	cek, err := hkdf.Expand(sha256.New, prk, "Content-Encoding: aes128gcm\x00", 16)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := hkdf.Expand(sha256.New, prk, "Content-Encoding: nonce\x00", 12)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	// A single record: the plaintext followed by the 0x02 last-record delimiter.
+	record := append(append([]byte{}, plaintext...), 0x02)
+
+	// Header: salt (16) || record size (4) || key id length (1) || key id (as_public)
+	var body bytes.Buffer
+	body.Write(salt)
+	binary.Write(&body, binary.BigEndian, uint32(webPushRecordSize))
+	body.WriteByte(byte(len(asPublicBytes)))
+	body.Write(asPublicBytes)
+	body.Write(gcm.Seal(nil, nonce, record, nil))
+	return body.Bytes(), nil
+}
+
+// sendWebPush delivers one notification to a browser subscription. It returns an *UnregisteredTokenError
+// when the push service reports the subscription as gone (404 or 410).
+func sendWebPush(ctx context.Context, sub WebPushSubscription, n PushNotification) error {
+	payload, err := json.Marshal(map[string]interface{}{
+		"title":     n.Title,
+		"body":      n.Body,
+		"senderId":  n.SenderID,
+		"isDefault": n.IsDefault,
+	})
+	if err != nil {
+		return err
+	}
+	body, err := encryptWebPushPayload(sub, payload)
+	if err != nil {
+		return err
+	}
+	authorization, err := vapidAuthorization(sub.Endpoint, time.Now())
+	if err != nil {
+		return err
+	}
+
+	ttl := n.TTL
+	if ttl <= 0 {
+		ttl = webPushDefaultTTL
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, sub.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Encoding", "aes128gcm")
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("TTL", strconv.FormatInt(int64(ttl.Seconds()), 10))
+	req.Header.Set("Urgency", "high")
+	req.Header.Set("Authorization", authorization)
+
+	resp, err := webPushClient.Do(req)
+	if err != nil {
+		return withoutURL(err)
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+		return &UnregisteredTokenError{Token: sub.Endpoint, Err: fmt.Errorf("push service answered %s", resp.Status)}
+	case resp.StatusCode >= 300:
+		return fmt.Errorf("push service answered %s", resp.Status)
+	}
+	return nil
+}
+
+// sendWebPushNotifications sends a notification to every browser subscription of an offline user.
+func sendWebPushNotifications(msg Message) {
+	if vapidKey == nil {
+		return
+	}
+	subscriptions, err := store.GetWebPushSubscriptions(msg.To)
+	if err != nil || len(subscriptions) == 0 {
+		return
+	}
+	log.Printf("[WEBPUSH] Sending push notification from %s to %d browser subscription(s) of %s.", msg.From, len(subscriptions), msg.To)
+
+	notification := buildPushNotification(msg)
+	ctx := context.Background()
+	for _, sub := range subscriptions {
+		err := sendWebPush(ctx, sub, notification)
+		var unregistered *UnregisteredTokenError
+		switch {
+		case errors.As(err, &unregistered):
+			log.Printf("[INFO] The Web Push subscription of device '%s' of user %s is gone. Removing it.", sub.DeviceID, msg.To)
+			goBackground(func() { store.DeleteWebPushSubscription(msg.To, sub.Endpoint) })
+		case err != nil:
+			log.Printf("[ERROR] Web Push send failed for device '%s' of user %s: %v", sub.DeviceID, msg.To, err)
+		default:
+			log.Printf("[WEBPUSH] Push notification sent successfully to device '%s' of user %s.", sub.DeviceID, msg.To)
+		}
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"plop_server/plopclient"
+)
+
+// useTestVAPIDKey installs a freshly generated VAPID key for the duration of a test.
+func useTestVAPIDKey(t *testing.T) {
+	encoded, err := generateVAPIDPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := parseVAPIDPrivateKey(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	previousKey, previousSubject := vapidKey, vapidSubject
+	vapidKey, vapidSubject = key, "mailto:test@example.com"
+	t.Cleanup(func() { vapidKey, vapidSubject = previousKey, previousSubject })
+}
+
+// newTestSubscription creates a browser-side key pair and the matching subscription.
+func newTestSubscription(t *testing.T, endpoint string) (WebPushSubscription, *ecdh.PrivateKey, []byte) {
+	uaPrivate, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authSecret := make([]byte, 16)
+	rand.Read(authSecret)
+	return WebPushSubscription{
+		UserID:   "bob",
+		Endpoint: endpoint,
+		P256dh:   base64.RawURLEncoding.EncodeToString(uaPrivate.PublicKey().Bytes()),
+		Auth:     base64.RawURLEncoding.EncodeToString(authSecret),
+	}, uaPrivate, authSecret
+}
+
+// decryptWebPushPayload is the user agent side of RFC 8291, used to check what the server sent.
+func decryptWebPushPayload(t *testing.T, body []byte, uaPrivate *ecdh.PrivateKey, authSecret []byte) []byte {
+	salt, keyIDLen := body[:16], int(body[20])
+	asPublicBytes := body[21 : 21+keyIDLen]
+	ciphertext := body[21+keyIDLen:]
+
+	asPublic, err := ecdh.P256().NewPublicKey(asPublicBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecdhSecret, err := uaPrivate.ECDH(asPublic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prkKey, _ := hkdf.Extract(sha256.New, ecdhSecret, authSecret)
+	ikm, _ := hkdf.Expand(sha256.New, prkKey, "WebPush: info\x00"+string(uaPrivate.PublicKey().Bytes())+string(asPublicBytes), 32)
+	prk, _ := hkdf.Extract(sha256.New, ikm, salt)
+	cek, _ := hkdf.Expand(sha256.New, prk, "Content-Encoding: aes128gcm\x00", 16)
+	nonce, _ := hkdf.Expand(sha256.New, prk, "Content-Encoding: nonce\x00", 12)
+
+	block, _ := aes.NewCipher(cek)
+	gcm, _ := cipher.NewGCM(block)
+	record, err := gcm.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		t.Fatalf("could not decrypt the web push payload: %v", err)
+	}
+	if record[len(record)-1] != 0x02 {
+		t.Fatalf("last record delimiter missing")
+	}
+	return record[:len(record)-1]
+}
+
+// verifyVAPIDToken checks the ES256 signature and audience of a VAPID Authorization header.
+func verifyVAPIDToken(t *testing.T, authorization, expectedAudience string) {
+	if !strings.HasPrefix(authorization, "vapid t=") {
+		t.Fatalf("unexpected Authorization header: %s", authorization)
+	}
+	parts := strings.SplitN(strings.TrimPrefix(authorization, "vapid t="), ", k=", 2)
+	token, publicKey := parts[0], parts[1]
+	if publicKey != vapidPublicKeyString() {
+		t.Errorf("k= should carry the VAPID public key")
+	}
+
+	segments := strings.Split(token, ".")
+	signature, _ := base64.RawURLEncoding.DecodeString(segments[2])
+	digest := sha256.Sum256([]byte(segments[0] + "." + segments[1]))
+	r, s := new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])
+	if !ecdsa.Verify(&vapidKey.PublicKey, digest[:], r, s) {
+		t.Error("VAPID token signature is invalid")
+	}
+
+	claimsJSON, _ := base64.RawURLEncoding.DecodeString(segments[1])
+	var claims map[string]interface{}
+	json.Unmarshal(claimsJSON, &claims)
+	if claims["aud"] != expectedAudience || claims["sub"] != vapidSubject {
+		t.Errorf("unexpected VAPID claims: %v", claims)
+	}
+}
+
+// useLocalPushService lets the Web Push client reach test servers on the loopback address.
+func useLocalPushService(t *testing.T) {
+	previous := webPushClient
+	webPushClient = &http.Client{Timeout: 10 * time.Second}
+	t.Cleanup(func() { webPushClient = previous })
+}
+
+func TestSendWebPush(t *testing.T) {
+	useTestVAPIDKey(t)
+	useLocalPushService(t)
+
+	var received *http.Request
+	var receivedBody []byte
+	pushService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r
+		receivedBody, _ = io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer pushService.Close()
+
+	sub, uaPrivate, authSecret := newTestSubscription(t, pushService.URL+"/push/abc")
+	notification := PushNotification{SenderID: "alice", Title: "Alice", Body: "J'arrive", TTL: time.Hour}
+
+	if err := sendWebPush(context.Background(), sub, notification); err != nil {
+		t.Fatalf("sendWebPush failed: %v", err)
+	}
+
+	if received.Header.Get("Content-Encoding") != "aes128gcm" || received.Header.Get("TTL") != "3600" {
+		t.Errorf("unexpected headers: %v", received.Header)
+	}
+	verifyVAPIDToken(t, received.Header.Get("Authorization"), pushService.URL)
+
+	plaintext := decryptWebPushPayload(t, receivedBody, uaPrivate, authSecret)
+	var payload map[string]interface{}
+	if err := json.Unmarshal(plaintext, &payload); err != nil {
+		t.Fatalf("decrypted payload is not JSON: %s", plaintext)
+	}
+	if payload["title"] != "Alice" || payload["body"] != "J'arrive" || payload["senderId"] != "alice" {
+		t.Errorf("unexpected payload: %v", payload)
+	}
+}
+
+func TestSendWebPushGoneSubscription(t *testing.T) {
+	useTestVAPIDKey(t)
+	useLocalPushService(t)
+
+	pushService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusGone)
+	}))
+	defer pushService.Close()
+
+	sub, _, _ := newTestSubscription(t, pushService.URL+"/push/expired")
+	err := sendWebPush(context.Background(), sub, PushNotification{Body: "Plop"})
+
+	var unregistered *UnregisteredTokenError
+	if !errors.As(err, &unregistered) || unregistered.Token != sub.Endpoint {
+		t.Errorf("410 Gone should be reported as an unregistered subscription, got %v", err)
+	}
+}
+
+func TestWebPushRefusesPrivateEndpoints(t *testing.T) {
+	useTestVAPIDKey(t)
+	for _, endpoint := range []string{"http://push.example.com/1", "https://localhost/push", "https://10.0.0.1/push", "https://[::1]/push", "https://169.254.169.254/latest"} {
+		if err := validateWebPushEndpoint(endpoint); err == nil {
+			t.Errorf("validateWebPushEndpoint(%q) should have failed", endpoint)
+		}
+	}
+	if err := validateWebPushEndpoint("https://fcm.googleapis.com/fcm/send/abc"); err != nil {
+		t.Errorf("a public push service should be accepted, got %v", err)
+	}
+
+	var attempts int32
+	pushService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+	}))
+	defer pushService.Close()
+
+	sub, _, _ := newTestSubscription(t, pushService.URL+"/push/abc")
+	err := sendWebPush(context.Background(), sub, PushNotification{Body: "Plop"})
+	if !errors.Is(err, errPrivateEndpoint) {
+		t.Errorf("a push service on a loopback address should be refused, got %v", err)
+	}
+	if err != nil && strings.Contains(err.Error(), sub.Endpoint) {
+		t.Errorf("errors end up in logs and must not contain the endpoint, got %v", err)
+	}
+	if attempts != 0 {
+		t.Errorf("the push service should not have been reached, got %d request(s)", attempts)
+	}
+}
+
+func TestWebPushUnsubscribeOnlyRemovesOwnSubscriptions(t *testing.T) {
+	s := newTestServer(t)
+	ctx := context.Background()
+	alice, mallory := s.newUser("Alice", ""), s.newUser("Mallory", "")
+	endpoint := "https://push.example.com/alice"
+	s.store.SaveWebPushSubscription(WebPushSubscription{UserID: alice.ID, DeviceID: alice.DeviceID, Endpoint: endpoint, P256dh: "key", Auth: "auth", CreatedAt: s.clock.Now()})
+
+	if _, err := mallory.api.UnsubscribeWebPush(ctx, plopclient.EndpointRequest{UserID: mallory.ID, Endpoint: endpoint}); err != nil {
+		t.Fatalf("UnsubscribeWebPush failed: %v", err)
+	}
+	if subscriptions, _ := s.store.GetWebPushSubscriptions(alice.ID); len(subscriptions) != 1 {
+		t.Errorf("another user must not remove alice's subscription, got %d left", len(subscriptions))
+	}
+	if _, err := alice.api.UnsubscribeWebPush(ctx, plopclient.EndpointRequest{UserID: alice.ID, Endpoint: endpoint}); err != nil {
+		t.Fatalf("UnsubscribeWebPush failed: %v", err)
+	}
+	if subscriptions, _ := s.store.GetWebPushSubscriptions(alice.ID); len(subscriptions) != 0 {
+		t.Errorf("alice's subscription should be removed, got %d left", len(subscriptions))
+	}
+}
+
+func TestEncryptWebPushPayloadRejectsBadKeys(t *testing.T) {
+	sub := WebPushSubscription{P256dh: base64.RawURLEncoding.EncodeToString(bytes.Repeat([]byte{1}, 65)), Auth: "AAAAAAAAAAAAAAAAAAAAAA"}
+	if _, err := encryptWebPushPayload(sub, []byte("{}")); err == nil {
+		t.Error("a p256dh key that is not on the curve should be rejected")
+	}
+}
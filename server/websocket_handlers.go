@@ -6,10 +6,22 @@ import (
 	"net/http"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 )
 
-const messageCooldown = 1 * time.Second
+// WebSocket close codes telling a client why the server disconnected it.
+const (
+	closeCodeDeviceRevoked   = 4001 // The device was signed out remotely
+	closeCodeAccountDeleted  = 4002 // The account was deleted
+	closeCodeAdminDisconnect = 4004 // An operator closed the connection
+)
+
+// maxMessageTTL caps message TTLs to what FCM accepts (4 weeks).
+const maxMessageTTL = 28 * 24 * time.Hour
+
+// defaultMessageTTL applies to messages sent without a TTL. Zero means pending messages never expire.
+var defaultMessageTTL = time.Duration(getEnvInt("DEFAULT_MESSAGE_TTL_SECONDS", 0)) * time.Second
 
 var upgrader = websocket.Upgrader{
 	CheckOrigin: func(r *http.Request) bool { return true },
@@ -19,122 +31,166 @@ var upgrader = websocket.Upgrader{
 func handleWebSocket(w http.ResponseWriter, r *http.Request) {
 	userId := r.URL.Query().Get("userId")
 	pseudo := r.URL.Query().Get("pseudo")
-	log.Printf("[WS] Connection attempt from userId=%s, pseudo=%s, remoteAddr=%s", userId, pseudo, r.RemoteAddr)
+	log.Printf("[WS] Connection attempt from userId=%s, remoteAddr=%s", userId, r.RemoteAddr)
 	if userId == "" {
 		log.Printf("[WS_ERROR] Connection failed: userId is missing from query. RemoteAddr=%s", r.RemoteAddr)
 		http.Error(w, "userId is missing", http.StatusBadRequest)
 		return
 	}
 
-	conn, err := upgrader.Upgrade(w, r, nil)
+	deviceId, err := authenticateRequest(r, userId)
+	if err != nil {
+		log.Printf("[WS_ERROR] Connection refused for userId=%s: %v. RemoteAddr=%s", userId, err, r.RemoteAddr)
+		writeAuthError(w, err)
+		return
+	}
+	ban, sanctioned, err := store.GetUserBan(userId)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	cacheSanction(userId, cachedSanction{ban: ban, sanctioned: sanctioned, checkedAt: timeNow()})
+
+	ws, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.Printf("[ERROR] WebSocket upgrade failed for userId=%s, pseudo=%s: %v", userId, pseudo, err)
+		log.Printf("[ERROR] WebSocket upgrade failed for userId=%s, deviceId=%s: %v", userId, deviceId, err)
+		return
+	}
+	conn := newClientConn(ws)
+	if sanctioned {
+		// Browsers cannot read the status of a refused handshake, so the refusal is a close frame.
+		log.Printf("[WS_ERROR] Connection refused for sanctioned userId=%s. RemoteAddr=%s", userId, r.RemoteAddr)
+		closeWithSanction(conn, ban)
 		return
 	}
 	defer func() {
-		log.Printf("[WS] Closing WebSocket connection for userId=%s, pseudo=%s", userId, pseudo)
+		log.Printf("[WS] Closing WebSocket connection for userId=%s, deviceId=%s", userId, deviceId)
 		conn.Close()
 	}()
 
 	clientsMutex.Lock()
 	if clients[userId] == nil {
-		clients[userId] = make(map[*websocket.Conn]bool)
+		clients[userId] = make(map[*clientConn]*clientInfo)
 	}
 	hasOtherDevices := len(clients[userId]) > 0
-	clients[userId][conn] = true
-	log.Printf("[WS] Client %s (%s) connected. Total connections for user: %d. HasOtherDevices: %t", userId, pseudo, len(clients[userId]), hasOtherDevices)
+	clients[userId][conn] = &clientInfo{ID: uuid.New().String(), DeviceID: deviceId, ConnectedAt: timeNow(), RemoteAddr: r.RemoteAddr}
+	log.Printf("[WS] Client %s (device '%s') connected. Total connections for user: %d. HasOtherDevices: %t", userId, deviceId, len(clients[userId]), hasOtherDevices)
 	clientsMutex.Unlock()
 
+	if deviceId != "" {
+		goBackground(func() { store.TouchDevice(userId, deviceId) })
+	}
+
 	if pseudo != "" {
-		log.Printf("[WS] Updating pseudo for userId=%s to '%s'", userId, pseudo)
-		go dbSaveUserPseudo(userId, pseudo)
+		goBackground(func() { adoptConnectionPseudo(userId, pseudo) })
 	}
 
 	log.Printf("[WS] Delivering pending messages for userId=%s, if any.", userId)
-	go dbSendPendingMessages(userId, conn) // Ensure conn is a type that dbSendPendingMessages expects, or adapt
+	goBackground(func() { sendPendingMessages(userId, conn) })
 
 	if hasOtherDevices {
 		log.Printf("[WS] New device for userId=%s. Requesting sync from other devices.", userId)
 		broadcastMessageToUser(userId, Message{Type: "sync_request", From: "server"}, conn) // Added 'From' for clarity
+	} else {
+		now := timeNow()
+		goBackground(func() { notifyPresenceChange(userId, true, now) })
 	}
 
-	listenForMessages(conn, userId, pseudo)
+	listenForMessages(conn, userId, deviceId)
 
 	clientsMutex.Lock()
 	delete(clients[userId], conn)
 	remainingConnections := len(clients[userId])
 	if remainingConnections == 0 {
 		delete(clients, userId)
-		log.Printf("[WS] Last client for user %s (%s) disconnected. Removing user from active list.", userId, pseudo)
+		log.Printf("[WS] Last client for user %s (device '%s') disconnected. Removing user from active list.", userId, deviceId)
+		// Started under the lock: whoever sees the user gone can wait for the notification.
+		now := timeNow()
+		goBackground(func() { notifyPresenceChange(userId, false, now) })
 	} else {
-		log.Printf("[WS] Client for user %s (%s) disconnected. %d connections remaining for this user.", userId, pseudo, remainingConnections)
+		log.Printf("[WS] Client for user %s (device '%s') disconnected. %d connections remaining for this user.", userId, deviceId, remainingConnections)
 	}
 	clientsMutex.Unlock()
-	log.Printf("[WS] Exiting handleWebSocket for userId=%s, pseudo=%s after client disconnection", userId, pseudo)
+	log.Printf("[WS] Exiting handleWebSocket for userId=%s, deviceId=%s after client disconnection", userId, deviceId)
 }
 
 // listenForMessages reads messages from a WebSocket connection and routes them.
-func listenForMessages(conn *websocket.Conn, fromUserId string, fromPseudo string) {
-	log.Printf("[WS_READ_LOOP] Listening for messages from userId=%s (%s)", fromUserId, fromPseudo)
-	defer log.Printf("[WS_READ_LOOP] Exiting message read loop for userId=%s (%s)", fromUserId, fromPseudo)
+func listenForMessages(conn *clientConn, fromUserId string, fromDeviceId string) {
+	log.Printf("[WS_READ_LOOP] Listening for messages from userId=%s (device '%s')", fromUserId, fromDeviceId)
+	defer log.Printf("[WS_READ_LOOP] Exiting message read loop for userId=%s (device '%s')", fromUserId, fromDeviceId)
 
 	for {
 		messageType, p, err := conn.ReadMessage()
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure, websocket.CloseNormalClosure) {
-				log.Printf("[WS_READ_ERROR] Unexpected close error reading message from userId=%s (%s): %v. Closing connection.", fromUserId, fromPseudo, err)
+				log.Printf("[WS_READ_ERROR] Unexpected close error reading message from userId=%s (device '%s'): %v. Closing connection.", fromUserId, fromDeviceId, err)
 			} else if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
-				log.Printf("[WS_READ_INFO] Normal WebSocket close from userId=%s (%s): %v.", fromUserId, fromPseudo, err)
+				log.Printf("[WS_READ_INFO] Normal WebSocket close from userId=%s (device '%s'): %v.", fromUserId, fromDeviceId, err)
 			} else {
-				log.Printf("[WS_READ_ERROR] Error reading message from userId=%s (%s): %v. Closing connection.", fromUserId, fromPseudo, err)
+				log.Printf("[WS_READ_ERROR] Error reading message from userId=%s (device '%s'): %v. Closing connection.", fromUserId, fromDeviceId, err)
 			}
 			break
 		}
-		log.Printf("[WS_RAW_MSG_RECV] Received raw message from userId=%s (%s). Type: %d, Size: %d bytes", fromUserId, fromPseudo, messageType, len(p))
+		log.Printf("[WS_RAW_MSG_RECV] Received raw message from userId=%s (device '%s'). Type: %d, Size: %d bytes", fromUserId, fromDeviceId, messageType, len(p))
 
 		var msg Message
 		if err := json.Unmarshal(p, &msg); err != nil {
-			log.Printf("[WARN_UNMARSHAL] Failed to unmarshal message from userId=%s (%s): %v. Raw: %s", fromUserId, fromPseudo, err, string(p))
+			log.Printf("[WARN_UNMARSHAL] Failed to unmarshal message from userId=%s (device '%s'): %v", fromUserId, fromDeviceId, err)
 			continue
 		}
 		msg.From = fromUserId // Ensure 'From' is set correctly for subsequent logic
-		log.Printf("[WS_MSG_RECV] Received structured message of type '%s' from userId=%s (%s) to userId=%s", msg.Type, msg.From, fromPseudo, msg.To)
+		log.Printf("[WS_MSG_RECV] Received structured message of type '%s' from userId=%s (device '%s') to userId=%s", msg.Type, msg.From, fromDeviceId, msg.To)
 
 		switch msg.Type {
 		case "plop":
-			handlePlopMessage(conn, msg, fromPseudo)
+			handlePlopMessage(conn, msg, fromDeviceId)
+		case "schedule_create", "schedule_list", "schedule_cancel":
+			handleScheduleCommand(conn, msg)
+		case "link_approve", "link_deny":
+			handleLinkCommand(conn, msg)
 		case "sync_data_broadcast":
-			log.Printf("[SYNC_RELAY] Relaying 'sync_data_broadcast' from userId=%s (%s) to their other devices.", msg.From, fromPseudo)
+			log.Printf("[SYNC_RELAY] Relaying 'sync_data_broadcast' from userId=%s (device '%s') to their other devices.", msg.From, fromDeviceId)
 			broadcastMessageToUser(msg.From, msg, conn)
 		case "ping":
-			log.Printf("[WS_PING] Received 'ping' from userId=%s (%s).", msg.From, fromPseudo)
+			log.Printf("[WS_PING] Received 'ping' from userId=%s (device '%s').", msg.From, fromDeviceId)
 			// Optional: send a pong message if not handled by SetPongHandler
 			// if err := conn.WriteMessage(websocket.PongMessage, nil); err != nil {
-			// 	log.Printf("[ERROR] Failed to send pong to %s (%s): %v", msg.From, fromPseudo, err)
+			// 	log.Printf("[ERROR] Failed to send pong to %s (device '%s'): %v", msg.From, fromDeviceId, err)
 			// }
 		default:
-			log.Printf("[WARN_UNKNOWN_MSG] Unknown message type '%s' from userId=%s (%s)", msg.Type, msg.From, fromPseudo)
+			log.Printf("[WARN_UNKNOWN_MSG] Unknown message type '%s' from userId=%s (device '%s')", msg.Type, msg.From, fromDeviceId)
 		}
 	}
 }
 
-// handlePlopMessage processes a "plop" message, checking the cooldown and forwarding it.
-func handlePlopMessage(conn *websocket.Conn, msg Message, fromPseudo string) {
-	log.Printf("[PLOP_HANDLER] Processing 'plop' from userId=%s (%s) to userId=%s. Cooldown check...", msg.From, fromPseudo, msg.To)
+// handlePlopMessage processes a "plop" message, checking its payload and the rate limits and forwarding it.
+// Plops from a suspended or banned user close their connection instead.
+func handlePlopMessage(conn *clientConn, msg Message, fromDeviceId string) {
+	log.Printf("[PLOP_HANDLER] Processing 'plop' from userId=%s (device '%s') to userId=%s. Rate limit check...", msg.From, fromDeviceId, msg.To)
 
-	userLastMessageMutex.Lock()
-	lastTime, found := userLastMessageTime[msg.From]
-	canSendMessage := !found || time.Since(lastTime) > messageCooldown
-	if canSendMessage {
-		userLastMessageTime[msg.From] = time.Now()
+	now := timeNow()
+	if ban, sanctioned := sanctionFor(msg.From, now); sanctioned {
+		log.Printf("[PLOP_HANDLER] Refusing 'plop' from sanctioned userId=%s (device '%s'). Closing the connection.", msg.From, fromDeviceId)
+		closeWithSanction(conn, ban)
+		return
 	}
-	userLastMessageMutex.Unlock()
+	if err := preparePlopPayload(&msg.Payload); err != nil {
+		log.Printf("[PLOP_HANDLER] Refusing 'plop' %s from userId=%s (device '%s'): %v", msg.ID, msg.From, fromDeviceId, err)
+		errorMsg := Message{Type: "plop_error", From: "server", To: msg.From, Payload: MessagePayload{RecipientID: msg.To, MessageID: msg.ID, Text: err.Error()}}
+		if err := conn.WriteJSON(errorMsg); err != nil {
+			log.Printf("[ERROR] Failed to send 'plop_error' to %s (device '%s'): %v", msg.From, fromDeviceId, err)
+		}
+		return
+	}
+	allowed, retryAfter := plopLimiter.allow(msg.From, msg.To, now)
+	recentPlops.record(msg.From, msg.To, ReportedMessage{MessageID: msg.ID, SentAt: now, RateLimited: !allowed})
 
-	if canSendMessage {
-		log.Printf("[PLOP_HANDLER] Cooldown PASSED for userId=%s (%s). Forwarding and sending ack.", msg.From, fromPseudo)
+	if allowed {
+		log.Printf("[PLOP_HANDLER] Rate limit PASSED for userId=%s (device '%s'). Forwarding and sending ack.", msg.From, fromDeviceId)
 		ackPayload := MessagePayload{
 			RecipientID: msg.To, // This field should exist in MessagePayload
 			Text:        "plop_ack", // Optional: add some text to ack payload for clarity
+			MessageID:   msg.ID,
 		}
 		ackMessage := Message{
 			Type:    "message_ack",
@@ -144,19 +200,26 @@ func handlePlopMessage(conn *websocket.Conn, msg Message, fromPseudo string) {
 		}
 
 		if err := conn.WriteJSON(ackMessage); err != nil {
-			log.Printf("[ERROR_ACK] Could not send 'message_ack' to userId=%s (%s) for plop to %s: %v", msg.From, fromPseudo, msg.To, err)
+			log.Printf("[ERROR_ACK] Could not send 'message_ack' to userId=%s (device '%s') for plop to %s: %v", msg.From, fromDeviceId, msg.To, err)
 		} else {
-			log.Printf("[PLOP_ACK_SENT] Sent 'message_ack' for 'plop' to userId=%s (%s) regarding recipient %s", msg.From, fromPseudo, msg.To)
+			log.Printf("[PLOP_ACK_SENT] Sent 'message_ack' for 'plop' to userId=%s (device '%s') regarding recipient %s", msg.From, fromDeviceId, msg.To)
 		}
 		sendDirectMessage(msg) // Forward the original plop message
 	} else {
-		log.Printf("[WARN_COOLDOWN] Cooldown ACTIVE for userId=%s (%s). 'plop' message to %s ignored.", msg.From, fromPseudo, msg.To)
-		// Optionally, inform the sender about the cooldown
-		// cooldownInfoPayload := MessagePayload{Text: "Message cooldown active. Please wait."}
-		// cooldownInfoMsg := Message{Type: "cooldown_notice", From: "server", To: msg.From, Payload: cooldownInfoPayload}
-		// if err := conn.WriteJSON(cooldownInfoMsg); err != nil {
-		// 	log.Printf("[ERROR_COOLDOWN_NOTICE] Failed to send 'cooldown_notice' to %s (%s): %v", msg.From, fromPseudo, err)
-		// }
+		log.Printf("[WARN_RATE_LIMIT] Rate limit HIT for userId=%s (device '%s'). 'plop' message %s to %s dropped, retry after %v.", msg.From, fromDeviceId, msg.ID, msg.To, retryAfter)
+		rateLimitedMsg := Message{
+			Type: "rate_limited",
+			From: "server",
+			To:   msg.From,
+			Payload: MessagePayload{
+				RecipientID:  msg.To,
+				MessageID:    msg.ID,
+				RetryAfterMs: retryAfterMillis(retryAfter),
+			},
+		}
+		if err := conn.WriteJSON(rateLimitedMsg); err != nil {
+			log.Printf("[ERROR_RATE_LIMIT] Failed to send 'rate_limited' to %s (device '%s'): %v", msg.From, fromDeviceId, err)
+		}
 	}
 }
 
@@ -167,14 +230,12 @@ func sendDirectMessage(msg Message) {
 		log.Printf("[WARN_SEND_DIRECT] Dropping direct message from userId=%s: recipient 'to' field is empty. MsgType: %s", msg.From, msg.Type)
 		return
 	}
-	log.Printf("[SEND_DIRECT] Attempting to send message type '%s' from userId=%s to userId=%s. PayloadText: '%s'", msg.Type, msg.From, msg.To, msg.Payload.Text)
-	if msg.Payload.Latitude != 0 || msg.Payload.Longitude != 0 { // Check if coordinates are present
-		log.Printf("[SEND_DIRECT_LOCATION] Message from userId=%s to userId=%s includes location: Lat: %f, Lon: %f", msg.From, msg.To, msg.Payload.Latitude, msg.Payload.Longitude)
-	}
+	// Never log the content: it is either encrypted or none of the operators' business.
+	log.Printf("[SEND_DIRECT] Attempting to send message type '%s' from userId=%s to userId=%s. Encrypted: %t", msg.Type, msg.From, msg.To, msg.Payload.Envelope != nil)
 
 	clientsMutex.Lock()
 	recipientConnsMap, isOnline := clients[msg.To]
-	connsToSend := make([]*websocket.Conn, 0, len(recipientConnsMap)) // Buffer with expected size
+	connsToSend := make([]*clientConn, 0, len(recipientConnsMap)) // Buffer with expected size
 	if isOnline {
 		for conn := range recipientConnsMap {
 			connsToSend = append(connsToSend, conn)
@@ -195,17 +256,103 @@ func sendDirectMessage(msg Message) {
 		log.Printf("[MSG_DELIVERY_STATUS] Successfully sent to %d/%d devices for recipient %s from %s for message type '%s'.", successCount, len(connsToSend), msg.To, msg.From, msg.Type)
 	} else {
 		log.Printf("[MSG_DELIVERY] Recipient %s is OFFLINE for message type '%s' from %s. Storing pending message.", msg.To, msg.Type, msg.From)
-		go dbSavePendingMessage(msg)
-		go sendDirectMessageThroughFirebase(msg) // Ensure this function also has adequate logging
+		goBackground(func() { store.SavePendingMessage(msg) })
+		goBackground(func() { sendPushNotification(msg) })
+		goBackground(func() { sendWebPushNotifications(msg) })
+		goBackground(func() { sendUnifiedPushNotifications(msg) })
+	}
+}
+
+// sendPendingMessages delivers the stored offline messages of a user on a new connection, then clears them.
+func sendPendingMessages(userID string, conn connection) {
+	messagesToSend, err := store.GetPendingMessages(userID)
+	if err != nil {
+		return
+	}
+	if len(messagesToSend) == 0 {
+		log.Printf("[INFO] No pending messages found in DB for user %s.", userID)
+		return
+	}
+
+	log.Printf("[INFO] Found %d pending messages in DB for user %s. Attempting to send.", len(messagesToSend), userID)
+	for i, msg := range messagesToSend {
+		log.Printf("[DEBUG] Attempting to send pending message %d/%d from %s to %s via connection.", i+1, len(messagesToSend), msg.From, userID)
+		if err := conn.WriteJSON(msg); err != nil {
+			log.Printf("[ERROR] Failed to send pending message from %s to %s: %v. Message will remain in DB for next attempt.", msg.From, userID, err)
+			return // Stop trying to send further messages on this connection if one fails
+		}
+		log.Printf("[INFO] Successfully sent pending message %d/%d from %s to %s.", i+1, len(messagesToSend), msg.From, userID)
+	}
+
+	log.Printf("[INFO] All %d pending messages for %s sent successfully. Clearing them from DB.", len(messagesToSend), userID)
+	goBackground(func() { store.DeletePendingMessagesForUser(userID) }) // This is asynchronous
+}
+
+// sendServerEvent delivers a server event to every connection of a user, or queues it as a pending
+// message (without a push notification) when the user is offline.
+func sendServerEvent(msg Message) {
+	if isUserOnline(msg.To) {
+		broadcastMessageToUser(msg.To, msg, nil)
+		return
+	}
+	store.SavePendingMessage(msg)
+}
+
+// messageTTL returns how long a message stays deliverable, or zero if it never expires.
+func messageTTL(msg Message) time.Duration {
+	ttl := defaultMessageTTL
+	if msg.TTL > 0 {
+		ttl = time.Duration(msg.TTL) * time.Second
+	}
+	if ttl > maxMessageTTL {
+		ttl = maxMessageTTL
+	}
+	return ttl
+}
+
+// notifyMessageExpired tells the sender's devices that a message expired before reaching its recipient.
+func notifyMessageExpired(expired Message) {
+	statusMsg := Message{
+		Type: "message_status",
+		From: "server",
+		To:   expired.From,
+		Payload: MessagePayload{
+			RecipientID: expired.To,
+			MessageID:   expired.ID,
+			Status:      "expired",
+		},
+	}
+	broadcastMessageToUser(expired.From, statusMsg, nil)
+}
+
+// closeUserConnections closes the connections of a user matching a filter with the given close code
+// and reason, so the client knows why it was disconnected. It returns the number of connections closed.
+func closeUserConnections(userID string, match func(*clientInfo) bool, code int, reason string) int {
+	clientsMutex.Lock()
+	connsToClose := make([]*clientConn, 0, len(clients[userID]))
+	for conn, info := range clients[userID] {
+		if match(info) {
+			connsToClose = append(connsToClose, conn)
+		}
+	}
+	clientsMutex.Unlock()
+
+	closeMessage := websocket.FormatCloseMessage(code, reason)
+	for _, conn := range connsToClose {
+		if err := conn.WriteControl(websocket.CloseMessage, closeMessage, time.Now().Add(time.Second)); err != nil {
+			log.Printf("[WS] Could not send close frame to userId=%s: %v", userID, err)
+		}
+		conn.Close() // The read loop ends and handleWebSocket unregisters the connection
 	}
+	return len(connsToClose)
 }
 
 // broadcastMessageToUser sends a message to all active connections of a specific user.
 // The excludeConn parameter is used to prevent echoing a message back to its source.
-func broadcastMessageToUser(userID string, msg Message, excludeConn *websocket.Conn) {
+func broadcastMessageToUser(userID string, msg Message, excludeConn *clientConn) {
 	clientsMutex.Lock()
 	userConnsMap, found := clients[userID]
-	connsToBroadcast := make([]*websocket.Conn, 0, len(userConnsMap))
+	connsToBroadcast := make([]*clientConn, 0, len(userConnsMap))
 	if found {
 		for conn := range userConnsMap {
 			if conn != excludeConn {
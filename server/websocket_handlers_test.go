@@ -4,12 +4,24 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/DATA-DOG/go-sqlmock"
 	"github.com/gorilla/websocket"
 )
 
 func TestHandleWebSocket(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	setDB(db)
+	mock.ExpectQuery("SELECT EXISTS").WithArgs("test-user").WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+	mock.ExpectQuery("SELECT reason, banned_at, expires_at FROM user_bans").WithArgs("test-user").WillReturnRows(sqlmock.NewRows([]string{"reason", "banned_at", "expires_at"}))
+
 	server := httptest.NewServer(http.HandlerFunc(handleWebSocket))
 	defer server.Close()
 
@@ -19,5 +31,112 @@ func TestHandleWebSocket(t *testing.T) {
 	if err != nil {
 		t.Fatalf("could not open a ws connection on %s: %v", wsURL, err)
 	}
-	defer ws.Close()
+
+	// The disconnection notifies presence in the background, on this test's database: wait for it.
+	connected := func() bool {
+		clientsMutex.Lock()
+		defer clientsMutex.Unlock()
+		_, found := clients["test-user"]
+		return found
+	}
+	for deadline := time.Now().Add(time.Second); !connected() && time.Now().Before(deadline); {
+		time.Sleep(5 * time.Millisecond)
+	}
+	ws.Close()
+	for deadline := time.Now().Add(time.Second); connected() && time.Now().Before(deadline); {
+		time.Sleep(5 * time.Millisecond)
+	}
+	backgroundTasks.Wait()
+}
+
+func TestHandleWebSocketRefusesSanctionedUser(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	setDB(db)
+
+	server := httptest.NewServer(http.HandlerFunc(handleWebSocket))
+	defer server.Close()
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/?userId=banned-user"
+
+	suspendedUntil := time.Now().Add(time.Hour)
+	for _, expiresAt := range []*time.Time{nil, &suspendedUntil} {
+		mock.ExpectQuery("SELECT EXISTS").WithArgs("banned-user").WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+		mock.ExpectQuery("SELECT reason, banned_at, expires_at FROM user_bans").WithArgs("banned-user").
+			WillReturnRows(sqlmock.NewRows([]string{"reason", "banned_at", "expires_at"}).AddRow("spam", time.Now(), expiresAt))
+
+		ws, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+		if err != nil {
+			t.Fatalf("could not open a ws connection on %s: %v", wsURL, err)
+		}
+		wantCode := closeCodeBanned
+		if expiresAt != nil {
+			wantCode = closeCodeSuspended
+		}
+		ws.SetReadDeadline(time.Now().Add(time.Second))
+		if _, _, err := ws.ReadMessage(); !websocket.IsCloseError(err, wantCode) {
+			t.Errorf("expected close code %d, got %v", wantCode, err)
+		}
+		ws.Close()
+	}
+	clientsMutex.Lock()
+	_, registered := clients["banned-user"]
+	clientsMutex.Unlock()
+	if registered {
+		t.Error("a sanctioned user must not be registered as connected")
+	}
+}
+
+func TestMessageTTL(t *testing.T) {
+	previousDefault := defaultMessageTTL
+	defer func() { defaultMessageTTL = previousDefault }()
+
+	defaultMessageTTL = 0
+	if ttl := messageTTL(Message{}); ttl != 0 {
+		t.Errorf("without default nor message TTL, got %v, want 0", ttl)
+	}
+	if ttl := messageTTL(Message{TTL: 60}); ttl != time.Minute {
+		t.Errorf("message TTL should be used, got %v", ttl)
+	}
+
+	defaultMessageTTL = time.Hour
+	if ttl := messageTTL(Message{}); ttl != time.Hour {
+		t.Errorf("server default should apply, got %v", ttl)
+	}
+	if ttl := messageTTL(Message{TTL: 365 * 24 * 3600}); ttl != maxMessageTTL {
+		t.Errorf("TTL should be capped to %v, got %v", maxMessageTTL, ttl)
+	}
+}
+
+func TestConcurrentWritesToOneConnection(t *testing.T) {
+	s := newTestServer(t)
+	alice := s.newUser("Alice", "")
+	aliceWS := s.connect(alice)
+	clientsMutex.Lock()
+	var conn *clientConn
+	for c := range clients[alice.ID] {
+		conn = c
+	}
+	clientsMutex.Unlock()
+
+	// Broadcasts, presence updates and the scheduler write from their own goroutines; run with -race.
+	const writers, frames = 8, 10
+	var wg sync.WaitGroup
+	for range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range frames {
+				if err := conn.WriteJSON(Message{Type: "sync_request", From: "server"}); err != nil {
+					t.Errorf("write failed: %v", err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	for range writers * frames {
+		aliceWS.expect("sync_request")
+	}
 }